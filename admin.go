@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Site administration: giving users roles, banning them and watching for login lockouts
+// Moderators can ban plain users, admins can also ban staff, change roles and see lockouts
+
+// How far back the admin page lists login lockouts
+const adminLockoutWindow = 24 * time.Hour
+
+// ********
+// Handlers
+// ********
+
+// Handler for /admin endpoint
+func adminHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+	s *sessions.CookieStore,
+	tmplMap map[string]*template.Template,
+	userStore UserStore,
+	loginAttemptStore LoginAttemptStore,
+) {
+	pageData, err := getAdminPage(r.Context(), time.Now(), userStore, loginAttemptStore)
+	if err != nil {
+		logRequestError(r.Context(), "Couldn't get admin page", err)
+		renderError(w, r, s, tmplMap, err, "/contests")
+		return
+	}
+	renderTemplate(w, r, s, tmplMap["admin.html"], http.StatusOK, pageData)
+}
+
+// Handler for an admin changing a user's role
+func userRoleHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+	s *sessions.CookieStore,
+	tmplMap map[string]*template.Template,
+	userStore UserStore,
+) {
+	userId, _, err := getSessionUser(r)
+	if err == nil {
+		_, err = setUserRole(r.Context(), userId, r.PostFormValue("username"), r.PostFormValue("role"), userStore)
+	}
+	if err != nil {
+		logRequestError(r.Context(), "Couldn't change user role", err)
+		renderError(w, r, s, tmplMap, err, "/admin")
+		return
+	}
+	http.Redirect(w, r, "/admin", 302)
+}
+
+// Handler for banning and unbanning a user
+func userBanHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+	s *sessions.CookieStore,
+	tmplMap map[string]*template.Template,
+	userStore UserStore,
+	sessionStore SessionStore,
+) {
+	userId, _, err := getSessionUser(r)
+	if err == nil {
+		banned := r.PostFormValue("banned") == "true"
+		_, err = setUserBanned(r.Context(), userId, r.PostFormValue("username"), banned, userStore, sessionStore)
+	}
+	if err != nil {
+		logRequestError(r.Context(), "Couldn't change user ban", err)
+		renderError(w, r, s, tmplMap, err, "/admin")
+		return
+	}
+	http.Redirect(w, r, "/admin", 302)
+}
+
+// *******
+// Actions
+// *******
+
+// Get the staff, banned users and recent lockouts, for anyone who can ban users
+func getAdminPage(
+	ctx context.Context,
+	now time.Time,
+	userStore UserStore,
+	loginAttemptStore LoginAttemptStore,
+) (AdminPageData, error) {
+	if err := checkPermission(ctx, PERM_BAN_USERS); err != nil {
+		return AdminPageData{}, err
+	}
+	users, err := userStore.ListStaffAndBanned(ctx)
+	if err != nil {
+		return AdminPageData{}, err
+	}
+	pageData := AdminPageData{
+		Users: users,
+		CanSetRoles: hasPermission(ctx, PERM_SET_ROLES),
+		CanViewLockouts: hasPermission(ctx, PERM_VIEW_LOCKOUTS),
+	}
+	if pageData.CanViewLockouts {
+		pageData.Lockouts, err = listLockouts(ctx, now.Add(-adminLockoutWindow), loginAttemptStore)
+		if err != nil {
+			return AdminPageData{}, err
+		}
+	}
+	return pageData, nil
+}
+
+// Give a user a site role
+// Admins can't change their own role, so there is always someone left to undo a mistake
+func setUserRole(
+	ctx context.Context,
+	actorId primitive.ObjectID,
+	username string,
+	role string,
+	userStore UserStore,
+) (User, error) {
+	if err := checkPermission(ctx, PERM_SET_ROLES); err != nil {
+		return User{}, err
+	}
+	if !isSiteRole(role) {
+		return User{}, badRequestError("Role must be one of " + strings.Join(siteRoles, ", "))
+	}
+	user, err := findUser(ctx, strings.TrimSpace(username), userStore)
+	if err != nil {
+		return User{}, err
+	}
+	if user.Id == actorId {
+		return User{}, badRequestError("You can't change your own role")
+	}
+	if err := userStore.UpdateRole(ctx, user.Id, role); err != nil {
+		return User{}, err
+	}
+	slog.InfoContext(ctx, "User role changed", "username", user.Username, "role", role)
+	user.Role = role
+	return user, nil
+}
+
+// Ban or unban a user, banning logs them out everywhere
+// Only admins can ban admins and moderators
+func setUserBanned(
+	ctx context.Context,
+	actorId primitive.ObjectID,
+	username string,
+	banned bool,
+	userStore UserStore,
+	sessionStore SessionStore,
+) (User, error) {
+	if err := checkPermission(ctx, PERM_BAN_USERS); err != nil {
+		return User{}, err
+	}
+	user, err := findUser(ctx, strings.TrimSpace(username), userStore)
+	if err != nil {
+		return User{}, err
+	}
+	if user.Id == actorId {
+		return User{}, badRequestError("You can't ban yourself")
+	}
+	if user.GetRole() != ROLE_USER && !hasPermission(ctx, PERM_SET_ROLES) {
+		return User{}, forbiddenError("Only admins can ban admins and moderators")
+	}
+	if err := userStore.UpdateBanned(ctx, user.Id, banned); err != nil {
+		return User{}, err
+	}
+	if banned {
+		if _, err := sessionStore.DeleteByUser(ctx, user.Id); err != nil {
+			// Their sessions are refused while they're banned anyway
+			slog.ErrorContext(ctx, "Couldn't end banned user's sessions", "error", err)
+		}
+	}
+	slog.InfoContext(ctx, "User ban changed", "username", user.Username, "banned", banned)
+	user.Banned = banned
+	return user, nil
+}
+
+// List login lockouts that started at or after since, newest first
+func listLockouts(ctx context.Context, since time.Time, loginAttemptStore LoginAttemptStore) ([]LoginLockout, error) {
+	if err := checkPermission(ctx, PERM_VIEW_LOCKOUTS); err != nil {
+		return nil, err
+	}
+	return loginAttemptStore.ListLockouts(ctx, since)
+}
+
+// Make the configured users admins, so a new site has someone to hand out roles
+func promoteAdmins(ctx context.Context, usernames []string, userStore UserStore) {
+	for _, username := range usernames {
+		user, err := userStore.GetByUsername(ctx, username)
+		if err != nil {
+			slog.WarnContext(ctx, "Couldn't find configured admin", "username", username, "error", err)
+			continue
+		}
+		if user.GetRole() == ROLE_ADMIN {
+			continue
+		}
+		if err := userStore.UpdateRole(ctx, user.Id, ROLE_ADMIN); err != nil {
+			slog.ErrorContext(ctx, "Couldn't make configured user an admin", "username", username, "error", err)
+			continue
+		}
+		slog.InfoContext(ctx, "Configured user made an admin", "username", username)
+	}
+}
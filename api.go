@@ -0,0 +1,2122 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/sessions"
+)
+
+// ***********
+// JSON Bodies
+// ***********
+
+type APIError struct {
+	Status int `json:"status"`
+	Message string `json:"message"`
+}
+
+type APIUser struct {
+	Id string `json:"id"`
+	Username string `json:"username"`
+}
+
+// The logged in user, with the CSRF token to send in the X-CSRF-Token header
+// when using the session cookie
+type APISessionUser struct {
+	APIUser
+	CSRFToken string `json:"csrfToken,omitempty"`
+}
+
+type APIContest struct {
+	Id string `json:"id"`
+	Name string `json:"name"`
+	State string `json:"state"`
+	Description string `json:"description"`
+	OwnerId string `json:"ownerId"`
+	OwnerName string `json:"ownerName"`
+	TimeCreated time.Time `json:"timeCreated"`
+	SubmissionEnd *time.Time `json:"submissionEnd,omitempty"`
+	VotingEnd *time.Time `json:"votingEnd,omitempty"`
+	VotingMethod string `json:"votingMethod"`
+	EntryCount int64 `json:"entryCount"`
+	Visibility string `json:"visibility"`
+	// Slug of the community hosting the contest
+	Community string `json:"community,omitempty"`
+}
+
+type APIContestDetail struct {
+	Contest APIContest `json:"contest"`
+	EntryCount int64 `json:"entryCount"`
+	CanSubmit bool `json:"canSubmit"`
+	CanVote bool `json:"canVote"`
+	CanStartVoting bool `json:"canStartVoting"`
+	CanConcludeVoting bool `json:"canConcludeVoting"`
+}
+
+type APIEntry struct {
+	Id string `json:"id"`
+	ContestId string `json:"contestId"`
+	Name string `json:"name"`
+	ImageUrl string `json:"imageUrl"`
+	OwnerId string `json:"ownerId"`
+	OwnerName string `json:"ownerName"`
+	Variants []APIImageVariant `json:"variants"`
+	Camera *APICameraInfo `json:"camera,omitempty"`
+}
+
+type APICameraInfo struct {
+	Make string `json:"make,omitempty"`
+	Model string `json:"model,omitempty"`
+	LensModel string `json:"lensModel,omitempty"`
+	ExposureTime float64 `json:"exposureTime,omitempty"`
+	FNumber float64 `json:"fNumber,omitempty"`
+	ISO int `json:"iso,omitempty"`
+	FocalLength float64 `json:"focalLength,omitempty"`
+}
+
+type APIImageVariant struct {
+	Name string `json:"name"`
+	Width int `json:"width"`
+	Url string `json:"url"`
+}
+
+type APIEntryResult struct {
+	Entry APIEntry `json:"entry"`
+	Votes int64 `json:"votes"`
+}
+
+type APIResults struct {
+	VotingMethod string `json:"votingMethod"`
+	Winners []APIEntry `json:"winners"`
+	Results []APIEntryResult `json:"results"`
+}
+
+type APIDuplicateMatch struct {
+	Entry APIEntry `json:"entry"`
+	Match APIEntry `json:"match"`
+	MatchContest APIContest `json:"matchContest"`
+	Distance int `json:"distance"`
+}
+
+type APIVote struct {
+	Id string `json:"id"`
+	ContestId string `json:"contestId"`
+	EntryId string `json:"entryId,omitempty"`
+	Choices []APIBallotChoice `json:"choices,omitempty"`
+}
+
+type APIBallotChoice struct {
+	EntryId string `json:"entryId"`
+	Value int `json:"value"`
+}
+
+type APICredentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+type APINewContest struct {
+	Name string `json:"name"`
+	Description string `json:"description"`
+	SubmissionEnd *time.Time `json:"submissionEnd"`
+	VotingEnd *time.Time `json:"votingEnd"`
+	VotingMethod string `json:"votingMethod"`
+	Visibility string `json:"visibility"`
+	// Slug of the community to host the contest, you must be one of its admins
+	Community string `json:"community"`
+}
+
+type APICommunity struct {
+	Id string `json:"id"`
+	Name string `json:"name"`
+	Slug string `json:"slug"`
+	Description string `json:"description"`
+	TimeCreated time.Time `json:"timeCreated"`
+	// The requesting user's role, empty if they aren't a member
+	Role string `json:"role,omitempty"`
+}
+
+type APINewCommunity struct {
+	Name string `json:"name"`
+	Description string `json:"description"`
+}
+
+type APICommunityMember struct {
+	UserId string `json:"userId"`
+	Username string `json:"username"`
+	Role string `json:"role"`
+	TimeJoined time.Time `json:"timeJoined"`
+}
+
+type APIRoleChange struct {
+	Role string `json:"role"`
+}
+
+type APIParticipant struct {
+	UserId string `json:"userId"`
+	Username string `json:"username"`
+	TimeAdded time.Time `json:"timeAdded"`
+	// Set if the user joined with an invite link
+	InviteId string `json:"inviteId,omitempty"`
+}
+
+type APINewParticipant struct {
+	Username string `json:"username"`
+}
+
+type APIInvite struct {
+	Id string `json:"id"`
+	Code string `json:"code"`
+	Url string `json:"url"`
+	TimeCreated time.Time `json:"timeCreated"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	// 0 for no limit
+	MaxUses int `json:"maxUses"`
+	Uses int `json:"uses"`
+}
+
+type APINewInvite struct {
+	ExpiresAt *time.Time `json:"expiresAt"`
+	MaxUses int `json:"maxUses"`
+}
+
+type APIAccessToken struct {
+	Id string `json:"id"`
+	Name string `json:"name"`
+	Prefix string `json:"prefix"`
+	Scopes []string `json:"scopes"`
+	TimeCreated time.Time `json:"timeCreated"`
+	LastUsed *time.Time `json:"lastUsed,omitempty"`
+	// Only set in the response to creating the token
+	Token string `json:"token,omitempty"`
+}
+
+type APINewAccessToken struct {
+	Name string `json:"name"`
+	Scopes []string `json:"scopes"`
+}
+
+type APIUserSession struct {
+	Id string `json:"id"`
+	Device string `json:"device"`
+	UserAgent string `json:"userAgent"`
+	IP string `json:"ip"`
+	TimeCreated time.Time `json:"timeCreated"`
+	LastSeen time.Time `json:"lastSeen"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	// Whether this is the session making the request
+	Current bool `json:"current"`
+}
+
+// A user's profile, sections hidden by their privacy settings are null
+type APIUserProfile struct {
+	Id string `json:"id"`
+	Username string `json:"username"`
+	Contests []APIContest `json:"contests"`
+	Entries []APIProfileEntry `json:"entries"`
+	Wins []APIProfileEntry `json:"wins"`
+	Stats *APIProfileStats `json:"stats"`
+	// Only included on the user's own profile
+	Privacy *APIPrivacy `json:"privacy,omitempty"`
+}
+
+type APIProfileEntry struct {
+	Entry APIEntry `json:"entry"`
+	Contest APIContest `json:"contest"`
+	// Omitted until the contest concludes
+	Placement int `json:"placement,omitempty"`
+	EntryCount int `json:"entryCount,omitempty"`
+	Won bool `json:"won"`
+}
+
+type APIProfileStats struct {
+	ContestsCreated int `json:"contestsCreated"`
+	EntriesSubmitted int `json:"entriesSubmitted"`
+	Wins int `json:"wins"`
+	Podiums int `json:"podiums"`
+	VotesCast int64 `json:"votesCast"`
+}
+
+type APIPrivacy struct {
+	HideContests bool `json:"hideContests"`
+	HideEntries bool `json:"hideEntries"`
+	HideWins bool `json:"hideWins"`
+	HideStats bool `json:"hideStats"`
+}
+
+type APIStateChange struct {
+	State string `json:"state"`
+	// Admins can move a contest into any state, skipping the usual checks
+	Force bool `json:"force"`
+}
+
+// Fields left out are kept as they are
+type APIContestEdit struct {
+	Name *string `json:"name"`
+	Description *string `json:"description"`
+}
+
+type APIAdminUser struct {
+	Id string `json:"id"`
+	Username string `json:"username"`
+	Role string `json:"role"`
+	Banned bool `json:"banned"`
+}
+
+type APIBanChange struct {
+	Banned bool `json:"banned"`
+}
+
+type APILockout struct {
+	// "account" or "ip"
+	Kind string `json:"kind"`
+	Value string `json:"value"`
+	IP string `json:"ip"`
+	Failures int `json:"failures"`
+	Start time.Time `json:"start"`
+	Until time.Time `json:"until"`
+}
+
+// Ballot for a contest, only the field for the contest's voting method is used
+type APINewVote struct {
+	// Plurality: the entry voted for
+	EntryId string `json:"entryId,omitempty"`
+	// Approval: every entry the voter approves of
+	EntryIds []string `json:"entryIds,omitempty"`
+	// Score: stars from 1 to 5 for each entry
+	Scores map[string]int `json:"scores,omitempty"`
+	// Ranked: entries in order of preference, first choice first
+	Ranking []string `json:"ranking,omitempty"`
+}
+
+// Contest states as they appear in the API
+var apiStateNames = map[int]string{
+	OPEN: "open",
+	VOTING: "voting",
+	CONCLUDED: "concluded",
+}
+
+// Contest state for one of apiStateNames
+func stateFromName(name string) (int, bool) {
+	for value, stateName := range apiStateNames {
+		if stateName == name {
+			return value, true
+		}
+	}
+	return 0, false
+}
+
+func toAPIUser(user User) APIUser {
+	return APIUser{user.Id.Hex(), user.Username}
+}
+
+func toAPIContest(contest Contest) APIContest {
+	return APIContest{
+		Id: contest.GetStringId(),
+		Name: contest.Name,
+		State: apiStateNames[contest.State],
+		Description: contest.Description,
+		OwnerId: contest.OwnerId.Hex(),
+		OwnerName: contest.OwnerName,
+		TimeCreated: contest.TimeCreated,
+		SubmissionEnd: contest.SubmissionEnd,
+		VotingEnd: contest.VotingEnd,
+		VotingMethod: contest.GetVotingMethod(),
+		EntryCount: contest.EntryCount,
+		Visibility: contest.GetVisibility(),
+		Community: contest.CommunitySlug,
+	}
+}
+
+func toAPICommunity(community Community, role string) APICommunity {
+	return APICommunity{
+		Id: community.GetStringId(),
+		Name: community.Name,
+		Slug: community.Slug,
+		Description: community.Description,
+		TimeCreated: community.TimeCreated,
+		Role: role,
+	}
+}
+
+func toAPICommunityMember(member CommunityMember) APICommunityMember {
+	return APICommunityMember{member.UserId.Hex(), member.Username, member.Role, member.TimeJoined}
+}
+
+func toAPIParticipant(participant ContestParticipant) APIParticipant {
+	apiParticipant := APIParticipant{
+		UserId: participant.UserId.Hex(),
+		Username: participant.Username,
+		TimeAdded: participant.TimeAdded,
+	}
+	if participant.InviteId != nil {
+		apiParticipant.InviteId = participant.InviteId.Hex()
+	}
+	return apiParticipant
+}
+
+func toAPIInvite(invite ContestInvite, baseUrl string) APIInvite {
+	return APIInvite{
+		Id: invite.GetStringId(),
+		Code: invite.Code,
+		Url: baseUrl + inviteUrl(invite),
+		TimeCreated: invite.TimeCreated,
+		ExpiresAt: invite.ExpiresAt,
+		MaxUses: invite.MaxUses,
+		Uses: invite.Uses,
+	}
+}
+
+func toAPIEntry(entry ContestEntry) APIEntry {
+	return APIEntry{
+		Id: entry.GetStringId(),
+		ContestId: entry.ContestID.Hex(),
+		Name: entry.Name,
+		ImageUrl: entry.ImagePath,
+		OwnerId: entry.OwnerId.Hex(),
+		OwnerName: entry.OwnerName,
+		Variants: toAPIImageVariants(entry.Variants),
+		Camera: toAPICameraInfo(entry.Camera),
+	}
+}
+
+func toAPICameraInfo(camera *CameraInfo) *APICameraInfo {
+	if camera == nil {
+		return nil
+	}
+	apiCamera := APICameraInfo(*camera)
+	return &apiCamera
+}
+
+func toAPIImageVariants(variants []ImageVariant) []APIImageVariant {
+	apiVariants := []APIImageVariant{}
+	for _, variant := range variants {
+		apiVariants = append(apiVariants, APIImageVariant{variant.Name, variant.Width, variant.Path})
+	}
+	return apiVariants
+}
+
+func toAPIEntries(entries []ContestEntry) []APIEntry {
+	apiEntries := []APIEntry{}
+	for _, entry := range entries {
+		apiEntries = append(apiEntries, toAPIEntry(entry))
+	}
+	return apiEntries
+}
+
+func toAPIVote(vote ContestVote) APIVote {
+	apiVote := APIVote{Id: vote.Id.Hex(), ContestId: vote.ContestID.Hex()}
+	if !vote.EntryID.IsZero() {
+		apiVote.EntryId = vote.EntryID.Hex()
+	}
+	for _, choice := range vote.Choices {
+		apiVote.Choices = append(apiVote.Choices, APIBallotChoice{choice.EntryID.Hex(), choice.Value})
+	}
+	return apiVote
+}
+
+// Convert an API ballot into the entry ID to value map used by castVote
+func fromAPIBallot(contest Contest, body APINewVote) map[string]int {
+	ballot := map[string]int{}
+	if contest.IsApproval() {
+		for _, entryId := range body.EntryIds {
+			ballot[entryId] = 1
+		}
+	} else if contest.IsScore() {
+		for entryId, score := range body.Scores {
+			ballot[entryId] = score
+		}
+	} else if contest.IsRanked() {
+		for i, entryId := range body.Ranking {
+			// Give a repeated entry an invalid rank so buildBallot rejects the ballot
+			if _, ok := ballot[entryId]; ok {
+				ballot[entryId] = 0
+				continue
+			}
+			ballot[entryId] = i + 1
+		}
+	} else if body.EntryId != "" {
+		ballot[body.EntryId] = 1
+	}
+	return ballot
+}
+
+func toAPIAccessToken(token AccessToken) APIAccessToken {
+	return APIAccessToken{
+		Id: token.GetStringId(),
+		Name: token.Name,
+		Prefix: token.Prefix,
+		Scopes: token.Scopes,
+		TimeCreated: token.TimeCreated,
+		LastUsed: token.LastUsed,
+	}
+}
+
+func toAPIUserProfile(profile UserProfile) APIUserProfile {
+	apiProfile := APIUserProfile{
+		Id: profile.UserId.Hex(),
+		Username: profile.Username,
+		Entries: toAPIProfileEntries(profile.Entries),
+		Wins: toAPIProfileEntries(profile.Wins),
+	}
+	if profile.Contests != nil {
+		apiProfile.Contests = []APIContest{}
+		for _, contest := range profile.Contests {
+			apiProfile.Contests = append(apiProfile.Contests, toAPIContest(contest))
+		}
+	}
+	if stats := profile.Stats; stats != nil {
+		apiProfile.Stats = &APIProfileStats{stats.ContestsCreated, stats.EntriesSubmitted, stats.Wins, stats.Podiums, stats.VotesCast}
+	}
+	if profile.IsOwnProfile {
+		privacy := toAPIPrivacy(profile.Privacy)
+		apiProfile.Privacy = &privacy
+	}
+	return apiProfile
+}
+
+// Keeps hidden sections nil
+func toAPIProfileEntries(entries []ProfileEntry) []APIProfileEntry {
+	if entries == nil {
+		return nil
+	}
+	apiEntries := []APIProfileEntry{}
+	for _, entry := range entries {
+		apiEntries = append(apiEntries, APIProfileEntry{
+			Entry: toAPIEntry(entry.Entry),
+			Contest: toAPIContest(entry.Contest),
+			Placement: entry.Placement,
+			EntryCount: entry.EntryCount,
+			Won: entry.Won,
+		})
+	}
+	return apiEntries
+}
+
+func toAPIPrivacy(privacy UserPrivacy) APIPrivacy {
+	return APIPrivacy{privacy.HideContests, privacy.HideEntries, privacy.HideWins, privacy.HideStats}
+}
+
+func toAPIUserSession(session UserSession, current bool) APIUserSession {
+	return APIUserSession{
+		Id: session.GetStringId(),
+		Device: session.Device(),
+		UserAgent: session.UserAgent,
+		IP: session.IP,
+		TimeCreated: session.TimeCreated,
+		LastSeen: session.LastSeen,
+		ExpiresAt: session.ExpiresAt,
+		Current: current,
+	}
+}
+
+func toAPIAdminUser(user User) APIAdminUser {
+	return APIAdminUser{user.Id.Hex(), user.Username, user.GetRole(), user.Banned}
+}
+
+func toAPILockout(lockout LoginLockout) APILockout {
+	return APILockout{lockout.Kind, lockout.Value, lockout.IP, lockout.Failures, lockout.Start, lockout.Until}
+}
+
+// *******
+// Helpers
+// *******
+
+// Write v as the JSON response body
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("Couldn't write JSON response", "error", err)
+	}
+}
+
+// Write an error object with the status code for err
+func writeAPIError(w http.ResponseWriter, r *http.Request, err error) {
+	status := errorStatus(err)
+	message := err.Error()
+	logRequestError(r.Context(), "API request failed", err)
+	if status == http.StatusInternalServerError {
+		// Don't leak internal errors to the client
+		message = "Something went wrong, please try again"
+	}
+	writeJSON(w, status, map[string]APIError{"error": {status, message}})
+}
+
+// Decode a JSON request body into v
+func decodeJSON(r *http.Request, v interface{}) error {
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return badRequestError("Request body is not valid JSON: " + err.Error())
+	}
+	return nil
+}
+
+// Helper for login required API endpoints
+// Responds with 401 instead of redirecting to the login page
+func apiLoginRequiredMixin(
+	w http.ResponseWriter,
+	r *http.Request,
+	s *sessions.CookieStore,
+	scope string,
+) bool {
+	if !isLoggedIn(r) {
+		writeAPIError(w, r, unauthorizedError("Log in to use this endpoint"))
+		return true
+	}
+	if err := checkScope(r, scope); err != nil {
+		writeAPIError(w, r, err)
+		return true
+	}
+	return false
+}
+
+// ********
+// Handlers
+// ********
+
+// Handler for POST /api/v1/auth/signup
+func apiSignupHandler(w http.ResponseWriter, r *http.Request, userStore UserStore) {
+	var credentials APICredentials
+	if err := decodeJSON(r, &credentials); err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	user, err := createNewUser(r.Context(), credentials.Username, credentials.Password, userStore)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, toAPIUser(user))
+}
+
+// Handler for POST /api/v1/auth/login
+func apiLoginHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+	s *sessions.CookieStore,
+	userStore UserStore,
+	loginAttemptStore LoginAttemptStore,
+	sessionStore SessionStore,
+) {
+	var credentials APICredentials
+	if err := decodeJSON(r, &credentials); err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	wait, err := attemptLogin(r.Context(), credentials.Username, credentials.Password, clientIP(r), time.Now(), userStore, loginAttemptStore)
+	if err != nil {
+		if wait > 0 {
+			w.Header().Set("Retry-After", retryAfterSeconds(wait))
+		}
+		writeAPIError(w, r, err)
+		return
+	}
+	userId := getUserId(r.Context(), credentials.Username, userStore)
+	if err := startSession(w, r, s, sessionStore, userId, credentials.Username); err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	csrfToken, err := getCSRFToken(w, r, s)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, APISessionUser{APIUser{userId.Hex(), credentials.Username}, csrfToken})
+}
+
+// Handler for POST /api/v1/auth/logout
+func apiLogoutHandler(w http.ResponseWriter, r *http.Request, s *sessions.CookieStore, sessionStore SessionStore) {
+	endSession(w, r, s, sessionStore)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Handler for GET /api/v1/auth/me
+func apiCurrentUserHandler(w http.ResponseWriter, r *http.Request, s *sessions.CookieStore) {
+	userId, username, err := getSessionUser(r)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	user := APISessionUser{APIUser: APIUser{userId.Hex(), username}}
+	// Access token requests don't need a CSRF token
+	if _, ok := getRequestToken(r); !ok {
+		user.CSRFToken, err = getCSRFToken(w, r, s)
+		if err != nil {
+			writeAPIError(w, r, err)
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, user)
+}
+
+// Handler for GET /api/v1/contests
+// Takes the same query parameters as the contest list page, the next page is linked in the Link header
+func apiContestListHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+	userStore UserStore,
+	contestStore ContestStore,
+	communityStore CommunityStore,
+	participantStore ParticipantStore,
+	memberStore CommunityMemberStore,
+) {
+	viewerId, _, err := getSessionUser(r)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	query, err := parseContestQuery(r.URL.Query())
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	page, err := searchContests(r.Context(), viewerId, query, userStore, contestStore, communityStore, participantStore, memberStore)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	apiContests := []APIContest{}
+	for _, contest := range page.Contests {
+		apiContests = append(apiContests, toAPIContest(contest))
+	}
+	if page.NextCursor != "" {
+		w.Header().Set("Link", "<" + nextPageUrl(r.URL.Path, r.URL.Query(), page.NextCursor) + `>; rel="next"`)
+	}
+	writeJSON(w, http.StatusOK, apiContests)
+}
+
+// Handler for POST /api/v1/contests
+func apiCreateContestHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+	contestStore ContestStore,
+	communityStore CommunityStore,
+	memberStore CommunityMemberStore,
+) {
+	ownerId, ownerName, err := getSessionUser(r)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	var body APINewContest
+	if err := decodeJSON(r, &body); err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	community, err := findHostCommunity(r.Context(), ownerId, body.Community, communityStore, memberStore)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	contest, err := createNewContest(
+		r.Context(),
+		ownerId,
+		ownerName,
+		body.Name,
+		body.Description,
+		body.SubmissionEnd,
+		body.VotingEnd,
+		body.VotingMethod,
+		body.Visibility,
+		community,
+		contestStore,
+	)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, toAPIContest(contest))
+}
+
+// Handler for GET /api/v1/contests/{contestId}
+func apiContestDetailHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+	contestStore ContestStore,
+	entryStore EntryStore,
+	voteStore VoteStore,
+	participantStore ParticipantStore,
+	memberStore CommunityMemberStore,
+	contestId string,
+) {
+	userId, _, err := getSessionUser(r)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	contest, err := findContestForUser(r.Context(), contestId, userId, contestStore, participantStore, memberStore)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	detail := getContestDetail(r.Context(), userId, contest, entryStore, voteStore, memberStore)
+	writeJSON(w, http.StatusOK, APIContestDetail{
+		Contest: toAPIContest(contest),
+		EntryCount: detail.EntryCount,
+		CanSubmit: detail.ShowSubmitForm,
+		CanVote: detail.ShowVoteForm,
+		CanStartVoting: detail.ShowEndSubmission,
+		CanConcludeVoting: detail.ShowEndVoting,
+	})
+}
+
+// Handler for POST /api/v1/contests/{contestId}/state
+func apiContestStateHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+	contestStore ContestStore,
+	entryStore EntryStore,
+	participantStore ParticipantStore,
+	memberStore CommunityMemberStore,
+	contestId string,
+) {
+	userId, _, err := getSessionUser(r)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	contest, err := findContestForUser(r.Context(), contestId, userId, contestStore, participantStore, memberStore)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	var body APIStateChange
+	if err := decodeJSON(r, &body); err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	state, ok := stateFromName(body.State)
+	if !ok {
+		writeAPIError(w, r, badRequestError("State must be one of \"open\", \"voting\" or \"concluded\""))
+		return
+	}
+	if body.Force {
+		contest, err = forceContestState(r.Context(), contest, state, contestStore)
+	} else {
+		contest, err = changeContestState(r.Context(), userId, contest, state, contestStore, entryStore, memberStore)
+	}
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, toAPIContest(contest))
+}
+
+// Handler for GET /api/v1/contests/{contestId}/entries
+// Entries are only visible once voting starts, same as the contest page
+func apiEntryListHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+	contestStore ContestStore,
+	entryStore EntryStore,
+	participantStore ParticipantStore,
+	memberStore CommunityMemberStore,
+	contestId string,
+) {
+	userId, _, err := getSessionUser(r)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	contest, err := findContestForUser(r.Context(), contestId, userId, contestStore, participantStore, memberStore)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	if contest.IsOpen() {
+		writeAPIError(w, r, conflictError("Entries are hidden until voting starts"))
+		return
+	}
+	writeJSON(w, http.StatusOK, toAPIEntries(getContestEntries(r.Context(), contest.Id, entryStore)))
+}
+
+// Handler for POST /api/v1/contests/{contestId}/entries
+// Takes a multipart form with the image in "img" and the entry name in "name"
+func apiSubmitEntryHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+	contestStore ContestStore,
+	entryStore EntryStore,
+	participantStore ParticipantStore,
+	memberStore CommunityMemberStore,
+	blobStore BlobStore,
+	contestId string,
+) {
+	ownerId, ownerName, err := getSessionUser(r)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	contest, err := findContestForUser(r.Context(), contestId, ownerId, contestStore, participantStore, memberStore)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	r.ParseMultipartForm(maxUploadSize)
+	uploadedFile, _, err := r.FormFile("img")
+	if err != nil {
+		writeAPIError(w, r, badRequestError("Request must include an image in the \"img\" field"))
+		return
+	}
+	defer uploadedFile.Close()
+	entry, err := submitEntry(
+		r.Context(),
+		ownerId,
+		ownerName,
+		contest,
+		r.PostFormValue("name"),
+		uploadedFile,
+		contestStore,
+		entryStore,
+		blobStore,
+	)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, toAPIEntry(entry))
+}
+
+// Handler for POST /api/v1/contests/{contestId}/votes
+func apiVoteHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+	contestStore ContestStore,
+	entryStore EntryStore,
+	voteStore VoteStore,
+	participantStore ParticipantStore,
+	memberStore CommunityMemberStore,
+	contestId string,
+) {
+	voterId, _, err := getSessionUser(r)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	contest, err := findContestForUser(r.Context(), contestId, voterId, contestStore, participantStore, memberStore)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	var body APINewVote
+	if err := decodeJSON(r, &body); err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	vote, err := castVote(r.Context(), voterId, contest, fromAPIBallot(contest, body), entryStore, voteStore)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, toAPIVote(vote))
+}
+
+// Handler for GET /api/v1/contests/{contestId}/results
+func apiResultsHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+	contestStore ContestStore,
+	entryStore EntryStore,
+	voteStore VoteStore,
+	participantStore ParticipantStore,
+	memberStore CommunityMemberStore,
+	contestId string,
+) {
+	userId, _, err := getSessionUser(r)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	contest, err := findContestForUser(r.Context(), contestId, userId, contestStore, participantStore, memberStore)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	if !contest.IsConcluded() {
+		writeAPIError(w, r, conflictError("Results are available once voting concludes"))
+		return
+	}
+	results := getContestResults(r.Context(), contest, entryStore, voteStore)
+	apiResults := APIResults{
+		VotingMethod: contest.GetVotingMethod(),
+		Winners: toAPIEntries(contestWinners(results)),
+		Results: []APIEntryResult{},
+	}
+	for _, result := range results {
+		apiResults.Results = append(apiResults.Results, APIEntryResult{toAPIEntry(result.Entry), result.Votes})
+	}
+	writeJSON(w, http.StatusOK, apiResults)
+}
+
+// Handler for GET /api/v1/contests/{contestId}/duplicates
+func apiDuplicatesHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+	contestStore ContestStore,
+	entryStore EntryStore,
+	participantStore ParticipantStore,
+	memberStore CommunityMemberStore,
+	contestId string,
+) {
+	userId, _, err := getSessionUser(r)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	contest, err := findContestForUser(r.Context(), contestId, userId, contestStore, participantStore, memberStore)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	matches, err := getDuplicateReport(r.Context(), userId, contest, contestStore, entryStore, participantStore, memberStore)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	apiMatches := []APIDuplicateMatch{}
+	for _, match := range matches {
+		apiMatches = append(apiMatches, APIDuplicateMatch{
+			Entry: toAPIEntry(match.Entry),
+			Match: toAPIEntry(match.Match),
+			MatchContest: toAPIContest(match.MatchContest),
+			Distance: match.Distance,
+		})
+	}
+	writeJSON(w, http.StatusOK, apiMatches)
+}
+
+// Handler for GET /api/v1/contests/{contestId}/participants
+func apiParticipantListHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+	contestStore ContestStore,
+	participantStore ParticipantStore,
+	memberStore CommunityMemberStore,
+	inviteStore InviteStore,
+	contestId string,
+) {
+	userId, _, err := getSessionUser(r)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	contest, err := findContestForUser(r.Context(), contestId, userId, contestStore, participantStore, memberStore)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	pageData, err := getParticipantPage(r.Context(), userId, contest, participantStore, memberStore, inviteStore)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	apiParticipants := []APIParticipant{}
+	for _, participant := range pageData.Participants {
+		apiParticipants = append(apiParticipants, toAPIParticipant(participant))
+	}
+	writeJSON(w, http.StatusOK, apiParticipants)
+}
+
+// Handler for POST /api/v1/contests/{contestId}/participants
+func apiAddParticipantHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+	userStore UserStore,
+	contestStore ContestStore,
+	participantStore ParticipantStore,
+	memberStore CommunityMemberStore,
+	contestId string,
+) {
+	userId, _, err := getSessionUser(r)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	contest, err := findContestForUser(r.Context(), contestId, userId, contestStore, participantStore, memberStore)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	var body APINewParticipant
+	if err := decodeJSON(r, &body); err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	participant, err := addContestParticipant(r.Context(), userId, contest, body.Username, userStore, participantStore, memberStore)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, toAPIParticipant(participant))
+}
+
+// Handler for DELETE /api/v1/contests/{contestId}/participants/{userId}
+func apiRemoveParticipantHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+	contestStore ContestStore,
+	participantStore ParticipantStore,
+	memberStore CommunityMemberStore,
+	contestId string,
+	participantId string,
+) {
+	userId, _, err := getSessionUser(r)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	contest, err := findContestForUser(r.Context(), contestId, userId, contestStore, participantStore, memberStore)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	if err := removeContestParticipant(r.Context(), userId, contest, participantId, participantStore, memberStore); err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Handler for GET /api/v1/contests/{contestId}/invites
+func apiInviteListHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+	contestStore ContestStore,
+	participantStore ParticipantStore,
+	memberStore CommunityMemberStore,
+	inviteStore InviteStore,
+	contestId string,
+) {
+	userId, _, err := getSessionUser(r)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	contest, err := findContestForUser(r.Context(), contestId, userId, contestStore, participantStore, memberStore)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	pageData, err := getParticipantPage(r.Context(), userId, contest, participantStore, memberStore, inviteStore)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	apiInvites := []APIInvite{}
+	for _, invite := range pageData.Invites {
+		apiInvites = append(apiInvites, toAPIInvite(invite, requestBaseUrl(r)))
+	}
+	writeJSON(w, http.StatusOK, apiInvites)
+}
+
+// Handler for POST /api/v1/contests/{contestId}/invites
+func apiCreateInviteHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+	contestStore ContestStore,
+	participantStore ParticipantStore,
+	memberStore CommunityMemberStore,
+	inviteStore InviteStore,
+	contestId string,
+) {
+	userId, _, err := getSessionUser(r)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	contest, err := findContestForUser(r.Context(), contestId, userId, contestStore, participantStore, memberStore)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	var body APINewInvite
+	if err := decodeJSON(r, &body); err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	invite, err := createContestInvite(r.Context(), userId, contest, body.ExpiresAt, body.MaxUses, memberStore, inviteStore)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, toAPIInvite(invite, requestBaseUrl(r)))
+}
+
+// Handler for DELETE /api/v1/contests/{contestId}/invites/{inviteId}
+func apiRevokeInviteHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+	contestStore ContestStore,
+	participantStore ParticipantStore,
+	memberStore CommunityMemberStore,
+	inviteStore InviteStore,
+	contestId string,
+	inviteId string,
+) {
+	userId, _, err := getSessionUser(r)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	contest, err := findContestForUser(r.Context(), contestId, userId, contestStore, participantStore, memberStore)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	if err := revokeContestInvite(r.Context(), userId, contest, inviteId, memberStore, inviteStore); err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Handler for POST /api/v1/invites/{code}, joins the invite's contest
+func apiAcceptInviteHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+	contestStore ContestStore,
+	participantStore ParticipantStore,
+	memberStore CommunityMemberStore,
+	inviteStore InviteStore,
+	code string,
+) {
+	userId, username, err := getSessionUser(r)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	contest, err := acceptInvite(r.Context(), userId, username, code, contestStore, participantStore, memberStore, inviteStore)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, toAPIContest(contest))
+}
+
+// Handler for GET /api/v1/communities
+func apiCommunityListHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+	communityStore CommunityStore,
+	memberStore CommunityMemberStore,
+) {
+	userId, _, err := getSessionUser(r)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	communities, err := communityStore.List(r.Context())
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	memberships, err := getMemberships(r.Context(), userId, memberStore)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	apiCommunities := []APICommunity{}
+	for _, community := range communities {
+		apiCommunities = append(apiCommunities, toAPICommunity(community, memberships[community.Id].Role))
+	}
+	writeJSON(w, http.StatusOK, apiCommunities)
+}
+
+// Handler for POST /api/v1/communities
+func apiCreateCommunityHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+	communityStore CommunityStore,
+	memberStore CommunityMemberStore,
+) {
+	userId, username, err := getSessionUser(r)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	var body APINewCommunity
+	if err := decodeJSON(r, &body); err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	community, err := createCommunity(r.Context(), userId, username, body.Name, body.Description, communityStore, memberStore)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, toAPICommunity(community, COMMUNITY_ADMIN))
+}
+
+// Handler for GET /api/v1/communities/{slug}
+func apiCommunityHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+	communityStore CommunityStore,
+	memberStore CommunityMemberStore,
+	slug string,
+) {
+	userId, _, err := getSessionUser(r)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	community, err := findCommunity(r.Context(), slug, communityStore)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	pageData, err := getCommunityPage(r.Context(), userId, community, memberStore)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, toAPICommunity(community, pageData.Membership.Role))
+}
+
+// Handler for GET /api/v1/communities/{slug}/members
+func apiCommunityMemberListHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+	communityStore CommunityStore,
+	memberStore CommunityMemberStore,
+	slug string,
+) {
+	community, err := findCommunity(r.Context(), slug, communityStore)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	members, err := memberStore.ListByCommunity(r.Context(), community.Id)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	apiMembers := []APICommunityMember{}
+	for _, member := range members {
+		apiMembers = append(apiMembers, toAPICommunityMember(member))
+	}
+	writeJSON(w, http.StatusOK, apiMembers)
+}
+
+// Handler for POST /api/v1/communities/{slug}/join
+func apiJoinCommunityHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+	communityStore CommunityStore,
+	memberStore CommunityMemberStore,
+	slug string,
+) {
+	userId, username, err := getSessionUser(r)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	community, err := findCommunity(r.Context(), slug, communityStore)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	member, err := joinCommunity(r.Context(), userId, username, community, memberStore)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, toAPICommunityMember(member))
+}
+
+// Handler for POST /api/v1/communities/{slug}/leave
+func apiLeaveCommunityHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+	communityStore CommunityStore,
+	memberStore CommunityMemberStore,
+	slug string,
+) {
+	userId, _, err := getSessionUser(r)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	community, err := findCommunity(r.Context(), slug, communityStore)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	if err := leaveCommunity(r.Context(), userId, community, memberStore); err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Handler for PUT /api/v1/communities/{slug}/members/{userId}
+func apiChangeMemberRoleHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+	communityStore CommunityStore,
+	memberStore CommunityMemberStore,
+	slug string,
+	memberId string,
+) {
+	userId, _, err := getSessionUser(r)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	community, err := findCommunity(r.Context(), slug, communityStore)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	var body APIRoleChange
+	if err := decodeJSON(r, &body); err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	member, err := changeMemberRole(r.Context(), userId, community, memberId, body.Role, memberStore)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, toAPICommunityMember(member))
+}
+
+// Handler for DELETE /api/v1/communities/{slug}/members/{userId}
+func apiRemoveCommunityMemberHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+	communityStore CommunityStore,
+	memberStore CommunityMemberStore,
+	slug string,
+	memberId string,
+) {
+	userId, _, err := getSessionUser(r)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	community, err := findCommunity(r.Context(), slug, communityStore)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	if err := removeCommunityMember(r.Context(), userId, community, memberId, memberStore); err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Handler for GET /api/v1/tokens
+func apiTokenListHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+	tokenStore TokenStore,
+) {
+	userId, _, err := getSessionUser(r)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	tokens, err := tokenStore.ListByUser(r.Context(), userId)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	apiTokens := []APIAccessToken{}
+	for _, token := range tokens {
+		apiTokens = append(apiTokens, toAPIAccessToken(token))
+	}
+	writeJSON(w, http.StatusOK, apiTokens)
+}
+
+// Handler for POST /api/v1/tokens
+// The response is the only time the token value is returned
+func apiCreateTokenHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+	tokenStore TokenStore,
+) {
+	userId, username, err := getSessionUser(r)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	var body APINewAccessToken
+	if err := decodeJSON(r, &body); err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	token, value, err := createAccessToken(r.Context(), userId, username, body.Name, body.Scopes, tokenStore)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	apiToken := toAPIAccessToken(token)
+	apiToken.Token = value
+	writeJSON(w, http.StatusCreated, apiToken)
+}
+
+// Handler for DELETE /api/v1/tokens/{tokenId}
+func apiRevokeTokenHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+	tokenStore TokenStore,
+	tokenId string,
+) {
+	userId, _, err := getSessionUser(r)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	if err := revokeAccessToken(r.Context(), userId, tokenId, tokenStore); err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Handler for GET /api/v1/users/{username}
+func apiUserProfileHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+	userStore UserStore,
+	contestStore ContestStore,
+	entryStore EntryStore,
+	voteStore VoteStore,
+	participantStore ParticipantStore,
+	memberStore CommunityMemberStore,
+	username string,
+) {
+	viewerId, _, err := getSessionUser(r)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	profile, err := getUserProfile(r.Context(), viewerId, username, userStore, contestStore, entryStore, voteStore, participantStore, memberStore)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, toAPIUserProfile(profile))
+}
+
+// Handler for PUT /api/v1/users/{username}/privacy
+func apiPrivacyHandler(w http.ResponseWriter, r *http.Request, userStore UserStore, username string) {
+	userId, _, err := getSessionUser(r)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	var body APIPrivacy
+	if err := decodeJSON(r, &body); err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	privacy := UserPrivacy{body.HideContests, body.HideEntries, body.HideWins, body.HideStats}
+	if err := updatePrivacy(r.Context(), userId, username, privacy, userStore); err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, toAPIPrivacy(privacy))
+}
+
+// Handler for GET /api/v1/sessions
+func apiSessionListHandler(w http.ResponseWriter, r *http.Request, sessionStore SessionStore) {
+	userId, _, err := getSessionUser(r)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	userSessions, err := sessionStore.ListByUser(r.Context(), userId)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	current, _ := getRequestSession(r)
+	apiSessions := []APIUserSession{}
+	for _, userSession := range userSessions {
+		apiSessions = append(apiSessions, toAPIUserSession(userSession, userSession.Id == current.Id))
+	}
+	writeJSON(w, http.StatusOK, apiSessions)
+}
+
+// Handler for DELETE /api/v1/sessions/{sessionId}
+func apiRevokeSessionHandler(w http.ResponseWriter, r *http.Request, sessionStore SessionStore, sessionId string) {
+	userId, _, err := getSessionUser(r)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	if err := revokeSession(r.Context(), userId, sessionId, sessionStore); err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Handler for DELETE /api/v1/sessions
+// Logs out every session, including the one making the request
+func apiRevokeAllSessionsHandler(w http.ResponseWriter, r *http.Request, sessionStore SessionStore) {
+	userId, _, err := getSessionUser(r)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	if _, err := sessionStore.DeleteByUser(r.Context(), userId); err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Handler for PATCH /api/v1/contests/{contestId}
+func apiEditContestHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+	contestStore ContestStore,
+	participantStore ParticipantStore,
+	memberStore CommunityMemberStore,
+	contestId string,
+) {
+	userId, _, err := getSessionUser(r)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	contest, err := findContestForUser(r.Context(), contestId, userId, contestStore, participantStore, memberStore)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	var body APIContestEdit
+	if err := decodeJSON(r, &body); err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	name := contest.Name
+	if body.Name != nil {
+		name = *body.Name
+	}
+	description := contest.Description
+	if body.Description != nil {
+		description = *body.Description
+	}
+	contest, err = editContest(r.Context(), userId, contest, name, description, contestStore, memberStore)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, toAPIContest(contest))
+}
+
+// Handler for DELETE /api/v1/contests/{contestId}
+func apiDeleteContestHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+	contestStore ContestStore,
+	entryStore EntryStore,
+	voteStore VoteStore,
+	participantStore ParticipantStore,
+	memberStore CommunityMemberStore,
+	blobStore BlobStore,
+	contestId string,
+) {
+	userId, _, err := getSessionUser(r)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	contest, err := findContestForUser(r.Context(), contestId, userId, contestStore, participantStore, memberStore)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	if err := deleteContest(r.Context(), userId, contest, contestStore, entryStore, voteStore, memberStore, blobStore); err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Handler for DELETE /api/v1/contests/{contestId}/entries/{entryId}
+func apiRemoveEntryHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+	contestStore ContestStore,
+	entryStore EntryStore,
+	voteStore VoteStore,
+	participantStore ParticipantStore,
+	memberStore CommunityMemberStore,
+	blobStore BlobStore,
+	contestId string,
+	entryId string,
+) {
+	userId, _, err := getSessionUser(r)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	contest, err := findContestForUser(r.Context(), contestId, userId, contestStore, participantStore, memberStore)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	err = removeEntry(r.Context(), userId, contest, entryId, contestStore, entryStore, voteStore, memberStore, blobStore)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Handler for GET /api/v1/admin/users
+// Lists users with a site role or a ban
+func apiAdminUserListHandler(w http.ResponseWriter, r *http.Request, userStore UserStore) {
+	if err := checkPermission(r.Context(), PERM_BAN_USERS); err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	users, err := userStore.ListStaffAndBanned(r.Context())
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	apiUsers := []APIAdminUser{}
+	for _, user := range users {
+		apiUsers = append(apiUsers, toAPIAdminUser(user))
+	}
+	writeJSON(w, http.StatusOK, apiUsers)
+}
+
+// Handler for PUT /api/v1/admin/users/{username}/role
+func apiSetUserRoleHandler(w http.ResponseWriter, r *http.Request, userStore UserStore, username string) {
+	userId, _, err := getSessionUser(r)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	var body APIRoleChange
+	if err := decodeJSON(r, &body); err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	user, err := setUserRole(r.Context(), userId, username, body.Role, userStore)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, toAPIAdminUser(user))
+}
+
+// Handler for PUT /api/v1/admin/users/{username}/ban
+func apiSetUserBannedHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+	userStore UserStore,
+	sessionStore SessionStore,
+	username string,
+) {
+	userId, _, err := getSessionUser(r)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	var body APIBanChange
+	if err := decodeJSON(r, &body); err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	user, err := setUserBanned(r.Context(), userId, username, body.Banned, userStore, sessionStore)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, toAPIAdminUser(user))
+}
+
+// Handler for GET /api/v1/admin/lockouts
+// ?since= is how far back to look as a duration, e.g. "1h", a day by default
+func apiLockoutListHandler(w http.ResponseWriter, r *http.Request, loginAttemptStore LoginAttemptStore) {
+	window := adminLockoutWindow
+	if since := r.URL.Query().Get("since"); since != "" {
+		parsed, err := time.ParseDuration(since)
+		if err != nil || parsed <= 0 {
+			writeAPIError(w, r, badRequestError("since must be a positive duration such as \"1h\""))
+			return
+		}
+		window = parsed
+	}
+	lockouts, err := listLockouts(r.Context(), time.Now().Add(-window), loginAttemptStore)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	apiLockouts := []APILockout{}
+	for _, lockout := range lockouts {
+		apiLockouts = append(apiLockouts, toAPILockout(lockout))
+	}
+	writeJSON(w, http.StatusOK, apiLockouts)
+}
+
+// ******
+// Routes
+// ******
+
+// Register JSON API routes under /api/v1
+func registerAPIRoutes(
+	router *mux.Router,
+	store *sessions.CookieStore,
+	userStore UserStore,
+	contestStore ContestStore,
+	entryStore EntryStore,
+	voteStore VoteStore,
+	tokenStore TokenStore,
+	loginAttemptStore LoginAttemptStore,
+	sessionStore SessionStore,
+	participantStore ParticipantStore,
+	inviteStore InviteStore,
+	communityStore CommunityStore,
+	memberStore CommunityMemberStore,
+	blobStore BlobStore,
+) {
+	api := router.PathPrefix("/api/v1").Subrouter()
+	api.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeAPIError(w, r, notFoundError("No such endpoint"))
+	})
+
+	// Authentication routes
+	api.HandleFunc("/auth/signup", func(w http.ResponseWriter, r *http.Request) {
+		apiSignupHandler(w, r, userStore)
+	}).Methods("POST")
+
+	api.HandleFunc("/auth/login", func(w http.ResponseWriter, r *http.Request) {
+		apiLoginHandler(w, r, store, userStore, loginAttemptStore, sessionStore)
+	}).Methods("POST")
+
+	api.HandleFunc("/auth/logout", func(w http.ResponseWriter, r *http.Request) {
+		apiLogoutHandler(w, r, store, sessionStore)
+	}).Methods("POST")
+
+	api.HandleFunc("/auth/me", func(w http.ResponseWriter, r *http.Request) {
+		if apiLoginRequiredMixin(w, r, store, SCOPE_READ) {
+			return
+		}
+		apiCurrentUserHandler(w, r, store)
+	}).Methods("GET")
+
+	// Contest routes (authentication needed)
+	api.HandleFunc("/contests", func(w http.ResponseWriter, r *http.Request) {
+		if apiLoginRequiredMixin(w, r, store, SCOPE_READ) {
+			return
+		}
+		apiContestListHandler(w, r, userStore, contestStore, communityStore, participantStore, memberStore)
+	}).Methods("GET")
+
+	api.HandleFunc("/contests", func(w http.ResponseWriter, r *http.Request) {
+		if apiLoginRequiredMixin(w, r, store, SCOPE_MANAGE) {
+			return
+		}
+		apiCreateContestHandler(w, r, contestStore, communityStore, memberStore)
+	}).Methods("POST")
+
+	api.HandleFunc("/contests/{contestId}", func(w http.ResponseWriter, r *http.Request) {
+		if apiLoginRequiredMixin(w, r, store, SCOPE_READ) {
+			return
+		}
+		contestId := mux.Vars(r)["contestId"]
+		apiContestDetailHandler(w, r, contestStore, entryStore, voteStore, participantStore, memberStore, contestId)
+	}).Methods("GET")
+
+	api.HandleFunc("/contests/{contestId}", func(w http.ResponseWriter, r *http.Request) {
+		if apiLoginRequiredMixin(w, r, store, SCOPE_MANAGE) {
+			return
+		}
+		contestId := mux.Vars(r)["contestId"]
+		apiEditContestHandler(w, r, contestStore, participantStore, memberStore, contestId)
+	}).Methods("PATCH")
+
+	api.HandleFunc("/contests/{contestId}", func(w http.ResponseWriter, r *http.Request) {
+		if apiLoginRequiredMixin(w, r, store, SCOPE_MANAGE) {
+			return
+		}
+		contestId := mux.Vars(r)["contestId"]
+		apiDeleteContestHandler(w, r, contestStore, entryStore, voteStore, participantStore, memberStore, blobStore, contestId)
+	}).Methods("DELETE")
+
+	api.HandleFunc("/contests/{contestId}/state", func(w http.ResponseWriter, r *http.Request) {
+		if apiLoginRequiredMixin(w, r, store, SCOPE_MANAGE) {
+			return
+		}
+		contestId := mux.Vars(r)["contestId"]
+		apiContestStateHandler(w, r, contestStore, entryStore, participantStore, memberStore, contestId)
+	}).Methods("POST")
+
+	api.HandleFunc("/contests/{contestId}/entries", func(w http.ResponseWriter, r *http.Request) {
+		if apiLoginRequiredMixin(w, r, store, SCOPE_READ) {
+			return
+		}
+		contestId := mux.Vars(r)["contestId"]
+		apiEntryListHandler(w, r, contestStore, entryStore, participantStore, memberStore, contestId)
+	}).Methods("GET")
+
+	api.HandleFunc("/contests/{contestId}/entries", func(w http.ResponseWriter, r *http.Request) {
+		if apiLoginRequiredMixin(w, r, store, SCOPE_SUBMIT) {
+			return
+		}
+		contestId := mux.Vars(r)["contestId"]
+		apiSubmitEntryHandler(w, r, contestStore, entryStore, participantStore, memberStore, blobStore, contestId)
+	}).Methods("POST")
+
+	api.HandleFunc("/contests/{contestId}/entries/{entryId}", func(w http.ResponseWriter, r *http.Request) {
+		if apiLoginRequiredMixin(w, r, store, SCOPE_MANAGE) {
+			return
+		}
+		vars := mux.Vars(r)
+		apiRemoveEntryHandler(w, r, contestStore, entryStore, voteStore, participantStore, memberStore, blobStore, vars["contestId"], vars["entryId"])
+	}).Methods("DELETE")
+
+	api.HandleFunc("/contests/{contestId}/votes", func(w http.ResponseWriter, r *http.Request) {
+		if apiLoginRequiredMixin(w, r, store, SCOPE_VOTE) {
+			return
+		}
+		contestId := mux.Vars(r)["contestId"]
+		apiVoteHandler(w, r, contestStore, entryStore, voteStore, participantStore, memberStore, contestId)
+	}).Methods("POST")
+
+	api.HandleFunc("/contests/{contestId}/results", func(w http.ResponseWriter, r *http.Request) {
+		if apiLoginRequiredMixin(w, r, store, SCOPE_READ) {
+			return
+		}
+		contestId := mux.Vars(r)["contestId"]
+		apiResultsHandler(w, r, contestStore, entryStore, voteStore, participantStore, memberStore, contestId)
+	}).Methods("GET")
+
+	api.HandleFunc("/contests/{contestId}/duplicates", func(w http.ResponseWriter, r *http.Request) {
+		if apiLoginRequiredMixin(w, r, store, SCOPE_MANAGE) {
+			return
+		}
+		contestId := mux.Vars(r)["contestId"]
+		apiDuplicatesHandler(w, r, contestStore, entryStore, participantStore, memberStore, contestId)
+	}).Methods("GET")
+
+	// Participant and invite routes for invite-only contests
+	api.HandleFunc("/contests/{contestId}/participants", func(w http.ResponseWriter, r *http.Request) {
+		if apiLoginRequiredMixin(w, r, store, SCOPE_MANAGE) {
+			return
+		}
+		contestId := mux.Vars(r)["contestId"]
+		apiParticipantListHandler(w, r, contestStore, participantStore, memberStore, inviteStore, contestId)
+	}).Methods("GET")
+
+	api.HandleFunc("/contests/{contestId}/participants", func(w http.ResponseWriter, r *http.Request) {
+		if apiLoginRequiredMixin(w, r, store, SCOPE_MANAGE) {
+			return
+		}
+		contestId := mux.Vars(r)["contestId"]
+		apiAddParticipantHandler(w, r, userStore, contestStore, participantStore, memberStore, contestId)
+	}).Methods("POST")
+
+	api.HandleFunc("/contests/{contestId}/participants/{userId}", func(w http.ResponseWriter, r *http.Request) {
+		if apiLoginRequiredMixin(w, r, store, SCOPE_MANAGE) {
+			return
+		}
+		vars := mux.Vars(r)
+		apiRemoveParticipantHandler(w, r, contestStore, participantStore, memberStore, vars["contestId"], vars["userId"])
+	}).Methods("DELETE")
+
+	api.HandleFunc("/contests/{contestId}/invites", func(w http.ResponseWriter, r *http.Request) {
+		if apiLoginRequiredMixin(w, r, store, SCOPE_MANAGE) {
+			return
+		}
+		contestId := mux.Vars(r)["contestId"]
+		apiInviteListHandler(w, r, contestStore, participantStore, memberStore, inviteStore, contestId)
+	}).Methods("GET")
+
+	api.HandleFunc("/contests/{contestId}/invites", func(w http.ResponseWriter, r *http.Request) {
+		if apiLoginRequiredMixin(w, r, store, SCOPE_MANAGE) {
+			return
+		}
+		contestId := mux.Vars(r)["contestId"]
+		apiCreateInviteHandler(w, r, contestStore, participantStore, memberStore, inviteStore, contestId)
+	}).Methods("POST")
+
+	api.HandleFunc("/contests/{contestId}/invites/{inviteId}", func(w http.ResponseWriter, r *http.Request) {
+		if apiLoginRequiredMixin(w, r, store, SCOPE_MANAGE) {
+			return
+		}
+		vars := mux.Vars(r)
+		apiRevokeInviteHandler(w, r, contestStore, participantStore, memberStore, inviteStore, vars["contestId"], vars["inviteId"])
+	}).Methods("DELETE")
+
+	api.HandleFunc("/invites/{code}", func(w http.ResponseWriter, r *http.Request) {
+		if apiLoginRequiredMixin(w, r, store, SCOPE_MANAGE) {
+			return
+		}
+		code := mux.Vars(r)["code"]
+		apiAcceptInviteHandler(w, r, contestStore, participantStore, memberStore, inviteStore, code)
+	}).Methods("POST")
+
+	// Community routes
+	api.HandleFunc("/communities", func(w http.ResponseWriter, r *http.Request) {
+		if apiLoginRequiredMixin(w, r, store, SCOPE_READ) {
+			return
+		}
+		apiCommunityListHandler(w, r, communityStore, memberStore)
+	}).Methods("GET")
+
+	api.HandleFunc("/communities", func(w http.ResponseWriter, r *http.Request) {
+		if apiLoginRequiredMixin(w, r, store, SCOPE_MANAGE) {
+			return
+		}
+		apiCreateCommunityHandler(w, r, communityStore, memberStore)
+	}).Methods("POST")
+
+	api.HandleFunc("/communities/{slug}", func(w http.ResponseWriter, r *http.Request) {
+		if apiLoginRequiredMixin(w, r, store, SCOPE_READ) {
+			return
+		}
+		slug := mux.Vars(r)["slug"]
+		apiCommunityHandler(w, r, communityStore, memberStore, slug)
+	}).Methods("GET")
+
+	api.HandleFunc("/communities/{slug}/members", func(w http.ResponseWriter, r *http.Request) {
+		if apiLoginRequiredMixin(w, r, store, SCOPE_READ) {
+			return
+		}
+		slug := mux.Vars(r)["slug"]
+		apiCommunityMemberListHandler(w, r, communityStore, memberStore, slug)
+	}).Methods("GET")
+
+	api.HandleFunc("/communities/{slug}/join", func(w http.ResponseWriter, r *http.Request) {
+		if apiLoginRequiredMixin(w, r, store, SCOPE_MANAGE) {
+			return
+		}
+		slug := mux.Vars(r)["slug"]
+		apiJoinCommunityHandler(w, r, communityStore, memberStore, slug)
+	}).Methods("POST")
+
+	api.HandleFunc("/communities/{slug}/leave", func(w http.ResponseWriter, r *http.Request) {
+		if apiLoginRequiredMixin(w, r, store, SCOPE_MANAGE) {
+			return
+		}
+		slug := mux.Vars(r)["slug"]
+		apiLeaveCommunityHandler(w, r, communityStore, memberStore, slug)
+	}).Methods("POST")
+
+	api.HandleFunc("/communities/{slug}/members/{userId}", func(w http.ResponseWriter, r *http.Request) {
+		if apiLoginRequiredMixin(w, r, store, SCOPE_MANAGE) {
+			return
+		}
+		vars := mux.Vars(r)
+		apiChangeMemberRoleHandler(w, r, communityStore, memberStore, vars["slug"], vars["userId"])
+	}).Methods("PUT")
+
+	api.HandleFunc("/communities/{slug}/members/{userId}", func(w http.ResponseWriter, r *http.Request) {
+		if apiLoginRequiredMixin(w, r, store, SCOPE_MANAGE) {
+			return
+		}
+		vars := mux.Vars(r)
+		apiRemoveCommunityMemberHandler(w, r, communityStore, memberStore, vars["slug"], vars["userId"])
+	}).Methods("DELETE")
+
+	// Access token routes (browser session needed, tokens can't mint other tokens)
+	api.HandleFunc("/tokens", func(w http.ResponseWriter, r *http.Request) {
+		if apiLoginRequiredMixin(w, r, store, "") {
+			return
+		}
+		apiTokenListHandler(w, r, tokenStore)
+	}).Methods("GET")
+
+	api.HandleFunc("/tokens", func(w http.ResponseWriter, r *http.Request) {
+		if apiLoginRequiredMixin(w, r, store, "") {
+			return
+		}
+		apiCreateTokenHandler(w, r, tokenStore)
+	}).Methods("POST")
+
+	api.HandleFunc("/tokens/{tokenId}", func(w http.ResponseWriter, r *http.Request) {
+		if apiLoginRequiredMixin(w, r, store, "") {
+			return
+		}
+		tokenId := mux.Vars(r)["tokenId"]
+		apiRevokeTokenHandler(w, r, tokenStore, tokenId)
+	}).Methods("DELETE")
+
+	// Profile routes
+	api.HandleFunc("/users/{username}", func(w http.ResponseWriter, r *http.Request) {
+		if apiLoginRequiredMixin(w, r, store, SCOPE_READ) {
+			return
+		}
+		username := mux.Vars(r)["username"]
+		apiUserProfileHandler(w, r, userStore, contestStore, entryStore, voteStore, participantStore, memberStore, username)
+	}).Methods("GET")
+
+	api.HandleFunc("/users/{username}/privacy", func(w http.ResponseWriter, r *http.Request) {
+		if apiLoginRequiredMixin(w, r, store, "") {
+			return
+		}
+		username := mux.Vars(r)["username"]
+		apiPrivacyHandler(w, r, userStore, username)
+	}).Methods("PUT")
+
+	// Site administration routes (browser session needed)
+	api.HandleFunc("/admin/users", func(w http.ResponseWriter, r *http.Request) {
+		if apiLoginRequiredMixin(w, r, store, "") {
+			return
+		}
+		apiAdminUserListHandler(w, r, userStore)
+	}).Methods("GET")
+
+	api.HandleFunc("/admin/users/{username}/role", func(w http.ResponseWriter, r *http.Request) {
+		if apiLoginRequiredMixin(w, r, store, "") {
+			return
+		}
+		username := mux.Vars(r)["username"]
+		apiSetUserRoleHandler(w, r, userStore, username)
+	}).Methods("PUT")
+
+	api.HandleFunc("/admin/users/{username}/ban", func(w http.ResponseWriter, r *http.Request) {
+		if apiLoginRequiredMixin(w, r, store, "") {
+			return
+		}
+		username := mux.Vars(r)["username"]
+		apiSetUserBannedHandler(w, r, userStore, sessionStore, username)
+	}).Methods("PUT")
+
+	api.HandleFunc("/admin/lockouts", func(w http.ResponseWriter, r *http.Request) {
+		if apiLoginRequiredMixin(w, r, store, "") {
+			return
+		}
+		apiLockoutListHandler(w, r, loginAttemptStore)
+	}).Methods("GET")
+
+	// Session routes (browser session needed)
+	api.HandleFunc("/sessions", func(w http.ResponseWriter, r *http.Request) {
+		if apiLoginRequiredMixin(w, r, store, "") {
+			return
+		}
+		apiSessionListHandler(w, r, sessionStore)
+	}).Methods("GET")
+
+	api.HandleFunc("/sessions", func(w http.ResponseWriter, r *http.Request) {
+		if apiLoginRequiredMixin(w, r, store, "") {
+			return
+		}
+		apiRevokeAllSessionsHandler(w, r, sessionStore)
+	}).Methods("DELETE")
+
+	api.HandleFunc("/sessions/{sessionId}", func(w http.ResponseWriter, r *http.Request) {
+		if apiLoginRequiredMixin(w, r, store, "") {
+			return
+		}
+		sessionId := mux.Vars(r)["sessionId"]
+		apiRevokeSessionHandler(w, r, sessionStore, sessionId)
+	}).Methods("DELETE")
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Build a JSON API request
+func newAPIRequest(method string, path string, body interface{}) *http.Request {
+	var reqBody bytes.Buffer
+	if body != nil {
+		json.NewEncoder(&reqBody).Encode(body)
+	}
+	req := httptest.NewRequest(method, "/api/v1" + path, &reqBody)
+	req.Header.Set("Content-Type", "application/json")
+	return req
+}
+
+// Decode a JSON response body into out if given
+func decodeResponse(t *testing.T, rec *httptest.ResponseRecorder, out interface{}) {
+	if out == nil {
+		return
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), out); err != nil {
+		t.Fatalf("Response is not valid JSON: %v", rec.Body.String())
+	}
+}
+
+// Send a JSON API request, decoding the response body into out if given
+func (a *testApp) apiCall(
+	t *testing.T,
+	method string,
+	path string,
+	body interface{},
+	cookies []*http.Cookie,
+	out interface{},
+) *httptest.ResponseRecorder {
+	req := newAPIRequest(method, path, body)
+	// Sent by clients using the session cookie, from the login response
+	req.Header.Set(csrfHeader, a.csrfToken(cookies))
+	rec := a.do(req, cookies)
+	decodeResponse(t, rec, out)
+	return rec
+}
+
+// Sign up and log in through the API, returning session cookies
+func (a *testApp) apiLogin(t *testing.T, username string) []*http.Cookie {
+	credentials := APICredentials{username, "password"}
+	if rec := a.apiCall(t, "POST", "/auth/signup", credentials, nil, nil); rec.Code != http.StatusCreated {
+		t.Fatalf("API signup for %v failed with %v", username, rec.Code)
+	}
+	rec := a.apiCall(t, "POST", "/auth/login", credentials, nil, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("API login for %v failed with %v", username, rec.Code)
+	}
+	return rec.Result().Cookies()
+}
+
+func (a *testApp) apiSubmitEntry(contestId string, cookies []*http.Cookie) *httptest.ResponseRecorder {
+	req := newEntryUploadRequest(contestId)
+	req.Header.Set(csrfHeader, a.csrfToken(cookies))
+	return a.do(req, cookies)
+}
+
+// Build a multipart request submitting an entry through the API
+func newEntryUploadRequest(contestId string) *http.Request {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	writer.WriteField("name", "My entry")
+	part, _ := writer.CreateFormFile("img", "photo.png")
+	part.Write(createPNG(10, 10))
+	writer.Close()
+	req := httptest.NewRequest("POST", "/api/v1/contests/" + contestId + "/entries", body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	return req
+}
+
+// Check that a response is a JSON error object with the expected status
+func expectAPIError(t *testing.T, rec *httptest.ResponseRecorder, status int) {
+	t.Helper()
+	var body map[string]APIError
+	json.Unmarshal(rec.Body.Bytes(), &body)
+	if rec.Code != status || body["error"].Status != status || body["error"].Message == "" {
+		t.Errorf("Expected %v error object, got %v: %v", status, rec.Code, rec.Body.String())
+	}
+}
+
+func TestAPIAuth(t *testing.T){
+	app := newTestApp(t)
+	expectAPIError(t, app.apiCall(t, "GET", "/auth/me", nil, nil, nil), http.StatusUnauthorized)
+
+	cookies := app.apiLogin(t, "bill")
+	var user APIUser
+	app.apiCall(t, "GET", "/auth/me", nil, cookies, &user)
+	if user.Username != "bill" || user.Id == "" {
+		t.Error("Current user should be returned")
+	}
+
+	rec := app.apiCall(t, "POST", "/auth/logout", nil, cookies, nil)
+	if rec.Code != http.StatusNoContent {
+		t.Errorf("Logout should return no content, got %v", rec.Code)
+	}
+	expectAPIError(t, app.apiCall(t, "GET", "/auth/me", nil, rec.Result().Cookies(), nil), http.StatusUnauthorized)
+}
+
+func TestAPIAuthErrors(t *testing.T){
+	app := newTestApp(t)
+	app.apiLogin(t, "bill")
+	expectAPIError(t, app.apiCall(t, "POST", "/auth/signup", APICredentials{"bill", "x"}, nil, nil), http.StatusConflict)
+	expectAPIError(t, app.apiCall(t, "POST", "/auth/login", APICredentials{"bill", "wrong"}, nil, nil), http.StatusUnauthorized)
+	expectAPIError(t, app.apiCall(t, "POST", "/auth/login", "not an object", nil, nil), http.StatusBadRequest)
+}
+
+func TestAPIContestNotFound(t *testing.T){
+	app := newTestApp(t)
+	cookies := app.apiLogin(t, "bill")
+	expectAPIError(t, app.apiCall(t, "GET", "/contests/nope", nil, cookies, nil), http.StatusNotFound)
+	expectAPIError(t, app.apiCall(t, "GET", "/nope", nil, cookies, nil), http.StatusNotFound)
+}
+
+func TestAPICreateContest(t *testing.T){
+	app := newTestApp(t)
+	cookies := app.apiLogin(t, "bill")
+	expectAPIError(t, app.apiCall(t, "POST", "/contests", APINewContest{}, cookies, nil), http.StatusBadRequest)
+
+	var contest APIContest
+	rec := app.apiCall(t, "POST", "/contests", APINewContest{Name: "Sunsets"}, cookies, &contest)
+	if rec.Code != http.StatusCreated || contest.State != "open" || contest.OwnerName != "bill" {
+		t.Fatalf("Contest should be created, got %v", rec.Body.String())
+	}
+
+	var contests []APIContest
+	app.apiCall(t, "GET", "/contests", nil, cookies, &contests)
+	if len(contests) != 1 || contests[0].Id != contest.Id {
+		t.Error("Contest list should include new contest")
+	}
+
+	var detail APIContestDetail
+	app.apiCall(t, "GET", "/contests/" + contest.Id, nil, cookies, &detail)
+	if detail.Contest.Name != "Sunsets" || !detail.CanSubmit || detail.CanStartVoting {
+		t.Errorf("Unexpected contest detail %+v", detail)
+	}
+}
+
+func TestAPIContestLifecycle(t *testing.T){
+	app := newTestApp(t)
+	owner := app.apiLogin(t, "bill")
+	entrant := app.apiLogin(t, "ted")
+	var contest APIContest
+	app.apiCall(t, "POST", "/contests", APINewContest{Name: "Sunsets"}, owner, &contest)
+
+	var entry APIEntry
+	rec := app.apiSubmitEntry(contest.Id, entrant)
+	json.Unmarshal(rec.Body.Bytes(), &entry)
+	if rec.Code != http.StatusCreated || entry.OwnerName != "ted" || !strings.HasPrefix(entry.ImageUrl, "/uploadedImages/") {
+		t.Fatalf("Entry should be created, got %v", rec.Body.String())
+	}
+	expectAPIError(t, app.apiSubmitEntry(contest.Id, entrant), http.StatusConflict)
+	expectAPIError(t, app.apiCall(t, "GET", "/contests/" + contest.Id + "/entries", nil, owner, nil), http.StatusConflict)
+
+	stateUrl := "/contests/" + contest.Id + "/state"
+	expectAPIError(t, app.apiCall(t, "POST", stateUrl, APIStateChange{State: "voting"}, entrant, nil), http.StatusForbidden)
+	expectAPIError(t, app.apiCall(t, "POST", stateUrl, APIStateChange{State: "concluded"}, owner, nil), http.StatusConflict)
+	expectAPIError(t, app.apiCall(t, "POST", stateUrl, APIStateChange{State: "paused"}, owner, nil), http.StatusBadRequest)
+	app.apiCall(t, "POST", stateUrl, APIStateChange{State: "voting"}, owner, &contest)
+	if contest.State != "voting" {
+		t.Fatal("Contest should be voting")
+	}
+
+	var entries []APIEntry
+	app.apiCall(t, "GET", "/contests/" + contest.Id + "/entries", nil, owner, &entries)
+	if len(entries) != 1 || entries[0].Id != entry.Id {
+		t.Error("Entries should be listed once voting starts")
+	}
+
+	votesUrl := "/contests/" + contest.Id + "/votes"
+	expectAPIError(t, app.apiCall(t, "GET", "/contests/" + contest.Id + "/results", nil, owner, nil), http.StatusConflict)
+	if rec := app.apiCall(t, "POST", votesUrl, APINewVote{EntryId: entry.Id}, owner, nil); rec.Code != http.StatusCreated {
+		t.Fatalf("Vote should be created, got %v", rec.Body.String())
+	}
+	expectAPIError(t, app.apiCall(t, "POST", votesUrl, APINewVote{EntryId: entry.Id}, owner, nil), http.StatusConflict)
+	expectAPIError(t, app.apiCall(t, "POST", votesUrl, APINewVote{EntryId: "nope"}, entrant, nil), http.StatusBadRequest)
+
+	app.apiCall(t, "POST", stateUrl, APIStateChange{State: "concluded"}, owner, &contest)
+	var results APIResults
+	app.apiCall(t, "GET", "/contests/" + contest.Id + "/results", nil, entrant, &results)
+	if len(results.Winners) != 1 || results.Winners[0].Id != entry.Id || results.Results[0].Votes != 1 {
+		t.Errorf("Unexpected results %+v", results)
+	}
+}
@@ -2,16 +2,14 @@ package main
 
 import (
 	"context"
-	"errors"
+	"crypto/subtle"
 	"html/template"
-	"log"
+	"log/slog"
 	"net/http"
 	"time"
 	"github.com/gorilla/sessions"
-	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/crypto/bcrypt"
 )
 
 // ***********
@@ -24,6 +22,7 @@ type AuthFormData struct {
 	ButtonText string
 	RedirectUrl string
 	RedirectText string
+	Error string
 }
 
 // ********
@@ -31,14 +30,8 @@ type AuthFormData struct {
 // ********
 
 // Handler for /logout endpoint
-func logoutHandler(w http.ResponseWriter, r *http.Request, s *sessions.CookieStore) {
-    session, err := s.Get(r, "session")
-    if err == nil { //If there is no error, then remove session
-		if session.Values["loggedin"] != "false" {
-			session.Values["loggedin"] = "false"
-			session.Save(r, w)
-		}
-    }
+func logoutHandler(w http.ResponseWriter, r *http.Request, s *sessions.CookieStore, sessionStore SessionStore) {
+    endSession(w, r, s, sessionStore)
     //redirect to login regardless of an error
     http.Redirect(w, r, "/login", 302) 
 }
@@ -50,42 +43,48 @@ func loginHandler(
 	r *http.Request,
 	s *sessions.CookieStore,
 	tmplMap map[string]*template.Template,
-	userCollection *mongo.Collection,
+	userStore UserStore,
+	loginAttemptStore LoginAttemptStore,
+	sessionStore SessionStore,
 ) {
-    session, err := s.Get(r, "session")
 	loginData := AuthFormData{
-		"Log In",
-		"/login",
-		"Log In",
-		"/signup",
-		"Create an Account",
-	}
-    if err != nil {
-		// in case of error during fetching session info, show login page
-		tmplMap["authForm.html"].ExecuteTemplate(w, "base", loginData) 
-    } else {
-		isLoggedIn := session.Values["loggedin"]
-		if isLoggedIn != "true" {
-			if r.Method == "POST" {
-				username := r.PostFormValue("username")
-				password := r.PostFormValue("password")
-				// Attempt to log user in
-				if (verifyCredentials(username, password, userCollection)) {
-					userId := getUserId(username, userCollection)
-					session.Values["loggedin"] = "true"
-					session.Values["username"] = username
-					session.Values["userId"] = userId.Hex()
-					session.Save(r, w)
-					http.Redirect(w, r, "/contests", 302)
-					return
-				}
-			}
-			tmplMap["authForm.html"].ExecuteTemplate(w, "base", loginData)
-			return
-		}
+		Header: "Log In",
+		FormUrl: "/login",
+		ButtonText: "Log In",
+		RedirectUrl: "/signup",
+		RedirectText: "Create an Account",
+	}
+	if isLoggedIn(r) {
 		// Redirect to contests page if logged in
 		http.Redirect(w, r, "/contests", 302)
-    }
+		return
+	}
+	status := http.StatusOK
+	if r.Method == "POST" {
+		username := r.PostFormValue("username")
+		password := r.PostFormValue("password")
+		// Attempt to log user in
+		wait, err := attemptLogin(r.Context(), username, password, clientIP(r), time.Now(), userStore, loginAttemptStore)
+		if err == nil {
+			userId := getUserId(r.Context(), username, userStore)
+			err = startSession(w, r, s, sessionStore, userId, username)
+			if err == nil {
+				http.Redirect(w, r, "/contests", 302)
+				return
+			}
+		}
+		// Show the login page again with the reason, and how long to wait if there were too many attempts
+		logRequestError(r.Context(), "Login failed", err)
+		loginData.Error = err.Error()
+		if wait > 0 {
+			w.Header().Set("Retry-After", retryAfterSeconds(wait))
+			status = http.StatusTooManyRequests
+		} else if errorStatus(err) == http.StatusInternalServerError {
+			loginData.Error = "Something went wrong, please try again"
+			status = http.StatusInternalServerError
+		}
+	}
+	renderTemplate(w, r, s, tmplMap["authForm.html"], status, loginData)
 }
 
 // Handler for /signup endpoint
@@ -94,16 +93,29 @@ func signupHandler(
 	r *http.Request,
 	s *sessions.CookieStore,
 	tmplMap map[string]*template.Template,
-	userCollection *mongo.Collection,
+	userStore UserStore,
 ) {
+	signupData := AuthFormData{
+		Header: "Create an Account",
+		FormUrl: "/signup",
+		ButtonText: "Sign Up",
+		RedirectUrl: "/login",
+		RedirectText: "Already have an account? Log in here",
+	}
 	if r.Method == "POST" {
 		// Attemp to create user
 		username := r.PostFormValue("username")
 		password := r.PostFormValue("password")
-		err := createNewUser(username, password, userCollection)
+		_, err := createNewUser(r.Context(), username, password, userStore)
 		if err != nil {
-			// Redirect back to sign up page user cannot be created
-			http.Redirect(w, r, "/signup", 302)	
+			// Show sign up page again with the reason the user couldn't be created
+			logRequestError(r.Context(), "Couldn't create user", err)
+			status := errorStatus(err)
+			signupData.Error = err.Error()
+			if status == http.StatusInternalServerError {
+				signupData.Error = "Something went wrong, please try again"
+			}
+			renderTemplate(w, r, s, tmplMap["authForm.html"], status, signupData)
 			return
 		}
 		// Redirect to login page if successful
@@ -111,14 +123,7 @@ func signupHandler(
 		return
 	} else {
 		// Display sign up page for GET request
-		signupData := AuthFormData{
-			"Create an Account",
-			"/signup",
-			"Sign Up",
-			"/login",
-			"Already have an account? Log in here",
-		}
-		tmplMap["authForm.html"].ExecuteTemplate(w, "base", signupData)
+		renderTemplate(w, r, s, tmplMap["authForm.html"], http.StatusOK, signupData)
 		return
 	}
 }
@@ -129,23 +134,30 @@ func homeHandler(
 	r *http.Request,
 	s *sessions.CookieStore,
 ) {
-	if isLoggedIn(r, s) {
+	if isLoggedIn(r) {
 		http.Redirect(w, r, "/contests", 302)
 	}
 	http.Redirect(w, r, "/", 302)
 }
 
 // Helper for login required endpoints
+// Requests authenticated with an access token also need the given scope
 func loginRequiredHandlerMixin(
 	w http.ResponseWriter,
 	r *http.Request,
 	s *sessions.CookieStore,
+	scope string,
 ) bool {
-	if !isLoggedIn(r, s){
-		log.Println("Not authorized for this request")
+	if !isLoggedIn(r){
+		slog.InfoContext(r.Context(), "Not logged in, redirecting to login")
 		http.Redirect(w, r, "/login", 302)
 		return true
 	}
+	if err := checkScope(r, scope); err != nil {
+		logRequestError(r.Context(), "Access token is missing a scope", err)
+		writeAPIError(w, r, err)
+		return true
+	}
 	return false
 }
 
@@ -155,58 +167,126 @@ func loginRequiredHandlerMixin(
 // *******
 
 // Return userId as a Mongo ObjectId
-func getUserId(username string, userCollection *mongo.Collection) primitive.ObjectID {
-	var result User
-	err := userCollection.FindOne(context.TODO(), bson.D{{"username", username}}).Decode(&result)
+func getUserId(ctx context.Context, username string, userStore UserStore) primitive.ObjectID {
+	result, err := userStore.GetByUsername(ctx, username)
 	if err != nil {
-		log.Println("User not found")
+		slog.WarnContext(ctx, "User not found", "username", username, "error", err)
 	}
 	return result.Id
 }
 
+// Return the logged in user's ID and username
+// Uses the access token's user for requests authenticated with a token
+func getSessionUser(r *http.Request) (primitive.ObjectID, string, error) {
+	if token, ok := getRequestToken(r); ok {
+		setLogUser(r.Context(), token.UserId)
+		return token.UserId, token.Username, nil
+	}
+	userSession, ok := getRequestSession(r)
+	if !ok {
+		return primitive.NilObjectID, "", unauthorizedError("Not logged in")
+	}
+	setLogUser(r.Context(), userSession.UserId)
+	return userSession.UserId, userSession.Username, nil
+}
+
 // Return if user is logged in
-func isLoggedIn(r *http.Request, s *sessions.CookieStore) bool {
-	session, _ := s.Get(r, "session")
-	if session.Values["loggedin"] == "true" {
+func isLoggedIn(r *http.Request) bool {
+	if _, ok := getRequestToken(r); ok {
 		return true
 	}
-	return false
+	_, ok := getRequestSession(r)
+	return ok
 }
 
 // Returns if user credentials are valid
-func verifyCredentials(username string, password string, userCollection *mongo.Collection) bool {
-	var user User
+// Users still stored with a plaintext password are rehashed on a successful login
+func verifyCredentials(ctx context.Context, username string, password string, userStore UserStore) bool {
 	if (username == "" || password == "") {
 		return false
 	}
-	err := userCollection.FindOne(context.TODO(), bson.D{{"username", username}}).Decode(&user)
+	user, err := userStore.GetByUsername(ctx, username)
 	if err != nil {
-		log.Print(err)
+		slog.InfoContext(ctx, "Login for unknown user", "username", username, "error", err)
 		return false
 	}
-	if user.Password != password {
+	valid, needsRehash := checkPassword(user.Password, password)
+	if !valid {
 		return false
 	}
+	if needsRehash {
+		rehashPassword(ctx, user.Id, password, userStore)
+	}
 	return true
 }
 
 // Create new user in database
-func createNewUser(username string, password string, userCollection *mongo.Collection) error {
+func createNewUser(ctx context.Context, username string, password string, userStore UserStore) (User, error) {
 	if username == "" || password == "" {
-		return errors.New("Invalid username or password")
+		return User{}, badRequestError("Invalid username or password")
 	}
-	opts := options.Count().SetLimit(1).SetMaxTime(5 * time.Second)
-	count, countErr := userCollection.CountDocuments(context.TODO(), bson.D{{"username", username}}, opts)
-	if countErr != nil {
-		return countErr
+	passwordHash, hashErr := hashPassword(password)
+	if hashErr != nil {
+		return User{}, hashErr
 	}
-	if count != 0 {
-		return errors.New("User ID already exists")
+	newUser := User{primitive.NewObjectID(), username, passwordHash, UserPrivacy{}, ROLE_USER, false}
+	// Username uniqueness is enforced by the store
+	insertErr := userStore.Create(ctx, newUser)
+	if insertErr == ErrDuplicate {
+		return User{}, conflictError("That username is already taken")
 	}
-	newUser := User{primitive.NewObjectID(), username, password}
-	_, insertErr := userCollection.InsertOne(context.TODO(), newUser)
 	if insertErr != nil {
-		return insertErr
+		return User{}, insertErr
+	}
+	return newUser, nil
+}
+
+// Replace a user's stored password with a freshly computed hash
+func rehashPassword(ctx context.Context, userId primitive.ObjectID, password string, userStore UserStore) {
+	passwordHash, err := hashPassword(password)
+	if err != nil {
+		slog.ErrorContext(ctx, "Couldn't hash password", "error", err)
+		return
+	}
+	updateErr := userStore.UpdatePassword(ctx, userId, passwordHash)
+	if updateErr != nil {
+		slog.ErrorContext(ctx, "Couldn't rehash password", "user_id", userId.Hex(), "error", updateErr)
+	}
+}
+
+// ****************
+// Password Hashing
+// ****************
+
+// Cost used when hashing new passwords, stored hashes below this cost get upgraded on login
+var passwordHashCost = 12
+
+// Hash a password with bcrypt
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), passwordHashCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// Check if a stored password is a bcrypt hash rather than legacy plaintext
+func isPasswordHash(stored string) bool {
+	_, err := bcrypt.Cost([]byte(stored))
+	return err == nil
+}
+
+// Compare a password attempt against the stored value
+// Returns whether the password matches and whether the stored value should be rehashed
+func checkPassword(stored string, password string) (bool, bool) {
+	if !isPasswordHash(stored) {
+		// Legacy plaintext row, compare in constant time and upgrade on success
+		match := subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1
+		return match, match
+	}
+	if bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)) != nil {
+		return false, false
 	}
-	return nil
+	cost, _ := bcrypt.Cost([]byte(stored))
+	return true, cost < passwordHashCost
 }
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Password hashing tests
+func TestHashPasswordVerifies(t *testing.T){
+	hash, err := hashPassword("hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash == "hunter2" || !isPasswordHash(hash) {
+		t.Error("Password should be stored as a bcrypt hash")
+	}
+	valid, needsRehash := checkPassword(hash, "hunter2")
+	if !valid || needsRehash {
+		t.Error("Correct password should verify without rehash")
+	}
+	valid, _ = checkPassword(hash, "hunter3")
+	if valid {
+		t.Error("Wrong password should not verify")
+	}
+}
+
+func TestCheckPasswordLegacyPlaintext(t *testing.T){
+	valid, needsRehash := checkPassword("hunter2", "hunter2")
+	if !valid || !needsRehash {
+		t.Error("Legacy plaintext password should verify and be rehashed")
+	}
+	valid, needsRehash = checkPassword("hunter2", "hunter3")
+	if valid || needsRehash {
+		t.Error("Wrong legacy password should not verify or be rehashed")
+	}
+}
+
+func TestCheckPasswordLowCost(t *testing.T){
+	hash, err := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid, needsRehash := checkPassword(string(hash), "hunter2")
+	if !valid || !needsRehash {
+		t.Error("Low cost hash should verify and be rehashed")
+	}
+}
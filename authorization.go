@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/sessions"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Who may do what
+// Every user manages the contests they created, and admins of a community manage the contests it hosts.
+// Site roles add permissions on top of that: moderators can see every contest, remove entries and
+// ban users, and admins can do anything. Handlers go through these checks rather than comparing IDs
+
+// Things a site role can allow
+const (
+	// See and take part in any contest, whatever its visibility
+	PERM_VIEW_ANY_CONTEST = "view_any_contest"
+	// Change the state of any contest, see its possible duplicates and manage its participants
+	PERM_MANAGE_ANY_CONTEST = "manage_any_contest"
+	PERM_EDIT_ANY_CONTEST = "edit_any_contest"
+	PERM_DELETE_ANY_CONTEST = "delete_any_contest"
+	// Move any contest into any state, ignoring the usual order
+	PERM_FORCE_STATE = "force_state"
+	PERM_REMOVE_ANY_ENTRY = "remove_any_entry"
+	PERM_BAN_USERS = "ban_users"
+	PERM_SET_ROLES = "set_roles"
+	PERM_VIEW_LOCKOUTS = "view_lockouts"
+)
+
+var siteRoles = []string{ROLE_ADMIN, ROLE_MODERATOR, ROLE_USER}
+
+var rolePermissions = map[string][]string{
+	ROLE_ADMIN: {
+		PERM_VIEW_ANY_CONTEST,
+		PERM_MANAGE_ANY_CONTEST,
+		PERM_EDIT_ANY_CONTEST,
+		PERM_DELETE_ANY_CONTEST,
+		PERM_FORCE_STATE,
+		PERM_REMOVE_ANY_ENTRY,
+		PERM_BAN_USERS,
+		PERM_SET_ROLES,
+		PERM_VIEW_LOCKOUTS,
+	},
+	ROLE_MODERATOR: {
+		PERM_VIEW_ANY_CONTEST,
+		PERM_REMOVE_ANY_ENTRY,
+		PERM_BAN_USERS,
+	},
+	ROLE_USER: {},
+}
+
+// ***********
+// Middlewares
+// ***********
+
+// Look up the logged in user and store them in the request context, where the permission checks find their role
+// Banned users are turned away, whether they use a session or an access token
+func userMiddleware(
+	s *sessions.CookieStore,
+	tmplMap map[string]*template.Template,
+	userStore UserStore,
+) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			userId, _, err := getSessionUser(r)
+			if err != nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+			respondError := func(err error) {
+				if strings.HasPrefix(r.URL.Path, "/api/") {
+					writeAPIError(w, r, err)
+				} else {
+					renderError(w, r, s, tmplMap, err, "/")
+				}
+			}
+			user, err := userStore.Get(r.Context(), userId)
+			if err == ErrNotFound {
+				// Carry on as a plain user, the handler reports the missing account
+				next.ServeHTTP(w, r)
+				return
+			}
+			if err != nil {
+				// Without the user the ban can't be checked, so don't let the request through
+				slog.ErrorContext(r.Context(), "Couldn't look up logged in user", "error", err)
+				respondError(serviceUnavailableError("Couldn't check your account, please try again"))
+				return
+			}
+			if user.Banned {
+				respondError(forbiddenError("This account has been banned"))
+				return
+			}
+			ctx := context.WithValue(r.Context(), userContextKey, user)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// ******
+// Checks
+// ******
+
+// Role of the user a request context belongs to, plain users if there is no user
+func contextRole(ctx context.Context) string {
+	user, ok := ctx.Value(userContextKey).(User)
+	if !ok {
+		return ROLE_USER
+	}
+	return user.GetRole()
+}
+
+func roleHasPermission(role string, permission string) bool {
+	for _, rolePermission := range rolePermissions[role] {
+		if rolePermission == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether the user a request context belongs to has a permission through their site role
+func hasPermission(ctx context.Context, permission string) bool {
+	return roleHasPermission(contextRole(ctx), permission)
+}
+
+func checkPermission(ctx context.Context, permission string) error {
+	if !hasPermission(ctx, permission) {
+		return forbiddenError("You don't have permission to do that")
+	}
+	return nil
+}
+
+// Check a user may act on a contest as its manager
+// The owner and admins of the community hosting the contest always may, other users only if their role has permission
+// action describes what is being done for the error, e.g. "edit this contest"
+func authorizeContest(
+	ctx context.Context,
+	userId primitive.ObjectID,
+	contest Contest,
+	permission string,
+	action string,
+	memberStore CommunityMemberStore,
+) error {
+	if userId == contest.OwnerId || hasPermission(ctx, permission) {
+		return nil
+	}
+	if contest.CommunityId != nil {
+		member, err := memberStore.Get(ctx, *contest.CommunityId, userId)
+		if err != nil && err != ErrNotFound {
+			return err
+		}
+		if err == nil && member.IsAdmin() {
+			return nil
+		}
+	}
+	return forbiddenError("Only the contest owner can " + action)
+}
+
+// Whether a user may act on a contest, for deciding what to show them
+func canActOnContest(
+	ctx context.Context,
+	userId primitive.ObjectID,
+	contest Contest,
+	permission string,
+	memberStore CommunityMemberStore,
+) bool {
+	err := authorizeContest(ctx, userId, contest, permission, "", memberStore)
+	if err != nil && errorStatus(err) != http.StatusForbidden {
+		slog.ErrorContext(ctx, "Couldn't check contest permission", "error", err)
+	}
+	return err == nil
+}
+
+func isSiteRole(role string) bool {
+	for _, siteRole := range siteRoles {
+		if role == siteRole {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func (a *testApp) setRole(t *testing.T, username string, role string) {
+	user, err := a.users.GetByUsername(context.TODO(), username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.users.UpdateRole(context.TODO(), user.Id, role); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func roleContext(role string) context.Context {
+	return context.WithValue(context.Background(), userContextKey, User{Username: "staff", Role: role})
+}
+
+func TestRolePermissions(t *testing.T){
+	if !roleHasPermission(ROLE_ADMIN, PERM_SET_ROLES) || !roleHasPermission(ROLE_ADMIN, PERM_FORCE_STATE) {
+		t.Error("Admins should be able to do anything")
+	}
+	if !roleHasPermission(ROLE_MODERATOR, PERM_REMOVE_ANY_ENTRY) || roleHasPermission(ROLE_MODERATOR, PERM_DELETE_ANY_CONTEST) {
+		t.Error("Moderators should remove entries but not delete contests")
+	}
+	if roleHasPermission(ROLE_USER, PERM_VIEW_ANY_CONTEST) || roleHasPermission("owner", PERM_VIEW_ANY_CONTEST) {
+		t.Error("Plain users and unknown roles should have no permissions")
+	}
+	if (User{}).GetRole() != ROLE_USER || hasPermission(context.Background(), PERM_BAN_USERS) {
+		t.Error("Users without a role should be plain users")
+	}
+}
+
+func TestAuthorizeContest(t *testing.T){
+	ownerId := primitive.NewObjectID()
+	contest := createContest(primitive.NewObjectID(), ownerId, OPEN)
+	members := NewMemoryCommunityMemberStore()
+	if err := authorizeContest(context.Background(), ownerId, contest, PERM_MANAGE_ANY_CONTEST, "start voting", members); err != nil {
+		t.Errorf("Owner should be allowed, got %v", err)
+	}
+	err := authorizeContest(context.Background(), primitive.NewObjectID(), contest, PERM_MANAGE_ANY_CONTEST, "start voting", members)
+	if errorStatus(err) != http.StatusForbidden || err.Error() != "Only the contest owner can start voting" {
+		t.Errorf("Other users should be forbidden, got %v", err)
+	}
+	if err := authorizeContest(roleContext(ROLE_MODERATOR), primitive.NewObjectID(), contest, PERM_MANAGE_ANY_CONTEST, "start voting", members); err == nil {
+		t.Error("Moderators should not manage other users' contests")
+	}
+	if err := authorizeContest(roleContext(ROLE_ADMIN), primitive.NewObjectID(), contest, PERM_MANAGE_ANY_CONTEST, "start voting", members); err != nil {
+		t.Errorf("Admins should manage any contest, got %v", err)
+	}
+}
+
+func TestAdminModeratesContests(t *testing.T){
+	app := newTestApp(t)
+	bill := app.apiLogin(t, "bill")
+	ted := app.apiLogin(t, "ted")
+	rufus := app.apiLogin(t, "rufus")
+	root := app.apiLogin(t, "root")
+	mod := app.apiLogin(t, "mod")
+	app.setRole(t, "root", ROLE_ADMIN)
+	app.setRole(t, "mod", ROLE_MODERATOR)
+	contest := app.createVisibleContest(t, "Sunsets", "", bill)
+	path := "/contests/" + contest.Id
+	var entry APIEntry
+	decodeResponse(t, app.apiSubmitEntry(contest.Id, ted), &entry)
+	app.apiSubmitEntry(contest.Id, rufus)
+
+	// Other users can't touch the contest
+	newName := "Sunrises"
+	expectAPIError(t, app.apiCall(t, "POST", path + "/state", APIStateChange{State: "voting"}, ted, nil), http.StatusForbidden)
+	expectAPIError(t, app.apiCall(t, "PATCH", path, APIContestEdit{Name: &newName}, ted, nil), http.StatusForbidden)
+	expectAPIError(t, app.apiCall(t, "DELETE", path, nil, ted, nil), http.StatusForbidden)
+	expectAPIError(t, app.apiCall(t, "DELETE", path + "/entries/" + entry.Id, nil, rufus, nil), http.StatusForbidden)
+
+	// Admins can edit and force any state, skipping voting or going back
+	var edited APIContest
+	if rec := app.apiCall(t, "PATCH", path, APIContestEdit{Name: &newName}, root, &edited); rec.Code != http.StatusOK || edited.Name != "Sunrises" || edited.Description != contest.Description {
+		t.Errorf("Admin should edit the contest, got %v", rec.Body.String())
+	}
+	expectAPIError(t, app.apiCall(t, "POST", path + "/state", APIStateChange{State: "concluded", Force: true}, mod, nil), http.StatusForbidden)
+	var forced APIContest
+	app.apiCall(t, "POST", path + "/state", APIStateChange{State: "concluded", Force: true}, root, &forced)
+	if forced.State != "concluded" {
+		t.Errorf("Admin should force the contest to conclude, got %+v", forced)
+	}
+	expectAPIError(t, app.apiCall(t, "POST", path + "/state", APIStateChange{State: "open"}, root, nil), http.StatusConflict)
+	app.apiCall(t, "POST", path + "/state", APIStateChange{State: "open", Force: true}, root, &forced)
+	if forced.State != "open" {
+		t.Errorf("Admin should reopen the contest, got %+v", forced)
+	}
+
+	// Moderators remove entries but can't delete contests
+	if rec := app.apiCall(t, "DELETE", path + "/entries/" + entry.Id, nil, mod, nil); rec.Code != http.StatusNoContent {
+		t.Fatalf("Moderator should remove the entry, got %v", rec.Body.String())
+	}
+	expectAPIError(t, app.apiCall(t, "DELETE", path + "/entries/" + entry.Id, nil, mod, nil), http.StatusNotFound)
+	var detail APIContestDetail
+	app.apiCall(t, "GET", path, nil, bill, &detail)
+	if detail.Contest.EntryCount != 1 {
+		t.Errorf("Removing an entry should update the count, got %v", detail.Contest.EntryCount)
+	}
+	if rec := app.apiSubmitEntry(contest.Id, ted); rec.Code != http.StatusCreated {
+		t.Errorf("Removed entrant should be able to enter again, got %v", rec.Body.String())
+	}
+	expectAPIError(t, app.apiCall(t, "DELETE", path, nil, mod, nil), http.StatusForbidden)
+
+	if rec := app.apiCall(t, "DELETE", path, nil, root, nil); rec.Code != http.StatusNoContent {
+		t.Fatalf("Admin should delete the contest, got %v", rec.Body.String())
+	}
+	expectAPIError(t, app.apiCall(t, "GET", path, nil, bill, nil), http.StatusNotFound)
+	if count, _ := app.entries.CountByContest(context.TODO(), objectId(t, contest.Id)); count != 0 {
+		t.Errorf("Deleting a contest should delete its entries, %v left", count)
+	}
+}
+
+func objectId(t *testing.T, hex string) primitive.ObjectID {
+	id, err := primitive.ObjectIDFromHex(hex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func TestStaffSeeHiddenContests(t *testing.T){
+	app := newTestApp(t)
+	bill := app.apiLogin(t, "bill")
+	ted := app.apiLogin(t, "ted")
+	mod := app.apiLogin(t, "mod")
+	app.setRole(t, "mod", ROLE_MODERATOR)
+	private := app.createVisibleContest(t, "Private", INVITE_ONLY, bill)
+	expectAPIError(t, app.apiCall(t, "GET", "/contests/" + private.Id, nil, ted, nil), http.StatusNotFound)
+	if rec := app.apiCall(t, "GET", "/contests/" + private.Id, nil, mod, nil); rec.Code != http.StatusOK {
+		t.Errorf("Moderators should see invite-only contests, got %v", rec.Code)
+	}
+	expectAPIError(t, app.apiCall(t, "GET", "/contests/" + private.Id + "/participants", nil, mod, nil), http.StatusForbidden)
+}
+
+func TestBanUsers(t *testing.T){
+	app := newTestApp(t)
+	root := app.apiLogin(t, "root")
+	mod := app.apiLogin(t, "mod")
+	ted := app.apiLogin(t, "ted")
+	app.setRole(t, "root", ROLE_ADMIN)
+	app.setRole(t, "mod", ROLE_MODERATOR)
+
+	var banned APIAdminUser
+	if rec := app.apiCall(t, "PUT", "/admin/users/ted/ban", APIBanChange{true}, mod, &banned); rec.Code != http.StatusOK || !banned.Banned {
+		t.Fatalf("Moderator should ban users, got %v", rec.Body.String())
+	}
+	expectAPIError(t, app.apiCall(t, "GET", "/auth/me", nil, ted, nil), http.StatusUnauthorized)
+	expectAPIError(t, app.apiCall(t, "POST", "/auth/login", APICredentials{"ted", "password"}, nil, nil), http.StatusForbidden)
+	var users []APIAdminUser
+	app.apiCall(t, "GET", "/admin/users", nil, mod, &users)
+	if len(users) != 3 || users[2].Username != "ted" || users[1].Role != ROLE_ADMIN {
+		t.Errorf("Staff and banned users should be listed, got %+v", users)
+	}
+
+	// Only admins ban staff and hand out roles
+	expectAPIError(t, app.apiCall(t, "PUT", "/admin/users/root/ban", APIBanChange{true}, mod, nil), http.StatusForbidden)
+	expectAPIError(t, app.apiCall(t, "PUT", "/admin/users/ted/role", APIRoleChange{ROLE_MODERATOR}, mod, nil), http.StatusForbidden)
+	expectAPIError(t, app.apiCall(t, "PUT", "/admin/users/mod/role", APIRoleChange{"owner"}, root, nil), http.StatusBadRequest)
+	expectAPIError(t, app.apiCall(t, "PUT", "/admin/users/root/role", APIRoleChange{ROLE_USER}, root, nil), http.StatusBadRequest)
+	expectAPIError(t, app.apiCall(t, "PUT", "/admin/users/nobody/ban", APIBanChange{true}, root, nil), http.StatusNotFound)
+
+	// Admin routes need a browser session, even with every scope
+	token := app.createToken(t, root, SCOPE_READ, SCOPE_SUBMIT, SCOPE_VOTE, SCOPE_MANAGE)
+	expectAPIError(t, app.tokenCall(t, "GET", "/admin/users", nil, token.Token, nil), http.StatusForbidden)
+	expectAPIError(t, app.tokenCall(t, "GET", "/admin/lockouts", nil, token.Token, nil), http.StatusForbidden)
+	expectAPIError(t, app.tokenCall(t, "PUT", "/admin/users/ted/ban", APIBanChange{true}, token.Token, nil), http.StatusForbidden)
+	expectAPIError(t, app.tokenCall(t, "PUT", "/admin/users/ted/role", APIRoleChange{ROLE_MODERATOR}, token.Token, nil), http.StatusForbidden)
+
+	app.apiCall(t, "PUT", "/admin/users/ted/ban", APIBanChange{false}, root, nil)
+	if rec := app.apiCall(t, "POST", "/auth/login", APICredentials{"ted", "password"}, nil, nil); rec.Code != http.StatusOK {
+		t.Errorf("Unbanned user should log in, got %v", rec.Code)
+	}
+	app.apiCall(t, "PUT", "/admin/users/mod/role", APIRoleChange{ROLE_USER}, root, nil)
+	expectAPIError(t, app.apiCall(t, "GET", "/admin/users", nil, mod, nil), http.StatusForbidden)
+}
+
+func TestBannedUserTokens(t *testing.T){
+	app := newTestApp(t)
+	ted := app.apiLogin(t, "ted")
+	token := app.createToken(t, ted, SCOPE_READ)
+	user, _ := app.users.GetByUsername(context.TODO(), "ted")
+	app.users.UpdateBanned(context.TODO(), user.Id, true)
+	expectAPIError(t, app.tokenCall(t, "GET", "/auth/me", nil, token.Token, nil), http.StatusForbidden)
+}
+
+// User store that can't be reached
+type failingUserStore struct {
+	*MemoryUserStore
+}
+
+func (f failingUserStore) Get(ctx context.Context, userId primitive.ObjectID) (User, error) {
+	return User{}, errors.New("connection refused")
+}
+
+func TestUserLookupFailure(t *testing.T){
+	store := newSessionStore("test secret")
+	handler := userMiddleware(store, loadTemplates(), failingUserStore{NewMemoryUserStore()})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("Request should not get through without checking the user")
+	}))
+	userSession := UserSession{Id: primitive.NewObjectID(), UserId: primitive.NewObjectID(), Username: "ted"}
+	for _, path := range []string{"/api/v1/contests", "/contests"} {
+		req := httptest.NewRequest("GET", path, nil)
+		req = req.WithContext(context.WithValue(req.Context(), sessionContextKey, userSession))
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != http.StatusServiceUnavailable || strings.Contains(rec.Body.String(), "connection refused") {
+			t.Errorf("%v should fail without leaking the error, got %v %v", path, rec.Code, rec.Body.String())
+		}
+	}
+}
+
+func TestLockoutsAdminOnly(t *testing.T){
+	app := newTestApp(t)
+	root := app.apiLogin(t, "root")
+	mod := app.apiLogin(t, "mod")
+	app.setRole(t, "root", ROLE_ADMIN)
+	app.setRole(t, "mod", ROLE_MODERATOR)
+	now := time.Now()
+	app.loginAttempts.CreateLockout(context.TODO(), LoginLockout{primitive.NewObjectID(), LOCKOUT_ACCOUNT, "mod", "192.0.2.1", 10, now, now.Add(loginLockoutDuration)})
+	app.loginAttempts.CreateLockout(context.TODO(), LoginLockout{primitive.NewObjectID(), LOCKOUT_IP, "192.0.2.2", "192.0.2.2", 50, now.Add(-2 * time.Hour), now})
+	expectAPIError(t, app.apiCall(t, "GET", "/admin/lockouts", nil, mod, nil), http.StatusForbidden)
+	expectAPIError(t, app.apiCall(t, "GET", "/admin/lockouts?since=soon", nil, root, nil), http.StatusBadRequest)
+	var lockouts []APILockout
+	if rec := app.apiCall(t, "GET", "/admin/lockouts?since=1h", nil, root, &lockouts); rec.Code != http.StatusOK {
+		t.Fatalf("Admin should see lockouts, got %v", rec.Body.String())
+	}
+	if len(lockouts) != 1 || lockouts[0].Kind != LOCKOUT_ACCOUNT || lockouts[0].Value != "mod" {
+		t.Errorf("Unexpected lockouts %+v", lockouts)
+	}
+}
+
+func TestAdminPages(t *testing.T){
+	app := newTestApp(t)
+	bill := app.login(t, "bill")
+	ted := app.login(t, "ted")
+	root := app.login(t, "root")
+	app.setRole(t, "root", ROLE_ADMIN)
+	contest := app.createContest(t, bill)
+	contestPath := "/contests/" + contest.GetStringId()
+	var entry APIEntry
+	decodeResponse(t, app.apiSubmitEntry(contest.GetStringId(), ted), &entry)
+
+	if body := app.get(contestPath, bill).Body.String(); !strings.Contains(body, "/edit") || strings.Contains(body, "Force State") {
+		t.Error("Owner should be able to edit the contest but not force its state")
+	}
+	body := app.get(contestPath, root).Body.String()
+	if !strings.Contains(body, "Force State") || !strings.Contains(body, "/entries/" + entry.Id + "/remove") {
+		t.Error("Admin should see moderation tools on the contest page")
+	}
+	app.postForm(contestPath + "/edit", url.Values{"contestname": {"Sunrises"}}, root)
+	app.postForm(contestPath + "/force-state", url.Values{"state": {"voting"}}, root)
+	if current, _ := app.contests.Get(context.TODO(), contest.Id); current.Name != "Sunrises" || current.State != VOTING {
+		t.Errorf("Admin should edit and force the contest, got %+v", current)
+	}
+	app.postForm(contestPath + "/entries/" + entry.Id + "/remove", url.Values{}, root)
+	if count, _ := app.entries.CountByContest(context.TODO(), contest.Id); count != 0 {
+		t.Error("Admin should remove the entry")
+	}
+	if rec := app.postForm(contestPath + "/delete", url.Values{}, ted); rec.Code != http.StatusForbidden {
+		t.Errorf("Other users should not delete the contest, got %v", rec.Code)
+	}
+	if rec := app.postForm(contestPath + "/delete", url.Values{}, root); rec.Header().Get("Location") != "/contests" {
+		t.Errorf("Deleting should redirect to the contest list, got %v", rec.Code)
+	}
+
+	if body := app.get("/contests", root).Body.String(); !strings.Contains(body, `href="/admin"`) {
+		t.Error("Admins should get a link to the admin page")
+	}
+	if rec := app.get("/admin", ted); rec.Code != http.StatusForbidden {
+		t.Errorf("Plain users should not see the admin page, got %v", rec.Code)
+	}
+	app.postForm("/admin/users/ban", url.Values{"username": {"ted"}, "banned": {"true"}}, root)
+	if body := app.get("/admin", root).Body.String(); !strings.Contains(body, "Banned") || !strings.Contains(body, "Login Lockouts") {
+		t.Error("Admin page should list banned users and lockouts")
+	}
+	if rec := app.get("/contests", ted); rec.Code == http.StatusOK {
+		t.Error("Banned user should be logged out")
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Returned for a file name that could escape the storage location
+var errInvalidBlobName = errors.New("Invalid file name")
+
+func checkBlobName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\\") {
+		return errInvalidBlobName
+	}
+	return nil
+}
+
+// ****************
+// Local filesystem
+// ****************
+
+// Stores files in a directory on this server
+// Only suitable for a single server instance, unless the directory is shared
+type LocalBlobStore struct {
+	dir string
+}
+
+func NewLocalBlobStore(dir string) (*LocalBlobStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &LocalBlobStore{dir}, nil
+}
+
+func (l *LocalBlobStore) Put(ctx context.Context, name string, data []byte, contentType string) error {
+	if err := checkBlobName(name); err != nil {
+		return err
+	}
+	path := filepath.Join(l.dir, name)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		os.Remove(path)
+		return err
+	}
+	return nil
+}
+
+func (l *LocalBlobStore) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	if err := checkBlobName(name); err != nil {
+		return nil, ErrNotFound
+	}
+	file, err := os.Open(filepath.Join(l.dir, name))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	return file, err
+}
+
+func (l *LocalBlobStore) Delete(ctx context.Context, name string) error {
+	if err := checkBlobName(name); err != nil {
+		return err
+	}
+	err := os.Remove(filepath.Join(l.dir, name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// *************
+// S3 compatible
+// *************
+
+// Stores files in a bucket on Amazon S3 or a compatible service like MinIO
+// Objects are addressed path style, e.g. http://localhost:9000/bucket/name,
+// which every S3 compatible service supports
+type S3BlobStore struct {
+	endpoint string
+	bucket string
+	region string
+	accessKey string
+	secretKey string
+	client *http.Client
+}
+
+// Uses Amazon S3 in the given region when endpoint is empty
+func NewS3BlobStore(endpoint string, bucket string, region string, accessKey string, secretKey string) (*S3BlobStore, error) {
+	if region == "" {
+		region = "us-east-1"
+	}
+	if endpoint == "" {
+		endpoint = "https://s3." + region + ".amazonaws.com"
+	}
+	endpointUrl, err := url.Parse(endpoint)
+	if err != nil || endpointUrl.Host == "" {
+		return nil, fmt.Errorf("Invalid S3 endpoint %q", endpoint)
+	}
+	if bucket == "" {
+		return nil, errors.New("S3 bucket name is required")
+	}
+	return &S3BlobStore{
+		endpoint: strings.TrimSuffix(endpoint, "/"),
+		bucket: bucket,
+		region: region,
+		accessKey: accessKey,
+		secretKey: secretKey,
+		client: &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+func (s *S3BlobStore) Put(ctx context.Context, name string, data []byte, contentType string) error {
+	if err := checkBlobName(name); err != nil {
+		return err
+	}
+	resp, err := s.do(ctx, "PUT", name, data, contentType)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *S3BlobStore) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	if err := checkBlobName(name); err != nil {
+		return nil, ErrNotFound
+	}
+	resp, err := s.do(ctx, "GET", name, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (s *S3BlobStore) Delete(ctx context.Context, name string) error {
+	if err := checkBlobName(name); err != nil {
+		return err
+	}
+	resp, err := s.do(ctx, "DELETE", name, nil, "")
+	if err == ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Send a signed request for an object in the bucket
+// Returns ErrNotFound for a missing object and an error for any other unsuccessful status
+func (s *S3BlobStore) do(ctx context.Context, method string, name string, body []byte, contentType string) (*http.Response, error) {
+	objectUrl := s.endpoint + "/" + url.PathEscape(s.bucket) + "/" + url.PathEscape(name)
+	req, err := http.NewRequestWithContext(ctx, method, objectUrl, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	payloadHash := sha256.Sum256(body)
+	signS3Request(req, s.accessKey, s.secretKey, s.region, hex.EncodeToString(payloadHash[:]), time.Now())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, ErrNotFound
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, fmt.Errorf("S3 %v %v failed with %v: %s", method, name, resp.Status, message)
+	}
+	return resp, nil
+}
+
+// Add an AWS Signature Version 4 Authorization header to a request
+// Every header already on the request is signed, along with the host
+// https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html
+func signS3Request(req *http.Request, accessKey string, secretKey string, region string, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	// Headers are signed in sorted order by lowercase name
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	var names []string
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	signingKey := hmacSHA256([]byte("AWS4" + secretKey), date)
+	signingKey = hmacSHA256(signingKey, region)
+	signingKey = hmacSHA256(signingKey, "s3")
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential=" + accessKey + "/" + scope +
+		", SignedHeaders=" + signedHeaders + ", Signature=" + signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
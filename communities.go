@@ -0,0 +1,563 @@
+package main
+
+import (
+	"context"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gorilla/sessions"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Communities host contests on behalf of a group of users
+// Anyone can join a community. Admins manage members and roles and host contests, which any admin can run
+// the same as the contest's owner, and moderators can remove members. Contests hosted by a community can be
+// restricted to its members
+
+var communityRoles = []string{COMMUNITY_ADMIN, COMMUNITY_MODERATOR, COMMUNITY_MEMBER}
+
+const maxCommunitySlugLength = 50
+
+// ********
+// Handlers
+// ********
+
+// Handler for /communities endpoint, lists communities and creates one on POST
+func communityIndexHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+	s *sessions.CookieStore,
+	tmplMap map[string]*template.Template,
+	communityStore CommunityStore,
+	memberStore CommunityMemberStore,
+) {
+	userId, username, err := getSessionUser(r)
+	if err != nil {
+		logRequestError(r.Context(), "Couldn't get session user", err)
+		http.Redirect(w, r, "/contests", 302)
+		return
+	}
+	listData := CommunityListData{}
+	status := http.StatusOK
+	if r.Method == "POST" {
+		listData.Name = r.PostFormValue("name")
+		listData.Description = r.PostFormValue("description")
+		community, err := createCommunity(r.Context(), userId, username, listData.Name, listData.Description, communityStore, memberStore)
+		if err == nil {
+			http.Redirect(w, r, communityUrl(community), 302)
+			return
+		}
+		if status = errorStatus(err); status == http.StatusInternalServerError {
+			logRequestError(r.Context(), "Couldn't create community", err)
+			renderError(w, r, s, tmplMap, err, "/communities")
+			return
+		}
+		// Show the form again with what was wrong
+		listData.Error = err.Error()
+	}
+	listData.Communities, err = communityStore.List(r.Context())
+	if err == nil {
+		listData.Memberships, err = getMemberships(r.Context(), userId, memberStore)
+	}
+	if err != nil {
+		logRequestError(r.Context(), "Couldn't list communities", err)
+		renderError(w, r, s, tmplMap, err, "/contests")
+		return
+	}
+	renderTemplate(w, r, s, tmplMap["communities.html"], status, listData)
+}
+
+// Handler for /communities/{slug} endpoint, the community's members and contest feed
+func communityHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+	s *sessions.CookieStore,
+	tmplMap map[string]*template.Template,
+	userStore UserStore,
+	contestStore ContestStore,
+	communityStore CommunityStore,
+	participantStore ParticipantStore,
+	memberStore CommunityMemberStore,
+	slug string,
+) {
+	userId, _, err := getSessionUser(r)
+	if err != nil {
+		logRequestError(r.Context(), "Couldn't get session user", err)
+		http.Redirect(w, r, "/contests", 302)
+		return
+	}
+	community, err := findCommunity(r.Context(), slug, communityStore)
+	if err != nil {
+		logRequestError(r.Context(), "Couldn't find community", err)
+		renderError(w, r, s, tmplMap, err, "/communities")
+		return
+	}
+	// The feed pages through the community's contests the same as the contest list
+	params := r.URL.Query()
+	query, err := parseContestQuery(url.Values{"community": {community.Slug}, "cursor": params["cursor"]})
+	if err != nil {
+		renderError(w, r, s, tmplMap, err, communityUrl(community))
+		return
+	}
+	pageData, err := getCommunityPage(r.Context(), userId, community, memberStore)
+	if err != nil {
+		logRequestError(r.Context(), "Couldn't get community", err)
+		renderError(w, r, s, tmplMap, err, "/communities")
+		return
+	}
+	page, err := searchContests(r.Context(), userId, query, userStore, contestStore, communityStore, participantStore, memberStore)
+	if err != nil {
+		logRequestError(r.Context(), "Couldn't find community contests", err)
+	}
+	pageData.Contests = page.Contests
+	pageData.IsLaterPage = query.After != nil
+	if page.NextCursor != "" {
+		pageData.NextUrl = nextPageUrl(r.URL.Path, url.Values{}, page.NextCursor)
+	}
+	renderTemplate(w, r, s, tmplMap["community.html"], http.StatusOK, pageData)
+}
+
+// Handler for joining and leaving a community
+func communityMembershipHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+	s *sessions.CookieStore,
+	tmplMap map[string]*template.Template,
+	communityStore CommunityStore,
+	memberStore CommunityMemberStore,
+	slug string,
+	join bool,
+) {
+	userId, username, err := getSessionUser(r)
+	if err != nil {
+		logRequestError(r.Context(), "Couldn't get session user", err)
+		http.Redirect(w, r, "/contests", 302)
+		return
+	}
+	community, err := findCommunity(r.Context(), slug, communityStore)
+	if err == nil {
+		if join {
+			_, err = joinCommunity(r.Context(), userId, username, community, memberStore)
+		} else {
+			err = leaveCommunity(r.Context(), userId, community, memberStore)
+		}
+	}
+	if err != nil {
+		logRequestError(r.Context(), "Couldn't change community membership", err)
+		renderError(w, r, s, tmplMap, err, "/communities/" + slug)
+		return
+	}
+	http.Redirect(w, r, communityUrl(community), 302)
+}
+
+// Handler for an admin changing a member's role
+func communityRoleHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+	s *sessions.CookieStore,
+	tmplMap map[string]*template.Template,
+	communityStore CommunityStore,
+	memberStore CommunityMemberStore,
+	slug string,
+	memberId string,
+) {
+	userId, _, err := getSessionUser(r)
+	if err != nil {
+		logRequestError(r.Context(), "Couldn't get session user", err)
+		http.Redirect(w, r, "/contests", 302)
+		return
+	}
+	community, err := findCommunity(r.Context(), slug, communityStore)
+	if err == nil {
+		_, err = changeMemberRole(r.Context(), userId, community, memberId, r.PostFormValue("role"), memberStore)
+	}
+	if err != nil {
+		logRequestError(r.Context(), "Couldn't change member role", err)
+		renderError(w, r, s, tmplMap, err, "/communities/" + slug)
+		return
+	}
+	http.Redirect(w, r, communityUrl(community), 302)
+}
+
+// Handler for an admin or moderator removing a member
+func removeCommunityMemberHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+	s *sessions.CookieStore,
+	tmplMap map[string]*template.Template,
+	communityStore CommunityStore,
+	memberStore CommunityMemberStore,
+	slug string,
+	memberId string,
+) {
+	userId, _, err := getSessionUser(r)
+	if err != nil {
+		logRequestError(r.Context(), "Couldn't get session user", err)
+		http.Redirect(w, r, "/contests", 302)
+		return
+	}
+	community, err := findCommunity(r.Context(), slug, communityStore)
+	if err == nil {
+		err = removeCommunityMember(r.Context(), userId, community, memberId, memberStore)
+	}
+	if err != nil {
+		logRequestError(r.Context(), "Couldn't remove member", err)
+		renderError(w, r, s, tmplMap, err, "/communities/" + slug)
+		return
+	}
+	http.Redirect(w, r, communityUrl(community), 302)
+}
+
+// *******
+// Actions
+// *******
+
+// Create a community, with its creator as the first admin
+func createCommunity(
+	ctx context.Context,
+	userId primitive.ObjectID,
+	username string,
+	name string,
+	description string,
+	communityStore CommunityStore,
+	memberStore CommunityMemberStore,
+) (Community, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return Community{}, badRequestError("Community name is required")
+	}
+	slug := communitySlug(name)
+	if slug == "" {
+		return Community{}, badRequestError("Community name must include a letter or number")
+	}
+	community := Community{
+		Id: primitive.NewObjectID(),
+		Name: name,
+		Slug: slug,
+		Description: strings.TrimSpace(description),
+		CreatedBy: userId,
+		TimeCreated: time.Now(),
+	}
+	err := communityStore.Create(ctx, community)
+	if err == ErrDuplicate {
+		return Community{}, conflictError("A community named \"" + slug + "\" already exists")
+	}
+	if err != nil {
+		return Community{}, err
+	}
+	err = memberStore.Add(ctx, CommunityMember{
+		Id: primitive.NewObjectID(),
+		CommunityId: community.Id,
+		UserId: userId,
+		Username: username,
+		Role: COMMUNITY_ADMIN,
+		TimeJoined: community.TimeCreated,
+	})
+	if err != nil {
+		// Nobody could manage a community without an admin, so give up the slug again
+		if _, deleteErr := communityStore.Delete(ctx, community.Id); deleteErr != nil {
+			slog.ErrorContext(ctx, "Couldn't delete community without an admin", "community_id", community.Id.Hex(), "error", deleteErr)
+		}
+		return Community{}, err
+	}
+	return community, nil
+}
+
+// Get a community's members and the viewer's own membership
+func getCommunityPage(
+	ctx context.Context,
+	viewerId primitive.ObjectID,
+	community Community,
+	memberStore CommunityMemberStore,
+) (CommunityPageData, error) {
+	members, err := memberStore.ListByCommunity(ctx, community.Id)
+	if err != nil {
+		return CommunityPageData{}, err
+	}
+	pageData := CommunityPageData{Community: community, Members: members}
+	for _, member := range members {
+		if member.UserId == viewerId {
+			pageData.Membership = member
+			pageData.IsMember = true
+		}
+	}
+	return pageData, nil
+}
+
+func joinCommunity(
+	ctx context.Context,
+	userId primitive.ObjectID,
+	username string,
+	community Community,
+	memberStore CommunityMemberStore,
+) (CommunityMember, error) {
+	member := CommunityMember{
+		Id: primitive.NewObjectID(),
+		CommunityId: community.Id,
+		UserId: userId,
+		Username: username,
+		Role: COMMUNITY_MEMBER,
+		TimeJoined: time.Now(),
+	}
+	err := memberStore.Add(ctx, member)
+	if err == ErrDuplicate {
+		return CommunityMember{}, conflictError("You're already a member of this community")
+	}
+	if err != nil {
+		return CommunityMember{}, err
+	}
+	return member, nil
+}
+
+func leaveCommunity(
+	ctx context.Context,
+	userId primitive.ObjectID,
+	community Community,
+	memberStore CommunityMemberStore,
+) error {
+	member, err := findMember(ctx, community, userId, memberStore)
+	if err != nil {
+		return err
+	}
+	_, err = memberStore.Remove(ctx, community.Id, member.UserId)
+	return lastAdminError(err)
+}
+
+// Give a member a new role, only admins can change roles
+func changeMemberRole(
+	ctx context.Context,
+	userId primitive.ObjectID,
+	community Community,
+	memberId string,
+	role string,
+	memberStore CommunityMemberStore,
+) (CommunityMember, error) {
+	if !isCommunityRole(role) {
+		return CommunityMember{}, badRequestError("Role must be one of " + strings.Join(communityRoles, ", "))
+	}
+	if _, err := checkCommunityRole(ctx, userId, community, COMMUNITY_ADMIN, memberStore); err != nil {
+		return CommunityMember{}, err
+	}
+	member, err := findMemberByHex(ctx, community, memberId, memberStore)
+	if err != nil {
+		return CommunityMember{}, err
+	}
+	if err := memberStore.UpdateRole(ctx, community.Id, member.UserId, role); err != nil {
+		return CommunityMember{}, lastAdminError(err)
+	}
+	member.Role = role
+	return member, nil
+}
+
+// Remove a member, admins can remove anyone and moderators can remove members without a role
+func removeCommunityMember(
+	ctx context.Context,
+	userId primitive.ObjectID,
+	community Community,
+	memberId string,
+	memberStore CommunityMemberStore,
+) error {
+	remover, err := checkCommunityRole(ctx, userId, community, COMMUNITY_MODERATOR, memberStore)
+	if err != nil {
+		return err
+	}
+	member, err := findMemberByHex(ctx, community, memberId, memberStore)
+	if err != nil {
+		return err
+	}
+	if !remover.IsAdmin() && member.Role != COMMUNITY_MEMBER {
+		return forbiddenError("Only admins can remove admins and moderators")
+	}
+	_, err = memberStore.Remove(ctx, community.Id, member.UserId)
+	return lastAdminError(err)
+}
+
+// Look up the community a new contest is hosted by, nil if slug is empty
+// Only the community's admins can host contests for it
+func findHostCommunity(
+	ctx context.Context,
+	userId primitive.ObjectID,
+	slug string,
+	communityStore CommunityStore,
+	memberStore CommunityMemberStore,
+) (*Community, error) {
+	if slug == "" {
+		return nil, nil
+	}
+	community, err := findCommunity(ctx, slug, communityStore)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := checkCommunityRole(ctx, userId, community, COMMUNITY_ADMIN, memberStore); err != nil {
+		return nil, forbiddenError("Only community admins can host contests for " + community.Name)
+	}
+	return &community, nil
+}
+
+// List the communities a user can host contests for
+func listHostCommunities(
+	ctx context.Context,
+	userId primitive.ObjectID,
+	communityStore CommunityStore,
+	memberStore CommunityMemberStore,
+) ([]Community, error) {
+	memberships, err := memberStore.ListByUser(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+	communities := []Community{}
+	for _, member := range memberships {
+		if !member.IsAdmin() {
+			continue
+		}
+		community, err := communityStore.Get(ctx, member.CommunityId)
+		if err != nil {
+			return nil, err
+		}
+		communities = append(communities, community)
+	}
+	return communities, nil
+}
+
+// *******
+// Helpers
+// *******
+
+// Look up a community from the slug in a request path
+func findCommunity(ctx context.Context, slug string, communityStore CommunityStore) (Community, error) {
+	community, err := communityStore.GetBySlug(ctx, slug)
+	if err == ErrNotFound {
+		return Community{}, notFoundError("Community not found")
+	}
+	return community, err
+}
+
+func findMember(
+	ctx context.Context,
+	community Community,
+	userId primitive.ObjectID,
+	memberStore CommunityMemberStore,
+) (CommunityMember, error) {
+	member, err := memberStore.Get(ctx, community.Id, userId)
+	if err == ErrNotFound {
+		return CommunityMember{}, notFoundError("Member not found")
+	}
+	return member, err
+}
+
+// Look up a member from the user ID in a request path
+func findMemberByHex(
+	ctx context.Context,
+	community Community,
+	userId string,
+	memberStore CommunityMemberStore,
+) (CommunityMember, error) {
+	userObjId, err := primitive.ObjectIDFromHex(userId)
+	if err != nil {
+		return CommunityMember{}, notFoundError("Member not found")
+	}
+	return findMember(ctx, community, userObjId, memberStore)
+}
+
+// Check a user has at least a role in a community, returning their membership
+// Moderator is satisfied by admins too
+func checkCommunityRole(
+	ctx context.Context,
+	userId primitive.ObjectID,
+	community Community,
+	role string,
+	memberStore CommunityMemberStore,
+) (CommunityMember, error) {
+	member, err := memberStore.Get(ctx, community.Id, userId)
+	if err != nil && err != ErrNotFound {
+		return CommunityMember{}, err
+	}
+	allowed := err == nil
+	switch role {
+	case COMMUNITY_ADMIN:
+		allowed = allowed && member.IsAdmin()
+	case COMMUNITY_MODERATOR:
+		allowed = allowed && member.IsModerator()
+	}
+	if !allowed {
+		return CommunityMember{}, forbiddenError("You need to be a community " + role + " to do that")
+	}
+	return member, nil
+}
+
+// Every community keeps at least one admin, which the member store enforces
+func lastAdminError(err error) error {
+	if err == ErrLastAdmin {
+		return conflictError("A community needs at least one admin, make someone else an admin first")
+	}
+	return err
+}
+
+// IDs of the communities a user is a member of
+func listCommunityIds(ctx context.Context, userId primitive.ObjectID, memberStore CommunityMemberStore) ([]primitive.ObjectID, error) {
+	memberships, err := memberStore.ListByUser(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+	communityIds := []primitive.ObjectID{}
+	for _, member := range memberships {
+		communityIds = append(communityIds, member.CommunityId)
+	}
+	return communityIds, nil
+}
+
+// A user's memberships, keyed by community ID
+func getMemberships(
+	ctx context.Context,
+	userId primitive.ObjectID,
+	memberStore CommunityMemberStore,
+) (map[primitive.ObjectID]CommunityMember, error) {
+	memberships, err := memberStore.ListByUser(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+	byCommunity := map[primitive.ObjectID]CommunityMember{}
+	for _, member := range memberships {
+		byCommunity[member.CommunityId] = member
+	}
+	return byCommunity, nil
+}
+
+func isCommunityRole(role string) bool {
+	for _, communityRole := range communityRoles {
+		if role == communityRole {
+			return true
+		}
+	}
+	return false
+}
+
+// URL name for a community, e.g. "Film Photographers" becomes "film-photographers"
+func communitySlug(name string) string {
+	var slug strings.Builder
+	dash := false
+	for _, c := range strings.ToLower(name) {
+		if unicode.IsLetter(c) || unicode.IsDigit(c) {
+			if dash && slug.Len() > 0 {
+				slug.WriteRune('-')
+			}
+			slug.WriteRune(c)
+			dash = false
+		} else {
+			dash = true
+		}
+		if slug.Len() >= maxCommunitySlugLength {
+			break
+		}
+	}
+	return slug.String()
+}
+
+func communityUrl(community Community) string {
+	return "/communities/" + community.Slug
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Create a community through the API, the creator becomes its admin
+func (a *testApp) createCommunity(t *testing.T, name string, cookies []*http.Cookie) APICommunity {
+	var community APICommunity
+	rec := a.apiCall(t, "POST", "/communities", APINewCommunity{Name: name}, cookies, &community)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("Creating community %v failed with %v", name, rec.Body.String())
+	}
+	return community
+}
+
+func (a *testApp) userId(t *testing.T, username string) string {
+	user, err := a.users.GetByUsername(context.TODO(), username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user.Id.Hex()
+}
+
+func TestCommunityMembership(t *testing.T){
+	app := newTestApp(t)
+	bill := app.apiLogin(t, "bill")
+	ted := app.apiLogin(t, "ted")
+	community := app.createCommunity(t, "Wyld Stallyns!", bill)
+	if community.Slug != "wyld-stallyns" || community.Role != COMMUNITY_ADMIN {
+		t.Errorf("Unexpected community %+v", community)
+	}
+	expectAPIError(t, app.apiCall(t, "POST", "/communities", APINewCommunity{Name: "wyld stallyns"}, ted, nil), http.StatusConflict)
+	expectAPIError(t, app.apiCall(t, "POST", "/communities", APINewCommunity{Name: "!!"}, ted, nil), http.StatusBadRequest)
+
+	path := "/communities/" + community.Slug
+	// Read-only tokens can't join or leave communities
+	readToken := app.createToken(t, ted, SCOPE_READ)
+	for _, action := range []string{"/join", "/leave"} {
+		expectAPIError(t, app.tokenCall(t, "POST", path + action, nil, readToken.Token, nil), http.StatusForbidden)
+		req := httptest.NewRequest("POST", path + action, nil)
+		req.Header.Set("Authorization", "Bearer " + readToken.Token)
+		if rec := app.do(req, nil); rec.Code != http.StatusForbidden {
+			t.Errorf("Community %v should need the manage scope, got %v", action, rec.Code)
+		}
+	}
+	if rec := app.apiCall(t, "POST", path + "/join", nil, ted, nil); rec.Code != http.StatusCreated {
+		t.Fatalf("Joining failed with %v", rec.Body.String())
+	}
+	expectAPIError(t, app.apiCall(t, "POST", path + "/join", nil, ted, nil), http.StatusConflict)
+	var members []APICommunityMember
+	app.apiCall(t, "GET", path + "/members", nil, ted, &members)
+	if len(members) != 2 || members[1].Username != "ted" || members[1].Role != COMMUNITY_MEMBER {
+		t.Errorf("Unexpected members %+v", members)
+	}
+
+	// The last admin can't leave or step down
+	billPath := path + "/members/" + app.userId(t, "bill")
+	expectAPIError(t, app.apiCall(t, "POST", path + "/leave", nil, bill, nil), http.StatusConflict)
+	expectAPIError(t, app.apiCall(t, "PUT", billPath, APIRoleChange{COMMUNITY_MEMBER}, bill, nil), http.StatusConflict)
+	expectAPIError(t, app.apiCall(t, "PUT", billPath, APIRoleChange{"owner"}, bill, nil), http.StatusBadRequest)
+
+	// Moderators can remove members but not admins
+	tedPath := path + "/members/" + app.userId(t, "ted")
+	expectAPIError(t, app.apiCall(t, "PUT", tedPath, APIRoleChange{COMMUNITY_ADMIN}, ted, nil), http.StatusForbidden)
+	app.apiCall(t, "PUT", tedPath, APIRoleChange{COMMUNITY_MODERATOR}, bill, nil)
+	expectAPIError(t, app.apiCall(t, "DELETE", billPath, nil, ted, nil), http.StatusForbidden)
+	rufus := app.apiLogin(t, "rufus")
+	app.apiCall(t, "POST", path + "/join", nil, rufus, nil)
+	if rec := app.apiCall(t, "DELETE", path + "/members/" + app.userId(t, "rufus"), nil, ted, nil); rec.Code != http.StatusNoContent {
+		t.Errorf("Moderators should remove members, got %v", rec.Body.String())
+	}
+
+	// Once there's another admin the first one can leave
+	app.apiCall(t, "PUT", tedPath, APIRoleChange{COMMUNITY_ADMIN}, bill, nil)
+	if rec := app.apiCall(t, "POST", path + "/leave", nil, bill, nil); rec.Code != http.StatusNoContent {
+		t.Errorf("Admin should leave once there's another admin, got %v", rec.Body.String())
+	}
+	var communities []APICommunity
+	app.apiCall(t, "GET", "/communities", nil, bill, &communities)
+	if len(communities) != 1 || communities[0].Role != "" {
+		t.Errorf("Community should be listed without a role, got %+v", communities)
+	}
+}
+
+func TestCommunityHostedContests(t *testing.T){
+	app := newTestApp(t)
+	bill := app.apiLogin(t, "bill")
+	ted := app.apiLogin(t, "ted")
+	rufus := app.apiLogin(t, "rufus")
+	community := app.createCommunity(t, "Photographers", bill)
+	path := "/communities/" + community.Slug
+	app.apiCall(t, "POST", path + "/join", nil, ted, nil)
+
+	// Only admins host contests
+	expectAPIError(t, app.apiCall(t, "POST", "/contests", APINewContest{Name: "Theirs", Community: community.Slug}, ted, nil), http.StatusForbidden)
+	expectAPIError(t, app.apiCall(t, "POST", "/contests", APINewContest{Name: "Nowhere", Community: "nowhere"}, bill, nil), http.StatusNotFound)
+	expectAPIError(t, app.apiCall(t, "POST", "/contests", APINewContest{Name: "Members", Visibility: MEMBERS_ONLY}, bill, nil), http.StatusBadRequest)
+	var contest APIContest
+	app.apiCall(t, "POST", "/contests", APINewContest{Name: "Members", Visibility: MEMBERS_ONLY, Community: community.Slug}, bill, &contest)
+	if contest.Community != community.Slug {
+		t.Fatalf("Contest should be hosted by the community, got %+v", contest)
+	}
+	app.createVisibleContest(t, "Elsewhere", "", rufus)
+
+	// Members-only contests are hidden from everyone else
+	if names, _ := app.listContests(t, "/contests", ted); strings.Join(names, ",") != "Elsewhere,Members" {
+		t.Errorf("Members should see the contest listed, got %v", names)
+	}
+	if names, _ := app.listContests(t, "/contests", rufus); strings.Join(names, ",") != "Elsewhere" {
+		t.Errorf("Other users should not see the contest listed, got %v", names)
+	}
+	expectAPIError(t, app.apiCall(t, "GET", "/contests/" + contest.Id, nil, rufus, nil), http.StatusNotFound)
+	expectAPIError(t, app.apiSubmitEntry(contest.Id, rufus), http.StatusNotFound)
+	if names, _ := app.listContests(t, "/contests?community=" + community.Slug, ted); strings.Join(names, ",") != "Members" {
+		t.Errorf("Community feed should only list its contests, got %v", names)
+	}
+	if names, _ := app.listContests(t, "/contests?community=nowhere", ted); len(names) != 0 {
+		t.Errorf("Unknown community should have no contests, got %v", names)
+	}
+
+	// Any admin of the community runs the contest
+	if rec := app.apiSubmitEntry(contest.Id, ted); rec.Code != http.StatusCreated {
+		t.Fatalf("Members should submit entries, got %v", rec.Body.String())
+	}
+	stateUrl := "/contests/" + contest.Id + "/state"
+	expectAPIError(t, app.apiCall(t, "POST", stateUrl, APIStateChange{State: "voting"}, ted, nil), http.StatusForbidden)
+	app.apiCall(t, "PUT", path + "/members/" + app.userId(t, "ted"), APIRoleChange{COMMUNITY_ADMIN}, bill, nil)
+	if rec := app.apiCall(t, "POST", stateUrl, APIStateChange{State: "voting"}, ted, &contest); rec.Code != http.StatusOK || contest.State != "voting" {
+		t.Errorf("Community admins should start voting, got %v", rec.Body.String())
+	}
+}
+
+func TestCommunityInviteOnlyContest(t *testing.T){
+	app := newTestApp(t)
+	bill := app.apiLogin(t, "bill")
+	ted := app.apiLogin(t, "ted")
+	rufus := app.apiLogin(t, "rufus")
+	community := app.createCommunity(t, "Photographers", bill)
+	path := "/communities/" + community.Slug
+	app.apiCall(t, "POST", path + "/join", nil, ted, nil)
+	var contest APIContest
+	app.apiCall(t, "POST", "/contests", APINewContest{Name: "Invites", Visibility: INVITE_ONLY, Community: community.Slug}, bill, &contest)
+	contestPath := "/contests/" + contest.Id
+
+	// Plain members still need an invite
+	expectAPIError(t, app.apiCall(t, "GET", contestPath, nil, ted, nil), http.StatusNotFound)
+
+	// Other admins of the community run the contest without being invited
+	app.apiCall(t, "PUT", path + "/members/" + app.userId(t, "ted"), APIRoleChange{COMMUNITY_ADMIN}, bill, nil)
+	if rec := app.apiCall(t, "POST", contestPath + "/participants", APINewParticipant{"rufus"}, ted, nil); rec.Code != http.StatusCreated {
+		t.Fatalf("Community admins should add participants, got %v", rec.Body.String())
+	}
+	var participants []APIParticipant
+	if rec := app.apiCall(t, "GET", contestPath + "/participants", nil, ted, &participants); rec.Code != http.StatusOK || len(participants) != 1 {
+		t.Errorf("Community admins should see participants, got %v", rec.Body.String())
+	}
+	if rec := app.apiCall(t, "POST", contestPath + "/invites", APINewInvite{MaxUses: 1}, ted, nil); rec.Code != http.StatusCreated {
+		t.Errorf("Community admins should create invites, got %v", rec.Body.String())
+	}
+	if rec := app.apiSubmitEntry(contest.Id, rufus); rec.Code != http.StatusCreated {
+		t.Fatalf("Participants should submit entries, got %v", rec.Body.String())
+	}
+	if rec := app.apiCall(t, "POST", contestPath + "/state", APIStateChange{State: "voting"}, ted, &contest); rec.Code != http.StatusOK || contest.State != "voting" {
+		t.Errorf("Community admins should start voting, got %v", rec.Body.String())
+	}
+	if rec := app.apiCall(t, "POST", contestPath + "/state", APIStateChange{State: "concluded"}, ted, &contest); rec.Code != http.StatusOK || contest.State != "concluded" {
+		t.Errorf("Community admins should end voting, got %v", rec.Body.String())
+	}
+}
+
+func TestCommunityPages(t *testing.T){
+	app := newTestApp(t)
+	bill := app.login(t, "bill")
+	ted := app.login(t, "ted")
+	rec := app.postForm("/communities", url.Values{"name": {"Film Club"}, "description": {"Shoot film"}}, bill)
+	if rec.Header().Get("Location") != "/communities/film-club" {
+		t.Fatalf("Creating a community should redirect to it, got %v", rec.Code)
+	}
+	if rec := app.postForm("/communities", url.Values{"name": {"Film club"}}, ted); !strings.Contains(rec.Body.String(), "already exists") {
+		t.Error("Communities page should say the name is taken")
+	}
+
+	if body := app.get("/create-contest", bill).Body.String(); !strings.Contains(body, `value="film-club"`) {
+		t.Error("Admins should be able to host contests for the community")
+	}
+	rec = app.postForm("/create-contest", url.Values{"contestname": {"Rolls"}, "community": {"film-club"}}, bill)
+	contestPath := rec.Header().Get("Location")
+	if body := app.get(contestPath, ted).Body.String(); !strings.Contains(body, `href="/communities/film-club"`) {
+		t.Error("Contest page should link to the hosting community")
+	}
+
+	app.postForm("/communities/film-club/join", url.Values{}, ted)
+	body := app.get("/communities/film-club", ted).Body.String()
+	if !strings.Contains(body, "Rolls") || !strings.Contains(body, "member of this community") {
+		t.Error("Community page should show its contests and the viewer's membership")
+	}
+	if rec := app.get("/communities/nowhere", ted); rec.Code != http.StatusNotFound {
+		t.Errorf("Unknown community should be not found, got %v", rec.Code)
+	}
+}
+
+func TestCommunitySlug(t *testing.T){
+	tests := map[string]string{
+		"Film Photographers": "film-photographers",
+		"  --Night  Owls-- ": "night-owls",
+		"Café 35mm!": "café-35mm",
+		"?!": "",
+	}
+	for name, slug := range tests {
+		if got := communitySlug(name); got != slug {
+			t.Errorf("Slug for %q should be %q, got %q", name, slug, got)
+		}
+	}
+	if len(communitySlug(strings.Repeat("a", 80))) != maxCommunitySlugLength {
+		t.Error("Slugs should be limited in length")
+	}
+}
+
+// Member store that can't save new members
+type failingMemberStore struct {
+	*MemoryCommunityMemberStore
+}
+
+func (f failingMemberStore) Add(ctx context.Context, member CommunityMember) error {
+	return errors.New("connection refused")
+}
+
+func TestCreateCommunityWithoutAdmin(t *testing.T){
+	communityStore := NewMemoryCommunityStore()
+	memberStore := NewMemoryCommunityMemberStore()
+	userId := primitive.NewObjectID()
+	if _, err := createCommunity(context.TODO(), userId, "bill", "Photographers", "", communityStore, failingMemberStore{memberStore}); err == nil {
+		t.Fatal("Creating a community should fail when its admin can't be added")
+	}
+	if _, err := communityStore.GetBySlug(context.TODO(), "photographers"); err != ErrNotFound {
+		t.Errorf("Community without an admin should be deleted, got %v", err)
+	}
+	if _, err := createCommunity(context.TODO(), userId, "bill", "Photographers", "", communityStore, memberStore); err != nil {
+		t.Errorf("Community should be created again, got %v", err)
+	}
+}
+
+func TestConcurrentAdminChanges(t *testing.T){
+	memberStore := NewMemoryCommunityMemberStore()
+	for i := 0; i < 20; i++ {
+		community := Community{Id: primitive.NewObjectID()}
+		bill := CommunityMember{primitive.NewObjectID(), community.Id, primitive.NewObjectID(), "bill", COMMUNITY_ADMIN, time.Now()}
+		ted := CommunityMember{primitive.NewObjectID(), community.Id, primitive.NewObjectID(), "ted", COMMUNITY_ADMIN, time.Now()}
+		memberStore.Add(context.TODO(), bill)
+		memberStore.Add(context.TODO(), ted)
+		// Each admin demotes the other, or both leave, at the same time
+		results := make(chan error)
+		go func() {
+			_, err := changeMemberRole(context.TODO(), bill.UserId, community, ted.UserId.Hex(), COMMUNITY_MEMBER, memberStore)
+			results <- err
+		}()
+		go func() {
+			if i % 2 == 0 {
+				_, err := changeMemberRole(context.TODO(), ted.UserId, community, bill.UserId.Hex(), COMMUNITY_MEMBER, memberStore)
+				results <- err
+			} else {
+				results <- leaveCommunity(context.TODO(), ted.UserId, community, memberStore)
+			}
+		}()
+		<-results
+		<-results
+		admins := 0
+		members, _ := memberStore.ListByCommunity(context.TODO(), community.Id)
+		for _, member := range members {
+			if member.IsAdmin() {
+				admins++
+			}
+		}
+		if admins != 1 {
+			t.Fatalf("Community should keep one admin, got %v", admins)
+		}
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Environments the server can run in
+// Production refuses to start with settings that are only safe for local testing
+const (
+	ENV_DEVELOPMENT = "development"
+	ENV_PRODUCTION = "production"
+)
+
+// Values used when nothing else is configured, suitable for local development only
+const (
+	defaultSecretKey = "superdupersecret42"
+	defaultMaxUploadMB = 10
+)
+
+// Production session keys must be at least this long
+const minSecretKeyLength = 32
+
+// Server configuration
+// Settings are read in order from the defaults, a YAML config file,
+// environment variables and command line flags, each overriding the last
+type Config struct {
+	// ENV_DEVELOPMENT or ENV_PRODUCTION
+	Env string `yaml:"env"`
+	ListenAddr string `yaml:"listen_addr"`
+	// Address for the Prometheus /metrics listener, metrics aren't served when empty
+	MetricsAddr string `yaml:"metrics_addr"`
+	// Take client addresses from X-Forwarded-For, only safe behind a load balancer that sets it
+	TrustProxy bool `yaml:"trust_proxy"`
+	// Key for signing session cookies
+	SecretKey string `yaml:"secret_key"`
+	// Lowest level written to the log: debug, info, warn or error
+	LogLevel string `yaml:"log_level"`
+	// Usernames given the admin role at startup, so a new site has someone to hand out roles
+	Admins []string `yaml:"admins"`
+	Mongo MongoConfig `yaml:"mongo"`
+	Uploads UploadConfig `yaml:"uploads"`
+	S3 S3Config `yaml:"s3"`
+}
+
+type MongoConfig struct {
+	URI string `yaml:"uri"`
+	Database string `yaml:"database"`
+}
+
+type UploadConfig struct {
+	// Directory for uploaded images when they aren't stored in S3
+	Dir string `yaml:"dir"`
+	MaxSizeMB int64 `yaml:"max_size_mb"`
+}
+
+// Images are stored in S3 when a bucket is set, see NewS3BlobStore
+type S3Config struct {
+	Endpoint string `yaml:"endpoint"`
+	Bucket string `yaml:"bucket"`
+	Region string `yaml:"region"`
+	AccessKey string `yaml:"access_key"`
+	SecretKey string `yaml:"secret_key"`
+}
+
+func defaultConfig() Config {
+	return Config{
+		Env: ENV_DEVELOPMENT,
+		ListenAddr: ":3000",
+		SecretKey: defaultSecretKey,
+		LogLevel: "info",
+		Mongo: MongoConfig{
+			URI: "mongodb://localhost:27017",
+			Database: "photospot",
+		},
+		Uploads: UploadConfig{
+			Dir: "uploadedImages",
+			MaxSizeMB: defaultMaxUploadMB,
+		},
+	}
+}
+
+func (c Config) IsProduction() bool {
+	return c.Env == ENV_PRODUCTION
+}
+
+func (c Config) GetLogLevel() (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.LogLevel)); err != nil {
+		return level, fmt.Errorf("Log level must be debug, info, warn or error, got %q", c.LogLevel)
+	}
+	return level, nil
+}
+
+// A setting that can be overridden by an environment variable and a command line flag
+type configSetting struct {
+	flag string
+	env string
+	usage string
+	set func(c *Config, value string) error
+}
+
+func stringSetting(flag string, env string, usage string, field func(c *Config) *string) configSetting {
+	return configSetting{flag, env, usage, func(c *Config, value string) error {
+		*field(c) = value
+		return nil
+	}}
+}
+
+var configSettings = []configSetting{
+	stringSetting("env", "APP_ENV", "development or production", func(c *Config) *string { return &c.Env }),
+	stringSetting("listen", "LISTEN_ADDR", "address to listen on, e.g. :3000", func(c *Config) *string { return &c.ListenAddr }),
+	stringSetting("metrics-listen", "METRICS_ADDR", "address to serve Prometheus metrics on, e.g. 127.0.0.1:9100", func(c *Config) *string { return &c.MetricsAddr }),
+	{"trust-proxy", "TRUST_PROXY", "use X-Forwarded-For for client addresses, true behind a load balancer", func(c *Config, value string) error {
+		trust, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("Trust proxy must be true or false, got %q", value)
+		}
+		c.TrustProxy = trust
+		return nil
+	}},
+	stringSetting("secret-key", "SECRET_KEY", "key for signing session cookies", func(c *Config) *string { return &c.SecretKey }),
+	stringSetting("log-level", "LOG_LEVEL", "lowest log level to write: debug, info, warn or error", func(c *Config) *string { return &c.LogLevel }),
+	{"admins", "ADMIN_USERS", "comma separated usernames given the admin role at startup", func(c *Config, value string) error {
+		c.Admins = nil
+		for _, username := range strings.Split(value, ",") {
+			if username = strings.TrimSpace(username); username != "" {
+				c.Admins = append(c.Admins, username)
+			}
+		}
+		return nil
+	}},
+	stringSetting("mongo-uri", "MONGO_URI", "MongoDB connection string", func(c *Config) *string { return &c.Mongo.URI }),
+	stringSetting("mongo-database", "MONGO_DATABASE", "MongoDB database name", func(c *Config) *string { return &c.Mongo.Database }),
+	stringSetting("image-dir", "IMAGE_DIR", "directory for uploaded images", func(c *Config) *string { return &c.Uploads.Dir }),
+	{"max-upload-mb", "MAX_UPLOAD_MB", "largest image upload in MB", func(c *Config, value string) error {
+		size, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("Max upload size must be a whole number of MB, got %q", value)
+		}
+		c.Uploads.MaxSizeMB = size
+		return nil
+	}},
+	stringSetting("s3-endpoint", "S3_ENDPOINT", "S3 compatible endpoint, defaults to Amazon S3", func(c *Config) *string { return &c.S3.Endpoint }),
+	stringSetting("s3-bucket", "S3_BUCKET", "bucket for uploaded images, instead of image-dir", func(c *Config) *string { return &c.S3.Bucket }),
+	stringSetting("s3-region", "S3_REGION", "S3 region", func(c *Config) *string { return &c.S3.Region }),
+	stringSetting("s3-access-key", "S3_ACCESS_KEY", "S3 access key", func(c *Config) *string { return &c.S3.AccessKey }),
+	stringSetting("s3-secret-key", "S3_SECRET_KEY", "S3 secret key", func(c *Config) *string { return &c.S3.SecretKey }),
+}
+
+// Load the configuration from command line arguments, environment variables
+// and the config file named by the -config flag or CONFIG_FILE variable
+func loadConfig(args []string, getenv func(string) string) (Config, error) {
+	flags := flag.NewFlagSet("image-contest", flag.ContinueOnError)
+	configFile := flags.String("config", getenv("CONFIG_FILE"), "path to a YAML config file")
+	flagValues := make(map[string]*string)
+	for _, setting := range configSettings {
+		flagValues[setting.flag] = flags.String(setting.flag, "", setting.usage + " (env " + setting.env + ")")
+	}
+	if err := flags.Parse(args); err != nil {
+		return Config{}, err
+	}
+
+	config := defaultConfig()
+	if *configFile != "" {
+		if err := readConfigFile(*configFile, &config); err != nil {
+			return Config{}, err
+		}
+	}
+	for _, setting := range configSettings {
+		if value := getenv(setting.env); value != "" {
+			if err := setting.set(&config, value); err != nil {
+				return Config{}, fmt.Errorf("%v: %w", setting.env, err)
+			}
+		}
+	}
+	// Only flags given on the command line override, so an unset flag doesn't reset a value
+	setFlags := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) { setFlags[f.Name] = true })
+	for _, setting := range configSettings {
+		if setFlags[setting.flag] {
+			if err := setting.set(&config, *flagValues[setting.flag]); err != nil {
+				return Config{}, fmt.Errorf("-%v: %w", setting.flag, err)
+			}
+		}
+	}
+	return config, config.validate()
+}
+
+// Read a YAML config file over config, rejecting unknown settings so typos aren't ignored
+func readConfigFile(path string, config *Config) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("Couldn't read config file: %w", err)
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(config); err != nil && err != io.EOF {
+		return fmt.Errorf("Invalid config file %v: %w", path, err)
+	}
+	return nil
+}
+
+// Check the configuration is complete and safe to run with
+func (c Config) validate() error {
+	if c.Env != ENV_DEVELOPMENT && c.Env != ENV_PRODUCTION {
+		return fmt.Errorf("Environment must be %v or %v, got %q", ENV_DEVELOPMENT, ENV_PRODUCTION, c.Env)
+	}
+	if _, err := c.GetLogLevel(); err != nil {
+		return err
+	}
+	if c.ListenAddr == "" {
+		return errors.New("Listen address is required")
+	}
+	if c.MetricsAddr == c.ListenAddr {
+		return errors.New("Metrics must be served on a different address to the site")
+	}
+	if c.Mongo.URI == "" || c.Mongo.Database == "" {
+		return errors.New("MongoDB URI and database name are required")
+	}
+	if c.Uploads.MaxSizeMB <= 0 {
+		return errors.New("Max upload size must be at least 1 MB")
+	}
+	if c.S3.Bucket == "" && c.Uploads.Dir == "" {
+		return errors.New("An image directory or S3 bucket is required")
+	}
+	if c.SecretKey == "" {
+		return errors.New("Secret key is required")
+	}
+	// Anyone could forge session cookies signed with the published default key
+	if c.IsProduction() {
+		if c.SecretKey == defaultSecretKey {
+			return errors.New("Refusing to run in production with the default secret key, set SECRET_KEY")
+		}
+		if len(c.SecretKey) < minSecretKeyLength {
+			return fmt.Errorf("Secret key must be at least %v characters in production", minSecretKeyLength)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Environment variable lookup from a map
+func testEnv(vars map[string]string) func(string) string {
+	return func(name string) string {
+		return vars[name]
+	}
+}
+
+func writeConfigFile(t *testing.T, contents string) string {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigDefaults(t *testing.T){
+	config, err := loadConfig(nil, testEnv(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(config, defaultConfig()) || config.IsProduction() {
+		t.Errorf("Unexpected default config %+v", config)
+	}
+}
+
+func TestLoadConfigPrecedence(t *testing.T){
+	path := writeConfigFile(t, `
+listen_addr: ":8080"
+mongo:
+  uri: mongodb://db:27017
+  database: fromfile
+uploads:
+  max_size_mb: 20
+`)
+	env := map[string]string{"CONFIG_FILE": path, "MONGO_DATABASE": "fromenv", "MAX_UPLOAD_MB": "30", "ADMIN_USERS": "bill, ted,"}
+	config, err := loadConfig([]string{"-max-upload-mb", "40"}, testEnv(env))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// File overrides defaults, the environment overrides the file and flags override both
+	if config.ListenAddr != ":8080" || config.Mongo.URI != "mongodb://db:27017" || config.Uploads.Dir != "uploadedImages" {
+		t.Errorf("Config file should override defaults, got %+v", config)
+	}
+	if config.Mongo.Database != "fromenv" || config.Uploads.MaxSizeMB != 40 {
+		t.Errorf("Environment and flags should override the file, got %+v", config)
+	}
+	if !reflect.DeepEqual(config.Admins, []string{"bill", "ted"}) {
+		t.Errorf("Admins should be read from a comma separated list, got %v", config.Admins)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T){
+	tests := []struct {
+		name string
+		args []string
+		env map[string]string
+		message string
+	}{
+		{"unknown setting", []string{"-config", writeConfigFile(t, "listen: \":80\"")}, nil, "field listen not found"},
+		{"missing file", []string{"-config", "missing.yaml"}, nil, "Couldn't read config file"},
+		{"bad number", nil, map[string]string{"MAX_UPLOAD_MB": "ten"}, "whole number"},
+		{"bad env", []string{"-env", "staging"}, nil, "Environment must be"},
+		{"bad log level", nil, map[string]string{"LOG_LEVEL": "verbose"}, "Log level must be"},
+		{"metrics on site address", []string{"-metrics-listen", ":3000"}, nil, "different address"},
+		{"no upload size", []string{"-max-upload-mb", "0"}, nil, "at least 1 MB"},
+		{"production default secret", []string{"-env", "production"}, nil, "default secret key"},
+		{"production short secret", []string{"-env", "production", "-secret-key", "short"}, nil, "at least 32 characters"},
+	}
+	for _, test := range tests {
+		_, err := loadConfig(test.args, testEnv(test.env))
+		if err == nil || !strings.Contains(err.Error(), test.message) {
+			t.Errorf("%v: expected error containing %q, got %v", test.name, test.message, err)
+		}
+	}
+
+	secret := strings.Repeat("s", minSecretKeyLength)
+	config, err := loadConfig(nil, testEnv(map[string]string{"APP_ENV": "production", "SECRET_KEY": secret}))
+	if err != nil || !config.IsProduction() {
+		t.Errorf("Production should start with a strong secret key, got %v", err)
+	}
+}
@@ -0,0 +1,624 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Contest visibility, participants and invite links
+// Public contests are listed for everyone, unlisted contests can be opened by anyone with the link,
+// invite-only contests can only be seen by their owner and participants,
+// and members-only contests by the members of the community hosting them.
+// Participants are added by the owner or join through an invite link, which can expire or be limited to a number of uses
+
+var contestVisibilities = []string{PUBLIC, UNLISTED, INVITE_ONLY, MEMBERS_ONLY}
+
+// Length of the random part of invite codes, in bytes
+const inviteCodeBytes = 16
+
+// ********
+// Handlers
+// ********
+
+// Handler for an invite-only contest's participants page, and for adding a participant by username
+func contestParticipantsHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+	s *sessions.CookieStore,
+	tmplMap map[string]*template.Template,
+	userStore UserStore,
+	contestStore ContestStore,
+	participantStore ParticipantStore,
+	memberStore CommunityMemberStore,
+	inviteStore InviteStore,
+	contestId string,
+) {
+	userId, _, err := getSessionUser(r)
+	if err != nil {
+		logRequestError(r.Context(), "Couldn't get session user", err)
+		http.Redirect(w, r, "/contests", 302)
+		return
+	}
+	contest, err := findContestForUser(r.Context(), contestId, userId, contestStore, participantStore, memberStore)
+	if err != nil {
+		logRequestError(r.Context(), "Couldn't find contest", err)
+		renderError(w, r, s, tmplMap, err, "/contests")
+		return
+	}
+	var addErr error
+	if r.Method == "POST" {
+		_, addErr = addContestParticipant(r.Context(), userId, contest, r.PostFormValue("username"), userStore, participantStore, memberStore)
+		if addErr == nil {
+			http.Redirect(w, r, participantsUrl(contest), 302)
+			return
+		}
+		if status := errorStatus(addErr); status != http.StatusNotFound && status != http.StatusConflict {
+			logRequestError(r.Context(), "Couldn't add participant", addErr)
+			renderError(w, r, s, tmplMap, addErr, participantsUrl(contest))
+			return
+		}
+	}
+	pageData, err := getParticipantPage(r.Context(), userId, contest, participantStore, memberStore, inviteStore)
+	if err != nil {
+		logRequestError(r.Context(), "Couldn't get participants", err)
+		renderError(w, r, s, tmplMap, err, "/contests/" + contestId)
+		return
+	}
+	pageData.BaseUrl = requestBaseUrl(r)
+	status := http.StatusOK
+	if addErr != nil {
+		// Show the list again with why the user couldn't be added
+		pageData.Error = addErr.Error()
+		status = errorStatus(addErr)
+	}
+	renderTemplate(w, r, s, tmplMap["participants.html"], status, pageData)
+}
+
+// Handler for removing a participant from an invite-only contest
+func removeParticipantHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+	s *sessions.CookieStore,
+	tmplMap map[string]*template.Template,
+	contestStore ContestStore,
+	participantStore ParticipantStore,
+	memberStore CommunityMemberStore,
+	contestId string,
+	participantId string,
+) {
+	userId, _, err := getSessionUser(r)
+	if err != nil {
+		logRequestError(r.Context(), "Couldn't get session user", err)
+		http.Redirect(w, r, "/contests", 302)
+		return
+	}
+	contest, err := findContestForUser(r.Context(), contestId, userId, contestStore, participantStore, memberStore)
+	if err == nil {
+		err = removeContestParticipant(r.Context(), userId, contest, participantId, participantStore, memberStore)
+	}
+	if err != nil {
+		logRequestError(r.Context(), "Couldn't remove participant", err)
+		renderError(w, r, s, tmplMap, err, "/contests/" + contestId + "/participants")
+		return
+	}
+	http.Redirect(w, r, participantsUrl(contest), 302)
+}
+
+// Handler for creating an invite link to an invite-only contest
+func createInviteHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+	s *sessions.CookieStore,
+	tmplMap map[string]*template.Template,
+	contestStore ContestStore,
+	participantStore ParticipantStore,
+	memberStore CommunityMemberStore,
+	inviteStore InviteStore,
+	contestId string,
+) {
+	userId, _, err := getSessionUser(r)
+	if err != nil {
+		logRequestError(r.Context(), "Couldn't get session user", err)
+		http.Redirect(w, r, "/contests", 302)
+		return
+	}
+	contest, err := findContestForUser(r.Context(), contestId, userId, contestStore, participantStore, memberStore)
+	if err == nil {
+		var expiresAt *time.Time
+		var maxUses int
+		expiresAt, maxUses, err = parseInviteForm(r.PostFormValue("expiresin"), r.PostFormValue("maxuses"), time.Now())
+		if err == nil {
+			_, err = createContestInvite(r.Context(), userId, contest, expiresAt, maxUses, memberStore, inviteStore)
+		}
+	}
+	if err != nil {
+		logRequestError(r.Context(), "Couldn't create invite", err)
+		renderError(w, r, s, tmplMap, err, "/contests/" + contestId + "/participants")
+		return
+	}
+	http.Redirect(w, r, participantsUrl(contest), 302)
+}
+
+// Handler for revoking an invite link
+func revokeInviteHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+	s *sessions.CookieStore,
+	tmplMap map[string]*template.Template,
+	contestStore ContestStore,
+	participantStore ParticipantStore,
+	memberStore CommunityMemberStore,
+	inviteStore InviteStore,
+	contestId string,
+	inviteId string,
+) {
+	userId, _, err := getSessionUser(r)
+	if err != nil {
+		logRequestError(r.Context(), "Couldn't get session user", err)
+		http.Redirect(w, r, "/contests", 302)
+		return
+	}
+	contest, err := findContestForUser(r.Context(), contestId, userId, contestStore, participantStore, memberStore)
+	if err == nil {
+		err = revokeContestInvite(r.Context(), userId, contest, inviteId, memberStore, inviteStore)
+	}
+	if err != nil {
+		logRequestError(r.Context(), "Couldn't revoke invite", err)
+		renderError(w, r, s, tmplMap, err, "/contests/" + contestId + "/participants")
+		return
+	}
+	http.Redirect(w, r, participantsUrl(contest), 302)
+}
+
+// Handler for /invites/{code}, which asks the user to join the contest and joins it on POST
+func inviteHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+	s *sessions.CookieStore,
+	tmplMap map[string]*template.Template,
+	contestStore ContestStore,
+	participantStore ParticipantStore,
+	memberStore CommunityMemberStore,
+	inviteStore InviteStore,
+	code string,
+) {
+	userId, username, err := getSessionUser(r)
+	if err != nil {
+		logRequestError(r.Context(), "Couldn't get session user", err)
+		http.Redirect(w, r, "/contests", 302)
+		return
+	}
+	if r.Method == "POST" {
+		contest, err := acceptInvite(r.Context(), userId, username, code, contestStore, participantStore, memberStore, inviteStore)
+		if err != nil {
+			logRequestError(r.Context(), "Couldn't accept invite", err)
+			renderError(w, r, s, tmplMap, err, "/contests")
+			return
+		}
+		http.Redirect(w, r, "/contests/" + contest.GetStringId(), 302)
+		return
+	}
+	_, contest, err := findInvite(r.Context(), code, contestStore, inviteStore)
+	if err != nil {
+		logRequestError(r.Context(), "Couldn't find invite", err)
+		renderError(w, r, s, tmplMap, err, "/contests")
+		return
+	}
+	// Users who can already see the contest don't need to use up the invite
+	if checkContestAccess(r.Context(), userId, contest, participantStore, memberStore) == nil {
+		http.Redirect(w, r, "/contests/" + contest.GetStringId(), 302)
+		return
+	}
+	renderTemplate(w, r, s, tmplMap["invite.html"], http.StatusOK, InvitePageData{contest, code})
+}
+
+// *******
+// Actions
+// *******
+
+// Look up a contest from the ID in a request path, as long as the user is allowed to see it
+func findContestForUser(
+	ctx context.Context,
+	contestId string,
+	userId primitive.ObjectID,
+	contestStore ContestStore,
+	participantStore ParticipantStore,
+	memberStore CommunityMemberStore,
+) (Contest, error) {
+	contest, err := findContest(ctx, contestId, contestStore)
+	if err != nil {
+		return Contest{}, err
+	}
+	if err := checkContestAccess(ctx, userId, contest, participantStore, memberStore); err != nil {
+		return Contest{}, err
+	}
+	return contest, nil
+}
+
+// Invite-only and members-only contests look like they don't exist to anyone not allowed in
+func checkContestAccess(
+	ctx context.Context,
+	userId primitive.ObjectID,
+	contest Contest,
+	participantStore ParticipantStore,
+	memberStore CommunityMemberStore,
+) error {
+	if userId == contest.OwnerId || hasPermission(ctx, PERM_VIEW_ANY_CONTEST) {
+		return nil
+	}
+	allowed := true
+	switch contest.GetVisibility() {
+	case INVITE_ONLY:
+		// Admins of the hosting community manage the contest, so they're let in without an invite
+		if contest.CommunityId != nil {
+			member, err := memberStore.Get(ctx, *contest.CommunityId, userId)
+			if err != nil && err != ErrNotFound {
+				return err
+			}
+			if err == nil && member.IsAdmin() {
+				break
+			}
+		}
+		isParticipant, err := participantStore.IsParticipant(ctx, contest.Id, userId)
+		if err != nil {
+			return err
+		}
+		allowed = isParticipant
+	case MEMBERS_ONLY:
+		if contest.CommunityId == nil {
+			allowed = false
+			break
+		}
+		_, err := memberStore.Get(ctx, *contest.CommunityId, userId)
+		if err != nil && err != ErrNotFound {
+			return err
+		}
+		allowed = err == nil
+	}
+	if !allowed {
+		return notFoundError("Contest not found")
+	}
+	return nil
+}
+
+// Get an invite-only contest's participants and invites, for its managers
+func getParticipantPage(
+	ctx context.Context,
+	userId primitive.ObjectID,
+	contest Contest,
+	participantStore ParticipantStore,
+	memberStore CommunityMemberStore,
+	inviteStore InviteStore,
+) (ParticipantPageData, error) {
+	if err := checkCanManageParticipants(ctx, userId, contest, memberStore); err != nil {
+		return ParticipantPageData{}, err
+	}
+	participants, err := participantStore.ListByContest(ctx, contest.Id)
+	if err != nil {
+		return ParticipantPageData{}, err
+	}
+	invites, err := inviteStore.ListByContest(ctx, contest.Id)
+	if err != nil {
+		return ParticipantPageData{}, err
+	}
+	return ParticipantPageData{Contest: contest, Participants: participants, Invites: invites}, nil
+}
+
+// Let a user into an invite-only contest
+func addContestParticipant(
+	ctx context.Context,
+	userId primitive.ObjectID,
+	contest Contest,
+	username string,
+	userStore UserStore,
+	participantStore ParticipantStore,
+	memberStore CommunityMemberStore,
+) (ContestParticipant, error) {
+	if err := checkCanManageParticipants(ctx, userId, contest, memberStore); err != nil {
+		return ContestParticipant{}, err
+	}
+	username = strings.TrimSpace(username)
+	if username == "" {
+		return ContestParticipant{}, badRequestError("Username is required")
+	}
+	user, err := findUser(ctx, username, userStore)
+	if err != nil {
+		return ContestParticipant{}, err
+	}
+	if user.Id == contest.OwnerId {
+		return ContestParticipant{}, badRequestError("The contest owner can always see the contest")
+	}
+	participant := ContestParticipant{
+		Id: primitive.NewObjectID(),
+		ContestId: contest.Id,
+		UserId: user.Id,
+		Username: user.Username,
+		TimeAdded: time.Now(),
+	}
+	err = participantStore.Add(ctx, participant)
+	if err == ErrDuplicate {
+		return ContestParticipant{}, conflictError(user.Username + " is already a participant")
+	}
+	if err != nil {
+		return ContestParticipant{}, err
+	}
+	return participant, nil
+}
+
+// Take a user out of an invite-only contest, their entries and votes are kept
+func removeContestParticipant(
+	ctx context.Context,
+	userId primitive.ObjectID,
+	contest Contest,
+	participantId string,
+	participantStore ParticipantStore,
+	memberStore CommunityMemberStore,
+) error {
+	if err := checkCanManageParticipants(ctx, userId, contest, memberStore); err != nil {
+		return err
+	}
+	participantObjId, err := primitive.ObjectIDFromHex(participantId)
+	if err != nil {
+		return notFoundError("Participant not found")
+	}
+	removed, err := participantStore.Remove(ctx, contest.Id, participantObjId)
+	if err != nil {
+		return err
+	}
+	if !removed {
+		return notFoundError("Participant not found")
+	}
+	return nil
+}
+
+// Create an invite link, expiresAt and maxUses of 0 mean no limit
+func createContestInvite(
+	ctx context.Context,
+	userId primitive.ObjectID,
+	contest Contest,
+	expiresAt *time.Time,
+	maxUses int,
+	memberStore CommunityMemberStore,
+	inviteStore InviteStore,
+) (ContestInvite, error) {
+	if err := checkCanManageParticipants(ctx, userId, contest, memberStore); err != nil {
+		return ContestInvite{}, err
+	}
+	currentTime := time.Now()
+	if expiresAt != nil && !expiresAt.After(currentTime) {
+		return ContestInvite{}, badRequestError("Invite expiry must be in the future")
+	}
+	if maxUses < 0 {
+		return ContestInvite{}, badRequestError("Maximum uses can't be negative")
+	}
+	code, err := generateInviteCode()
+	if err != nil {
+		return ContestInvite{}, err
+	}
+	invite := ContestInvite{
+		Id: primitive.NewObjectID(),
+		ContestId: contest.Id,
+		Code: code,
+		TimeCreated: currentTime,
+		ExpiresAt: expiresAt,
+		MaxUses: maxUses,
+	}
+	if err := inviteStore.Create(ctx, invite); err != nil {
+		return ContestInvite{}, err
+	}
+	return invite, nil
+}
+
+// Delete an invite link, users who already joined with it stay participants
+func revokeContestInvite(
+	ctx context.Context,
+	userId primitive.ObjectID,
+	contest Contest,
+	inviteId string,
+	memberStore CommunityMemberStore,
+	inviteStore InviteStore,
+) error {
+	if err := checkCanManageParticipants(ctx, userId, contest, memberStore); err != nil {
+		return err
+	}
+	inviteObjId, err := primitive.ObjectIDFromHex(inviteId)
+	if err != nil {
+		return notFoundError("Invite not found")
+	}
+	deleted, err := inviteStore.Delete(ctx, contest.Id, inviteObjId)
+	if err != nil {
+		return err
+	}
+	if !deleted {
+		return notFoundError("Invite not found")
+	}
+	return nil
+}
+
+// Look up an invite and its contest from the code in an invite link
+func findInvite(
+	ctx context.Context,
+	code string,
+	contestStore ContestStore,
+	inviteStore InviteStore,
+) (ContestInvite, Contest, error) {
+	invite, err := inviteStore.GetByCode(ctx, code)
+	if err == ErrNotFound {
+		return ContestInvite{}, Contest{}, notFoundError("Invite not found, it may have been revoked")
+	}
+	if err != nil {
+		return ContestInvite{}, Contest{}, err
+	}
+	contest, err := contestStore.Get(ctx, invite.ContestId)
+	if err == ErrNotFound {
+		return ContestInvite{}, Contest{}, notFoundError("Invite not found, it may have been revoked")
+	}
+	if err != nil {
+		return ContestInvite{}, Contest{}, err
+	}
+	setLogContest(ctx, contest.Id)
+	return invite, contest, nil
+}
+
+// Join a contest with an invite link
+func acceptInvite(
+	ctx context.Context,
+	userId primitive.ObjectID,
+	username string,
+	code string,
+	contestStore ContestStore,
+	participantStore ParticipantStore,
+	memberStore CommunityMemberStore,
+	inviteStore InviteStore,
+) (Contest, error) {
+	invite, contest, err := findInvite(ctx, code, contestStore, inviteStore)
+	if err != nil {
+		return Contest{}, err
+	}
+	// Opening an invite again once joined shouldn't count as another use
+	if err := checkContestAccess(ctx, userId, contest, participantStore, memberStore); err == nil {
+		return contest, nil
+	} else if errorStatus(err) != http.StatusNotFound {
+		return Contest{}, err
+	}
+	used, err := inviteStore.Use(ctx, invite.Id, time.Now())
+	if err != nil {
+		return Contest{}, err
+	}
+	if !used {
+		return Contest{}, forbiddenError("This invite has expired or has been used up, ask the contest owner for a new one")
+	}
+	err = participantStore.Add(ctx, ContestParticipant{
+		Id: primitive.NewObjectID(),
+		ContestId: contest.Id,
+		UserId: userId,
+		Username: username,
+		TimeAdded: time.Now(),
+		InviteId: &invite.Id,
+	})
+	// Joined with another request at the same time
+	if err != nil && err != ErrDuplicate {
+		return Contest{}, err
+	}
+	return contest, nil
+}
+
+// *******
+// Helpers
+// *******
+
+func isContestVisibility(visibility string) bool {
+	for _, contestVisibility := range contestVisibilities {
+		if visibility == contestVisibility {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether a contest shows up in contest lists and on profiles for a viewer
+// Unlisted contests are left out for everyone but their owner, the same as contests the viewer isn't allowed into
+// memberOf holds the invite-only contests the viewer is in, and communities the communities they belong to
+func isContestListed(
+	contest Contest,
+	viewerId primitive.ObjectID,
+	memberOf []primitive.ObjectID,
+	communities []primitive.ObjectID,
+) bool {
+	if contest.GetVisibility() == PUBLIC || contest.OwnerId == viewerId {
+		return true
+	}
+	switch contest.GetVisibility() {
+	case INVITE_ONLY:
+		return containsId(memberOf, contest.Id)
+	case MEMBERS_ONLY:
+		return contest.CommunityId != nil && containsId(communities, *contest.CommunityId)
+	}
+	return false
+}
+
+func containsId(ids []primitive.ObjectID, id primitive.ObjectID) bool {
+	for _, each := range ids {
+		if each == id {
+			return true
+		}
+	}
+	return false
+}
+
+// Participants and invites only apply to invite-only contests, and only their managers manage them
+func checkCanManageParticipants(
+	ctx context.Context,
+	userId primitive.ObjectID,
+	contest Contest,
+	memberStore CommunityMemberStore,
+) error {
+	err := authorizeContest(ctx, userId, contest, PERM_MANAGE_ANY_CONTEST, "manage participants", memberStore)
+	if err != nil {
+		return err
+	}
+	if !contest.IsInviteOnly() {
+		return badRequestError("Only invite-only contests have participants")
+	}
+	return nil
+}
+
+// Read the invite form's expiry, a duration like "24h" or empty for never, and maximum uses, empty for unlimited
+func parseInviteForm(expiresIn string, maxUses string, now time.Time) (*time.Time, int, error) {
+	var expiresAt *time.Time
+	if expiresIn != "" {
+		duration, err := time.ParseDuration(expiresIn)
+		if err != nil || duration <= 0 {
+			return nil, 0, badRequestError("Invalid invite expiry")
+		}
+		expiry := now.Add(duration)
+		expiresAt = &expiry
+	}
+	uses := 0
+	if maxUses != "" {
+		n, err := strconv.Atoi(maxUses)
+		if err != nil || n < 0 {
+			return nil, 0, badRequestError("Maximum uses must be a number, or empty for unlimited")
+		}
+		uses = n
+	}
+	return expiresAt, uses, nil
+}
+
+// Random code for an invite link
+func generateInviteCode() (string, error) {
+	code := make([]byte, inviteCodeBytes)
+	if _, err := rand.Read(code); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(code), nil
+}
+
+func participantsUrl(contest Contest) string {
+	return "/contests/" + contest.GetStringId() + "/participants"
+}
+
+func inviteUrl(invite ContestInvite) string {
+	return "/invites/" + invite.Code
+}
+
+// Scheme and host the request was made to, for links shared outside the site
+func requestBaseUrl(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); trustProxyHeaders && proto != "" {
+		scheme = proto
+	}
+	return scheme + "://" + r.Host
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Create a contest through the API with the given visibility
+func (a *testApp) createVisibleContest(t *testing.T, name string, visibility string, cookies []*http.Cookie) APIContest {
+	var contest APIContest
+	rec := a.apiCall(t, "POST", "/contests", APINewContest{Name: name, Visibility: visibility}, cookies, &contest)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("Creating %v contest failed with %v", visibility, rec.Body.String())
+	}
+	return contest
+}
+
+func TestContestVisibilityListing(t *testing.T){
+	app := newTestApp(t)
+	bill := app.apiLogin(t, "bill")
+	ted := app.apiLogin(t, "ted")
+	app.createVisibleContest(t, "Public", "", bill)
+	unlisted := app.createVisibleContest(t, "Unlisted", UNLISTED, bill)
+	private := app.createVisibleContest(t, "Private", INVITE_ONLY, bill)
+	if unlisted.Visibility != UNLISTED || private.Visibility != INVITE_ONLY {
+		t.Errorf("Contests should keep their visibility, got %v and %v", unlisted.Visibility, private.Visibility)
+	}
+	expectAPIError(t, app.apiCall(t, "POST", "/contests", APINewContest{Name: "Secret", Visibility: "secret"}, bill, nil), http.StatusBadRequest)
+
+	if names, _ := app.listContests(t, "/contests", bill); strings.Join(names, ",") != "Private,Unlisted,Public" {
+		t.Errorf("Owners should see all their contests, got %v", names)
+	}
+	if names, _ := app.listContests(t, "/contests", ted); strings.Join(names, ",") != "Public" {
+		t.Errorf("Other users should only see public contests, got %v", names)
+	}
+	var profile APIUserProfile
+	app.apiCall(t, "GET", "/users/bill", nil, ted, &profile)
+	if len(profile.Contests) != 1 || profile.Stats.ContestsCreated != 1 {
+		t.Errorf("Profile should only list and count public contests, got %+v %+v", profile.Contests, profile.Stats)
+	}
+	app.apiCall(t, "GET", "/users/bill", nil, bill, &profile)
+	if len(profile.Contests) != 3 || profile.Stats.ContestsCreated != 3 {
+		t.Errorf("Owners should see all their contests counted, got %+v", profile.Stats)
+	}
+
+	// Unlisted contests can be opened with the link, invite-only contests can't
+	if rec := app.apiCall(t, "GET", "/contests/" + unlisted.Id, nil, ted, nil); rec.Code != http.StatusOK {
+		t.Errorf("Unlisted contest should be visible with the link, got %v", rec.Code)
+	}
+	for _, path := range []string{"", "/entries", "/results", "/duplicates", "/participants"} {
+		expectAPIError(t, app.apiCall(t, "GET", "/contests/" + private.Id + path, nil, ted, nil), http.StatusNotFound)
+	}
+	expectAPIError(t, app.apiSubmitEntry(private.Id, ted), http.StatusNotFound)
+	expectAPIError(t, app.apiCall(t, "POST", "/contests/" + private.Id + "/votes", APINewVote{}, ted, nil), http.StatusNotFound)
+	if rec := app.get("/contests/" + private.Id, ted); rec.Header().Get("Location") != "/contests" {
+		t.Errorf("Contest page should redirect users who aren't participants, got %v", rec.Code)
+	}
+}
+
+func TestContestParticipants(t *testing.T){
+	app := newTestApp(t)
+	bill := app.login(t, "bill")
+	ted := app.login(t, "ted")
+	rufus := app.login(t, "rufus")
+	rec := app.postForm("/create-contest", url.Values{"contestname": {"Private"}, "visibility": {INVITE_ONLY}}, bill)
+	contestPath := rec.Header().Get("Location")
+	participantsPath := contestPath + "/participants"
+
+	if rec := app.postForm(participantsPath, url.Values{"username": {"ted"}}, rufus); rec.Code != http.StatusNotFound {
+		t.Errorf("Users who can't see the contest should not add participants, got %v", rec.Code)
+	}
+	if rec := app.postForm(participantsPath, url.Values{"username": {"ted"}}, bill); rec.Header().Get("Location") != participantsPath {
+		t.Fatalf("Owner should add participants, got %v", rec.Code)
+	}
+	if rec := app.postForm(participantsPath, url.Values{"username": {"ted"}}, bill); rec.Code != http.StatusConflict {
+		t.Errorf("Adding a participant twice should conflict, got %v", rec.Code)
+	}
+	if rec := app.postForm(participantsPath, url.Values{"username": {"nobody"}}, bill); !strings.Contains(rec.Body.String(), "User not found") {
+		t.Error("Participants page should say the user wasn't found")
+	}
+
+	if rec := app.get(contestPath, ted); rec.Code != http.StatusOK {
+		t.Fatalf("Participants should see the contest, got %v", rec.Code)
+	}
+	if rec := app.get(participantsPath, ted); rec.Code != http.StatusForbidden {
+		t.Errorf("Only the owner should manage participants, got %v", rec.Code)
+	}
+	if rec := app.get(contestPath, bill); !strings.Contains(rec.Body.String(), participantsPath) {
+		t.Error("Contest page should link the owner to the participants page")
+	}
+
+	tedUser, _ := app.users.GetByUsername(context.TODO(), "ted")
+	app.postForm(participantsPath + "/" + tedUser.Id.Hex() + "/remove", url.Values{}, bill)
+	if rec := app.get(contestPath, ted); rec.Header().Get("Location") != "/contests" {
+		t.Errorf("Removed participants should lose access, got %v", rec.Code)
+	}
+
+	// Public contests don't have participants
+	public := app.createContest(t, bill)
+	if rec := app.postForm("/contests/" + public.GetStringId() + "/participants", url.Values{"username": {"ted"}}, bill); rec.Code != http.StatusBadRequest {
+		t.Errorf("Public contests should not take participants, got %v", rec.Code)
+	}
+}
+
+func TestContestInvites(t *testing.T){
+	app := newTestApp(t)
+	bill := app.apiLogin(t, "bill")
+	ted := app.apiLogin(t, "ted")
+	rufus := app.apiLogin(t, "rufus")
+	contest := app.createVisibleContest(t, "Private", INVITE_ONLY, bill)
+	invitesPath := "/contests/" + contest.Id + "/invites"
+
+	past := time.Now().Add(-time.Hour)
+	expectAPIError(t, app.apiCall(t, "POST", invitesPath, APINewInvite{ExpiresAt: &past}, bill, nil), http.StatusBadRequest)
+	expectAPIError(t, app.apiCall(t, "POST", invitesPath, APINewInvite{MaxUses: 1}, ted, nil), http.StatusNotFound)
+	var invite APIInvite
+	if rec := app.apiCall(t, "POST", invitesPath, APINewInvite{MaxUses: 1}, bill, &invite); rec.Code != http.StatusCreated {
+		t.Fatalf("Owner should create invites, got %v", rec.Body.String())
+	}
+	if !strings.HasSuffix(invite.Url, "/invites/" + invite.Code) {
+		t.Errorf("Invite should include its link, got %v", invite.Url)
+	}
+
+	// The invite page asks before joining, and accepting it again doesn't use it up
+	if body := app.get("/invites/" + invite.Code, ted).Body.String(); !strings.Contains(body, "Join Contest") {
+		t.Error("Invite page should ask the user to join")
+	}
+	// Read-only tokens can't join contests
+	readToken := app.createToken(t, ted, SCOPE_READ)
+	expectAPIError(t, app.tokenCall(t, "POST", "/invites/" + invite.Code, nil, readToken.Token, nil), http.StatusForbidden)
+	req := httptest.NewRequest("POST", "/invites/" + invite.Code, nil)
+	req.Header.Set("Authorization", "Bearer " + readToken.Token)
+	if rec := app.do(req, nil); rec.Code != http.StatusForbidden {
+		t.Errorf("Invite page should need the manage scope to accept, got %v", rec.Code)
+	}
+	for i := 0; i < 2; i++ {
+		if rec := app.apiCall(t, "POST", "/invites/" + invite.Code, nil, ted, nil); rec.Code != http.StatusOK {
+			t.Fatalf("Accepting an invite failed with %v", rec.Body.String())
+		}
+	}
+	if rec := app.get("/invites/" + invite.Code, ted); rec.Header().Get("Location") != "/contests/" + contest.Id {
+		t.Errorf("Invite page should send participants to the contest, got %v", rec.Code)
+	}
+	expectAPIError(t, app.apiCall(t, "POST", "/invites/" + invite.Code, nil, rufus, nil), http.StatusForbidden)
+
+	var participants []APIParticipant
+	app.apiCall(t, "GET", "/contests/" + contest.Id + "/participants", nil, bill, &participants)
+	if len(participants) != 1 || participants[0].Username != "ted" || participants[0].InviteId != invite.Id {
+		t.Errorf("Participant should be recorded with the invite, got %+v", participants)
+	}
+	var invites []APIInvite
+	app.apiCall(t, "GET", invitesPath, nil, bill, &invites)
+	if len(invites) != 1 || invites[0].Uses != 1 {
+		t.Errorf("Invite should be used once, got %+v", invites)
+	}
+	if names, _ := app.listContests(t, "/contests", ted); len(names) != 1 {
+		t.Errorf("Participants should see the contest listed, got %v", names)
+	}
+
+	if rec := app.apiCall(t, "DELETE", invitesPath + "/" + invite.Id, nil, bill, nil); rec.Code != http.StatusNoContent {
+		t.Fatalf("Revoking an invite failed with %v", rec.Code)
+	}
+	expectAPIError(t, app.apiCall(t, "POST", "/invites/" + invite.Code, nil, rufus, nil), http.StatusNotFound)
+}
+
+func TestInviteUsable(t *testing.T){
+	now := time.Now()
+	past := now.Add(-time.Minute)
+	future := now.Add(time.Minute)
+	tests := []struct {
+		invite ContestInvite
+		usable bool
+	}{
+		{ContestInvite{}, true},
+		{ContestInvite{ExpiresAt: &future, MaxUses: 2, Uses: 1}, true},
+		{ContestInvite{ExpiresAt: &past}, false},
+		{ContestInvite{MaxUses: 2, Uses: 2}, false},
+	}
+	for _, test := range tests {
+		if test.invite.IsUsable(now) != test.usable {
+			t.Errorf("Invite %+v should be usable: %v", test.invite, test.usable)
+		}
+	}
+	if _, _, err := parseInviteForm("-24h", "", now); errorStatus(err) != http.StatusBadRequest {
+		t.Errorf("Negative expiry should be a bad request, got %v", err)
+	}
+	expiresAt, maxUses, err := parseInviteForm("24h", "5", now)
+	if err != nil || !expiresAt.Equal(now.Add(24 * time.Hour)) || maxUses != 5 {
+		t.Errorf("Unexpected invite form %v %v %v", expiresAt, maxUses, err)
+	}
+}
@@ -0,0 +1,464 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Contest actions shared by the HTML and JSON API handlers
+// Requests that aren't allowed return a ContestActionError
+
+// Struct to hold an entry with its vote count
+// For score voting this is the total stars, for ranked choice the votes in its last round
+type EntryResult struct {
+	Entry ContestEntry
+	Votes int64
+}
+
+// Look up a contest from the ID in a request path
+func findContest(ctx context.Context, contestId string, contestStore ContestStore) (Contest, error) {
+	contestObjId, err := primitive.ObjectIDFromHex(contestId)
+	if err != nil {
+		return Contest{}, notFoundError("Contest not found")
+	}
+	contest, err := contestStore.Get(ctx, contestObjId)
+	if err == ErrNotFound {
+		return Contest{}, notFoundError("Contest not found")
+	}
+	if err == nil {
+		setLogContest(ctx, contest.Id)
+	}
+	return contest, err
+}
+
+// Get what a user can see and do on a contest's detail page
+func getContestDetail(
+	ctx context.Context,
+	userId primitive.ObjectID,
+	contest Contest,
+	entryStore EntryStore,
+	voteStore VoteStore,
+	memberStore CommunityMemberStore,
+) ContestDetailData {
+	entryCount := getNumSubmissions(ctx, contest.Id, entryStore)
+	canManage := canActOnContest(ctx, userId, contest, PERM_MANAGE_ANY_CONTEST, memberStore)
+	detail := ContestDetailData{
+		Contest: contest,
+		EntryCount: entryCount,
+		ShowDuplicateReport: canManage,
+		ShowParticipants: canManage && contest.IsInviteOnly(),
+		ShowEdit: canActOnContest(ctx, userId, contest, PERM_EDIT_ANY_CONTEST, memberStore),
+		ShowDelete: canActOnContest(ctx, userId, contest, PERM_DELETE_ANY_CONTEST, memberStore),
+		ShowRemoveEntries: canActOnContest(ctx, userId, contest, PERM_REMOVE_ANY_ENTRY, memberStore),
+		ShowForceState: hasPermission(ctx, PERM_FORCE_STATE),
+	}
+	if contest.IsOpen() {
+		hasEntered := !canUserSubmit(ctx, userId, contest.Id, entryStore)
+		detail.ShowSubmitForm = checkCanSubmit(contest, hasEntered) == nil
+		detail.ShowEndSubmission = canManage && checkStateTransition(contest, entryCount, VOTING) == nil
+	} else if contest.IsVoting() {
+		hasVoted := !canUserVote(ctx, userId, contest.Id, voteStore)
+		detail.Entries = getContestEntries(ctx, contest.Id, entryStore)
+		detail.ShowVoteForm = checkCanVote(contest, hasVoted) == nil
+		detail.ShowEndVoting = canManage && checkStateTransition(contest, entryCount, CONCLUDED) == nil
+	} else {
+		detail.Entries = getContestWinners(ctx, contest, entryStore, voteStore)
+	}
+	if detail.ShowRemoveEntries {
+		detail.RemovableEntries = getContestEntries(ctx, contest.Id, entryStore)
+	}
+	return detail
+}
+
+// Create a new open contest
+func createNewContest(
+	ctx context.Context,
+	ownerId primitive.ObjectID,
+	ownerName string,
+	name string,
+	description string,
+	submissionEnd *time.Time,
+	votingEnd *time.Time,
+	votingMethod string,
+	visibility string,
+	community *Community,
+	contestStore ContestStore,
+) (Contest, error) {
+	currentTime := time.Now()
+	if name == "" {
+		return Contest{}, badRequestError("Contest name is required")
+	}
+	if votingMethod == "" {
+		votingMethod = PLURALITY
+	}
+	if !isVotingMethod(votingMethod) {
+		return Contest{}, badRequestError("Voting method must be one of " + strings.Join(votingMethods, ", "))
+	}
+	if visibility == "" {
+		visibility = PUBLIC
+	}
+	if !isContestVisibility(visibility) {
+		return Contest{}, badRequestError("Visibility must be one of " + strings.Join(contestVisibilities, ", "))
+	}
+	if visibility == MEMBERS_ONLY && community == nil {
+		return Contest{}, badRequestError("Only contests hosted by a community can be restricted to its members")
+	}
+	if err := validateContestDeadlines(submissionEnd, votingEnd, currentTime); err != nil {
+		return Contest{}, badRequestError(err.Error())
+	}
+	newContest := Contest{
+		Id: primitive.NewObjectID(),
+		Name: name,
+		State: OPEN,
+		Description: description,
+		OwnerId: ownerId,
+		OwnerName: ownerName,
+		TimeCreated: currentTime,
+		SubmissionEnd: submissionEnd,
+		VotingEnd: votingEnd,
+		VotingMethod: votingMethod,
+		Visibility: visibility,
+	}
+	if community != nil {
+		newContest.CommunityId = &community.Id
+		newContest.CommunitySlug = community.Slug
+		newContest.CommunityName = community.Name
+	}
+	if err := contestStore.Create(ctx, newContest); err != nil {
+		return Contest{}, err
+	}
+	contestsCreated.WithLabelValues(votingMethod).Inc()
+	return newContest, nil
+}
+
+// Save an uploaded image as a user's entry to a contest
+func submitEntry(
+	ctx context.Context,
+	ownerId primitive.ObjectID,
+	ownerName string,
+	contest Contest,
+	name string,
+	image io.Reader,
+	contestStore ContestStore,
+	entryStore EntryStore,
+	blobStore BlobStore,
+) (ContestEntry, error) {
+	// Check if user is allowed to make submission
+	hasEntered := !canUserSubmit(ctx, ownerId, contest.Id, entryStore)
+	if err := checkCanSubmit(contest, hasEntered); err != nil {
+		return ContestEntry{}, err
+	}
+
+	// Read the upload into memory and check it is an image
+	data, err := io.ReadAll(io.LimitReader(image, maxUploadSize + 1))
+	uploadBytes.Add(float64(len(data)))
+	if err != nil {
+		return ContestEntry{}, err
+	}
+	if int64(len(data)) > maxUploadSize {
+		return ContestEntry{}, badRequestError("Images can be at most " + strconv.FormatInt(maxUploadSize >> 20, 10) + " MB")
+	}
+	img, format, err := decodeUpload(data)
+	if err != nil {
+		return ContestEntry{}, err
+	}
+
+	// Never store the uploaded metadata, it can include where the photo was taken
+	data, camera, orientation, err := stripMetadata(data, format)
+	if err != nil {
+		return ContestEntry{}, badRequestError("That image is damaged or incomplete, please try another file")
+	}
+	img = applyOrientation(img, orientation)
+
+	// The same photo can't be entered twice, even by different accounts
+	hash := imageHash(img)
+	if err := checkNotDuplicate(hash, getContestEntries(ctx, contest.Id, entryStore)); err != nil {
+		return ContestEntry{}, err
+	}
+
+	// Store the image under a name generated from the entry ID
+	entryId := primitive.NewObjectID()
+	imageName := entryId.Hex() + uploadExtensions[format]
+	if err := blobStore.Put(ctx, imageName, data, imageContentTypes[uploadExtensions[format]]); err != nil {
+		return ContestEntry{}, err
+	}
+
+	// Resized copies are optional, pages fall back to the original image without them
+	variants, err := generateImageVariants(ctx, img, format, blobStore, entryId.Hex())
+	if err != nil {
+		slog.WarnContext(ctx, "Couldn't resize image", "entry_id", entryId.Hex(), "error", err)
+	}
+
+	// Save entry in database
+	newEntry := ContestEntry{
+		Id: entryId,
+		ContestID: contest.Id,
+		ImagePath: imageUrlPrefix + imageName,
+		Name: name,
+		OwnerId: ownerId,
+		OwnerName: ownerName,
+		Variants: variants,
+		Camera: camera,
+		ImageHash: hash,
+		ImageHashBands: imageHashBands(hash),
+	}
+	insertErr := entryStore.Create(ctx, newEntry)
+	if insertErr != nil {
+		// Don't keep the image around for an entry that wasn't saved
+		if err := blobStore.Delete(ctx, imageName); err != nil {
+			slog.ErrorContext(ctx, "Couldn't delete image for unsaved entry", "image", imageName, "error", err)
+		}
+		removeImageVariants(ctx, blobStore, variants)
+		if insertErr == ErrDuplicate {
+			return ContestEntry{}, conflictError("You may only make one entry per contest")
+		}
+		return ContestEntry{}, insertErr
+	}
+	if err := contestStore.IncrementEntryCount(ctx, contest.Id); err != nil {
+		slog.ErrorContext(ctx, "Couldn't update contest entry count", "error", err)
+	}
+	entriesSubmitted.Inc()
+	return newEntry, nil
+}
+
+// Move a contest into a new state on behalf of a user
+func changeContestState(
+	ctx context.Context,
+	userId primitive.ObjectID,
+	contest Contest,
+	state int,
+	contestStore ContestStore,
+	entryStore EntryStore,
+	memberStore CommunityMemberStore,
+) (Contest, error) {
+	// Verify the transition is allowed before updating
+	err := authorizeContest(ctx, userId, contest, PERM_MANAGE_ANY_CONTEST, "change the state of this contest", memberStore)
+	if err != nil {
+		return Contest{}, err
+	}
+	entryCount := getNumSubmissions(ctx, contest.Id, entryStore)
+	if err := checkStateTransition(contest, entryCount, state); err != nil {
+		return Contest{}, err
+	}
+
+	// Only update if the state hasn't been changed by another request in the meantime
+	updated, err := contestStore.UpdateState(ctx, contest.Id, contest.State, state)
+	if err != nil {
+		return Contest{}, err
+	}
+	if !updated {
+		return Contest{}, conflictError("This contest has already changed state")
+	}
+	contestStateTransitions.WithLabelValues(apiStateNames[state], TRIGGER_OWNER).Inc()
+	contest.State = state
+	return contest, nil
+}
+
+// Move a contest into any state, skipping the usual checks, for admins fixing a contest
+func forceContestState(
+	ctx context.Context,
+	contest Contest,
+	state int,
+	contestStore ContestStore,
+) (Contest, error) {
+	if err := checkPermission(ctx, PERM_FORCE_STATE); err != nil {
+		return Contest{}, err
+	}
+	if state == contest.State {
+		return Contest{}, conflictError("This contest is already " + strings.ToLower(contest.GetStateString()))
+	}
+	updated, err := contestStore.UpdateState(ctx, contest.Id, contest.State, state)
+	if err != nil {
+		return Contest{}, err
+	}
+	if !updated {
+		return Contest{}, conflictError("This contest has already changed state")
+	}
+	slog.InfoContext(ctx, "Contest state forced", "from", apiStateNames[contest.State], "to", apiStateNames[state])
+	contestStateTransitions.WithLabelValues(apiStateNames[state], TRIGGER_ADMIN).Inc()
+	contest.State = state
+	return contest, nil
+}
+
+// Change a contest's name and description
+func editContest(
+	ctx context.Context,
+	userId primitive.ObjectID,
+	contest Contest,
+	name string,
+	description string,
+	contestStore ContestStore,
+	memberStore CommunityMemberStore,
+) (Contest, error) {
+	if err := authorizeContest(ctx, userId, contest, PERM_EDIT_ANY_CONTEST, "edit this contest", memberStore); err != nil {
+		return Contest{}, err
+	}
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return Contest{}, badRequestError("Contest name is required")
+	}
+	err := contestStore.UpdateDetails(ctx, contest.Id, name, description)
+	if err == ErrNotFound {
+		return Contest{}, notFoundError("Contest not found")
+	}
+	if err != nil {
+		return Contest{}, err
+	}
+	contest.Name = name
+	contest.Description = description
+	return contest, nil
+}
+
+// Delete a contest with its entries, their images and the votes cast in it
+func deleteContest(
+	ctx context.Context,
+	userId primitive.ObjectID,
+	contest Contest,
+	contestStore ContestStore,
+	entryStore EntryStore,
+	voteStore VoteStore,
+	memberStore CommunityMemberStore,
+	blobStore BlobStore,
+) error {
+	if err := authorizeContest(ctx, userId, contest, PERM_DELETE_ANY_CONTEST, "delete this contest", memberStore); err != nil {
+		return err
+	}
+	entries := getContestEntries(ctx, contest.Id, entryStore)
+	deleted, err := contestStore.Delete(ctx, contest.Id)
+	if err != nil {
+		return err
+	}
+	if !deleted {
+		return notFoundError("Contest not found")
+	}
+	// The contest is gone, so anything left behind can't be reached and is only logged
+	if _, err := voteStore.DeleteByContest(ctx, contest.Id); err != nil {
+		slog.ErrorContext(ctx, "Couldn't delete votes for deleted contest", "error", err)
+	}
+	if _, err := entryStore.DeleteByContest(ctx, contest.Id); err != nil {
+		slog.ErrorContext(ctx, "Couldn't delete entries for deleted contest", "error", err)
+	}
+	for _, entry := range entries {
+		removeEntryImages(ctx, blobStore, entry)
+	}
+	slog.InfoContext(ctx, "Contest deleted", "entries", len(entries))
+	return nil
+}
+
+// Remove an entry from a contest
+// Ballots that included the entry are deleted too, so those voters can vote again
+func removeEntry(
+	ctx context.Context,
+	userId primitive.ObjectID,
+	contest Contest,
+	entryId string,
+	contestStore ContestStore,
+	entryStore EntryStore,
+	voteStore VoteStore,
+	memberStore CommunityMemberStore,
+	blobStore BlobStore,
+) error {
+	if err := authorizeContest(ctx, userId, contest, PERM_REMOVE_ANY_ENTRY, "remove entries", memberStore); err != nil {
+		return err
+	}
+	entryObjId, err := primitive.ObjectIDFromHex(entryId)
+	if err != nil {
+		return notFoundError("Entry not found")
+	}
+	entry, err := entryStore.Get(ctx, entryObjId)
+	if err == ErrNotFound || (err == nil && entry.ContestID != contest.Id) {
+		return notFoundError("Entry not found")
+	}
+	if err != nil {
+		return err
+	}
+	deleted, err := entryStore.Delete(ctx, entry.Id)
+	if err != nil {
+		return err
+	}
+	if !deleted {
+		return notFoundError("Entry not found")
+	}
+	ballots, err := voteStore.DeleteByEntry(ctx, contest.Id, entry.Id)
+	if err != nil {
+		slog.ErrorContext(ctx, "Couldn't delete ballots for removed entry", "error", err)
+	}
+	if err := contestStore.DecrementEntryCount(ctx, contest.Id); err != nil {
+		slog.ErrorContext(ctx, "Couldn't update contest entry count", "error", err)
+	}
+	// The other entries' placements are tallied again when next needed
+	if contest.IsConcluded() {
+		if err := contestStore.SetResultsRecorded(ctx, contest.Id, false); err != nil {
+			slog.ErrorContext(ctx, "Couldn't clear contest results", "error", err)
+		}
+	}
+	removeEntryImages(ctx, blobStore, entry)
+	slog.InfoContext(ctx, "Entry removed", "entry_id", entry.Id.Hex(), "ballots", ballots)
+	return nil
+}
+
+// Record a user's ballot
+// The ballot maps entry IDs to the value given to them, see buildBallot
+func castVote(
+	ctx context.Context,
+	voterId primitive.ObjectID,
+	contest Contest,
+	ballot map[string]int,
+	entryStore EntryStore,
+	voteStore VoteStore,
+) (ContestVote, error) {
+	// Verify contest is accepting votes from this user
+	hasVoted := !canUserVote(ctx, voterId, contest.Id, voteStore)
+	if err := checkCanVote(contest, hasVoted); err != nil {
+		return ContestVote{}, err
+	}
+
+	// Verify ballot only has entries from this contest and follows the voting method
+	choices, err := buildBallot(contest, ballot, getContestEntries(ctx, contest.Id, entryStore))
+	if err != nil {
+		return ContestVote{}, err
+	}
+
+	// Create vote object and store
+	newContestVote := ContestVote{
+		Id: primitive.NewObjectID(),
+		ContestID: contest.Id,
+		UserID: voterId,
+	}
+	if contest.IsPlurality() {
+		newContestVote.EntryID = choices[0].EntryID
+	} else {
+		newContestVote.Choices = choices
+	}
+	insertErr := voteStore.Create(ctx, newContestVote)
+	if insertErr == ErrDuplicate {
+		return ContestVote{}, conflictError("You may only vote once")
+	}
+	if insertErr != nil {
+		return ContestVote{}, insertErr
+	}
+	votesCast.WithLabelValues(contest.GetVotingMethod()).Inc()
+	return newContestVote, nil
+}
+
+// Get every entry in a contest with its votes counted by the contest's voting method
+// Results are ordered from first place to last
+func getContestResults(
+	ctx context.Context,
+	contest Contest,
+	entryStore EntryStore,
+	voteStore VoteStore,
+) []EntryResult {
+	votes, err := voteStore.ListByContest(ctx, contest.Id)
+	if err != nil {
+		slog.ErrorContext(ctx, "Couldn't list votes", "error", err)
+		return []EntryResult{}
+	}
+	return tallyVotes(contest.GetVotingMethod(), getContestEntries(ctx, contest.Id, entryStore), votes)
+}
@@ -1,19 +1,11 @@
 package main
 
 import (
-	"context"
-	"io/ioutil"
-	"os"
-
 	"html/template"
-	"log"
 	"net/http"
 	"time"
 
 	"github.com/gorilla/sessions"
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo"
 )
 
 
@@ -23,30 +15,45 @@ func contestIndexHandler(
 	r *http.Request,
 	s *sessions.CookieStore,
 	tmplMap map[string]*template.Template,
-	contestCollection *mongo.Collection,
+	userStore UserStore,
+	contestStore ContestStore,
+	communityStore CommunityStore,
+	participantStore ParticipantStore,
+	memberStore CommunityMemberStore,
 ) {
-	// Fetch all contests
-	// TODO: Create option to filter contests by state, name, etc
-	var contests []*Contest
-	cursor, err := contestCollection.Find(context.TODO(), bson.D{})
+	params := r.URL.Query()
+	listData := ContestListData{
+		Search: params.Get("q"),
+		State: params.Get("state"),
+		Owner: params.Get("owner"),
+		Community: params.Get("community"),
+		Sort: params.Get("sort"),
+		IsLaterPage: params.Get("cursor") != "",
+		ShowAdmin: hasPermission(r.Context(), PERM_BAN_USERS),
+	}
+	query, err := parseContestQuery(params)
 	if err != nil {
-		log.Println("Couldn't find contests")
+		// Show the search form again with what was wrong
+		logRequestError(r.Context(), "Invalid contest search", err)
+		listData.Error = err.Error()
+		renderTemplate(w, r, s, tmplMap["contests.html"], errorStatus(err), listData)
+		return
 	}
-	for cursor.Next(context.TODO()) {
-		var curContest Contest
-		err := cursor.Decode(&curContest)
-		if err != nil {
-			log.Println("Couldn't get contest")
-		}
-		contests = append(contests, &curContest)
+	viewerId, _, err := getSessionUser(r)
+	if err != nil {
+		logRequestError(r.Context(), "Couldn't get session user", err)
+		http.Redirect(w, r, "/", 302)
+		return
 	}
-	if err := cursor.Err(); err != nil {
-		log.Println(err)
+	page, err := searchContests(r.Context(), viewerId, query, userStore, contestStore, communityStore, participantStore, memberStore)
+	if err != nil {
+		logRequestError(r.Context(), "Couldn't find contests", err)
 	}
-
-	cursor.Close(context.TODO())
-
-	tmplMap["contests.html"].ExecuteTemplate(w, "base", contests)
+	listData.Contests = page.Contests
+	if page.NextCursor != "" {
+		listData.NextUrl = nextPageUrl(r.URL.Path, params, page.NextCursor)
+	}
+	renderTemplate(w, r, s, tmplMap["contests.html"], http.StatusOK, listData)
 }
 
 // handler to render contest detail page
@@ -55,64 +62,36 @@ func contestDetailHandler(
 	r *http.Request,
 	s *sessions.CookieStore,
 	tmplMap map[string]*template.Template,
-	contestCollection *mongo.Collection,
-	contestEntryCollection *mongo.Collection,
-	contestVoteCollection *mongo.Collection,
+	contestStore ContestStore,
+	entryStore EntryStore,
+	voteStore VoteStore,
+	participantStore ParticipantStore,
+	memberStore CommunityMemberStore,
 	contestId string,
 ) {
 	// fetch necessary data
-	var contest Contest
-	contestObjId, idErr := primitive.ObjectIDFromHex(contestId)
-	if idErr != nil {
-		log.Println("Contest ID not valid")
-		http.Redirect(w, r, "/contests", 302)
-		return
-	}
-	err := contestCollection.FindOne(context.TODO(), bson.D{{"_id", contestObjId}}).Decode(&contest)
-	if err != nil {
-		log.Println("Contest not found")
-		http.Redirect(w, r, "/contests", 302)
-		return
-	}
-	session, err := s.Get(r, "session")
+	userId, _, err := getSessionUser(r)
 	if err != nil {
-		log.Println(err)
+		logRequestError(r.Context(), "Couldn't get session user", err)
 		http.Redirect(w, r, "/contests", 302)
 		return
 	}
-	userId, err := primitive.ObjectIDFromHex(session.Values["userId"].(string))
+	contest, err := findContestForUser(r.Context(), contestId, userId, contestStore, participantStore, memberStore)
 	if err != nil {
-		log.Println(err)
+		logRequestError(r.Context(), "Couldn't find contest", err)
 		http.Redirect(w, r, "/contests", 302)
 		return
 	}
-	entryCount := getNumSubmissions(contestObjId, contestEntryCollection)
+	detail := getContestDetail(r.Context(), userId, contest, entryStore, voteStore, memberStore)
 	if contest.IsOpen() {
 		// View for contest in open state
-		tmplMap["contestDetailOpen.html"].ExecuteTemplate(w, "base", ContestDetailData{
-			Contest: contest,
-			ShowSubmitForm: canUserSubmit(userId, contestObjId, contestEntryCollection),
-			EntryCount: entryCount,
-			ShowEndSubmission: canEndSubmission(userId, contest) && entryCount > 0,
-		})
+		renderTemplate(w, r, s, tmplMap["contestDetailOpen.html"], http.StatusOK, detail)
 	} else if contest.IsVoting() {
 		// View for contest in voting state
-		entries := getContestEntries(contestObjId, contestEntryCollection)
-		tmplMap["contestDetailVoting.html"].ExecuteTemplate(w, "base", ContestDetailData{
-			Contest: contest,
-			Entries: entries,
-			ShowVoteForm: canUserVote(userId, contestObjId, contestVoteCollection),
-			EntryCount: entryCount,
-			ShowEndVoting: canEndVoting(userId, contest),
-		})
+		renderTemplate(w, r, s, tmplMap["contestDetailVoting.html"], http.StatusOK, detail)
 	} else {
 		// View for concluded contest
-		winners := getContestWinners(contestObjId, contestEntryCollection, contestVoteCollection)
-		tmplMap["contestDetailConcluded.html"].ExecuteTemplate(w, "base", ContestDetailData{
-			Contest: contest,
-			Entries: winners,
-			EntryCount: entryCount,
-		})
+		renderTemplate(w, r, s, tmplMap["contestDetailConcluded.html"], http.StatusOK, detail)
 	}
 }
 
@@ -122,81 +101,57 @@ func contestPhotoSubmissionHandler(
 	r *http.Request,
 	s *sessions.CookieStore,
 	tmplMap map[string]*template.Template,
-	contestEntryCollection *mongo.Collection,
+	contestStore ContestStore,
+	entryStore EntryStore,
+	voteStore VoteStore,
+	participantStore ParticipantStore,
+	memberStore CommunityMemberStore,
+	blobStore BlobStore,
 	contestId string,
 ) {
 	// Get data and format IDs
-	session, err := s.Get(r, "session")
+	entryOwnerId, entryOwnerName, err := getSessionUser(r)
 	if err != nil {
-		log.Println(err)
+		logRequestError(r.Context(), "Couldn't get session user", err)
 		http.Redirect(w, r, "/contests", 302)
 		return
 	}
-	contestOwnerName := session.Values["username"].(string)
-	entryOwnerId, err := primitive.ObjectIDFromHex(session.Values["userId"].(string))
-	if err != nil {
-		log.Println(err)
-		http.Redirect(w, r, "/contests/", 302)
-		return
-	}
-	contestObjId, err := primitive.ObjectIDFromHex(contestId)
+	contest, err := findContestForUser(r.Context(), contestId, entryOwnerId, contestStore, participantStore, memberStore)
 	if err != nil {
-		log.Println(err)
-		http.Redirect(w, r, "/contests/", 302)
-		return
-	}
-
-	// Check if user is allowed to make submission
-	if !canUserSubmit(entryOwnerId, contestObjId, contestEntryCollection) {
-		log.Println("User doesn't have permission to enter contest")
-		http.Redirect(w, r, "/contests/" + contestId, 302)
+		logRequestError(r.Context(), "Couldn't find contest", err)
+		http.Redirect(w, r, "/contests", 302)
 		return
 	}
 
 	// Fetch image from form
-	// Max image size of 10 MB
-	r.ParseMultipartForm(10 << 20)
-	uploadedFile, handler, err := r.FormFile("img")
-	if err != nil {
-		log.Println("Couldn't fetch file")
-		http.Redirect(w, r, "/contests/" + contestId, 302)
-		return
+	r.ParseMultipartForm(maxUploadSize)
+	uploadedFile, _, err := r.FormFile("img")
+	if err == nil {
+		defer uploadedFile.Close()
+		_, err = submitEntry(
+			r.Context(),
+			entryOwnerId,
+			entryOwnerName,
+			contest,
+			r.PostFormValue("imgName"),
+			uploadedFile,
+			contestStore,
+			entryStore,
+			blobStore,
+		)
+	} else {
+		err = badRequestError("Please choose an image to upload")
 	}
-	defer uploadedFile.Close()
-
-	// Create new file on server to store image
-	entryId := primitive.NewObjectID()
-	entryName := r.PostFormValue("imgName")
-	imagePath := "uploadedImages/" + entryId.Hex() + handler.Filename
-	newFile, err := os.Create(imagePath)
-	if err != nil {
-		log.Printf("Issue saving file %v\n", err)
-		http.Redirect(w, r, "/contests/" + contestId, 302)
+	if errorStatus(err) == http.StatusBadRequest {
+		// Show what was wrong with the upload above the submission form
+		detail := getContestDetail(r.Context(), entryOwnerId, contest, entryStore, voteStore, memberStore)
+		detail.Error = err.Error()
+		renderTemplate(w, r, s, tmplMap["contestDetailOpen.html"], http.StatusBadRequest, detail)
 		return
 	}
-
-	// Write data to new file
-	fileBytes, err := ioutil.ReadAll(uploadedFile)
 	if err != nil {
-		log.Println("Couldn't read file")
-		http.Redirect(w, r, "/contests/" + contestId, 302)
-		return
-	}
-	newFile.Write(fileBytes)
-	
-	// Save entry in database
-	newEntry := ContestEntry{
-		entryId,
-		contestObjId,
-		"/" + imagePath,
-		entryName,
-		entryOwnerId,
-		contestOwnerName,
-	}
-	_, insertErr := contestEntryCollection.InsertOne(context.TODO(), newEntry)
-	if insertErr != nil {
-		log.Println(insertErr)
-		http.Redirect(w, r, "/contests", 302)
+		logRequestError(r.Context(), "Couldn't submit entry", err)
+		renderError(w, r, s, tmplMap, err, "/contests/" + contestId)
 		return
 	}
 	http.Redirect(w, r, "/contests/" + contestId, 302)
@@ -209,145 +164,366 @@ func createContestHandler(
 	r *http.Request,
 	s *sessions.CookieStore,
 	tmplMap map[string]*template.Template,
-	contestCollection *mongo.Collection,
+	contestStore ContestStore,
+	communityStore CommunityStore,
+	memberStore CommunityMemberStore,
 ) {
+	ownerObjId, contestOwnerName, err := getSessionUser(r)
+	if err != nil {
+		logRequestError(r.Context(), "Couldn't get session user", err)
+		http.Redirect(w, r, "/contests", 302)
+		return
+	}
+	// Communities the user can host the contest for
+	communities, err := listHostCommunities(r.Context(), ownerObjId, communityStore, memberStore)
+	if err != nil {
+		logRequestError(r.Context(), "Couldn't list communities", err)
+	}
 	if r.Method == "POST" {
-		session, err := s.Get(r, "session")
-		if err != nil {
-			log.Println(err)
-			http.Redirect(w, r, "/contests", 302)
-			return
-		}
-		// Fetch data from form and current session
+		// Fetch data from form
 		contestName := r.PostFormValue("contestname")
 		contestDescription := r.PostFormValue("contestdescription")
-		contestOwnerId := session.Values["userId"].(string)
-		ownerObjId, idErr := primitive.ObjectIDFromHex(contestOwnerId)
-		if idErr != nil {
-			log.Println("User ID not valid")
-			http.Redirect(w, r, "/contests", 302)
+		votingMethod := r.PostFormValue("votingmethod")
+		visibility := r.PostFormValue("visibility")
+		communitySlug := r.PostFormValue("community")
+		formData := CreateContestData{
+			Name: contestName,
+			Description: contestDescription,
+			VotingMethod: votingMethod,
+			Visibility: visibility,
+			Community: communitySlug,
+			Communities: communities,
+		}
+
+		// Optional deadlines for automatic state changes
+		submissionEnd, votingEnd, deadlineErr := parseContestDeadlines(
+			r.PostFormValue("submissionend"),
+			r.PostFormValue("votingend"),
+			r.PostFormValue("timezone"),
+			time.Now(),
+		)
+		if deadlineErr != nil {
+			formData.Error = deadlineErr.Error()
+			renderTemplate(w, r, s, tmplMap["createContest.html"], http.StatusBadRequest, formData)
 			return
 		}
-		contestOwnerName := session.Values["username"].(string)
-		currentTime := time.Now()
 
 		// Create contest and save in database
-		newContest := Contest{
-			primitive.NewObjectID(),
-			contestName,
-			OPEN,
-			contestDescription,
+		community, err := findHostCommunity(r.Context(), ownerObjId, communitySlug, communityStore, memberStore)
+		if err != nil {
+			logRequestError(r.Context(), "Couldn't find host community", err)
+			renderError(w, r, s, tmplMap, err, "/create-contest")
+			return
+		}
+		newContest, err := createNewContest(
+			r.Context(),
 			ownerObjId,
 			contestOwnerName,
-			currentTime,
+			contestName,
+			contestDescription,
+			submissionEnd,
+			votingEnd,
+			votingMethod,
+			visibility,
+			community,
+			contestStore,
+		)
+		if errorStatus(err) == http.StatusBadRequest {
+			formData.Error = err.Error()
+			renderTemplate(w, r, s, tmplMap["createContest.html"], http.StatusBadRequest, formData)
+			return
 		}
-		insertResult, insertErr := contestCollection.InsertOne(context.TODO(), newContest)
-		if insertErr != nil {
-			log.Println(insertErr)
+		if err != nil {
+			logRequestError(r.Context(), "Couldn't create contest", err)
 			http.Redirect(w, r, "/contests", 302)
 			return
 		}
-		http.Redirect(w, r, "/contests/" + insertResult.InsertedID.(primitive.ObjectID).Hex(), 302)
+		http.Redirect(w, r, "/contests/" + newContest.GetStringId(), 302)
 		return
 	} else {
 		// Render create contest form
-		tmplMap["createContest.html"].ExecuteTemplate(w, "base", nil)
+		renderTemplate(w, r, s, tmplMap["createContest.html"], http.StatusOK, CreateContestData{Communities: communities})
 		return
 	}
 }
 
-// Handler for request to start contest voting period
-// TODO: VERIFY CONTEST CAN START VOTING
+// Handler for requests to move a contest into its next state
 func contestChangeStateHandler(
 	w http.ResponseWriter,
 	r *http.Request,
 	s *sessions.CookieStore,
-	contestCollection *mongo.Collection,
+	tmplMap map[string]*template.Template,
+	contestStore ContestStore,
+	entryStore EntryStore,
+	participantStore ParticipantStore,
+	memberStore CommunityMemberStore,
 	contestId string,
 	state int,
 ) {
-	contestObjId, err := primitive.ObjectIDFromHex(contestId)
+	userId, _, err := getSessionUser(r)
+	if err != nil {
+		logRequestError(r.Context(), "Couldn't get session user", err)
+		http.Redirect(w, r, "/contests", 302)
+		return
+	}
+	contest, err := findContestForUser(r.Context(), contestId, userId, contestStore, participantStore, memberStore)
 	if err != nil {
-		log.Println(err)
+		logRequestError(r.Context(), "Couldn't find contest", err)
 		http.Redirect(w, r, "/contests", 302)
 		return
 	}
-	update := bson.D{{"$set", bson.D{{"state", state}}}}
-	_, updateErr := contestCollection.UpdateOne(
-		context.TODO(),
-		bson.D{{"_id", contestObjId}},
-		update,
-	)
-	if updateErr != nil {
-		log.Println(err)
+	if _, err := changeContestState(r.Context(), userId, contest, state, contestStore, entryStore, memberStore); err != nil {
+		logRequestError(r.Context(), "Couldn't change contest state", err)
+		renderError(w, r, s, tmplMap, err, "/contests/" + contestId)
+		return
 	}
 	http.Redirect(w, r, "/contests/" + contestId, 302)
 }
 
-func contestVoteHandler(
+// Handler for the contest owner or an admin editing a contest's name and description
+func editContestHandler(
 	w http.ResponseWriter,
 	r *http.Request,
 	s *sessions.CookieStore,
-	contestCollection *mongo.Collection,
-	contestVoteCollection *mongo.Collection,
-	contestEntryCollection *mongo.Collection,
+	tmplMap map[string]*template.Template,
+	contestStore ContestStore,
+	participantStore ParticipantStore,
+	memberStore CommunityMemberStore,
 	contestId string,
 ) {
-	session, err := s.Get(r, "session")
+	userId, _, err := getSessionUser(r)
 	if err != nil {
-		log.Println(err)
+		logRequestError(r.Context(), "Couldn't get session user", err)
 		http.Redirect(w, r, "/contests", 302)
 		return
 	}
-	// Verify contestEntry exists and can be voted on
-	imageVote := r.PostFormValue("image-vote")
-	entryId, err := primitive.ObjectIDFromHex(imageVote)
+	contest, err := findContestForUser(r.Context(), contestId, userId, contestStore, participantStore, memberStore)
 	if err != nil {
-		log.Println(err)
+		logRequestError(r.Context(), "Couldn't find contest", err)
 		http.Redirect(w, r, "/contests", 302)
 		return
 	}
-	contestObjId, err := primitive.ObjectIDFromHex(contestId)
+	if err := authorizeContest(r.Context(), userId, contest, PERM_EDIT_ANY_CONTEST, "edit this contest", memberStore); err != nil {
+		renderError(w, r, s, tmplMap, err, "/contests/" + contestId)
+		return
+	}
+	if r.Method != "POST" {
+		formData := EditContestData{Contest: contest, Name: contest.Name, Description: contest.Description}
+		renderTemplate(w, r, s, tmplMap["editContest.html"], http.StatusOK, formData)
+		return
+	}
+	name := r.PostFormValue("contestname")
+	description := r.PostFormValue("contestdescription")
+	_, err = editContest(r.Context(), userId, contest, name, description, contestStore, memberStore)
+	if errorStatus(err) == http.StatusBadRequest {
+		formData := EditContestData{contest, name, description, err.Error()}
+		renderTemplate(w, r, s, tmplMap["editContest.html"], http.StatusBadRequest, formData)
+		return
+	}
+	if err != nil {
+		logRequestError(r.Context(), "Couldn't edit contest", err)
+		renderError(w, r, s, tmplMap, err, "/contests/" + contestId)
+		return
+	}
+	http.Redirect(w, r, "/contests/" + contestId, 302)
+}
+
+// Handler for deleting a contest with everything submitted to it
+func deleteContestHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+	s *sessions.CookieStore,
+	tmplMap map[string]*template.Template,
+	contestStore ContestStore,
+	entryStore EntryStore,
+	voteStore VoteStore,
+	participantStore ParticipantStore,
+	memberStore CommunityMemberStore,
+	blobStore BlobStore,
+	contestId string,
+) {
+	userId, _, err := getSessionUser(r)
 	if err != nil {
-		log.Println(err)
+		logRequestError(r.Context(), "Couldn't get session user", err)
 		http.Redirect(w, r, "/contests", 302)
 		return
 	}
-	entryCount, countErr := contestEntryCollection.CountDocuments(
-		context.TODO(),
-		bson.D{{"_id", entryId}, {"contest_id", contestObjId}},
-	)
-	if countErr != nil {
-		log.Println(countErr)
+	contest, err := findContestForUser(r.Context(), contestId, userId, contestStore, participantStore, memberStore)
+	if err != nil {
+		logRequestError(r.Context(), "Couldn't find contest", err)
 		http.Redirect(w, r, "/contests", 302)
 		return
 	}
-	if entryCount != 1 {
-		log.Println("Request not valid")
+	if err := deleteContest(r.Context(), userId, contest, contestStore, entryStore, voteStore, memberStore, blobStore); err != nil {
+		logRequestError(r.Context(), "Couldn't delete contest", err)
+		renderError(w, r, s, tmplMap, err, "/contests/" + contestId)
+		return
+	}
+	http.Redirect(w, r, "/contests", 302)
+}
+
+// Handler for taking an entry out of a contest
+func removeEntryHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+	s *sessions.CookieStore,
+	tmplMap map[string]*template.Template,
+	contestStore ContestStore,
+	entryStore EntryStore,
+	voteStore VoteStore,
+	participantStore ParticipantStore,
+	memberStore CommunityMemberStore,
+	blobStore BlobStore,
+	contestId string,
+	entryId string,
+) {
+	userId, _, err := getSessionUser(r)
+	if err != nil {
+		logRequestError(r.Context(), "Couldn't get session user", err)
 		http.Redirect(w, r, "/contests", 302)
 		return
 	}
-	
-	// Validate current user
-	voterId, err := primitive.ObjectIDFromHex(session.Values["userId"].(string))
+	contest, err := findContestForUser(r.Context(), contestId, userId, contestStore, participantStore, memberStore)
 	if err != nil {
-		log.Println(err)
-		http.Redirect(w, r, "/contests/", 302)
+		logRequestError(r.Context(), "Couldn't find contest", err)
+		http.Redirect(w, r, "/contests", 302)
 		return
 	}
+	err = removeEntry(r.Context(), userId, contest, entryId, contestStore, entryStore, voteStore, memberStore, blobStore)
+	if err != nil {
+		logRequestError(r.Context(), "Couldn't remove entry", err)
+		renderError(w, r, s, tmplMap, err, "/contests/" + contestId)
+		return
+	}
+	http.Redirect(w, r, "/contests/" + contestId, 302)
+}
 
-	// Create vote object and store
-	newContestVote := ContestVote{
-		primitive.NewObjectID(),
-		contestObjId,
-		entryId,
-		voterId,
-	}
-	_, insertErr := contestVoteCollection.InsertOne(context.TODO(), newContestVote)
-	if insertErr != nil {
-		log.Println(insertErr)
+// Handler for an admin moving a contest into any state
+func forceStateHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+	s *sessions.CookieStore,
+	tmplMap map[string]*template.Template,
+	contestStore ContestStore,
+	participantStore ParticipantStore,
+	memberStore CommunityMemberStore,
+	contestId string,
+) {
+	userId, _, err := getSessionUser(r)
+	if err != nil {
+		logRequestError(r.Context(), "Couldn't get session user", err)
+		http.Redirect(w, r, "/contests", 302)
+		return
+	}
+	contest, err := findContestForUser(r.Context(), contestId, userId, contestStore, participantStore, memberStore)
+	if err != nil {
+		logRequestError(r.Context(), "Couldn't find contest", err)
 		http.Redirect(w, r, "/contests", 302)
 		return
 	}
+	state, ok := stateFromName(r.PostFormValue("state"))
+	if !ok {
+		err = badRequestError("Choose a state for the contest")
+	} else {
+		_, err = forceContestState(r.Context(), contest, state, contestStore)
+	}
+	if err != nil {
+		logRequestError(r.Context(), "Couldn't force contest state", err)
+		renderError(w, r, s, tmplMap, err, "/contests/" + contestId)
+		return
+	}
 	http.Redirect(w, r, "/contests/" + contestId, 302)
 }
+
+func contestVoteHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+	s *sessions.CookieStore,
+	tmplMap map[string]*template.Template,
+	contestStore ContestStore,
+	voteStore VoteStore,
+	entryStore EntryStore,
+	participantStore ParticipantStore,
+	memberStore CommunityMemberStore,
+	contestId string,
+) {
+	voterId, _, err := getSessionUser(r)
+	if err != nil {
+		logRequestError(r.Context(), "Couldn't get session user", err)
+		http.Redirect(w, r, "/contests", 302)
+		return
+	}
+	contest, err := findContestForUser(r.Context(), contestId, voterId, contestStore, participantStore, memberStore)
+	if err != nil {
+		logRequestError(r.Context(), "Couldn't find contest", err)
+		http.Redirect(w, r, "/contests", 302)
+		return
+	}
+	r.ParseForm()
+	ballot, err := parseBallotForm(contest, r.PostForm)
+	if err == nil {
+		_, err = castVote(r.Context(), voterId, contest, ballot, entryStore, voteStore)
+	}
+	if err != nil {
+		logRequestError(r.Context(), "Couldn't cast vote", err)
+		renderError(w, r, s, tmplMap, err, "/contests/" + contestId)
+		return
+	}
+	http.Redirect(w, r, "/contests/" + contestId, 302)
+}
+
+// Handler for the contest owner's report of entries that look the same as another entry
+func contestDuplicatesHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+	s *sessions.CookieStore,
+	tmplMap map[string]*template.Template,
+	contestStore ContestStore,
+	entryStore EntryStore,
+	participantStore ParticipantStore,
+	memberStore CommunityMemberStore,
+	contestId string,
+) {
+	userId, _, err := getSessionUser(r)
+	if err != nil {
+		logRequestError(r.Context(), "Couldn't get session user", err)
+		http.Redirect(w, r, "/contests", 302)
+		return
+	}
+	contest, err := findContestForUser(r.Context(), contestId, userId, contestStore, participantStore, memberStore)
+	if err != nil {
+		logRequestError(r.Context(), "Couldn't find contest", err)
+		http.Redirect(w, r, "/contests", 302)
+		return
+	}
+	matches, err := getDuplicateReport(r.Context(), userId, contest, contestStore, entryStore, participantStore, memberStore)
+	if err != nil {
+		logRequestError(r.Context(), "Couldn't get duplicate report", err)
+		renderError(w, r, s, tmplMap, err, "/contests/" + contestId)
+		return
+	}
+	renderTemplate(w, r, s, tmplMap["contestDuplicates.html"], http.StatusOK, DuplicateReportData{contest, matches})
+}
+
+// Render the error page with the status code for err
+func renderError(
+	w http.ResponseWriter,
+	r *http.Request,
+	s *sessions.CookieStore,
+	tmplMap map[string]*template.Template,
+	err error,
+	backUrl string,
+) {
+	status := errorStatus(err)
+	message := err.Error()
+	if status == http.StatusInternalServerError {
+		// Don't leak internal errors to the user
+		message = "Something went wrong, please try again"
+	}
+	renderTemplate(w, r, s, tmplMap["error.html"], status, ErrorData{
+		Status: status,
+		StatusText: http.StatusText(status),
+		Message: message,
+		BackUrl: backUrl,
+	})
+}
@@ -2,74 +2,164 @@ package main
 
 import (
 	"context"
-	"log"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
 
-	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo"
 )
 
 
 // Helper to check if user is able to make submission to contest
 func canUserSubmit(
+	ctx context.Context,
 	userId primitive.ObjectID,
 	contestId primitive.ObjectID,
-	contestEntryCollection *mongo.Collection,
+	entryStore EntryStore,
 ) bool {
-	entryCount, countErr := contestEntryCollection.CountDocuments(
-		context.TODO(),
-		bson.D{{"contest_id", contestId}, {"owner_id", userId}},
-	)
+	entryCount, countErr := entryStore.CountByOwner(ctx, contestId, userId)
 	if countErr != nil {
-		log.Println(countErr)
+		slog.ErrorContext(ctx, "Couldn't count user's entries", "error", countErr)
 		return false
 	}
 	return entryCount == 0
 }
 
 func canUserVote(
+	ctx context.Context,
 	userId primitive.ObjectID,
 	contestId primitive.ObjectID,
-	contestVoteCollection *mongo.Collection,
+	voteStore VoteStore,
 ) bool {
-	entryCount, countErr := contestVoteCollection.CountDocuments(
-		context.TODO(),
-		bson.D{{"contest_id", contestId}, {"user_id", userId}},
-	)
+	entryCount, countErr := voteStore.CountByUser(ctx, contestId, userId)
 	if countErr != nil {
-		log.Println(countErr)
+		slog.ErrorContext(ctx, "Couldn't count user's votes", "error", countErr)
 		return false
 	}
 	return entryCount == 0
 }
 
-// Check if current user can end submission period
-func canEndSubmission(
-	userId primitive.ObjectID,
-	contest Contest,
-) bool {
-	return contest.State == OPEN && contest.OwnerId == userId
+// Error for a contest action that isn't allowed
+// Status is the HTTP status code the handler should respond with
+type ContestActionError struct {
+	Status int
+	Message string
 }
 
-// Checks if current user can end voting period
-func canEndVoting(
-	userId primitive.ObjectID,
+func (e *ContestActionError) Error() string {
+	return e.Message
+}
+
+func badRequestError(message string) error {
+	return &ContestActionError{http.StatusBadRequest, message}
+}
+
+func notFoundError(message string) error {
+	return &ContestActionError{http.StatusNotFound, message}
+}
+
+func unauthorizedError(message string) error {
+	return &ContestActionError{http.StatusUnauthorized, message}
+}
+
+func forbiddenError(message string) error {
+	return &ContestActionError{http.StatusForbidden, message}
+}
+
+func conflictError(message string) error {
+	return &ContestActionError{http.StatusConflict, message}
+}
+
+func tooManyRequestsError(message string) error {
+	return &ContestActionError{http.StatusTooManyRequests, message}
+}
+
+func serviceUnavailableError(message string) error {
+	return &ContestActionError{http.StatusServiceUnavailable, message}
+}
+
+// Get the HTTP status code for an error returned by a contest action
+func errorStatus(err error) int {
+	var actionErr *ContestActionError
+	if errors.As(err, &actionErr) {
+		return actionErr.Status
+	}
+	return http.StatusInternalServerError
+}
+
+// Check if a contest can move into a new state
+// Contests only move forward OPEN -> VOTING -> CONCLUDED, who can move them is checked by authorizeContest
+func checkStateTransition(
 	contest Contest,
-) bool {
-	return contest.State == VOTING && contest.OwnerId == userId
+	entryCount int64,
+	state int,
+) error {
+	invalidErr := conflictError(fmt.Sprintf(
+		"Contest cannot move from \"%v\" to \"%v\"",
+		contest.GetStateString(),
+		Contest{State: state}.GetStateString(),
+	))
+	switch state {
+	case VOTING:
+		if !canEndSubmission(contest) {
+			return invalidErr
+		}
+		if entryCount < 1 {
+			return conflictError("Voting can't start until the contest has at least one entry")
+		}
+	case CONCLUDED:
+		if !canEndVoting(contest) {
+			return invalidErr
+		}
+	default:
+		return invalidErr
+	}
+	return nil
+}
+
+// Check if a user may submit an entry to a contest
+func checkCanSubmit(contest Contest, hasEntered bool) error {
+	if !contest.IsOpen() || deadlinePassed(contest.SubmissionEnd, time.Now()) {
+		return conflictError("This contest is no longer accepting submissions")
+	}
+	if hasEntered {
+		return conflictError("You may only make one entry per contest")
+	}
+	return nil
+}
+
+// Check if a user may vote in a contest
+func checkCanVote(contest Contest, hasVoted bool) error {
+	if !contest.IsVoting() || deadlinePassed(contest.VotingEnd, time.Now()) {
+		return conflictError("This contest is not accepting votes")
+	}
+	if hasVoted {
+		return conflictError("You may only vote once")
+	}
+	return nil
+}
+
+// Check if a contest's submission period can end
+func canEndSubmission(contest Contest) bool {
+	return contest.State == OPEN
+}
+
+// Check if a contest's voting period can end
+func canEndVoting(contest Contest) bool {
+	return contest.State == VOTING
 }
 
 // Get the number of submissions to a contest
 func getNumSubmissions(
+	ctx context.Context,
 	contestId primitive.ObjectID,
-	contestEntryCollection *mongo.Collection,
+	entryStore EntryStore,
 ) int64 {
-	entryCount, countErr := contestEntryCollection.CountDocuments(
-		context.TODO(),
-		bson.D{{"contest_id", contestId}},
-	)
+	entryCount, countErr := entryStore.CountByContest(ctx, contestId)
 	if countErr != nil {
-		log.Println(countErr)
+		slog.ErrorContext(ctx, "Couldn't count contest entries", "error", countErr)
 		return -1
 	}
 	return entryCount
@@ -77,56 +167,130 @@ func getNumSubmissions(
 
 // Get the entries submitted to a contest
 func getContestEntries(
+	ctx context.Context,
 	contestId primitive.ObjectID,
-	contestEntryCollection *mongo.Collection,
+	entryStore EntryStore,
 ) []ContestEntry {
-	var entries []ContestEntry
-	// Fetch entries into cursor
-	cursor, err := contestEntryCollection.Find(context.TODO(), bson.D{{"contest_id", contestId}})
+	entries, err := entryStore.ListByContest(ctx, contestId)
 	if err != nil {
-		log.Println("Couldn't find contests")
-	}
-	for cursor.Next(context.TODO()) {
-		// For each entry, add to array (slice)
-		var curEntry ContestEntry
-		err := cursor.Decode(&curEntry)
-		if err != nil {
-			log.Println("Couldn't get contest")
-		}
-		entries = append(entries, curEntry)
-	}
-	if err := cursor.Err(); err != nil {
-		log.Println(err)
+		slog.ErrorContext(ctx, "Couldn't find contest entries", "error", err)
 	}
-	cursor.Close(context.TODO())
 	return entries
 }
 
-// getContestWinners(contestObjId, contestEntryCollection, contestVoteCollection)
+// Get the entries with the most votes in a contest
 func getContestWinners(
-	contestId primitive.ObjectID,
-	contestEntryCollection *mongo.Collection,
-	contestVoteCollection *mongo.Collection,
+	ctx context.Context,
+	contest Contest,
+	entryStore EntryStore,
+	voteStore VoteStore,
 ) []ContestEntry {
+	return contestWinners(getContestResults(ctx, contest, entryStore, voteStore))
+}
+
+// Get the entries tied for first place in a contest's results
+func contestWinners(results []EntryResult) []ContestEntry {
 	var winners []ContestEntry
-	entries := getContestEntries(contestId, contestEntryCollection)
-	maxVotes := 0
-
-	for _, entry := range entries {
-		votes, err := contestVoteCollection.CountDocuments(
-			context.TODO(),
-			bson.D{{"contest_id", contestId}, {"entry_id", entry.Id}},
-		)
-		if err != nil {
-			log.Println(err)
+	for _, result := range results {
+		// Results are sorted, so every entry tied with the first is a winner
+		if result.Votes != results[0].Votes {
+			break
+		}
+		winners = append(winners, result.Entry)
+	}
+	return winners
+}
+
+// Position of an entry in a contest's results, counting tied entries as sharing a place
+// Returns 0 if the entry isn't in the results
+func entryPlacement(results []EntryResult, entryId primitive.ObjectID) int {
+	for _, result := range results {
+		if result.Entry.Id != entryId {
 			continue
 		}
-		if votes > int64(maxVotes) {
-			maxVotes = int(votes)
-			winners = []ContestEntry{entry}
-		} else if votes == int64(maxVotes) {
-			winners = append(winners, entry)
+		placement := 1
+		for _, other := range results {
+			if other.Votes > result.Votes {
+				placement++
+			}
+		}
+		return placement
+	}
+	return 0
+}
+
+// Format of datetime-local form inputs
+const deadlineInputLayout = "2006-01-02T15:04"
+
+// Parse the optional submission and voting deadlines from the create contest form
+// datetime-local inputs have no timezone, so the form sends the browser's IANA timezone
+// name along with them. Without one the deadlines are taken as UTC
+func parseContestDeadlines(
+	submissionEndValue string,
+	votingEndValue string,
+	timezone string,
+	now time.Time,
+) (*time.Time, *time.Time, error) {
+	location := time.UTC
+	if timezone != "" && timezone != "Local" {
+		loaded, err := time.LoadLocation(timezone)
+		if err != nil {
+			return nil, nil, errors.New("Unknown timezone " + timezone)
+		}
+		location = loaded
+	}
+	var submissionEnd, votingEnd *time.Time
+	if submissionEndValue != "" {
+		parsed, err := time.ParseInLocation(deadlineInputLayout, submissionEndValue, location)
+		if err != nil {
+			return nil, nil, errors.New("Submission deadline is not a valid date")
+		}
+		submissionEnd = &parsed
+	}
+	if votingEndValue != "" {
+		parsed, err := time.ParseInLocation(deadlineInputLayout, votingEndValue, location)
+		if err != nil {
+			return nil, nil, errors.New("Voting deadline is not a valid date")
 		}
+		votingEnd = &parsed
+	}
+	if err := validateContestDeadlines(submissionEnd, votingEnd, now); err != nil {
+		return nil, nil, err
 	}
-	return winners;
+	return submissionEnd, votingEnd, nil
 }
+
+// Check that optional deadlines are in the future and in order
+func validateContestDeadlines(submissionEnd *time.Time, votingEnd *time.Time, now time.Time) error {
+	if submissionEnd != nil && !submissionEnd.After(now) {
+		return errors.New("Submission deadline must be in the future")
+	}
+	if votingEnd != nil && !votingEnd.After(now) {
+		return errors.New("Voting deadline must be in the future")
+	}
+	if submissionEnd != nil && votingEnd != nil && !votingEnd.After(*submissionEnd) {
+		return errors.New("Voting deadline must be after the submission deadline")
+	}
+	return nil
+}
+
+// Check if an optional deadline has passed
+func deadlinePassed(deadline *time.Time, now time.Time) bool {
+	return deadline != nil && !now.Before(*deadline)
+}
+
+// Get the state a contest should be in once its deadlines are applied
+// Contests with no entries when submissions close skip voting and conclude
+func scheduledState(contest Contest, entryCount int64, now time.Time) int {
+	state := contest.State
+	if state == OPEN && deadlinePassed(contest.SubmissionEnd, now) {
+		if entryCount == 0 {
+			return CONCLUDED
+		}
+		state = VOTING
+	}
+	if state == VOTING && deadlinePassed(contest.VotingEnd, now) {
+		state = CONCLUDED
+	}
+	return state
+}
\ No newline at end of file
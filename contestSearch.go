@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Searching, filtering and paging through contest lists
+// Pages are fetched with an opaque cursor naming the last contest of the previous page,
+// so contests created while paging don't shift later pages
+
+// Sort orders for contest lists
+const (
+	SORT_NEWEST = "newest"
+	SORT_MOST_ENTRIES = "entries"
+	// Only contests with an upcoming deadline, soonest first
+	SORT_ENDING_SOON = "ending"
+)
+
+var contestSorts = []string{SORT_NEWEST, SORT_MOST_ENTRIES, SORT_ENDING_SOON}
+
+const (
+	defaultContestPageSize = 24
+	maxContestPageSize = 100
+)
+
+// Filters, sort order and page for listing contests
+type ContestQuery struct {
+	// Only contests in this state, any state if nil
+	State *int
+	// Words to match against contest names and descriptions
+	Search string
+	// Username of the contest owner
+	OwnerName string
+	// Set from OwnerName by searchContests, stores filter on this
+	OwnerId *primitive.ObjectID
+	// Slug of the community hosting the contests
+	CommunitySlug string
+	// Set from CommunitySlug by searchContests, stores filter on this
+	CommunityId *primitive.ObjectID
+	Sort string
+	// Only contests after this position in the sort order
+	After *ContestCursor
+	Limit int
+	// Set by searchContests, stores only return contests listed for this user
+	ViewerId primitive.ObjectID
+	// Invite-only contests the viewer is a participant in
+	MemberOf []primitive.ObjectID
+	// Communities the viewer is a member of
+	Communities []primitive.ObjectID
+}
+
+// Position of a contest in a sorted list
+type ContestCursor struct {
+	Sort string `json:"s"`
+	Id primitive.ObjectID `json:"id"`
+	EntryCount int64 `json:"n,omitempty"`
+	Deadline *time.Time `json:"d,omitempty"`
+}
+
+// One page of a contest list
+type ContestPage struct {
+	Contests []Contest
+	// Empty on the last page
+	NextCursor string
+}
+
+// Read contest list query parameters: state, q, owner, community, sort, cursor and limit
+func parseContestQuery(params url.Values) (ContestQuery, error) {
+	query := ContestQuery{
+		Search: strings.TrimSpace(params.Get("q")),
+		OwnerName: strings.TrimSpace(params.Get("owner")),
+		CommunitySlug: strings.TrimSpace(params.Get("community")),
+		Sort: SORT_NEWEST,
+		Limit: defaultContestPageSize,
+	}
+	if stateName := params.Get("state"); stateName != "" {
+		state, ok := parseContestState(stateName)
+		if !ok {
+			return ContestQuery{}, badRequestError("State must be one of open, voting or concluded")
+		}
+		query.State = &state
+	}
+	if sortOrder := params.Get("sort"); sortOrder != "" {
+		if !isContestSort(sortOrder) {
+			return ContestQuery{}, badRequestError("Sort must be one of " + strings.Join(contestSorts, ", "))
+		}
+		query.Sort = sortOrder
+	}
+	if limit := params.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 || n > maxContestPageSize {
+			return ContestQuery{}, badRequestError("Limit must be a number from 1 to " + strconv.Itoa(maxContestPageSize))
+		}
+		query.Limit = n
+	}
+	if cursor := params.Get("cursor"); cursor != "" {
+		after, err := decodeContestCursor(cursor)
+		if err != nil || after.Sort != query.Sort {
+			return ContestQuery{}, badRequestError("Invalid cursor, start again from the first page")
+		}
+		query.After = &after
+	}
+	return query, nil
+}
+
+// Get one page of the contests listed for a viewer that match a query
+func searchContests(
+	ctx context.Context,
+	viewerId primitive.ObjectID,
+	query ContestQuery,
+	userStore UserStore,
+	contestStore ContestStore,
+	communityStore CommunityStore,
+	participantStore ParticipantStore,
+	memberStore CommunityMemberStore,
+) (ContestPage, error) {
+	memberOf, err := participantStore.ListContestIds(ctx, viewerId)
+	if err != nil {
+		return ContestPage{}, err
+	}
+	communities, err := listCommunityIds(ctx, viewerId, memberStore)
+	if err != nil {
+		return ContestPage{}, err
+	}
+	query.ViewerId = viewerId
+	query.MemberOf = memberOf
+	query.Communities = communities
+	if query.CommunitySlug != "" {
+		community, err := communityStore.GetBySlug(ctx, query.CommunitySlug)
+		if err == ErrNotFound {
+			return ContestPage{Contests: []Contest{}}, nil
+		}
+		if err != nil {
+			return ContestPage{}, err
+		}
+		query.CommunityId = &community.Id
+	}
+	if query.OwnerName != "" {
+		owner, err := userStore.GetByUsername(ctx, query.OwnerName)
+		if err == ErrNotFound {
+			return ContestPage{Contests: []Contest{}}, nil
+		}
+		if err != nil {
+			return ContestPage{}, err
+		}
+		query.OwnerId = &owner.Id
+	}
+	// Fetch one extra contest to find out if there is another page
+	limit := query.Limit
+	query.Limit = limit + 1
+	contests, err := contestStore.Search(ctx, query)
+	if err != nil {
+		return ContestPage{}, err
+	}
+	page := ContestPage{Contests: contests}
+	if len(contests) > limit {
+		page.Contests = contests[:limit]
+		page.NextCursor = encodeContestCursor(contestCursor(query.Sort, contests[limit - 1]))
+	}
+	return page, nil
+}
+
+// *******
+// Helpers
+// *******
+
+// Accepts the API's state names in any case
+func parseContestState(name string) (int, bool) {
+	for state, stateName := range apiStateNames {
+		if strings.EqualFold(name, stateName) {
+			return state, true
+		}
+	}
+	return 0, false
+}
+
+func isContestSort(sortOrder string) bool {
+	for _, contestSort := range contestSorts {
+		if sortOrder == contestSort {
+			return true
+		}
+	}
+	return false
+}
+
+func contestCursor(sortOrder string, contest Contest) ContestCursor {
+	cursor := ContestCursor{Sort: sortOrder, Id: contest.Id}
+	switch sortOrder {
+	case SORT_MOST_ENTRIES:
+		cursor.EntryCount = contest.EntryCount
+	case SORT_ENDING_SOON:
+		cursor.Deadline = contest.CurrentDeadline()
+	}
+	return cursor
+}
+
+// Whether a comes before b in a sort order, contests with the same sort value are ordered by ID
+func contestCursorLess(sortOrder string, a ContestCursor, b ContestCursor) bool {
+	switch sortOrder {
+	case SORT_MOST_ENTRIES:
+		if a.EntryCount != b.EntryCount {
+			return a.EntryCount > b.EntryCount
+		}
+	case SORT_ENDING_SOON:
+		if !a.Deadline.Equal(*b.Deadline) {
+			return a.Deadline.Before(*b.Deadline)
+		}
+		return a.Id.Hex() < b.Id.Hex()
+	}
+	// Newest first
+	return a.Id.Hex() > b.Id.Hex()
+}
+
+func encodeContestCursor(cursor ContestCursor) string {
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeContestCursor(value string) (ContestCursor, error) {
+	var cursor ContestCursor
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return cursor, err
+	}
+	if err := json.Unmarshal(data, &cursor); err != nil {
+		return cursor, err
+	}
+	if cursor.Sort == SORT_ENDING_SOON && cursor.Deadline == nil {
+		return cursor, badRequestError("Cursor is missing a deadline")
+	}
+	return cursor, nil
+}
+
+// Link to the next page of a list, keeping the other query parameters
+func nextPageUrl(path string, params url.Values, cursor string) string {
+	next := url.Values{}
+	for key, values := range params {
+		next[key] = values
+	}
+	next.Set("cursor", cursor)
+	return path + "?" + next.Encode()
+}
+
+// Rough match for the in-memory store, Mongo's text index also matches other forms of each word
+func matchesSearch(contest Contest, search string) bool {
+	text := strings.ToLower(contest.Name + " " + contest.Description)
+	for _, word := range strings.Fields(strings.ToLower(search)) {
+		if strings.Contains(text, word) {
+			return true
+		}
+	}
+	return false
+}
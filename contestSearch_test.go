@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Store a contest directly, with its deadline and entry count already set
+func (a *testApp) addContest(t *testing.T, name string, owner string, state int, deadline *time.Time, entryCount int64) Contest {
+	user, err := a.users.GetByUsername(context.TODO(), owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contest := Contest{
+		Id: primitive.NewObjectID(),
+		Name: name,
+		Description: "A contest about " + strings.ToLower(name),
+		State: state,
+		OwnerId: user.Id,
+		OwnerName: owner,
+		TimeCreated: time.Now(),
+		EntryCount: entryCount,
+	}
+	if state == OPEN {
+		contest.SubmissionEnd = deadline
+	} else {
+		contest.VotingEnd = deadline
+	}
+	if err := a.contests.Create(context.TODO(), contest); err != nil {
+		t.Fatal(err)
+	}
+	return contest
+}
+
+// Names of the contests in an API list, and the link to the next page
+func (a *testApp) listContests(t *testing.T, path string, cookies []*http.Cookie) ([]string, string) {
+	var contests []APIContest
+	rec := a.apiCall(t, "GET", path, nil, cookies, &contests)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Listing %v failed with %v", path, rec.Body.String())
+	}
+	var names []string
+	for _, contest := range contests {
+		names = append(names, contest.Name)
+	}
+	next := rec.Header().Get("Link")
+	next = strings.TrimPrefix(strings.TrimSuffix(next, `>; rel="next"`), "</api/v1")
+	return names, next
+}
+
+func TestParseContestQuery(t *testing.T){
+	query, err := parseContestQuery(url.Values{"state": {"VOTING"}, "q": {" sunset "}, "limit": {"5"}})
+	if err != nil || *query.State != VOTING || query.Search != "sunset" || query.Limit != 5 || query.Sort != SORT_NEWEST {
+		t.Errorf("Unexpected query %+v %v", query, err)
+	}
+	cursor := encodeContestCursor(ContestCursor{Sort: SORT_NEWEST, Id: primitive.NewObjectID()})
+	invalid := []url.Values{
+		{"state": {"closed"}},
+		{"sort": {"oldest"}},
+		{"limit": {"0"}},
+		{"limit": {"1000"}},
+		{"cursor": {"nope"}},
+		// Cursors only work with the sort they came from
+		{"cursor": {cursor}, "sort": {SORT_MOST_ENTRIES}},
+	}
+	for _, params := range invalid {
+		if _, err := parseContestQuery(params); errorStatus(err) != http.StatusBadRequest {
+			t.Errorf("%v should be a bad request, got %v", params, err)
+		}
+	}
+}
+
+func TestContestSearchFilters(t *testing.T){
+	app := newTestApp(t)
+	cookies := app.login(t, "bill")
+	app.login(t, "ted")
+	app.addContest(t, "Sunsets", "bill", OPEN, nil, 0)
+	app.addContest(t, "Mountains", "bill", VOTING, nil, 0)
+	app.addContest(t, "Sunrise Over Mountains", "ted", CONCLUDED, nil, 0)
+
+	tests := map[string][]string{
+		"/contests": {"Sunrise Over Mountains", "Mountains", "Sunsets"},
+		"/contests?state=voting": {"Mountains"},
+		"/contests?q=mountains": {"Sunrise Over Mountains", "Mountains"},
+		"/contests?q=mountains&owner=bill": {"Mountains"},
+		"/contests?owner=nobody": nil,
+	}
+	for path, expected := range tests {
+		names, _ := app.listContests(t, path, cookies)
+		if strings.Join(names, ",") != strings.Join(expected, ",") {
+			t.Errorf("%v should list %v, got %v", path, expected, names)
+		}
+	}
+
+	body := app.get("/contests?q=sunsets", cookies).Body.String()
+	if !strings.Contains(body, "Sunsets") || strings.Contains(body, "Mountains") {
+		t.Error("Contest page should only list matching contests")
+	}
+	if !strings.Contains(body, `value="sunsets"`) {
+		t.Error("Search form should keep the search")
+	}
+	if rec := app.get("/contests?sort=oldest", cookies); rec.Code != http.StatusBadRequest {
+		t.Errorf("Invalid sort should be a bad request, got %v", rec.Code)
+	}
+}
+
+func TestContestSortAndPages(t *testing.T){
+	app := newTestApp(t)
+	cookies := app.login(t, "bill")
+	soon := time.Now().Add(time.Hour)
+	later := time.Now().Add(48 * time.Hour)
+	app.addContest(t, "A", "bill", OPEN, &later, 3)
+	app.addContest(t, "B", "bill", VOTING, &soon, 5)
+	app.addContest(t, "C", "bill", OPEN, nil, 3)
+	app.addContest(t, "D", "bill", CONCLUDED, nil, 9)
+	app.addContest(t, "E", "bill", VOTING, &later, 0)
+
+	tests := map[string]string{
+		SORT_NEWEST: "E,D,C,B,A",
+		SORT_MOST_ENTRIES: "D,B,C,A,E",
+		// Contests without a deadline are left out, tied deadlines are in creation order
+		SORT_ENDING_SOON: "B,A,E",
+	}
+	for sortOrder, expected := range tests {
+		// Page through two at a time
+		var all []string
+		next := "/contests?limit=2&sort=" + sortOrder
+		for pages := 0; next != ""; pages++ {
+			if pages > 5 {
+				t.Fatalf("Too many pages for %v", sortOrder)
+			}
+			var names []string
+			names, next = app.listContests(t, next, cookies)
+			all = append(all, names...)
+		}
+		if strings.Join(all, ",") != expected {
+			t.Errorf("Sorting by %v should list %v, got %v", sortOrder, expected, all)
+		}
+	}
+
+	body := app.get("/contests?limit=2&sort=entries", cookies).Body.String()
+	if !strings.Contains(body, "Next Page") || strings.Contains(body, "First Page") {
+		t.Error("First page should link to the next page")
+	}
+}
+
+func TestEntryCountUpdated(t *testing.T){
+	app := newTestApp(t)
+	contest := app.createContest(t, app.login(t, "bill"))
+	app.submitEntry(contest, app.login(t, "ted"))
+	if updated, _ := app.contests.Get(context.TODO(), contest.Id); updated.EntryCount != 1 {
+		t.Errorf("Submitting should count the entry, got %v", updated.EntryCount)
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"html/template"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/sessions"
+)
+
+// Cross-site request forgery protection
+// Each session gets a random token that every form posts back in a hidden field,
+// which another site can't read, so it can't make a logged in user's browser post a form.
+// JSON API clients using the session cookie send it in the X-CSRF-Token header,
+// they get it from the login response or GET /api/v1/auth/me
+
+const (
+	csrfSessionKey = "csrfToken"
+	csrfFieldName = "csrf_token"
+	// Alternative to the form field for requests made from scripts, required by the JSON API
+	csrfHeader = "X-CSRF-Token"
+)
+
+// Methods that don't change anything, and don't need a token
+var csrfSafeMethods = map[string]bool{"GET": true, "HEAD": true, "OPTIONS": true, "TRACE": true}
+
+// Functions available to every page template
+// csrfField is replaced with the request's token when the page is rendered, see renderTemplate
+var templateFuncs = template.FuncMap{
+	"csrfField": func() (template.HTML, error) {
+		return "", errors.New("csrfField can only be used in pages rendered by renderTemplate")
+	},
+}
+
+// Return the session's CSRF token, creating one if the session doesn't have one yet
+// Must be called before the response status is written, as a new token is saved in the session cookie
+func getCSRFToken(w http.ResponseWriter, r *http.Request, s *sessions.CookieStore) (string, error) {
+	session, _ := s.Get(r, "session")
+	if token, ok := session.Values[csrfSessionKey].(string); ok && token != "" {
+		return token, nil
+	}
+	token, err := newCSRFToken()
+	if err != nil {
+		return "", err
+	}
+	session.Values[csrfSessionKey] = token
+	return token, session.Save(r, w)
+}
+
+func newCSRFToken() (string, error) {
+	data := make([]byte, 32)
+	if _, err := rand.Read(data); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// Check a state-changing request carries the session's CSRF token
+func checkCSRFToken(r *http.Request, s *sessions.CookieStore) error {
+	session, _ := s.Get(r, "session")
+	expected, _ := session.Values[csrfSessionKey].(string)
+	if expected == "" {
+		return forbiddenError("Your session has expired, please go back, reload the page and try again")
+	}
+	token := r.Header.Get(csrfHeader)
+	if token == "" {
+		// Parse uploads with the same memory limit as the upload handlers
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+			r.ParseMultipartForm(maxUploadSize)
+		}
+		token = r.PostFormValue(csrfFieldName)
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(expected)) != 1 {
+		return forbiddenError("This form has expired, please go back, reload the page and try again")
+	}
+	return nil
+}
+
+// Check a state-changing JSON API request carries the session's CSRF token in the header
+func checkAPICSRFToken(r *http.Request, s *sessions.CookieStore) error {
+	session, _ := s.Get(r, "session")
+	expected, _ := session.Values[csrfSessionKey].(string)
+	token := r.Header.Get(csrfHeader)
+	if expected == "" || subtle.ConstantTimeCompare([]byte(token), []byte(expected)) != 1 {
+		return forbiddenError("Send the csrfToken from GET /api/v1/auth/me in the " + csrfHeader + " header")
+	}
+	return nil
+}
+
+// Reject state-changing requests made with the session cookie without the session's CSRF token
+// Requests authenticated with an access token aren't sent by browsers automatically, so don't need one.
+// JSON API requests without a session, like logging in, have no user to act for
+func csrfMiddleware(s *sessions.CookieStore, tmplMap map[string]*template.Template) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if csrfSafeMethods[r.Method] {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if _, ok := getRequestToken(r); ok {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if strings.HasPrefix(r.URL.Path, "/api/") {
+				if _, ok := getRequestSession(r); !ok {
+					next.ServeHTTP(w, r)
+					return
+				}
+				if err := checkAPICSRFToken(r, s); err != nil {
+					writeAPIError(w, r, err)
+					return
+				}
+				next.ServeHTTP(w, r)
+				return
+			}
+			if err := checkCSRFToken(r, s); err != nil {
+				logRequestError(r.Context(), "CSRF check failed", err)
+				renderError(w, r, s, tmplMap, err, "/")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Render a page template with the given status code
+// Forms in the page get the session's CSRF token from {{csrfField}}
+func renderTemplate(
+	w http.ResponseWriter,
+	r *http.Request,
+	s *sessions.CookieStore,
+	tmpl *template.Template,
+	status int,
+	data interface{},
+) {
+	token, err := getCSRFToken(w, r, s)
+	if err != nil {
+		logRequestError(r.Context(), "Couldn't create CSRF token", err)
+	}
+	// Templates are cloned so each request's token is only seen by its own page
+	page, err := tmpl.Clone()
+	if err != nil {
+		logRequestError(r.Context(), "Couldn't clone template", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	page.Funcs(template.FuncMap{
+		"csrfField": func() template.HTML {
+			return template.HTML(`<input type="hidden" name="` + csrfFieldName + `" value="` + template.HTMLEscapeString(token) + `">`)
+		},
+	})
+	w.WriteHeader(status)
+	if err := page.ExecuteTemplate(w, "base", data); err != nil {
+		logRequestError(r.Context(), "Couldn't render template", err)
+	}
+}
+
+// Create the session cookie store
+// SameSite=Lax also stops browsers sending the session cookie with posts from other sites
+func newSessionStore(secretKey string) *sessions.CookieStore {
+	store := sessions.NewCookieStore([]byte(secretKey))
+	store.Options.HttpOnly = true
+	store.Options.SameSite = http.SameSiteLaxMode
+	store.Options.MaxAge = int(sessionMaxAge.Seconds())
+	return store
+}
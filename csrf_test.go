@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestFormsIncludeCSRFToken(t *testing.T){
+	app := newTestApp(t)
+	cookies := app.login(t, "bill")
+	contest := app.createContest(t, cookies)
+	token := app.csrfToken(cookies)
+	if token == "" {
+		t.Fatal("Logged in session should have a CSRF token")
+	}
+	field := `<input type="hidden" name="csrf_token" value="` + token + `">`
+	for _, path := range []string{"/contests", "/create-contest", "/contests/" + contest.GetStringId(), "/account/tokens"} {
+		body := app.get(path, cookies).Body.String()
+		if strings.Count(body, `method="POST"`) != strings.Count(body, field) {
+			t.Errorf("Every post form on %v should include the CSRF token", path)
+		}
+	}
+	for _, cookie := range cookies {
+		if cookie.Name == "session" && cookie.SameSite != http.SameSiteLaxMode {
+			t.Errorf("Session cookie should be SameSite=Lax, got %v", cookie.SameSite)
+		}
+	}
+}
+
+func TestCSRFRejected(t *testing.T){
+	app := newTestApp(t)
+	owner := app.login(t, "bill")
+	contest := app.createContest(t, owner)
+	app.submitEntry(contest, app.login(t, "alice"))
+	stateUrl := "/contests/" + contest.GetStringId() + "/start-vote"
+
+	// A form posted from another site has no token, or one for a different session
+	for _, token := range []string{"", app.csrfToken(app.visit("/login"))} {
+		req := httptest.NewRequest("POST", stateUrl, strings.NewReader(url.Values{csrfFieldName: {token}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if rec := app.do(req, owner); rec.Code != http.StatusForbidden {
+			t.Errorf("Post with token %q should be forbidden, got %v", token, rec.Code)
+		}
+	}
+	if app.contestState(t, contest) != OPEN {
+		t.Fatal("Forged request should not change the contest")
+	}
+
+	// Scripts can send the token in a header instead
+	req := httptest.NewRequest("POST", stateUrl, nil)
+	req.Header.Set(csrfHeader, app.csrfToken(owner))
+	if rec := app.do(req, owner); rec.Code != http.StatusFound || app.contestState(t, contest) != VOTING {
+		t.Errorf("Post with the token header should be accepted, got %v", rec.Code)
+	}
+
+	// Logging out needs a token too, so other sites can't log users out
+	req = httptest.NewRequest("POST", "/logout", nil)
+	if rec := app.do(req, owner); rec.Code != http.StatusForbidden {
+		t.Errorf("Logout without a token should be forbidden, got %v", rec.Code)
+	}
+}
+
+func TestAPICSRF(t *testing.T){
+	app := newTestApp(t)
+	credentials := APICredentials{"bill", "password"}
+	app.apiCall(t, "POST", "/auth/signup", credentials, nil, nil)
+	var user APISessionUser
+	rec := app.apiCall(t, "POST", "/auth/login", credentials, nil, &user)
+	owner := rec.Result().Cookies()
+	if user.CSRFToken == "" || user.CSRFToken != app.csrfToken(owner) {
+		t.Fatalf("Login should return the session's CSRF token, got %+v", user)
+	}
+	var me APISessionUser
+	app.apiCall(t, "GET", "/auth/me", nil, owner, &me)
+	if me.CSRFToken != user.CSRFToken {
+		t.Errorf("Current user should include the CSRF token, got %+v", me)
+	}
+
+	// Another site can send the session cookie, but can't read the token
+	for _, token := range []string{"", app.csrfToken(app.visit("/login"))} {
+		req := newAPIRequest("POST", "/contests", APINewContest{Name: "Forged"})
+		req.Header.Set(csrfHeader, token)
+		expectAPIError(t, app.do(req, owner), http.StatusForbidden)
+	}
+	req := newAPIRequest("POST", "/contests", APINewContest{Name: "Sunsets"})
+	req.Header.Set(csrfHeader, user.CSRFToken)
+	if rec := app.do(req, owner); rec.Code != http.StatusCreated {
+		t.Errorf("Post with the token header should be accepted, got %v", rec.Code)
+	}
+}
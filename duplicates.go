@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"image"
+	"log/slog"
+	"math/bits"
+	"sort"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"golang.org/x/image/draw"
+)
+
+// Perceptual hashes stay almost the same when a photo is resized, re-encoded
+// or slightly edited, so they catch the same photo being entered twice
+
+// Images whose hashes differ in at most this many bits are treated as the same photo
+const duplicateHashDistance = 6
+
+// Hashes are split into this many 8 bit bands to look up similar images
+// Two hashes that differ in fewer bits than there are bands share at least one band
+const imageHashBandCount = 8
+
+// Difference hash of an image: shrink it to 9x8 grayscale pixels and set a bit
+// for each pixel that is brighter than the one to its right
+// Returned as an int64 since BSON has no unsigned integers
+func imageHash(img image.Image) int64 {
+	small := image.NewGray(image.Rect(0, 0, 9, 8))
+	draw.CatmullRom.Scale(small, small.Bounds(), img, img.Bounds(), draw.Src, nil)
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			hash <<= 1
+			if small.GrayAt(x, y).Y > small.GrayAt(x + 1, y).Y {
+				hash |= 1
+			}
+		}
+	}
+	return int64(hash)
+}
+
+// Number of bits that differ between two image hashes
+func imageHashDistance(a int64, b int64) int {
+	return bits.OnesCount64(uint64(a ^ b))
+}
+
+// Split a hash into bands tagged with their position, so that
+// band 2 with the value 0xAB is stored as 0x2AB
+func imageHashBands(hash int64) []int32 {
+	bands := make([]int32, imageHashBandCount)
+	for i := range bands {
+		bands[i] = int32(i << 8) | int32(uint64(hash) >> (8 * i) & 0xFF)
+	}
+	return bands
+}
+
+// Check a new image doesn't look the same as an entry already in the contest
+func checkNotDuplicate(hash int64, entries []ContestEntry) error {
+	for _, entry := range entries {
+		if entry.HasImageHash() && imageHashDistance(entry.ImageHash, hash) <= duplicateHashDistance {
+			return badRequestError("This photo looks the same as an entry already in this contest, please choose a different one")
+		}
+	}
+	return nil
+}
+
+// Find entries in any contest whose image looks the same as an entry in this contest
+// Only the contest owner may see the report, and it only includes entries they could see elsewhere
+func getDuplicateReport(
+	ctx context.Context,
+	userId primitive.ObjectID,
+	contest Contest,
+	contestStore ContestStore,
+	entryStore EntryStore,
+	participantStore ParticipantStore,
+	memberStore CommunityMemberStore,
+) ([]DuplicateMatch, error) {
+	err := authorizeContest(ctx, userId, contest, PERM_MANAGE_ANY_CONTEST, "see possible duplicates", memberStore)
+	if err != nil {
+		return nil, err
+	}
+	matches := []DuplicateMatch{}
+	contests := map[primitive.ObjectID]Contest{contest.Id: contest}
+	// Contests whose matching entries are left out of the report
+	hidden := map[primitive.ObjectID]bool{}
+	for _, entry := range getContestEntries(ctx, contest.Id, entryStore) {
+		if !entry.HasImageHash() {
+			continue
+		}
+		similar, err := entryStore.ListSimilarImages(ctx, entry.ImageHash, duplicateHashDistance)
+		if err != nil {
+			return nil, err
+		}
+		for _, match := range similar {
+			// Report each pair within this contest once
+			if match.Id == entry.Id || (match.ContestID == contest.Id && match.Id.Hex() < entry.Id.Hex()) {
+				continue
+			}
+			matchContest, ok := contests[match.ContestID]
+			if !ok {
+				matchContest, err = contestStore.Get(ctx, match.ContestID)
+				if err == ErrNotFound {
+					// Entries can outlive a deleted contest, there's nothing to link them to
+					slog.WarnContext(ctx, "Couldn't find contest for matching entry", "match_contest_id", match.ContestID.Hex())
+					hidden[match.ContestID] = true
+				} else if err != nil {
+					return nil, err
+				} else {
+					// Entries in invite-only contests the owner isn't in stay private, and so do entries in
+					// contests still taking submissions, which the contest page hides until voting starts
+					hidden[match.ContestID] = checkContestAccess(ctx, userId, matchContest, participantStore, memberStore) != nil ||
+						(matchContest.IsOpen() && !canActOnContest(ctx, userId, matchContest, PERM_MANAGE_ANY_CONTEST, memberStore))
+				}
+				contests[match.ContestID] = matchContest
+			}
+			if hidden[match.ContestID] {
+				continue
+			}
+			matches = append(matches, DuplicateMatch{
+				Entry: entry,
+				Match: match,
+				MatchContest: matchContest,
+				Distance: imageHashDistance(entry.ImageHash, match.ImageHash),
+			})
+		}
+	}
+	// Closest matches first
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].Distance < matches[j].Distance
+	})
+	return matches, nil
+}
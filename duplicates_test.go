@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image/jpeg"
+	"net/http"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Encode the pattern for seed as a JPEG, like a re-saved copy of a photo
+func createPatternJPEG(seed int64, width int, height int) []byte {
+	var buf bytes.Buffer
+	jpeg.Encode(&buf, createPatternImage(seed, width, height), &jpeg.Options{Quality: 70})
+	return buf.Bytes()
+}
+
+func TestImageHash(t *testing.T){
+	original := imageHash(createPatternImage(-1, 1200, 800))
+	resized, _, err := decodeUpload(createPatternJPEG(-1, 300, 200))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if distance := imageHashDistance(original, imageHash(resized)); distance > duplicateHashDistance {
+		t.Errorf("Resized copy should match, got distance %v", distance)
+	}
+	if distance := imageHashDistance(original, imageHash(createPatternImage(-2, 1200, 800))); distance <= duplicateHashDistance {
+		t.Errorf("Different images should not match, got distance %v", distance)
+	}
+}
+
+func TestImageHashBands(t *testing.T){
+	hash := imageHash(createPatternImage(-1, 100, 100))
+	// Flip one bit in all but the last band
+	similar := hash ^ 0x0001010101010101
+	shared := 0
+	bands := imageHashBands(similar)
+	for i, band := range imageHashBands(hash) {
+		if band == bands[i] {
+			shared++
+		}
+	}
+	if imageHashDistance(hash, similar) != 7 || shared != 1 {
+		t.Errorf("Hashes 7 bits apart should share one band, got %v", shared)
+	}
+}
+
+func TestDuplicateEntries(t *testing.T){
+	app := newTestApp(t)
+	owner := app.login(t, "bill")
+	alice := app.login(t, "alice")
+	bob := app.login(t, "bob")
+	contest := app.createContest(t, owner)
+	otherContest := app.createContest(t, owner)
+
+	if rec := app.submitImage(contest, "photo.jpg", createPatternJPEG(-1, 1200, 800), alice); rec.Code != http.StatusFound {
+		t.Fatalf("Submission should redirect, got %v", rec.Code)
+	}
+	rec := app.submitImage(contest, "copy.jpg", createPatternJPEG(-1, 600, 400), bob)
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "looks the same as an entry already in this contest") {
+		t.Errorf("Copy of an entry should be rejected, got %v", rec.Code)
+	}
+	if count, _ := app.entries.CountByContest(context.TODO(), contest.Id); count != 1 {
+		t.Errorf("Rejected copy should not be saved, got %v entries", count)
+	}
+
+	// The same photo can be entered in another contest, but shows up in the report
+	if rec := app.submitImage(otherContest, "copy.jpg", createPatternJPEG(-1, 600, 400), bob); rec.Code != http.StatusFound {
+		t.Fatalf("Copy in another contest should be accepted, got %v", rec.Code)
+	}
+	app.submitEntry(otherContest, alice)
+	// An entry left behind by a deleted contest isn't reported
+	orphan := getContestEntries(context.TODO(), contest.Id, app.entries)[0]
+	orphan.Id = primitive.NewObjectID()
+	orphan.ContestID = primitive.NewObjectID()
+	app.entries.Create(context.TODO(), orphan)
+
+	var matches []APIDuplicateMatch
+	rec = app.apiCall(t, "GET", "/contests/" + otherContest.GetStringId() + "/duplicates", nil, owner, &matches)
+	if rec.Code != http.StatusOK || len(matches) != 1 {
+		t.Fatalf("Expected one possible duplicate, got %v %+v", rec.Code, matches)
+	}
+	if matches[0].Entry.OwnerName != "bob" || matches[0].Match.OwnerName != "alice" || matches[0].MatchContest.Id != contest.GetStringId() {
+		t.Errorf("Unexpected match %+v", matches[0])
+	}
+
+	body := app.get("/contests/" + contest.GetStringId() + "/duplicates", owner).Body.String()
+	if !strings.Contains(body, "/contests/" + otherContest.GetStringId()) {
+		t.Error("Report should link to the contest with the matching entry")
+	}
+	if rec := app.get("/contests/" + contest.GetStringId() + "/duplicates", alice); rec.Code != http.StatusForbidden {
+		t.Errorf("Only the contest owner should see the report, got %v", rec.Code)
+	}
+
+	// Entries in someone else's contest stay hidden until its voting starts
+	rufus := app.login(t, "rufus")
+	rivalContest := app.createContest(t, rufus)
+	app.submitImage(rivalContest, "copy.jpg", createPatternJPEG(-1, 600, 400), alice)
+	app.apiCall(t, "GET", "/contests/" + otherContest.GetStringId() + "/duplicates", nil, owner, &matches)
+	if len(matches) != 1 {
+		t.Errorf("Entries in open contests should not be reported, got %+v", matches)
+	}
+	app.changeState(rivalContest, "start-vote", rufus)
+	app.apiCall(t, "GET", "/contests/" + otherContest.GetStringId() + "/duplicates", nil, owner, &matches)
+	if len(matches) != 2 || matches[0].MatchContest.Id != rivalContest.GetStringId() {
+		t.Errorf("Entries should be reported once voting starts, got %+v", matches)
+	}
+}
@@ -0,0 +1,476 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/sessions"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Test server backed by in-memory stores
+type testApp struct {
+	router *mux.Router
+	sessions *sessions.CookieStore
+	users *MemoryUserStore
+	contests *MemoryContestStore
+	entries *MemoryEntryStore
+	votes *MemoryVoteStore
+	tokens *MemoryTokenStore
+	loginAttempts *MemoryLoginAttemptStore
+	userSessions *MemorySessionStore
+	participants *MemoryParticipantStore
+	invites *MemoryInviteStore
+	communities *MemoryCommunityStore
+	members *MemoryCommunityMemberStore
+	blobs BlobStore
+	health *HealthChecker
+	imageDir string
+}
+
+// Test server storing images in a temporary directory
+func newTestApp(t *testing.T) *testApp {
+	imageDir := t.TempDir()
+	blobStore, err := NewLocalBlobStore(imageDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := newTestAppWithBlobs(t, blobStore)
+	app.imageDir = imageDir
+	return app
+}
+
+func newTestAppWithBlobs(t *testing.T, blobStore BlobStore) *testApp {
+	// Keep password hashing fast in tests
+	defaultCost := passwordHashCost
+	passwordHashCost = bcrypt.MinCost
+	t.Cleanup(func() { passwordHashCost = defaultCost })
+
+	app := &testApp{
+		users: NewMemoryUserStore(),
+		contests: NewMemoryContestStore(),
+		entries: NewMemoryEntryStore(),
+		votes: NewMemoryVoteStore(),
+		tokens: NewMemoryTokenStore(),
+		loginAttempts: NewMemoryLoginAttemptStore(),
+		userSessions: NewMemorySessionStore(),
+		participants: NewMemoryParticipantStore(),
+		invites: NewMemoryInviteStore(),
+		communities: NewMemoryCommunityStore(),
+		members: NewMemoryCommunityMemberStore(),
+		blobs: blobStore,
+		health: NewHealthChecker(),
+		sessions: newSessionStore("test secret"),
+	}
+	app.router = newRouter(
+		app.sessions,
+		loadTemplates(),
+		app.users,
+		app.contests,
+		app.entries,
+		app.votes,
+		app.tokens,
+		app.loginAttempts,
+		app.userSessions,
+		app.participants,
+		app.invites,
+		app.communities,
+		app.members,
+		app.blobs,
+		app.health,
+	)
+	return app
+}
+
+// Send a request with the given session cookies
+func (a *testApp) do(req *http.Request, cookies []*http.Cookie) *httptest.ResponseRecorder {
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+	rec := httptest.NewRecorder()
+	a.router.ServeHTTP(rec, req)
+	return rec
+}
+
+// Read the CSRF token from session cookies, as the forms on a page rendered for the session would include it
+func (a *testApp) csrfToken(cookies []*http.Cookie) string {
+	req := httptest.NewRequest("GET", "/", nil)
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+	session, _ := a.sessions.Get(req, "session")
+	token, _ := session.Values[csrfSessionKey].(string)
+	return token
+}
+
+// Post a form like a browser would from one of the site's pages, including the CSRF token
+func (a *testApp) postForm(path string, form url.Values, cookies []*http.Cookie) *httptest.ResponseRecorder {
+	form.Set(csrfFieldName, a.csrfToken(cookies))
+	req := httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return a.do(req, cookies)
+}
+
+func (a *testApp) get(path string, cookies []*http.Cookie) *httptest.ResponseRecorder {
+	return a.do(httptest.NewRequest("GET", path, nil), cookies)
+}
+
+// Load a page without logging in, returning the new session's cookies
+func (a *testApp) visit(path string) []*http.Cookie {
+	return a.get(path, nil).Result().Cookies()
+}
+
+// Sign up and log in a new user, returning their session cookies
+func (a *testApp) login(t *testing.T, username string) []*http.Cookie {
+	credentials := url.Values{"username": {username}, "password": {"password"}}
+	// Load the page first for a session with a CSRF token
+	cookies := a.visit("/signup")
+	if rec := a.postForm("/signup", credentials, cookies); rec.Header().Get("Location") != "/login" {
+		t.Fatalf("Signup for %v failed", username)
+	}
+	rec := a.postForm("/login", credentials, cookies)
+	if rec.Header().Get("Location") != "/contests" {
+		t.Fatalf("Login for %v failed", username)
+	}
+	return rec.Result().Cookies()
+}
+
+// Create a contest owned by the logged in user
+func (a *testApp) createContest(t *testing.T, cookies []*http.Cookie) Contest {
+	rec := a.postForm("/create-contest", url.Values{
+		"contestname": {"Sunsets"},
+		"contestdescription": {"Best sunset photo"},
+	}, cookies)
+	contestId := strings.TrimPrefix(rec.Header().Get("Location"), "/contests/")
+	contestObjId, err := primitive.ObjectIDFromHex(contestId)
+	if err != nil {
+		t.Fatalf("Create contest redirected to %v", rec.Header().Get("Location"))
+	}
+	contest, err := a.contests.Get(context.TODO(), contestObjId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return contest
+}
+
+func (a *testApp) submitEntry(contest Contest, cookies []*http.Cookie) *httptest.ResponseRecorder {
+	return a.submitImage(contest, "photo.png", createPNG(10, 10), cookies)
+}
+
+func (a *testApp) changeState(contest Contest, action string, cookies []*http.Cookie) *httptest.ResponseRecorder {
+	return a.postForm("/contests/" + contest.GetStringId() + "/" + action, url.Values{}, cookies)
+}
+
+func (a *testApp) vote(contest Contest, entryId string, cookies []*http.Cookie) *httptest.ResponseRecorder {
+	return a.postForm("/contests/" + contest.GetStringId() + "/vote", url.Values{"image-vote": {entryId}}, cookies)
+}
+
+func (a *testApp) contestState(t *testing.T, contest Contest) int {
+	current, err := a.contests.Get(context.TODO(), contest.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return current.State
+}
+
+// Authentication handler tests
+func TestSignupAndLogin(t *testing.T){
+	app := newTestApp(t)
+	cookies := app.login(t, "bill")
+	if rec := app.get("/contests", cookies); rec.Code != http.StatusOK {
+		t.Errorf("Logged in user should see contests, got %v", rec.Code)
+	}
+	user, err := app.users.GetByUsername(context.TODO(), "bill")
+	if err != nil || !isPasswordHash(user.Password) {
+		t.Error("User should be stored with a hashed password")
+	}
+}
+
+func TestSignupDuplicateUsername(t *testing.T){
+	app := newTestApp(t)
+	app.login(t, "bill")
+	rec := app.postForm("/signup", url.Values{"username": {"bill"}, "password": {"other"}}, app.visit("/signup"))
+	if rec.Code != http.StatusConflict || !strings.Contains(rec.Body.String(), "already taken") {
+		t.Errorf("Duplicate signup should show an error, got %v", rec.Code)
+	}
+}
+
+func TestSignupMissingPassword(t *testing.T){
+	app := newTestApp(t)
+	rec := app.postForm("/signup", url.Values{"username": {"bill"}}, app.visit("/signup"))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Signup without password should be rejected, got %v", rec.Code)
+	}
+}
+
+func TestLoginWrongPassword(t *testing.T){
+	app := newTestApp(t)
+	app.login(t, "bill")
+	rec := app.postForm("/login", url.Values{"username": {"bill"}, "password": {"wrong"}}, app.visit("/login"))
+	if rec.Code != http.StatusOK || rec.Header().Get("Location") != "" {
+		t.Error("Wrong password should render the login form again")
+	}
+}
+
+func TestLoginUpgradesPlaintextPassword(t *testing.T){
+	app := newTestApp(t)
+	app.users.Create(context.TODO(), User{primitive.NewObjectID(), "legacy", "password", UserPrivacy{}, ROLE_USER, false})
+	rec := app.postForm("/login", url.Values{"username": {"legacy"}, "password": {"password"}}, app.visit("/login"))
+	if rec.Header().Get("Location") != "/contests" {
+		t.Fatal("Legacy user should be able to log in")
+	}
+	user, _ := app.users.GetByUsername(context.TODO(), "legacy")
+	if !isPasswordHash(user.Password) {
+		t.Error("Legacy password should be rehashed on login")
+	}
+}
+
+func TestLogout(t *testing.T){
+	app := newTestApp(t)
+	cookies := app.login(t, "bill")
+	rec := app.postForm("/logout", url.Values{}, cookies)
+	if rec := app.get("/contests", rec.Result().Cookies()); rec.Header().Get("Location") != "/login" {
+		t.Error("Logged out user should be redirected to login")
+	}
+}
+
+func TestLoginRequired(t *testing.T){
+	app := newTestApp(t)
+	for _, path := range []string{"/contests", "/create-contest", "/contests/" + primitive.NewObjectID().Hex()} {
+		if rec := app.get(path, nil); rec.Header().Get("Location") != "/login" {
+			t.Errorf("%v should require login", path)
+		}
+	}
+}
+
+// Contest handler tests
+func TestCreateContest(t *testing.T){
+	app := newTestApp(t)
+	cookies := app.login(t, "bill")
+	contest := app.createContest(t, cookies)
+	if contest.OwnerName != "bill" || !contest.IsOpen() {
+		t.Error("Contest should be open and owned by creator")
+	}
+	rec := app.get("/contests", cookies)
+	if !strings.Contains(rec.Body.String(), "Sunsets") {
+		t.Error("Contest index should list new contest")
+	}
+	rec = app.get("/contests/" + contest.GetStringId(), cookies)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "Best sunset photo") {
+		t.Error("Contest detail should show contest")
+	}
+}
+
+func TestCreateContestInvalidDeadline(t *testing.T){
+	app := newTestApp(t)
+	cookies := app.login(t, "bill")
+	rec := app.postForm("/create-contest", url.Values{
+		"contestname": {"Sunsets"},
+		"submissionend": {time.Now().Add(-time.Hour).Format(deadlineInputLayout)},
+	}, cookies)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Deadline in the past should be rejected, got %v", rec.Code)
+	}
+	contests, _ := app.contests.List(context.TODO())
+	if len(contests) != 0 {
+		t.Error("Contest should not be created")
+	}
+}
+
+func TestSubmitEntry(t *testing.T){
+	app := newTestApp(t)
+	owner := app.login(t, "bill")
+	contest := app.createContest(t, owner)
+	entrant := app.login(t, "ted")
+	if rec := app.submitEntry(contest, entrant); rec.Code != http.StatusFound {
+		t.Fatalf("Submission should redirect, got %v", rec.Code)
+	}
+	entries, _ := app.entries.ListByContest(context.TODO(), contest.Id)
+	if len(entries) != 1 || entries[0].OwnerName != "ted" {
+		t.Fatal("Entry should be stored")
+	}
+	imageName := strings.TrimPrefix(entries[0].ImagePath, "/uploadedImages/")
+	if _, err := os.Stat(filepath.Join(app.imageDir, imageName)); err != nil {
+		t.Error("Image should be written to image directory")
+	}
+	if rec := app.submitEntry(contest, entrant); rec.Code != http.StatusConflict {
+		t.Errorf("Second submission should conflict, got %v", rec.Code)
+	}
+}
+
+func TestSubmitEntryClosedContest(t *testing.T){
+	app := newTestApp(t)
+	owner := app.login(t, "bill")
+	contest := app.createContest(t, owner)
+	app.submitEntry(contest, owner)
+	app.changeState(contest, "start-vote", owner)
+	entrant := app.login(t, "ted")
+	if rec := app.submitEntry(contest, entrant); rec.Code != http.StatusConflict {
+		t.Errorf("Submission to voting contest should conflict, got %v", rec.Code)
+	}
+}
+
+func TestChangeStateNotOwner(t *testing.T){
+	app := newTestApp(t)
+	owner := app.login(t, "bill")
+	contest := app.createContest(t, owner)
+	app.submitEntry(contest, owner)
+	other := app.login(t, "ted")
+	if rec := app.changeState(contest, "start-vote", other); rec.Code != http.StatusForbidden {
+		t.Errorf("Non-owner should be forbidden, got %v", rec.Code)
+	}
+	if app.contestState(t, contest) != OPEN {
+		t.Error("Contest state should not change")
+	}
+}
+
+func TestChangeStateInvalid(t *testing.T){
+	app := newTestApp(t)
+	owner := app.login(t, "bill")
+	contest := app.createContest(t, owner)
+	if rec := app.changeState(contest, "start-vote", owner); rec.Code != http.StatusConflict {
+		t.Errorf("Starting vote without entries should conflict, got %v", rec.Code)
+	}
+	app.submitEntry(contest, owner)
+	if rec := app.changeState(contest, "stop-vote", owner); rec.Code != http.StatusConflict {
+		t.Errorf("Concluding open contest should conflict, got %v", rec.Code)
+	}
+	if app.contestState(t, contest) != OPEN {
+		t.Error("Contest state should not change")
+	}
+}
+
+func TestContestLifecycle(t *testing.T){
+	app := newTestApp(t)
+	owner := app.login(t, "bill")
+	contest := app.createContest(t, owner)
+	entrant := app.login(t, "ted")
+	app.submitEntry(contest, owner)
+	app.submitEntry(contest, entrant)
+
+	if rec := app.changeState(contest, "start-vote", owner); rec.Code != http.StatusFound {
+		t.Fatalf("Owner should be able to start vote, got %v", rec.Code)
+	}
+	if app.contestState(t, contest) != VOTING {
+		t.Fatal("Contest should be voting")
+	}
+
+	entries, _ := app.entries.ListByContest(context.TODO(), contest.Id)
+	var tedEntry ContestEntry
+	for _, entry := range entries {
+		if entry.OwnerName == "ted" {
+			tedEntry = entry
+		}
+	}
+	if rec := app.vote(contest, tedEntry.GetStringId(), owner); rec.Code != http.StatusFound {
+		t.Fatalf("Vote should redirect, got %v", rec.Code)
+	}
+	if rec := app.vote(contest, tedEntry.GetStringId(), owner); rec.Code != http.StatusConflict {
+		t.Errorf("Second vote should conflict, got %v", rec.Code)
+	}
+
+	if rec := app.changeState(contest, "stop-vote", owner); rec.Code != http.StatusFound {
+		t.Fatalf("Owner should be able to conclude, got %v", rec.Code)
+	}
+	if rec := app.changeState(contest, "stop-vote", owner); rec.Code != http.StatusConflict {
+		t.Errorf("Concluding twice should conflict, got %v", rec.Code)
+	}
+	rec := app.get("/contests/" + contest.GetStringId(), owner)
+	if !strings.Contains(rec.Body.String(), `Submitted By: <a href="/users/ted">ted</a>`) {
+		t.Error("Concluded contest should show winner")
+	}
+}
+
+func TestVoteInvalidEntry(t *testing.T){
+	app := newTestApp(t)
+	owner := app.login(t, "bill")
+	contest := app.createContest(t, owner)
+	app.submitEntry(contest, owner)
+	if rec := app.vote(contest, primitive.NewObjectID().Hex(), owner); rec.Code != http.StatusConflict {
+		t.Errorf("Vote in open contest should conflict, got %v", rec.Code)
+	}
+	app.changeState(contest, "start-vote", owner)
+	if rec := app.vote(contest, primitive.NewObjectID().Hex(), owner); rec.Code != http.StatusBadRequest {
+		t.Errorf("Vote for unknown entry should be rejected, got %v", rec.Code)
+	}
+	if rec := app.vote(contest, "", owner); rec.Code != http.StatusBadRequest {
+		t.Errorf("Empty vote should be rejected, got %v", rec.Code)
+	}
+}
+
+// Stores enforce uniqueness even when handler checks are raced past
+func TestMemoryStoreUniqueness(t *testing.T){
+	users := NewMemoryUserStore()
+	users.Create(context.TODO(), User{primitive.NewObjectID(), "bill", "", UserPrivacy{}, ROLE_USER, false})
+	if users.Create(context.TODO(), User{primitive.NewObjectID(), "bill", "", UserPrivacy{}, ROLE_USER, false}) != ErrDuplicate {
+		t.Error("Duplicate username should be rejected")
+	}
+
+	contestId := primitive.NewObjectID()
+	userId := primitive.NewObjectID()
+	entries := NewMemoryEntryStore()
+	entries.Create(context.TODO(), ContestEntry{Id: primitive.NewObjectID(), ContestID: contestId, OwnerId: userId})
+	if entries.Create(context.TODO(), ContestEntry{Id: primitive.NewObjectID(), ContestID: contestId, OwnerId: userId}) != ErrDuplicate {
+		t.Error("Second entry by the same user should be rejected")
+	}
+	if entries.Create(context.TODO(), ContestEntry{Id: primitive.NewObjectID(), ContestID: primitive.NewObjectID(), OwnerId: userId}) != nil {
+		t.Error("Entry to a different contest should be allowed")
+	}
+
+	votes := NewMemoryVoteStore()
+	votes.Create(context.TODO(), ContestVote{Id: primitive.NewObjectID(), ContestID: contestId, UserID: userId})
+	if votes.Create(context.TODO(), ContestVote{Id: primitive.NewObjectID(), ContestID: contestId, UserID: userId}) != ErrDuplicate {
+		t.Error("Second vote by the same user should be rejected")
+	}
+}
+
+// Scheduler tests
+func TestAdvanceScheduledContests(t *testing.T){
+	contests := NewMemoryContestStore()
+	entries := NewMemoryEntryStore()
+	now := time.Now()
+	past := now.Add(-time.Minute)
+	future := now.Add(time.Hour)
+
+	withEntry := createContest(primitive.NewObjectID(), primitive.NewObjectID(), OPEN)
+	withEntry.SubmissionEnd = &past
+	withEntry.VotingEnd = &future
+	contests.Create(context.TODO(), withEntry)
+	entries.Create(context.TODO(), ContestEntry{Id: primitive.NewObjectID(), ContestID: withEntry.Id})
+
+	empty := createContest(primitive.NewObjectID(), primitive.NewObjectID(), OPEN)
+	empty.SubmissionEnd = &past
+	contests.Create(context.TODO(), empty)
+
+	voting := createContest(primitive.NewObjectID(), primitive.NewObjectID(), VOTING)
+	voting.VotingEnd = &past
+	contests.Create(context.TODO(), voting)
+
+	notDue := createContest(primitive.NewObjectID(), primitive.NewObjectID(), OPEN)
+	notDue.SubmissionEnd = &future
+	contests.Create(context.TODO(), notDue)
+
+	advanceScheduledContests(context.TODO(), now, contests, entries)
+
+	expected := map[primitive.ObjectID]int{
+		withEntry.Id: VOTING,
+		empty.Id: CONCLUDED,
+		voting.Id: CONCLUDED,
+		notDue.Id: OPEN,
+	}
+	for contestId, state := range expected {
+		contest, _ := contests.Get(context.TODO(), contestId)
+		if contest.State != state {
+			t.Errorf("Contest %v should be in state %v, got %v", contestId.Hex(), state, contest.State)
+		}
+	}
+}
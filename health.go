@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// How long a dependency has to respond to a health check
+const healthCheckTimeout = 2 * time.Second
+
+// Checks the server's dependencies for the health and readiness endpoints
+type HealthChecker struct {
+	mu sync.Mutex
+	checks map[string]func(ctx context.Context) error
+	draining bool
+}
+
+func NewHealthChecker() *HealthChecker {
+	return &HealthChecker{checks: make(map[string]func(ctx context.Context) error)}
+}
+
+// Add a dependency check, e.g. pinging the database
+func (h *HealthChecker) AddCheck(name string, check func(ctx context.Context) error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.checks[name] = check
+}
+
+// Report not ready from now on, so load balancers stop sending new requests during shutdown
+func (h *HealthChecker) SetDraining() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.draining = true
+}
+
+func (h *HealthChecker) IsDraining() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.draining
+}
+
+// Run every check, returning "ok" or "failing" for each and whether they all passed
+// Errors are logged rather than returned, as the readiness endpoint is public
+func (h *HealthChecker) Run(ctx context.Context) (map[string]string, bool) {
+	h.mu.Lock()
+	names := []string{}
+	checks := make(map[string]func(ctx context.Context) error)
+	for name, check := range h.checks {
+		names = append(names, name)
+		checks[name] = check
+	}
+	h.mu.Unlock()
+
+	sort.Strings(names)
+	results := make(map[string]string)
+	healthy := true
+	for _, name := range names {
+		checkCtx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+		err := checks[name](checkCtx)
+		cancel()
+		if err != nil {
+			slog.ErrorContext(ctx, "Health check failed", "check", name, "error", err)
+			results[name] = "failing"
+			healthy = false
+		} else {
+			results[name] = "ok"
+		}
+	}
+	return results, healthy
+}
+
+type HealthStatus struct {
+	Status string `json:"status"`
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+// Handler for /healthz
+// The server is alive as long as it can answer. Dependencies aren't checked,
+// so a database outage doesn't get every server instance restarted
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, HealthStatus{Status: "ok"})
+}
+
+// Handler for /readyz
+// Fails while a dependency is unreachable or the server is shutting down
+func readyzHandler(w http.ResponseWriter, r *http.Request, health *HealthChecker) {
+	checks, healthy := health.Run(r.Context())
+	if health.IsDraining() {
+		writeJSON(w, http.StatusServiceUnavailable, HealthStatus{"shutting down", checks})
+		return
+	}
+	if !healthy {
+		writeJSON(w, http.StatusServiceUnavailable, HealthStatus{"unavailable", checks})
+		return
+	}
+	writeJSON(w, http.StatusOK, HealthStatus{"ok", checks})
+}
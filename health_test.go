@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHealthEndpoints(t *testing.T){
+	app := newTestApp(t)
+	mongoErr := errors.New("connection refused")
+	var checkErr error
+	checkCount := 0
+	app.health.AddCheck("mongo", func(ctx context.Context) error {
+		if _, ok := ctx.Deadline(); !ok {
+			t.Error("Health checks should have a deadline")
+		}
+		checkCount++
+		return checkErr
+	})
+
+	var status HealthStatus
+	rec := app.get("/readyz", nil)
+	decodeResponse(t, rec, &status)
+	if rec.Code != http.StatusOK || status.Checks["mongo"] != "ok" {
+		t.Errorf("Server should be ready, got %v %+v", rec.Code, status)
+	}
+
+	// A database outage makes the server unready, but it is still alive
+	checkErr = mongoErr
+	rec = app.get("/readyz", nil)
+	decodeResponse(t, rec, &status)
+	if rec.Code != http.StatusServiceUnavailable || status.Checks["mongo"] != "failing" {
+		t.Errorf("Server should not be ready without the database, got %v %+v", rec.Code, status)
+	}
+	if strings.Contains(rec.Body.String(), mongoErr.Error()) {
+		t.Error("Readiness should not reveal dependency errors")
+	}
+	checkCount = 0
+	if rec := app.get("/healthz", nil); rec.Code != http.StatusOK || checkCount != 0 {
+		t.Errorf("Server should be alive without checking the database, got %v after %v checks", rec.Code, checkCount)
+	}
+
+	checkErr = nil
+	app.health.SetDraining()
+	rec = app.get("/readyz", nil)
+	decodeResponse(t, rec, &status)
+	if rec.Code != http.StatusServiceUnavailable || status.Status != "shutting down" {
+		t.Errorf("Server should not be ready while shutting down, got %v %+v", rec.Code, status)
+	}
+}
+
+func TestRequestTimeoutMiddleware(t *testing.T){
+	var deadline time.Time
+	handler := requestTimeoutMiddleware(time.Minute)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		deadline, _ = r.Context().Deadline()
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if remaining := time.Until(deadline); remaining <= 0 || remaining > time.Minute {
+		t.Errorf("Request context should have a one minute deadline, got %v", remaining)
+	}
+}
@@ -1,65 +1,207 @@
 package main
 
 import (
+	"net/http"
 	"testing"
+	"time"
 
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 // Contest helper tests
-func TestCanEndSubmissionSameId(t *testing.T){
+func TestCanEndSubmission(t *testing.T){
 	newId := primitive.NewObjectID()
 	sameContest := createContest(primitive.NewObjectID(), newId, OPEN)
-	if !canEndSubmission(newId, sameContest){
+	if !canEndSubmission(sameContest){
 		t.Error("Contest should be able to start vote")
 	}
 }
 
-func TestCanEndSubmissionDiffId(t *testing.T){
-	newId := primitive.NewObjectID()
-	sameContest := createContest(primitive.NewObjectID(), primitive.NewObjectID(), OPEN)
-	if canEndSubmission(newId, sameContest){
-		t.Error("Contest should not be able to start vote")
-	}
-}
-
 func TestCanEndSubmissionWrongState(t *testing.T){
 	newId := primitive.NewObjectID()
 	votingContest := createContest(primitive.NewObjectID(), newId, VOTING)
-	if canEndSubmission(newId, votingContest){
+	if canEndSubmission(votingContest){
 		t.Error("Voting contest should not be able to start vote")
 	}
 	concludedContest := createContest(primitive.NewObjectID(), newId, CONCLUDED)
-	if canEndSubmission(newId, concludedContest){
+	if canEndSubmission(concludedContest){
 		t.Error("Concluded contest should not be able to start vote")
 	}
 }
 
 
-func TestCanEndVotingSameId(t *testing.T){
+func TestCanEndVoting(t *testing.T){
 	newId := primitive.NewObjectID()
 	sameContest := createContest(primitive.NewObjectID(), newId, VOTING)
-	if !canEndVoting(newId, sameContest){
+	if !canEndVoting(sameContest){
 		t.Error("Contest should be able to start vote")
 	}
 }
 
-func TestCanEndVotingDiffId(t *testing.T){
+func TestCanEndVotingWrongState(t *testing.T){
 	newId := primitive.NewObjectID()
-	sameContest := createContest(primitive.NewObjectID(), primitive.NewObjectID(), VOTING)
-	if canEndVoting(newId, sameContest){
-		t.Error("Contest should not be able to start vote")
+	openContest := createContest(primitive.NewObjectID(), newId, OPEN)
+	if canEndVoting(openContest){
+		t.Error("Open contest should not be able to start vote")
+	}
+	concludedContest := createContest(primitive.NewObjectID(), newId, CONCLUDED)
+	if canEndVoting(concludedContest){
+		t.Error("Concluded contest should not be able to start vote")
 	}
 }
 
-func TestCanEndVotingWrongState(t *testing.T){
+// Contest state machine tests
+func TestStateTransitionForward(t *testing.T){
 	newId := primitive.NewObjectID()
 	openContest := createContest(primitive.NewObjectID(), newId, OPEN)
-	if canEndVoting(newId, openContest){
-		t.Error("Open contest should not be able to start vote")
+	if err := checkStateTransition(openContest, 1, VOTING); err != nil {
+		t.Error("Open contest with entries should be able to start vote")
+	}
+	votingContest := createContest(primitive.NewObjectID(), newId, VOTING)
+	if err := checkStateTransition(votingContest, 1, CONCLUDED); err != nil {
+		t.Error("Voting contest should be able to conclude")
+	}
+}
+
+func TestStateTransitionInvalid(t *testing.T){
+	newId := primitive.NewObjectID()
+	openContest := createContest(primitive.NewObjectID(), newId, OPEN)
+	if errorStatus(checkStateTransition(openContest, 1, CONCLUDED)) != http.StatusConflict {
+		t.Error("Open contest should not be able to skip voting")
+	}
+	if errorStatus(checkStateTransition(openContest, 0, VOTING)) != http.StatusConflict {
+		t.Error("Contest without entries should not be able to start vote")
 	}
 	concludedContest := createContest(primitive.NewObjectID(), newId, CONCLUDED)
-	if canEndVoting(newId, concludedContest){
-		t.Error("Concluded contest should not be able to start vote")
+	if errorStatus(checkStateTransition(concludedContest, 1, VOTING)) != http.StatusConflict {
+		t.Error("Concluded contest should not be able to move backwards")
+	}
+	if errorStatus(checkStateTransition(openContest, 1, OPEN)) != http.StatusConflict {
+		t.Error("Contest should not be able to move to its current state")
+	}
+}
+
+func TestCheckCanSubmit(t *testing.T){
+	openContest := createContest(primitive.NewObjectID(), primitive.NewObjectID(), OPEN)
+	if checkCanSubmit(openContest, false) != nil {
+		t.Error("User should be able to submit to open contest")
+	}
+	if errorStatus(checkCanSubmit(openContest, true)) != http.StatusConflict {
+		t.Error("User should not be able to submit twice")
+	}
+	votingContest := createContest(primitive.NewObjectID(), primitive.NewObjectID(), VOTING)
+	if errorStatus(checkCanSubmit(votingContest, false)) != http.StatusConflict {
+		t.Error("User should not be able to submit to voting contest")
+	}
+}
+
+func TestCheckCanVote(t *testing.T){
+	votingContest := createContest(primitive.NewObjectID(), primitive.NewObjectID(), VOTING)
+	if checkCanVote(votingContest, false) != nil {
+		t.Error("User should be able to vote in voting contest")
+	}
+	if errorStatus(checkCanVote(votingContest, true)) != http.StatusConflict {
+		t.Error("User should not be able to vote twice")
+	}
+	openContest := createContest(primitive.NewObjectID(), primitive.NewObjectID(), OPEN)
+	if errorStatus(checkCanVote(openContest, false)) != http.StatusConflict {
+		t.Error("User should not be able to vote in open contest")
+	}
+}
+
+// Contest deadline tests
+func TestScheduledStateNoDeadlines(t *testing.T){
+	contest := createContest(primitive.NewObjectID(), primitive.NewObjectID(), OPEN)
+	if scheduledState(contest, 1, time.Now()) != OPEN {
+		t.Error("Contest without deadlines should not change state")
+	}
+}
+
+func TestScheduledStateSubmissionEnd(t *testing.T){
+	now := time.Now()
+	past := now.Add(-time.Hour)
+	future := now.Add(time.Hour)
+	contest := createContest(primitive.NewObjectID(), primitive.NewObjectID(), OPEN)
+	contest.SubmissionEnd = &future
+	if scheduledState(contest, 1, now) != OPEN {
+		t.Error("Contest should stay open before submission deadline")
+	}
+	contest.SubmissionEnd = &past
+	if scheduledState(contest, 1, now) != VOTING {
+		t.Error("Contest should start voting after submission deadline")
+	}
+	if scheduledState(contest, 0, now) != CONCLUDED {
+		t.Error("Contest without entries should conclude after submission deadline")
+	}
+	contest.VotingEnd = &past
+	if scheduledState(contest, 1, now) != CONCLUDED {
+		t.Error("Contest should conclude when both deadlines have passed")
+	}
+}
+
+func TestScheduledStateVotingEnd(t *testing.T){
+	now := time.Now()
+	past := now.Add(-time.Hour)
+	contest := createContest(primitive.NewObjectID(), primitive.NewObjectID(), VOTING)
+	contest.VotingEnd = &past
+	if scheduledState(contest, 1, now) != CONCLUDED {
+		t.Error("Contest should conclude after voting deadline")
+	}
+	concludedContest := createContest(primitive.NewObjectID(), primitive.NewObjectID(), CONCLUDED)
+	concludedContest.VotingEnd = &past
+	if scheduledState(concludedContest, 1, now) != CONCLUDED {
+		t.Error("Concluded contest should stay concluded")
+	}
+}
+
+func TestParseContestDeadlines(t *testing.T){
+	now := time.Now()
+	submission := now.UTC().Add(time.Hour).Format(deadlineInputLayout)
+	voting := now.UTC().Add(2 * time.Hour).Format(deadlineInputLayout)
+	submissionEnd, votingEnd, err := parseContestDeadlines(submission, voting, "", now)
+	if err != nil || submissionEnd == nil || votingEnd == nil {
+		t.Error("Valid deadlines should parse")
+	}
+	submissionEnd, votingEnd, err = parseContestDeadlines("", "", "", now)
+	if err != nil || submissionEnd != nil || votingEnd != nil {
+		t.Error("Deadlines should be optional")
+	}
+	if _, _, err := parseContestDeadlines(voting, submission, "", now); err == nil {
+		t.Error("Voting deadline before submission deadline should not parse")
+	}
+	past := now.UTC().Add(-time.Hour).Format(deadlineInputLayout)
+	if _, _, err := parseContestDeadlines(past, "", "", now); err == nil {
+		t.Error("Deadline in the past should not parse")
+	}
+	if _, _, err := parseContestDeadlines("tomorrow", "", "", now); err == nil {
+		t.Error("Invalid deadline should not parse")
+	}
+}
+
+func TestParseContestDeadlinesTimezone(t *testing.T){
+	now := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	// New York is 5 hours behind UTC in winter and 4 in summer
+	submissionEnd, votingEnd, err := parseContestDeadlines("2030-01-02T12:00", "2030-07-02T12:00", "America/New_York", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !submissionEnd.Equal(time.Date(2030, 1, 2, 17, 0, 0, 0, time.UTC)) || !votingEnd.Equal(time.Date(2030, 7, 2, 16, 0, 0, 0, time.UTC)) {
+		t.Errorf("Deadlines should be read in the browser's timezone, got %v and %v", submissionEnd, votingEnd)
+	}
+	submissionEnd, _, _ = parseContestDeadlines("2030-01-02T12:00", "", "", now)
+	if !submissionEnd.Equal(time.Date(2030, 1, 2, 12, 0, 0, 0, time.UTC)) {
+		t.Errorf("Deadlines without a timezone should be UTC, got %v", submissionEnd)
+	}
+	if _, _, err := parseContestDeadlines("2030-01-02T12:00", "", "Mars/Olympus_Mons", now); err == nil {
+		t.Error("Unknown timezone should not parse")
+	}
+}
+
+func TestCheckCanSubmitAfterDeadline(t *testing.T){
+	past := time.Now().Add(-time.Minute)
+	openContest := createContest(primitive.NewObjectID(), primitive.NewObjectID(), OPEN)
+	openContest.SubmissionEnd = &past
+	if errorStatus(checkCanSubmit(openContest, false)) != http.StatusConflict {
+		t.Error("User should not be able to submit after deadline")
 	}
 }
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log/slog"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	// Register decoders for every format an entry can be uploaded in
+	_ "image/gif"
+	_ "golang.org/x/image/webp"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"golang.org/x/image/draw"
+)
+
+// URL path that uploaded images are served from
+const imageUrlPrefix = "/uploadedImages/"
+
+// Formats an entry can be uploaded in, with the extension its file is saved with
+var uploadExtensions = map[string]string{
+	"jpeg": ".jpg",
+	"png": ".png",
+	"gif": ".gif",
+	"webp": ".webp",
+}
+
+// Content types for every extension images are saved with, including resized copies
+var imageContentTypes = map[string]string{
+	".jpg": "image/jpeg",
+	".png": "image/png",
+	".gif": "image/gif",
+	".webp": "image/webp",
+}
+
+// Limits on uploaded images
+// Dimensions are checked from the image header before decoding, so a small file
+// can't make the server allocate a huge image
+const (
+	maxImageSide = 10000
+	maxImagePixels = 50 * 1000 * 1000
+)
+
+// Largest upload accepted in bytes, set from the configuration at startup
+var maxUploadSize int64 = defaultMaxUploadMB << 20
+
+// Resized copies made of every entry image, smallest first
+// Templates pick between them with srcset so pages with many entries load quickly
+var imageVariantSizes = []ImageVariant{
+	{Name: "thumbnail", Width: 320},
+	{Name: "medium", Width: 800},
+	{Name: "large", Width: 1600},
+}
+
+// Quality for resized copies saved as JPEG
+const variantJpegQuality = 85
+
+// Check an upload is an image in one of the allowed formats and within the size limits
+// The format is detected from the file contents, the uploaded filename is never trusted
+// Returns the decoded image and its format
+func decodeUpload(data []byte) (image.Image, string, error) {
+	notAnImage := badRequestError("Please upload a JPEG, PNG, GIF or WebP image")
+
+	// Check the magic bytes before handing the data to a decoder
+	contentType := http.DetectContentType(data)
+	format := strings.TrimPrefix(contentType, "image/")
+	if _, ok := uploadExtensions[format]; !ok || format == contentType {
+		return nil, "", notAnImage
+	}
+	config, configFormat, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || configFormat != format || config.Width == 0 || config.Height == 0 {
+		return nil, "", notAnImage
+	}
+	if config.Width > maxImageSide || config.Height > maxImageSide {
+		return nil, "", badRequestError("Images can be at most " + strconv.Itoa(maxImageSide) + " pixels wide or tall")
+	}
+	if config.Width * config.Height > maxImagePixels {
+		return nil, "", badRequestError("Images can be at most " + strconv.Itoa(maxImagePixels / 1000000) + " megapixels")
+	}
+
+	// Decode the whole image to make sure it isn't truncated or corrupt
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", badRequestError("That image is damaged or incomplete, please try another file")
+	}
+	return img, format, nil
+}
+
+// Save resized copies of an uploaded image
+// Images are never scaled up, so small uploads get fewer variants
+// Returns the variants that were saved, with Path set to the URL they are served from
+func generateImageVariants(ctx context.Context, src image.Image, format string, blobStore BlobStore, baseName string) ([]ImageVariant, error) {
+	// Keep transparency for formats that have it, everything else is stored as JPEG
+	extension := ".jpg"
+	if format == "png" || format == "gif" {
+		extension = ".png"
+	}
+
+	variants := []ImageVariant{}
+	for _, size := range imageVariantSizes {
+		if size.Width >= src.Bounds().Dx() {
+			break
+		}
+		variantName := baseName + "-" + size.Name + extension
+		data, err := encodeImage(resizeImage(src, size.Width), extension)
+		if err == nil {
+			err = blobStore.Put(ctx, variantName, data, imageContentTypes[extension])
+		}
+		if err != nil {
+			removeImageVariants(ctx, blobStore, variants)
+			return nil, err
+		}
+		variants = append(variants, ImageVariant{
+			Name: size.Name,
+			Width: size.Width,
+			Path: imageUrlPrefix + variantName,
+		})
+	}
+	return variants, nil
+}
+
+// Scale an image to the given width, keeping its aspect ratio
+func resizeImage(src image.Image, width int) image.Image {
+	bounds := src.Bounds()
+	height := bounds.Dy() * width / bounds.Dx()
+	if height < 1 {
+		height = 1
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, bounds, draw.Src, nil)
+	return dst
+}
+
+// Encode an image as JPEG or PNG depending on the extension
+func encodeImage(img image.Image, extension string) ([]byte, error) {
+	var buf bytes.Buffer
+	var err error
+	if extension == ".png" {
+		err = png.Encode(&buf, img)
+	} else {
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: variantJpegQuality})
+	}
+	return buf.Bytes(), err
+}
+
+// Delete the files for an entry's image and its variants
+func removeEntryImages(ctx context.Context, blobStore BlobStore, entry ContestEntry) {
+	if err := blobStore.Delete(ctx, strings.TrimPrefix(entry.ImagePath, imageUrlPrefix)); err != nil {
+		slog.ErrorContext(ctx, "Couldn't delete entry image", "path", entry.ImagePath, "error", err)
+	}
+	removeImageVariants(ctx, blobStore, entry.Variants)
+}
+
+// Delete the files for an entry's image variants
+func removeImageVariants(ctx context.Context, blobStore BlobStore, variants []ImageVariant) {
+	for _, variant := range variants {
+		if err := blobStore.Delete(ctx, strings.TrimPrefix(variant.Path, imageUrlPrefix)); err != nil {
+			slog.ErrorContext(ctx, "Couldn't delete image variant", "path", variant.Path, "error", err)
+		}
+	}
+}
+
+// Handler for /uploadedImages/{name}
+// Browsers are told not to guess a different content type, so an upload can
+// only ever be shown as an image. Names are never reused, so images in public contests
+// can be cached forever. Images in other contests are only served to users who can see the contest
+func uploadedImageHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+	contestStore ContestStore,
+	entryStore EntryStore,
+	participantStore ParticipantStore,
+	memberStore CommunityMemberStore,
+	blobStore BlobStore,
+	name string,
+) {
+	contest, err := getImageContest(r.Context(), name, contestStore, entryStore)
+	if err == nil && contest.GetVisibility() != PUBLIC {
+		viewerId, _, _ := getSessionUser(r)
+		err = checkContestAccess(r.Context(), viewerId, contest, participantStore, memberStore)
+	}
+	if errorStatus(err) == http.StatusNotFound {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		logRequestError(r.Context(), "Couldn't check image access", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	file, err := blobStore.Get(r.Context(), name)
+	if err == ErrNotFound {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Couldn't read image", "image", name, "error", err)
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
+	defer file.Close()
+	contentType, body, err := imageContentType(name, file)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Couldn't read image", "image", name, "error", err)
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
+	if contentType == "" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if contest.GetVisibility() == PUBLIC {
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	} else {
+		// Shared caches mustn't keep them, and browsers check again once access could have been removed
+		w.Header().Set("Cache-Control", "private, max-age=3600")
+	}
+	if _, err := io.Copy(w, body); err != nil {
+		slog.WarnContext(r.Context(), "Couldn't send image", "image", name, "error", err)
+	}
+}
+
+// Find the contest an uploaded image was entered in
+// Every image name starts with its entry's ID, including resized copies and images saved
+// under the uploader's filename
+func getImageContest(ctx context.Context, name string, contestStore ContestStore, entryStore EntryStore) (Contest, error) {
+	notFound := notFoundError("Image not found")
+	if len(name) < 24 {
+		return Contest{}, notFound
+	}
+	entryId, err := primitive.ObjectIDFromHex(name[:24])
+	if err != nil {
+		return Contest{}, notFound
+	}
+	entry, err := entryStore.Get(ctx, entryId)
+	if err == ErrNotFound {
+		return Contest{}, notFound
+	}
+	if err != nil {
+		return Contest{}, err
+	}
+	contest, err := contestStore.Get(ctx, entry.ContestID)
+	if err == ErrNotFound {
+		return Contest{}, notFound
+	}
+	return contest, err
+}
+
+// Content type to serve an uploaded image with, empty if the file isn't an image
+// Images saved before names were generated by the server keep the uploader's filename,
+// so their extension can be in any case or missing, and the type is sniffed from the contents instead.
+// Returns a reader for the whole file, including anything read while sniffing
+func imageContentType(name string, file io.Reader) (string, io.Reader, error) {
+	extension := strings.ToLower(path.Ext(name))
+	if extension == ".jpeg" {
+		extension = ".jpg"
+	}
+	if contentType, ok := imageContentTypes[extension]; ok {
+		return contentType, file, nil
+	}
+	header := make([]byte, 512)
+	n, err := io.ReadFull(file, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", nil, err
+	}
+	header = header[:n]
+	contentType := http.DetectContentType(header)
+	// Only ever serve images, so an uploaded page or script can't run on this site
+	if !strings.HasPrefix(contentType, "image/") || contentType == "image/svg+xml" {
+		return "", nil, nil
+	}
+	return contentType, io.MultiReader(bytes.NewReader(header), file), nil
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
+	"math/rand"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Seed for the pattern of the next image from createPNG
+var testImageSeed int64
+
+// Create an image of 16x16 blocks in random colours picked by seed
+// The same seed gives the same picture at any size
+func createPatternImage(seed int64, width int, height int) image.Image {
+	random := rand.New(rand.NewSource(seed))
+	colors := make([]color.RGBA, 16 * 16)
+	for i := range colors {
+		colors[i] = color.RGBA{uint8(random.Intn(256)), uint8(random.Intn(256)), uint8(random.Intn(256)), 255}
+	}
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for x := 0; x < width; x++ {
+		for y := 0; y < height; y++ {
+			img.Set(x, y, colors[x * 16 / width * 16 + y * 16 / height])
+		}
+	}
+	return img
+}
+
+// Encode a PNG image of the given size
+// Every call draws a different pattern, so images are never duplicates of each other
+func createPNG(width int, height int) []byte {
+	testImageSeed++
+	var buf bytes.Buffer
+	png.Encode(&buf, createPatternImage(testImageSeed, width, height))
+	return buf.Bytes()
+}
+
+// Submit an entry with the given image file through the contest page
+func (a *testApp) submitImage(contest Contest, filename string, data []byte, cookies []*http.Cookie) *httptest.ResponseRecorder {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	writer.WriteField(csrfFieldName, a.csrfToken(cookies))
+	writer.WriteField("imgName", "My entry")
+	part, _ := writer.CreateFormFile("img", filename)
+	part.Write(data)
+	writer.Close()
+	req := httptest.NewRequest("POST", "/contests/" + contest.GetStringId() + "/submit", body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	return a.do(req, cookies)
+}
+
+func TestGenerateImageVariants(t *testing.T){
+	dir := t.TempDir()
+	blobStore, _ := NewLocalBlobStore(dir)
+	img, format, err := decodeUpload(createPNG(1000, 500))
+	if err != nil {
+		t.Fatal(err)
+	}
+	variants, err := generateImageVariants(context.TODO(), img, format, blobStore, "entry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(variants) != 2 || variants[0].Name != "thumbnail" || variants[1].Name != "medium" {
+		t.Fatalf("Image should only be scaled down, got %+v", variants)
+	}
+	file, err := os.Open(filepath.Join(dir, filepath.Base(variants[0].Path)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	config, _, err := image.DecodeConfig(file)
+	if err != nil || config.Width != 320 || config.Height != 160 {
+		t.Errorf("Thumbnail should keep aspect ratio, got %+v %v", config, err)
+	}
+}
+
+// Encode a PNG header claiming the given size, without any pixel data
+func createPNGHeader(width int, height int) []byte {
+	data := createPNG(1, 1)
+	// IHDR data starts after the signature, chunk length and chunk type
+	binary.BigEndian.PutUint32(data[16:], uint32(width))
+	binary.BigEndian.PutUint32(data[20:], uint32(height))
+	binary.BigEndian.PutUint32(data[29:], crc32.ChecksumIEEE(data[12:29]))
+	return data[:33]
+}
+
+func TestDecodeUpload(t *testing.T){
+	valid := createPNG(20, 10)
+	var gifData bytes.Buffer
+	gif.Encode(&gifData, image.NewPaletted(image.Rect(0, 0, 5, 5), color.Palette{color.Black}), nil)
+	tests := []struct {
+		name string
+		data []byte
+		valid bool
+	}{
+		{"png", valid, true},
+		{"gif", gifData.Bytes(), true},
+		{"html", []byte("<html><script>alert(1)</script></html>"), false},
+		{"truncated", valid[:len(valid) - 20], false},
+		{"too wide", createPNGHeader(maxImageSide + 1, 1), false},
+		{"too many pixels", createPNGHeader(maxImageSide, maxImageSide), false},
+	}
+	for _, test := range tests {
+		_, _, err := decodeUpload(test.data)
+		if (err == nil) != test.valid {
+			t.Errorf("%v: expected valid %v, got %v", test.name, test.valid, err)
+		}
+		if err != nil && errorStatus(err) != http.StatusBadRequest {
+			t.Errorf("%v: rejected upload should be a bad request, got %v", test.name, err)
+		}
+	}
+}
+
+func TestUploadRejected(t *testing.T){
+	app := newTestApp(t)
+	owner := app.login(t, "bill")
+	contest := app.createContest(t, owner)
+	rec := app.submitImage(contest, "photo.jpg", []byte("<html>hello</html>"), owner)
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "Please upload a JPEG, PNG, GIF or WebP image") {
+		t.Errorf("Non-image should be rejected on the contest page, got %v", rec.Code)
+	}
+	if count, _ := app.entries.CountByContest(context.TODO(), contest.Id); count != 0 {
+		t.Error("Rejected upload should not create an entry")
+	}
+
+	if rec := app.submitImage(contest, "../../evil.html", createPNG(10, 10), owner); rec.Code != http.StatusFound {
+		t.Fatalf("Image should be accepted, got %v", rec.Code)
+	}
+	entries, _ := app.entries.ListByContest(context.TODO(), contest.Id)
+	if entries[0].ImagePath != "/uploadedImages/" + entries[0].GetStringId() + ".png" {
+		t.Errorf("Image should be saved under a generated name, got %v", entries[0].ImagePath)
+	}
+	files, _ := os.ReadDir(app.imageDir)
+	if len(files) != 1 {
+		t.Errorf("Only the original image should be saved, got %v files", len(files))
+	}
+
+	rec = app.get(entries[0].ImagePath, owner)
+	if rec.Header().Get("X-Content-Type-Options") != "nosniff" || rec.Header().Get("Content-Type") != "image/png" {
+		t.Errorf("Uploaded images should be served as images only, got %v", rec.Header())
+	}
+}
+
+// Images uploaded before names were generated keep the uploader's filename
+func TestLegacyImageNames(t *testing.T){
+	app := newTestApp(t)
+	owner := app.login(t, "bill")
+	ctx := context.TODO()
+	contest := app.createContest(t, owner)
+	files := map[string][]byte{
+		"5f1d7a2b3c4d5e6f70818283Holiday.JPEG": createJPEG(nil),
+		"5f1d7a2b3c4d5e6f70818284sunset": createPNG(10, 10),
+		"5f1d7a2b3c4d5e6f70818285notes.txt": []byte("<html><script>alert(1)</script></html>"),
+	}
+	for name, data := range files {
+		app.blobs.Put(ctx, name, data, "")
+		app.entries.Create(ctx, ContestEntry{Id: objectId(t, name[:24]), ContestID: contest.Id, OwnerId: primitive.NewObjectID(), ImagePath: imageUrlPrefix + name})
+	}
+	tests := map[string]string{
+		"5f1d7a2b3c4d5e6f70818283Holiday.JPEG": "image/jpeg",
+		"5f1d7a2b3c4d5e6f70818284sunset": "image/png",
+	}
+	for name, contentType := range tests {
+		rec := app.get(imageUrlPrefix + name, owner)
+		if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != contentType || rec.Body.Len() == 0 {
+			t.Errorf("%v should be served as %v, got %v %v", name, contentType, rec.Code, rec.Header().Get("Content-Type"))
+		}
+	}
+	if rec := app.get(imageUrlPrefix + "5f1d7a2b3c4d5e6f70818285notes.txt", owner); rec.Code != http.StatusNotFound {
+		t.Errorf("Files that aren't images should not be served, got %v", rec.Code)
+	}
+}
+
+func TestPrivateContestImages(t *testing.T){
+	app := newTestApp(t)
+	bill := app.apiLogin(t, "bill")
+	ted := app.apiLogin(t, "ted")
+	ctx := context.TODO()
+	images := map[string]string{}
+	for _, visibility := range []string{PUBLIC, INVITE_ONLY} {
+		contest := app.createVisibleContest(t, visibility, visibility, bill)
+		entry := ContestEntry{Id: primitive.NewObjectID(), ContestID: objectId(t, contest.Id), OwnerId: primitive.NewObjectID()}
+		images[visibility] = entry.GetStringId() + "-thumbnail.jpg"
+		app.entries.Create(ctx, entry)
+		app.blobs.Put(ctx, images[visibility], createJPEG(nil), "image/jpeg")
+	}
+
+	rec := app.get(imageUrlPrefix + images[PUBLIC], nil)
+	if rec.Code != http.StatusOK || !strings.HasPrefix(rec.Header().Get("Cache-Control"), "public") {
+		t.Errorf("Public contest images should be cached by anyone, got %v %v", rec.Code, rec.Header().Get("Cache-Control"))
+	}
+	for _, cookies := range [][]*http.Cookie{nil, ted} {
+		if rec := app.get(imageUrlPrefix + images[INVITE_ONLY], cookies); rec.Code != http.StatusNotFound {
+			t.Errorf("Invite-only contest images should only be served to participants, got %v", rec.Code)
+		}
+	}
+	rec = app.get(imageUrlPrefix + images[INVITE_ONLY], bill)
+	if rec.Code != http.StatusOK || !strings.HasPrefix(rec.Header().Get("Cache-Control"), "private") {
+		t.Errorf("Invite-only contest images should be served privately to the owner, got %v %v", rec.Code, rec.Header().Get("Cache-Control"))
+	}
+	app.blobs.Put(ctx, "orphan.png", createPNG(10, 10), "image/png")
+	if rec := app.get(imageUrlPrefix + "orphan.png", bill); rec.Code != http.StatusNotFound {
+		t.Errorf("Images without an entry should not be served, got %v", rec.Code)
+	}
+}
+
+func TestEntryImageVariants(t *testing.T){
+	app := newTestApp(t)
+	owner := app.login(t, "bill")
+	contest := app.createContest(t, owner)
+	if rec := app.submitImage(contest, "photo.png", createPNG(2000, 1000), owner); rec.Code != http.StatusFound {
+		t.Fatalf("Submission should redirect, got %v", rec.Code)
+	}
+	entries, _ := app.entries.ListByContest(context.TODO(), contest.Id)
+	if len(entries) != 1 || len(entries[0].Variants) != len(imageVariantSizes) {
+		t.Fatalf("Entry should record a path for every variant, got %+v", entries)
+	}
+	for _, variant := range entries[0].Variants {
+		if _, err := os.Stat(filepath.Join(app.imageDir, filepath.Base(variant.Path))); err != nil {
+			t.Errorf("Variant %v should be saved: %v", variant.Name, err)
+		}
+	}
+
+	app.changeState(contest, "start-vote", owner)
+	body := app.get("/contests/" + contest.GetStringId(), owner).Body.String()
+	if !strings.Contains(body, "srcset=\"" + entries[0].Variants[0].Path + " 320w") {
+		t.Error("Voting page should offer resized images with srcset")
+	}
+}
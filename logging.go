@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Structured JSON logs, one object per line
+// Lines logged while handling a request are tagged with its request ID, and the
+// user and contest once the handler has looked them up
+
+// Header for the request ID, taken from the request if a proxy already set one
+const requestIdHeader = "X-Request-ID"
+
+// Request IDs from clients are only trusted if they look like an ID
+var validRequestId = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+type logFieldsKey struct{}
+
+// Request details added to every log line, filled in as the request is handled
+type logFields struct {
+	mu sync.Mutex
+	requestId string
+	userId string
+	contestId string
+}
+
+func withLogFields(ctx context.Context, requestId string) context.Context {
+	return context.WithValue(ctx, logFieldsKey{}, &logFields{requestId: requestId})
+}
+
+func getLogFields(ctx context.Context) *logFields {
+	fields, _ := ctx.Value(logFieldsKey{}).(*logFields)
+	return fields
+}
+
+// Tag the rest of the request's log lines with the user making it
+func setLogUser(ctx context.Context, userId primitive.ObjectID) {
+	if fields := getLogFields(ctx); fields != nil {
+		fields.mu.Lock()
+		fields.userId = userId.Hex()
+		fields.mu.Unlock()
+	}
+}
+
+// Tag the rest of the request's log lines with the contest it is for
+func setLogContest(ctx context.Context, contestId primitive.ObjectID) {
+	if fields := getLogFields(ctx); fields != nil {
+		fields.mu.Lock()
+		fields.contestId = contestId.Hex()
+		fields.mu.Unlock()
+	}
+}
+
+// Adds the request's log fields to each record
+type contextLogHandler struct {
+	slog.Handler
+}
+
+func (h contextLogHandler) Handle(ctx context.Context, record slog.Record) error {
+	if fields := getLogFields(ctx); fields != nil {
+		fields.mu.Lock()
+		record.AddAttrs(slog.String("request_id", fields.requestId))
+		if fields.userId != "" {
+			record.AddAttrs(slog.String("user_id", fields.userId))
+		}
+		if fields.contestId != "" {
+			record.AddAttrs(slog.String("contest_id", fields.contestId))
+		}
+		fields.mu.Unlock()
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h contextLogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextLogHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextLogHandler) WithGroup(name string) slog.Handler {
+	return contextLogHandler{h.Handler.WithGroup(name)}
+}
+
+// Create a JSON logger that writes lines at or above level
+func newLogger(w io.Writer, level slog.Level) *slog.Logger {
+	return slog.New(contextLogHandler{slog.NewJSONHandler(w, &slog.HandlerOptions{Level: level})})
+}
+
+// Log an error from handling a request
+// Server errors are logged at error level, and requests that weren't allowed as warnings
+func logRequestError(ctx context.Context, message string, err error) {
+	level := slog.LevelWarn
+	if errorStatus(err) == http.StatusInternalServerError {
+		level = slog.LevelError
+	}
+	slog.Log(ctx, level, message, "error", err)
+}
+
+// Log an error that stops the server, and exit
+func logFatal(message string, err error) {
+	slog.Error(message, "error", err)
+	os.Exit(1)
+}
+
+func newRequestId() string {
+	data := make([]byte, 12)
+	rand.Read(data)
+	return hex.EncodeToString(data)
+}
+
+// Records the status code written by a handler
+// Flushing and hijacking are passed through, so streaming responses still work
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Flush() {
+	http.NewResponseController(s.ResponseWriter).Flush()
+}
+
+func (s *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(s.ResponseWriter).Hijack()
+}
+
+// For http.ResponseController
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// Give every request an ID, returned in the X-Request-ID header and added to its
+// log lines, and log each request once it has been handled
+func requestIdMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestId := r.Header.Get(requestIdHeader)
+		if !validRequestId.MatchString(requestId) {
+			requestId = newRequestId()
+		}
+		w.Header().Set(requestIdHeader, requestId)
+		ctx := withLogFields(r.Context(), requestId)
+		recorder := &statusRecorder{w, http.StatusOK}
+		start := time.Now()
+		next.ServeHTTP(recorder, r.WithContext(ctx))
+		slog.InfoContext(
+			ctx,
+			"Request handled",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", recorder.status,
+			"duration_ms", time.Since(start).Milliseconds(),
+		)
+	})
+}
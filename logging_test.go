@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Capture log lines written during a test as decoded JSON objects
+func captureLogs(t *testing.T, level slog.Level) func() []map[string]interface{} {
+	var buf bytes.Buffer
+	previous := slog.Default()
+	slog.SetDefault(newLogger(&buf, level))
+	t.Cleanup(func() { slog.SetDefault(previous) })
+	return func() []map[string]interface{} {
+		lines := []map[string]interface{}{}
+		for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+			if line == "" {
+				continue
+			}
+			entry := map[string]interface{}{}
+			if err := json.Unmarshal([]byte(line), &entry); err != nil {
+				t.Fatalf("Log line should be JSON, got %q", line)
+			}
+			lines = append(lines, entry)
+		}
+		return lines
+	}
+}
+
+func TestRequestLogging(t *testing.T){
+	app := newTestApp(t)
+	owner := app.login(t, "bill")
+	contest := app.createContest(t, owner)
+	logs := captureLogs(t, slog.LevelInfo)
+
+	// Voting on a contest that is still open for submissions is refused, and logged as a warning
+	req := httptest.NewRequest("POST", "/contests/" + contest.GetStringId() + "/vote", nil)
+	req.Header.Set(requestIdHeader, "lb-1234")
+	req.Header.Set(csrfHeader, app.csrfToken(owner))
+	rec := app.do(req, owner)
+	if rec.Header().Get(requestIdHeader) != "lb-1234" {
+		t.Errorf("Request ID from the load balancer should be kept, got %q", rec.Header().Get(requestIdHeader))
+	}
+
+	var warning, handled map[string]interface{}
+	for _, entry := range logs() {
+		if entry["msg"] == "Couldn't cast vote" {
+			warning = entry
+		}
+		if entry["msg"] == "Request handled" {
+			handled = entry
+		}
+	}
+	if warning == nil || handled == nil {
+		t.Fatalf("Expected a warning and a request line, got %v", logs())
+	}
+	if warning["level"] != "WARN" || warning["request_id"] != "lb-1234" || warning["contest_id"] != contest.GetStringId() || warning["user_id"] != contest.OwnerId.Hex() {
+		t.Errorf("Warning should be tagged with the request, user and contest, got %v", warning)
+	}
+	if handled["request_id"] != "lb-1234" || handled["status"] != float64(rec.Code) || handled["path"] != "/contests/" + contest.GetStringId() + "/vote" {
+		t.Errorf("Unexpected request line %v", handled)
+	}
+}
+
+func TestRequestIdGenerated(t *testing.T){
+	app := newTestApp(t)
+	logs := captureLogs(t, slog.LevelWarn)
+	req := httptest.NewRequest("GET", "/healthz", nil)
+	req.Header.Set(requestIdHeader, "not a valid id\n")
+	first := app.do(req, nil).Header().Get(requestIdHeader)
+	second := app.get("/healthz", nil).Header().Get(requestIdHeader)
+	if len(first) != 24 || len(second) != 24 || first == second {
+		t.Errorf("Each request should get a new ID, got %q and %q", first, second)
+	}
+	if lines := logs(); len(lines) != 0 {
+		t.Errorf("Request lines should not be written below the configured level, got %v", lines)
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Throttling of password guesses
+// Failed logins are counted for both the account and the client's IP address.
+// After a few free failures each attempt has to wait twice as long as the last,
+// and after lockoutFailures the account or address is locked out for loginLockoutDuration.
+// Attempts are counted before the password is checked and taken back if it was right,
+// so guesses sent at the same time can't all get past the throttle
+
+// Limits on failed logins for one account or IP address
+type loginLimits struct {
+	// Failures allowed before attempts have to wait
+	freeFailures int
+	// Failures that lock the account or address out
+	lockoutFailures int
+}
+
+var (
+	accountLoginLimits = loginLimits{freeFailures: 3, lockoutFailures: 10}
+	// Many users can share an address behind a NAT, so addresses get more attempts
+	ipLoginLimits = loginLimits{freeFailures: 10, lockoutFailures: 50}
+)
+
+const (
+	// Wait after the first failure past the free ones, doubling with each failure after that
+	loginBaseDelay = time.Second
+	loginMaxDelay = 5 * time.Minute
+	loginLockoutDuration = 15 * time.Minute
+	// Failures older than this are forgotten
+	loginFailureWindow = time.Hour
+	// Failure counts are deleted from Mongo this long after the last failure
+	loginAttemptExpiry = 24 * time.Hour
+)
+
+// Kinds of login lockout
+const (
+	LOCKOUT_ACCOUNT = "account"
+	LOCKOUT_IP = "ip"
+)
+
+// Set from the trust_proxy setting when the server runs behind a load balancer
+var trustProxyHeaders = false
+
+// Key for the failed login count of an account or IP address
+func loginAttemptKey(kind string, value string) string {
+	return kind + ":" + value
+}
+
+// Address of the client making a request
+// Behind a load balancer this is the address it appended to X-Forwarded-For,
+// as earlier addresses in the header can be set by the client
+func clientIP(r *http.Request) string {
+	if trustProxyHeaders {
+		forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+		if last := strings.TrimSpace(forwarded[len(forwarded) - 1]); last != "" {
+			return last
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// How long after the last failure the next attempt has to wait
+func loginBackoff(failures int, limits loginLimits) time.Duration {
+	if failures < limits.freeFailures {
+		return 0
+	}
+	doublings := failures - limits.freeFailures
+	if doublings >= 20 {
+		return loginMaxDelay
+	}
+	delay := loginBaseDelay << doublings
+	if delay > loginMaxDelay {
+		return loginMaxDelay
+	}
+	return delay
+}
+
+// Time until another login can be attempted, 0 if it can be attempted now
+func loginWait(attempts LoginAttempts, limits loginLimits, now time.Time) time.Duration {
+	if attempts.LockedUntil.After(now) {
+		return attempts.LockedUntil.Sub(now)
+	}
+	if attempts.LastFailure.Before(now.Add(-loginFailureWindow)) {
+		return 0
+	}
+	wait := attempts.LastFailure.Add(loginBackoff(attempts.Failures, limits)).Sub(now)
+	if wait < 0 {
+		return 0
+	}
+	return wait
+}
+
+// Describe a wait for the login form, e.g. "5 seconds" or "3 minutes"
+func formatLoginWait(wait time.Duration) string {
+	if wait <= time.Minute {
+		seconds := int(math.Ceil(wait.Seconds()))
+		if seconds == 1 {
+			return "1 second"
+		}
+		return strconv.Itoa(seconds) + " seconds"
+	}
+	return strconv.Itoa(int(math.Ceil(wait.Minutes()))) + " minutes"
+}
+
+// Value for the Retry-After header
+func retryAfterSeconds(wait time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(wait.Seconds())))
+}
+
+type loginThrottleCheck struct {
+	kind string
+	value string
+	limits loginLimits
+}
+
+// An attempt counted against an account or address, with the failures counted so far including it
+type countedLoginAttempt struct {
+	loginThrottleCheck
+	failures int
+}
+
+func loginThrottleChecks(username string, ip string) []loginThrottleCheck {
+	checks := []loginThrottleCheck{{LOCKOUT_IP, ip, ipLoginLimits}}
+	if username != "" {
+		checks = append(checks, loginThrottleCheck{LOCKOUT_ACCOUNT, username, accountLoginLimits})
+	}
+	return checks
+}
+
+// Check the account and address may attempt a login at now
+// Returns how long they have to wait, with a tooManyRequestsError, if they can't
+func checkLoginAllowed(
+	ctx context.Context,
+	username string,
+	ip string,
+	now time.Time,
+	attemptStore LoginAttemptStore,
+) (time.Duration, error) {
+	var wait time.Duration
+	for _, check := range loginThrottleChecks(username, ip) {
+		attempts, err := attemptStore.Get(ctx, loginAttemptKey(check.kind, check.value))
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		if checkWait := loginWait(attempts, check.limits, now); checkWait > wait {
+			wait = checkWait
+		}
+	}
+	if wait > 0 {
+		return wait, tooManyRequestsError(fmt.Sprintf(
+			"Too many failed login attempts, please wait %v before trying again",
+			formatLoginWait(wait),
+		))
+	}
+	return 0, nil
+}
+
+// Count a login attempt against the account and address before its password is checked
+// The attempt is throttled if one made at the same time means it has to wait,
+// returning how long with a tooManyRequestsError
+func countLoginAttempt(
+	ctx context.Context,
+	username string,
+	ip string,
+	now time.Time,
+	attemptStore LoginAttemptStore,
+) ([]countedLoginAttempt, time.Duration, error) {
+	var counted []countedLoginAttempt
+	var wait time.Duration
+	resetBefore := now.Add(-loginFailureWindow)
+	for _, check := range loginThrottleChecks(username, ip) {
+		before, err := attemptStore.AddAttempt(ctx, loginAttemptKey(check.kind, check.value), now, resetBefore)
+		if err != nil {
+			return counted, 0, err
+		}
+		failures := before.Failures + 1
+		if before.LastFailure.Before(resetBefore) {
+			failures = 1
+		}
+		counted = append(counted, countedLoginAttempt{check, failures})
+		if checkWait := loginWait(before, check.limits, now); checkWait > wait {
+			wait = checkWait
+		}
+	}
+	if wait > 0 {
+		return counted, wait, tooManyRequestsError(fmt.Sprintf(
+			"Too many failed login attempts, please wait %v before trying again",
+			formatLoginWait(wait),
+		))
+	}
+	return counted, 0, nil
+}
+
+// Lock out the account and address of a failed login if they've reached their limit
+func recordLoginFailure(ctx context.Context, ip string, now time.Time, counted []countedLoginAttempt, attemptStore LoginAttemptStore) {
+	for _, attempt := range counted {
+		check := attempt.loginThrottleCheck
+		if attempt.failures < check.limits.lockoutFailures {
+			continue
+		}
+		key := loginAttemptKey(check.kind, check.value)
+		until := now.Add(loginLockoutDuration)
+		if err := attemptStore.Lock(ctx, key, until); err != nil {
+			slog.ErrorContext(ctx, "Couldn't lock out login", "key", key, "error", err)
+			continue
+		}
+		lockout := LoginLockout{primitive.NewObjectID(), check.kind, check.value, ip, attempt.failures, now, until}
+		if err := attemptStore.CreateLockout(ctx, lockout); err != nil {
+			slog.ErrorContext(ctx, "Couldn't record login lockout", "key", key, "error", err)
+		}
+		slog.WarnContext(ctx, "Login locked out after repeated failures", "kind", check.kind, "value", check.value, "ip", ip, "until", until)
+	}
+}
+
+// Check a login attempt against the throttle and the user's password
+// Returns how long to wait if the attempt was throttled, and an error if the login failed
+func attemptLogin(
+	ctx context.Context,
+	username string,
+	password string,
+	ip string,
+	now time.Time,
+	userStore UserStore,
+	attemptStore LoginAttemptStore,
+) (time.Duration, error) {
+	// Attempts that already have to wait aren't counted
+	wait, err := checkLoginAllowed(ctx, username, ip, now, attemptStore)
+	if err != nil {
+		return wait, err
+	}
+	counted, wait, err := countLoginAttempt(ctx, username, ip, now, attemptStore)
+	if err != nil {
+		recordLoginFailure(ctx, ip, now, counted, attemptStore)
+		return wait, err
+	}
+	if !verifyCredentials(ctx, username, password, userStore) {
+		recordLoginFailure(ctx, ip, now, counted, attemptStore)
+		return 0, unauthorizedError("Invalid username or password")
+	}
+	// The address only loses this attempt, so logging in to one account can't hide guesses at others
+	if err := attemptStore.Reset(ctx, loginAttemptKey(LOCKOUT_ACCOUNT, username)); err != nil {
+		slog.ErrorContext(ctx, "Couldn't reset failed logins", "error", err)
+	}
+	if err := attemptStore.RemoveAttempt(ctx, loginAttemptKey(LOCKOUT_IP, ip)); err != nil {
+		slog.ErrorContext(ctx, "Couldn't take back login attempt", "error", err)
+	}
+	// Only say the account is banned to someone who knows its password
+	if user, err := userStore.GetByUsername(ctx, username); err == nil && user.Banned {
+		return 0, forbiddenError("This account has been banned")
+	}
+	return 0, nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Count a login attempt that got the password wrong
+func failLogin(t *testing.T, username string, ip string, now time.Time, store LoginAttemptStore) {
+	t.Helper()
+	counted, _, err := countLoginAttempt(context.TODO(), username, ip, now, store)
+	if err != nil && errorStatus(err) != http.StatusTooManyRequests {
+		t.Fatal(err)
+	}
+	recordLoginFailure(context.TODO(), ip, now, counted, store)
+}
+
+func TestLoginBackoff(t *testing.T){
+	expected := map[int]time.Duration{0: 0, 2: 0, 3: time.Second, 4: 2 * time.Second, 6: 8 * time.Second, 20: loginMaxDelay, 1000: loginMaxDelay}
+	for failures, delay := range expected {
+		if got := loginBackoff(failures, accountLoginLimits); got != delay {
+			t.Errorf("Backoff after %v failures should be %v, got %v", failures, delay, got)
+		}
+	}
+}
+
+func TestLoginLockout(t *testing.T){
+	ctx := context.TODO()
+	store := NewMemoryLoginAttemptStore()
+	now := time.Date(2021, 5, 1, 12, 0, 0, 0, time.UTC)
+	for i := 1; i <= accountLoginLimits.lockoutFailures; i++ {
+		if _, err := checkLoginAllowed(ctx, "bill", "10.0.0.1", now, store); err != nil {
+			t.Fatalf("Attempt %v should be allowed once the backoff has passed, got %v", i, err)
+		}
+		failLogin(t, "bill", "10.0.0.1", now, store)
+		if i < accountLoginLimits.lockoutFailures {
+			now = now.Add(loginBackoff(i, accountLoginLimits))
+		}
+	}
+
+	wait, err := checkLoginAllowed(ctx, "bill", "10.0.0.2", now, store)
+	if errorStatus(err) != http.StatusTooManyRequests || wait <= loginMaxDelay || !strings.Contains(err.Error(), "15 minutes") {
+		t.Errorf("Account should be locked out from any address, got %v %v", wait, err)
+	}
+	if _, err := checkLoginAllowed(ctx, "alice", "10.0.0.2", now, store); err != nil {
+		t.Errorf("Other accounts should not be locked out, got %v", err)
+	}
+	lockouts, _ := store.ListLockouts(ctx, now.Add(-time.Hour))
+	if len(lockouts) != 1 || lockouts[0].Kind != LOCKOUT_ACCOUNT || lockouts[0].Value != "bill" || lockouts[0].IP != "10.0.0.1" {
+		t.Errorf("Lockout should be recorded, got %+v", lockouts)
+	}
+
+	// The lockout ends, and the account gets its free attempts again
+	now = now.Add(loginLockoutDuration)
+	failLogin(t, "bill", "10.0.0.3", now, store)
+	if _, err := checkLoginAllowed(ctx, "bill", "10.0.0.3", now, store); err != nil {
+		t.Errorf("Lockout should have ended, got %v", err)
+	}
+}
+
+func TestLoginFailuresForgotten(t *testing.T){
+	ctx := context.TODO()
+	store := NewMemoryLoginAttemptStore()
+	now := time.Now()
+	for i := 0; i < accountLoginLimits.freeFailures; i++ {
+		failLogin(t, "bill", "10.0.0.1", now, store)
+	}
+	if _, err := checkLoginAllowed(ctx, "bill", "10.0.0.1", now, store); err == nil {
+		t.Fatal("Attempt straight after the free failures should wait")
+	}
+	later := now.Add(loginFailureWindow + time.Second)
+	failLogin(t, "bill", "10.0.0.1", later, store)
+	if attempts, _ := store.Get(ctx, loginAttemptKey(LOCKOUT_ACCOUNT, "bill")); attempts.Failures != 1 {
+		t.Errorf("Old failures should be forgotten, got %v", attempts.Failures)
+	}
+}
+
+func TestConcurrentLoginAttempts(t *testing.T){
+	store := NewMemoryLoginAttemptStore()
+	userStore := NewMemoryUserStore()
+	now := time.Now()
+	results := make(chan error)
+	for i := 0; i < 20; i++ {
+		go func() {
+			_, err := attemptLogin(context.TODO(), "bill", "guess", "10.0.0.1", now, userStore, store)
+			results <- err
+		}()
+	}
+	checked := 0
+	for i := 0; i < 20; i++ {
+		if errorStatus(<-results) == http.StatusUnauthorized {
+			checked++
+		}
+	}
+	if checked != accountLoginLimits.freeFailures {
+		t.Errorf("Only the free attempts should have their password checked, got %v", checked)
+	}
+}
+
+func TestLoginAttemptTakenBack(t *testing.T){
+	app := newTestApp(t)
+	app.login(t, "bill")
+	for i := 0; i < ipLoginLimits.freeFailures; i++ {
+		if _, err := attemptLogin(context.TODO(), "bill", "password", "10.0.0.1", time.Now(), app.users, app.loginAttempts); err != nil {
+			t.Fatalf("Login %v should succeed, got %v", i, err)
+		}
+	}
+	if attempts, _ := app.loginAttempts.Get(context.TODO(), loginAttemptKey(LOCKOUT_IP, "10.0.0.1")); attempts.Failures != 0 {
+		t.Errorf("Successful logins should not count against the address, got %v", attempts.Failures)
+	}
+}
+
+func TestLoginThrottled(t *testing.T){
+	app := newTestApp(t)
+	app.login(t, "bill")
+	cookies := app.visit("/login")
+	wrong := url.Values{"username": {"bill"}, "password": {"wrong"}}
+	for i := 0; i < accountLoginLimits.freeFailures; i++ {
+		rec := app.postForm("/login", wrong, cookies)
+		if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "Invalid username or password") {
+			t.Fatalf("Wrong password should show an error, got %v", rec.Code)
+		}
+	}
+
+	// Even the right password has to wait
+	rec := app.postForm("/login", url.Values{"username": {"bill"}, "password": {"password"}}, cookies)
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "1" {
+		t.Fatalf("Login should be throttled, got %v", rec.Code)
+	}
+	if !strings.Contains(rec.Body.String(), "Too many failed login attempts, please wait 1 second") {
+		t.Error("Login page should say how long to wait")
+	}
+	rec = app.apiCall(t, "POST", "/auth/login", APICredentials{"bill", "password"}, nil, nil)
+	expectAPIError(t, rec, http.StatusTooManyRequests)
+
+	// Other accounts can still log in from the same address
+	app.login(t, "alice")
+}
+
+func TestClientIP(t *testing.T){
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "10.0.0.1:5000"
+	req.Header.Add("X-Forwarded-For", "1.1.1.1, 2.2.2.2")
+	req.Header.Add("X-Forwarded-For", "3.3.3.3")
+	if ip := clientIP(req); ip != "10.0.0.1" {
+		t.Errorf("Forwarded addresses should be ignored by default, got %v", ip)
+	}
+	trustProxyHeaders = true
+	defer func() { trustProxyHeaders = false }()
+	if ip := clientIP(req); ip != "3.3.3.3" {
+		t.Errorf("Address added by the load balancer should be used, got %v", ip)
+	}
+}
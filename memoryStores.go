@@ -0,0 +1,1085 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// In-memory store implementations, used by tests and for running without MongoDB
+// Uniqueness constraints match the indexes created by ensureMongoIndexes
+
+// *****
+// Users
+// *****
+
+type MemoryUserStore struct {
+	mu sync.Mutex
+	users map[primitive.ObjectID]User
+}
+
+func NewMemoryUserStore() *MemoryUserStore {
+	return &MemoryUserStore{users: make(map[primitive.ObjectID]User)}
+}
+
+func (m *MemoryUserStore) Get(ctx context.Context, userId primitive.ObjectID) (User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	user, ok := m.users[userId]
+	if !ok {
+		return User{}, ErrNotFound
+	}
+	return user, nil
+}
+
+func (m *MemoryUserStore) GetByUsername(ctx context.Context, username string) (User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, user := range m.users {
+		if user.Username == username {
+			return user, nil
+		}
+	}
+	return User{}, ErrNotFound
+}
+
+func (m *MemoryUserStore) Create(ctx context.Context, user User) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.users[user.Id]; ok {
+		return ErrDuplicate
+	}
+	for _, existing := range m.users {
+		if existing.Username == user.Username {
+			return ErrDuplicate
+		}
+	}
+	m.users[user.Id] = user
+	return nil
+}
+
+func (m *MemoryUserStore) UpdatePassword(ctx context.Context, userId primitive.ObjectID, passwordHash string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	user, ok := m.users[userId]
+	if !ok {
+		return ErrNotFound
+	}
+	user.Password = passwordHash
+	m.users[userId] = user
+	return nil
+}
+
+func (m *MemoryUserStore) UpdatePrivacy(ctx context.Context, userId primitive.ObjectID, privacy UserPrivacy) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	user, ok := m.users[userId]
+	if !ok {
+		return ErrNotFound
+	}
+	user.Privacy = privacy
+	m.users[userId] = user
+	return nil
+}
+
+func (m *MemoryUserStore) UpdateRole(ctx context.Context, userId primitive.ObjectID, role string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	user, ok := m.users[userId]
+	if !ok {
+		return ErrNotFound
+	}
+	user.Role = role
+	m.users[userId] = user
+	return nil
+}
+
+func (m *MemoryUserStore) UpdateBanned(ctx context.Context, userId primitive.ObjectID, banned bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	user, ok := m.users[userId]
+	if !ok {
+		return ErrNotFound
+	}
+	user.Banned = banned
+	m.users[userId] = user
+	return nil
+}
+
+func (m *MemoryUserStore) ListStaffAndBanned(ctx context.Context) ([]User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	users := []User{}
+	for _, user := range m.users {
+		if user.GetRole() != ROLE_USER || user.Banned {
+			users = append(users, user)
+		}
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Username < users[j].Username
+	})
+	return users, nil
+}
+
+// ********
+// Contests
+// ********
+
+type MemoryContestStore struct {
+	mu sync.Mutex
+	contests map[primitive.ObjectID]Contest
+}
+
+func NewMemoryContestStore() *MemoryContestStore {
+	return &MemoryContestStore{contests: make(map[primitive.ObjectID]Contest)}
+}
+
+func (m *MemoryContestStore) Get(ctx context.Context, contestId primitive.ObjectID) (Contest, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	contest, ok := m.contests[contestId]
+	if !ok {
+		return Contest{}, ErrNotFound
+	}
+	return contest, nil
+}
+
+func (m *MemoryContestStore) List(ctx context.Context) ([]Contest, error) {
+	return m.filter(func(c Contest) bool { return true }), nil
+}
+
+func (m *MemoryContestStore) Search(ctx context.Context, query ContestQuery) ([]Contest, error) {
+	contests := m.filter(func(c Contest) bool {
+		if query.State != nil && c.State != *query.State {
+			return false
+		}
+		if query.OwnerId != nil && c.OwnerId != *query.OwnerId {
+			return false
+		}
+		if query.CommunityId != nil && (c.CommunityId == nil || *c.CommunityId != *query.CommunityId) {
+			return false
+		}
+		if !isContestListed(c, query.ViewerId, query.MemberOf, query.Communities) {
+			return false
+		}
+		if query.Search != "" && !matchesSearch(c, query.Search) {
+			return false
+		}
+		if query.Sort == SORT_ENDING_SOON && c.CurrentDeadline() == nil {
+			return false
+		}
+		return query.After == nil || contestCursorLess(query.Sort, *query.After, contestCursor(query.Sort, c))
+	})
+	sort.Slice(contests, func(i, j int) bool {
+		return contestCursorLess(query.Sort, contestCursor(query.Sort, contests[i]), contestCursor(query.Sort, contests[j]))
+	})
+	if len(contests) > query.Limit {
+		contests = contests[:query.Limit]
+	}
+	return contests, nil
+}
+
+func (m *MemoryContestStore) IncrementEntryCount(ctx context.Context, contestId primitive.ObjectID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	contest, ok := m.contests[contestId]
+	if !ok {
+		return ErrNotFound
+	}
+	contest.EntryCount++
+	m.contests[contestId] = contest
+	return nil
+}
+
+func (m *MemoryContestStore) DecrementEntryCount(ctx context.Context, contestId primitive.ObjectID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	contest, ok := m.contests[contestId]
+	if !ok {
+		return ErrNotFound
+	}
+	contest.EntryCount--
+	m.contests[contestId] = contest
+	return nil
+}
+
+func (m *MemoryContestStore) ListByOwner(ctx context.Context, ownerId primitive.ObjectID) ([]Contest, error) {
+	contests := m.filter(func(c Contest) bool { return c.OwnerId == ownerId })
+	// ObjectIDs start with their creation time
+	sort.Slice(contests, func(i, j int) bool {
+		return contests[i].Id.Hex() > contests[j].Id.Hex()
+	})
+	return contests, nil
+}
+
+func (m *MemoryContestStore) Create(ctx context.Context, contest Contest) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.contests[contest.Id]; ok {
+		return ErrDuplicate
+	}
+	m.contests[contest.Id] = contest
+	return nil
+}
+
+func (m *MemoryContestStore) UpdateState(ctx context.Context, contestId primitive.ObjectID, from int, to int) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	contest, ok := m.contests[contestId]
+	if !ok || contest.State != from {
+		return false, nil
+	}
+	contest.State = to
+	contest.ResultsRecorded = false
+	m.contests[contestId] = contest
+	return true, nil
+}
+
+func (m *MemoryContestStore) SetResultsRecorded(ctx context.Context, contestId primitive.ObjectID, recorded bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	contest, ok := m.contests[contestId]
+	if !ok {
+		return ErrNotFound
+	}
+	contest.ResultsRecorded = recorded
+	m.contests[contestId] = contest
+	return nil
+}
+
+func (m *MemoryContestStore) UpdateDetails(ctx context.Context, contestId primitive.ObjectID, name string, description string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	contest, ok := m.contests[contestId]
+	if !ok {
+		return ErrNotFound
+	}
+	contest.Name = name
+	contest.Description = description
+	m.contests[contestId] = contest
+	return nil
+}
+
+func (m *MemoryContestStore) ListDeadlinePassed(ctx context.Context, now time.Time) ([]Contest, error) {
+	return m.filter(func(c Contest) bool {
+		return (c.IsOpen() && deadlinePassed(c.SubmissionEnd, now)) ||
+			(c.IsVoting() && deadlinePassed(c.VotingEnd, now))
+	}), nil
+}
+
+func (m *MemoryContestStore) Delete(ctx context.Context, contestId primitive.ObjectID) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.contests[contestId]; !ok {
+		return false, nil
+	}
+	delete(m.contests, contestId)
+	return true, nil
+}
+
+// Return matching contests in creation order
+func (m *MemoryContestStore) filter(match func(Contest) bool) []Contest {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	contests := []Contest{}
+	for _, contest := range m.contests {
+		if match(contest) {
+			contests = append(contests, contest)
+		}
+	}
+	sort.Slice(contests, func(i, j int) bool {
+		return contests[i].Id.Hex() < contests[j].Id.Hex()
+	})
+	return contests
+}
+
+// *******
+// Entries
+// *******
+
+type MemoryEntryStore struct {
+	mu sync.Mutex
+	entries map[primitive.ObjectID]ContestEntry
+}
+
+func NewMemoryEntryStore() *MemoryEntryStore {
+	return &MemoryEntryStore{entries: make(map[primitive.ObjectID]ContestEntry)}
+}
+
+func (m *MemoryEntryStore) Get(ctx context.Context, entryId primitive.ObjectID) (ContestEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entry, ok := m.entries[entryId]
+	if !ok {
+		return ContestEntry{}, ErrNotFound
+	}
+	return entry, nil
+}
+
+func (m *MemoryEntryStore) Create(ctx context.Context, entry ContestEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.entries[entry.Id]; ok {
+		return ErrDuplicate
+	}
+	for _, existing := range m.entries {
+		if existing.ContestID == entry.ContestID && existing.OwnerId == entry.OwnerId {
+			return ErrDuplicate
+		}
+	}
+	m.entries[entry.Id] = entry
+	return nil
+}
+
+func (m *MemoryEntryStore) ListByContest(ctx context.Context, contestId primitive.ObjectID) ([]ContestEntry, error) {
+	return m.filter(func(e ContestEntry) bool { return e.ContestID == contestId }), nil
+}
+
+func (m *MemoryEntryStore) CountByContest(ctx context.Context, contestId primitive.ObjectID) (int64, error) {
+	return int64(len(m.filter(func(e ContestEntry) bool {
+		return e.ContestID == contestId
+	}))), nil
+}
+
+func (m *MemoryEntryStore) CountByOwner(ctx context.Context, contestId primitive.ObjectID, ownerId primitive.ObjectID) (int64, error) {
+	return int64(len(m.filter(func(e ContestEntry) bool {
+		return e.ContestID == contestId && e.OwnerId == ownerId
+	}))), nil
+}
+
+func (m *MemoryEntryStore) ListByOwner(ctx context.Context, ownerId primitive.ObjectID) ([]ContestEntry, error) {
+	entries := m.filter(func(e ContestEntry) bool { return e.OwnerId == ownerId })
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Id.Hex() > entries[j].Id.Hex()
+	})
+	return entries, nil
+}
+
+func (m *MemoryEntryStore) ListSimilarImages(ctx context.Context, hash int64, maxDistance int) ([]ContestEntry, error) {
+	return m.filter(func(e ContestEntry) bool {
+		return e.HasImageHash() && imageHashDistance(e.ImageHash, hash) <= maxDistance
+	}), nil
+}
+
+func (m *MemoryEntryStore) UpdateResult(ctx context.Context, entryId primitive.ObjectID, placement int, won bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entry, ok := m.entries[entryId]
+	if !ok {
+		return ErrNotFound
+	}
+	entry.Placement = placement
+	entry.Won = won
+	m.entries[entryId] = entry
+	return nil
+}
+
+func (m *MemoryEntryStore) Delete(ctx context.Context, entryId primitive.ObjectID) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.entries[entryId]; !ok {
+		return false, nil
+	}
+	delete(m.entries, entryId)
+	return true, nil
+}
+
+func (m *MemoryEntryStore) DeleteByContest(ctx context.Context, contestId primitive.ObjectID) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var deleted int64
+	for id, entry := range m.entries {
+		if entry.ContestID == contestId {
+			delete(m.entries, id)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+// Return matching entries in submission order
+func (m *MemoryEntryStore) filter(match func(ContestEntry) bool) []ContestEntry {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entries := []ContestEntry{}
+	for _, entry := range m.entries {
+		if match(entry) {
+			entries = append(entries, entry)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Id.Hex() < entries[j].Id.Hex()
+	})
+	return entries
+}
+
+// *****
+// Votes
+// *****
+
+type MemoryVoteStore struct {
+	mu sync.Mutex
+	votes map[primitive.ObjectID]ContestVote
+}
+
+func NewMemoryVoteStore() *MemoryVoteStore {
+	return &MemoryVoteStore{votes: make(map[primitive.ObjectID]ContestVote)}
+}
+
+func (m *MemoryVoteStore) Create(ctx context.Context, vote ContestVote) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.votes[vote.Id]; ok {
+		return ErrDuplicate
+	}
+	for _, existing := range m.votes {
+		if existing.ContestID == vote.ContestID && existing.UserID == vote.UserID {
+			return ErrDuplicate
+		}
+	}
+	m.votes[vote.Id] = vote
+	return nil
+}
+
+func (m *MemoryVoteStore) CountByUser(ctx context.Context, contestId primitive.ObjectID, userId primitive.ObjectID) (int64, error) {
+	return m.count(func(v ContestVote) bool {
+		return v.ContestID == contestId && v.UserID == userId
+	}), nil
+}
+
+func (m *MemoryVoteStore) ListByContest(ctx context.Context, contestId primitive.ObjectID) ([]ContestVote, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	votes := []ContestVote{}
+	for _, vote := range m.votes {
+		if vote.ContestID == contestId {
+			votes = append(votes, vote)
+		}
+	}
+	sort.Slice(votes, func(i, j int) bool {
+		return votes[i].Id.Hex() < votes[j].Id.Hex()
+	})
+	return votes, nil
+}
+
+func (m *MemoryVoteStore) CountByVoter(ctx context.Context, userId primitive.ObjectID) (int64, error) {
+	return m.count(func(v ContestVote) bool { return v.UserID == userId }), nil
+}
+
+func (m *MemoryVoteStore) DeleteByEntry(ctx context.Context, contestId primitive.ObjectID, entryId primitive.ObjectID) (int64, error) {
+	return m.delete(func(v ContestVote) bool {
+		if v.ContestID != contestId {
+			return false
+		}
+		for _, choice := range v.GetChoices() {
+			if choice.EntryID == entryId {
+				return true
+			}
+		}
+		return false
+	}), nil
+}
+
+func (m *MemoryVoteStore) DeleteByContest(ctx context.Context, contestId primitive.ObjectID) (int64, error) {
+	return m.delete(func(v ContestVote) bool { return v.ContestID == contestId }), nil
+}
+
+func (m *MemoryVoteStore) delete(match func(ContestVote) bool) int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var deleted int64
+	for id, vote := range m.votes {
+		if match(vote) {
+			delete(m.votes, id)
+			deleted++
+		}
+	}
+	return deleted
+}
+
+func (m *MemoryVoteStore) count(match func(ContestVote) bool) int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var count int64
+	for _, vote := range m.votes {
+		if match(vote) {
+			count++
+		}
+	}
+	return count
+}
+
+// ******
+// Tokens
+// ******
+
+type MemoryTokenStore struct {
+	mu sync.Mutex
+	tokens map[primitive.ObjectID]AccessToken
+}
+
+func NewMemoryTokenStore() *MemoryTokenStore {
+	return &MemoryTokenStore{tokens: make(map[primitive.ObjectID]AccessToken)}
+}
+
+func (m *MemoryTokenStore) Create(ctx context.Context, token AccessToken) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.tokens[token.Id]; ok {
+		return ErrDuplicate
+	}
+	for _, existing := range m.tokens {
+		if existing.TokenHash == token.TokenHash {
+			return ErrDuplicate
+		}
+	}
+	m.tokens[token.Id] = token
+	return nil
+}
+
+func (m *MemoryTokenStore) GetByHash(ctx context.Context, tokenHash string) (AccessToken, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, token := range m.tokens {
+		if token.TokenHash == tokenHash {
+			return token, nil
+		}
+	}
+	return AccessToken{}, ErrNotFound
+}
+
+func (m *MemoryTokenStore) ListByUser(ctx context.Context, userId primitive.ObjectID) ([]AccessToken, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	tokens := []AccessToken{}
+	for _, token := range m.tokens {
+		if token.UserId == userId {
+			tokens = append(tokens, token)
+		}
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].Id.Hex() < tokens[j].Id.Hex()
+	})
+	return tokens, nil
+}
+
+func (m *MemoryTokenStore) Delete(ctx context.Context, userId primitive.ObjectID, tokenId primitive.ObjectID) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	token, ok := m.tokens[tokenId]
+	if !ok || token.UserId != userId {
+		return false, nil
+	}
+	delete(m.tokens, tokenId)
+	return true, nil
+}
+
+func (m *MemoryTokenStore) UpdateLastUsed(ctx context.Context, tokenId primitive.ObjectID, lastUsed time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	token, ok := m.tokens[tokenId]
+	if !ok {
+		return ErrNotFound
+	}
+	token.LastUsed = &lastUsed
+	m.tokens[tokenId] = token
+	return nil
+}
+
+// **************
+// Login attempts
+// **************
+
+type MemoryLoginAttemptStore struct {
+	mu sync.Mutex
+	attempts map[string]LoginAttempts
+	lockouts []LoginLockout
+}
+
+func NewMemoryLoginAttemptStore() *MemoryLoginAttemptStore {
+	return &MemoryLoginAttemptStore{attempts: make(map[string]LoginAttempts)}
+}
+
+func (m *MemoryLoginAttemptStore) Get(ctx context.Context, key string) (LoginAttempts, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	attempts, ok := m.attempts[key]
+	if !ok {
+		return LoginAttempts{}, ErrNotFound
+	}
+	return attempts, nil
+}
+
+func (m *MemoryLoginAttemptStore) AddAttempt(ctx context.Context, key string, now time.Time, resetBefore time.Time) (LoginAttempts, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	before := m.attempts[key]
+	attempts := before
+	attempts.Key = key
+	if attempts.LastFailure.Before(resetBefore) {
+		attempts.Failures = 0
+	}
+	attempts.Failures++
+	attempts.LastFailure = now
+	m.attempts[key] = attempts
+	return before, nil
+}
+
+func (m *MemoryLoginAttemptStore) RemoveAttempt(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if attempts, ok := m.attempts[key]; ok && attempts.Failures > 0 {
+		attempts.Failures--
+		m.attempts[key] = attempts
+	}
+	return nil
+}
+
+func (m *MemoryLoginAttemptStore) Lock(ctx context.Context, key string, until time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	attempts := m.attempts[key]
+	attempts.Key = key
+	attempts.Failures = 0
+	attempts.LockedUntil = until
+	m.attempts[key] = attempts
+	return nil
+}
+
+func (m *MemoryLoginAttemptStore) Reset(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.attempts, key)
+	return nil
+}
+
+func (m *MemoryLoginAttemptStore) CreateLockout(ctx context.Context, lockout LoginLockout) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lockouts = append(m.lockouts, lockout)
+	return nil
+}
+
+func (m *MemoryLoginAttemptStore) ListLockouts(ctx context.Context, since time.Time) ([]LoginLockout, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	lockouts := []LoginLockout{}
+	for _, lockout := range m.lockouts {
+		if !lockout.Start.Before(since) {
+			lockouts = append(lockouts, lockout)
+		}
+	}
+	sort.SliceStable(lockouts, func(i, j int) bool {
+		return lockouts[i].Start.After(lockouts[j].Start)
+	})
+	return lockouts, nil
+}
+
+// ********
+// Sessions
+// ********
+
+type MemorySessionStore struct {
+	mu sync.Mutex
+	sessions map[primitive.ObjectID]UserSession
+}
+
+func NewMemorySessionStore() *MemorySessionStore {
+	return &MemorySessionStore{sessions: make(map[primitive.ObjectID]UserSession)}
+}
+
+func (m *MemorySessionStore) Create(ctx context.Context, session UserSession) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.sessions[session.Id]; ok {
+		return ErrDuplicate
+	}
+	for _, existing := range m.sessions {
+		if existing.TokenHash == session.TokenHash {
+			return ErrDuplicate
+		}
+	}
+	m.sessions[session.Id] = session
+	return nil
+}
+
+func (m *MemorySessionStore) GetByHash(ctx context.Context, tokenHash string) (UserSession, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, session := range m.sessions {
+		if session.TokenHash == tokenHash {
+			return session, nil
+		}
+	}
+	return UserSession{}, ErrNotFound
+}
+
+func (m *MemorySessionStore) ListByUser(ctx context.Context, userId primitive.ObjectID) ([]UserSession, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sessions := []UserSession{}
+	for _, session := range m.sessions {
+		if session.UserId == userId {
+			sessions = append(sessions, session)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].LastSeen.After(sessions[j].LastSeen)
+	})
+	return sessions, nil
+}
+
+func (m *MemorySessionStore) UpdateLastSeen(ctx context.Context, sessionId primitive.ObjectID, lastSeen time.Time, ip string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	session, ok := m.sessions[sessionId]
+	if !ok {
+		return ErrNotFound
+	}
+	session.LastSeen = lastSeen
+	session.IP = ip
+	m.sessions[sessionId] = session
+	return nil
+}
+
+func (m *MemorySessionStore) Delete(ctx context.Context, userId primitive.ObjectID, sessionId primitive.ObjectID) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	session, ok := m.sessions[sessionId]
+	if !ok || session.UserId != userId {
+		return false, nil
+	}
+	delete(m.sessions, sessionId)
+	return true, nil
+}
+
+func (m *MemorySessionStore) DeleteByUser(ctx context.Context, userId primitive.ObjectID) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var deleted int64
+	for id, session := range m.sessions {
+		if session.UserId == userId {
+			delete(m.sessions, id)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+// ************
+// Participants
+// ************
+
+type MemoryParticipantStore struct {
+	mu sync.Mutex
+	participants map[primitive.ObjectID]ContestParticipant
+}
+
+func NewMemoryParticipantStore() *MemoryParticipantStore {
+	return &MemoryParticipantStore{participants: make(map[primitive.ObjectID]ContestParticipant)}
+}
+
+func (m *MemoryParticipantStore) Add(ctx context.Context, participant ContestParticipant) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, existing := range m.participants {
+		if existing.ContestId == participant.ContestId && existing.UserId == participant.UserId {
+			return ErrDuplicate
+		}
+	}
+	m.participants[participant.Id] = participant
+	return nil
+}
+
+func (m *MemoryParticipantStore) IsParticipant(ctx context.Context, contestId primitive.ObjectID, userId primitive.ObjectID) (bool, error) {
+	return len(m.filter(func(p ContestParticipant) bool {
+		return p.ContestId == contestId && p.UserId == userId
+	})) > 0, nil
+}
+
+func (m *MemoryParticipantStore) ListByContest(ctx context.Context, contestId primitive.ObjectID) ([]ContestParticipant, error) {
+	return m.filter(func(p ContestParticipant) bool { return p.ContestId == contestId }), nil
+}
+
+func (m *MemoryParticipantStore) ListContestIds(ctx context.Context, userId primitive.ObjectID) ([]primitive.ObjectID, error) {
+	contestIds := []primitive.ObjectID{}
+	for _, participant := range m.filter(func(p ContestParticipant) bool { return p.UserId == userId }) {
+		contestIds = append(contestIds, participant.ContestId)
+	}
+	return contestIds, nil
+}
+
+func (m *MemoryParticipantStore) Remove(ctx context.Context, contestId primitive.ObjectID, userId primitive.ObjectID) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for id, participant := range m.participants {
+		if participant.ContestId == contestId && participant.UserId == userId {
+			delete(m.participants, id)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Return matching participants in the order they were added
+func (m *MemoryParticipantStore) filter(match func(ContestParticipant) bool) []ContestParticipant {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	participants := []ContestParticipant{}
+	for _, participant := range m.participants {
+		if match(participant) {
+			participants = append(participants, participant)
+		}
+	}
+	sort.Slice(participants, func(i, j int) bool {
+		return participants[i].Id.Hex() < participants[j].Id.Hex()
+	})
+	return participants
+}
+
+// *******
+// Invites
+// *******
+
+type MemoryInviteStore struct {
+	mu sync.Mutex
+	invites map[primitive.ObjectID]ContestInvite
+}
+
+func NewMemoryInviteStore() *MemoryInviteStore {
+	return &MemoryInviteStore{invites: make(map[primitive.ObjectID]ContestInvite)}
+}
+
+func (m *MemoryInviteStore) Create(ctx context.Context, invite ContestInvite) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, existing := range m.invites {
+		if existing.Id == invite.Id || existing.Code == invite.Code {
+			return ErrDuplicate
+		}
+	}
+	m.invites[invite.Id] = invite
+	return nil
+}
+
+func (m *MemoryInviteStore) GetByCode(ctx context.Context, code string) (ContestInvite, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, invite := range m.invites {
+		if invite.Code == code {
+			return invite, nil
+		}
+	}
+	return ContestInvite{}, ErrNotFound
+}
+
+func (m *MemoryInviteStore) ListByContest(ctx context.Context, contestId primitive.ObjectID) ([]ContestInvite, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	invites := []ContestInvite{}
+	for _, invite := range m.invites {
+		if invite.ContestId == contestId {
+			invites = append(invites, invite)
+		}
+	}
+	sort.Slice(invites, func(i, j int) bool {
+		return invites[i].Id.Hex() > invites[j].Id.Hex()
+	})
+	return invites, nil
+}
+
+func (m *MemoryInviteStore) Use(ctx context.Context, inviteId primitive.ObjectID, now time.Time) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	invite, ok := m.invites[inviteId]
+	if !ok || !invite.IsUsable(now) {
+		return false, nil
+	}
+	invite.Uses++
+	m.invites[inviteId] = invite
+	return true, nil
+}
+
+func (m *MemoryInviteStore) Delete(ctx context.Context, contestId primitive.ObjectID, inviteId primitive.ObjectID) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	invite, ok := m.invites[inviteId]
+	if !ok || invite.ContestId != contestId {
+		return false, nil
+	}
+	delete(m.invites, inviteId)
+	return true, nil
+}
+
+// ***********
+// Communities
+// ***********
+
+type MemoryCommunityStore struct {
+	mu sync.Mutex
+	communities map[primitive.ObjectID]Community
+}
+
+func NewMemoryCommunityStore() *MemoryCommunityStore {
+	return &MemoryCommunityStore{communities: make(map[primitive.ObjectID]Community)}
+}
+
+func (m *MemoryCommunityStore) Create(ctx context.Context, community Community) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, existing := range m.communities {
+		if existing.Id == community.Id || existing.Slug == community.Slug {
+			return ErrDuplicate
+		}
+	}
+	m.communities[community.Id] = community
+	return nil
+}
+
+func (m *MemoryCommunityStore) Get(ctx context.Context, communityId primitive.ObjectID) (Community, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	community, ok := m.communities[communityId]
+	if !ok {
+		return Community{}, ErrNotFound
+	}
+	return community, nil
+}
+
+func (m *MemoryCommunityStore) GetBySlug(ctx context.Context, slug string) (Community, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, community := range m.communities {
+		if community.Slug == slug {
+			return community, nil
+		}
+	}
+	return Community{}, ErrNotFound
+}
+
+func (m *MemoryCommunityStore) List(ctx context.Context) ([]Community, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	communities := []Community{}
+	for _, community := range m.communities {
+		communities = append(communities, community)
+	}
+	sort.Slice(communities, func(i, j int) bool {
+		return communities[i].Name < communities[j].Name
+	})
+	return communities, nil
+}
+
+func (m *MemoryCommunityStore) Delete(ctx context.Context, communityId primitive.ObjectID) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.communities[communityId]; !ok {
+		return false, nil
+	}
+	delete(m.communities, communityId)
+	return true, nil
+}
+
+// *****************
+// Community Members
+// *****************
+
+type MemoryCommunityMemberStore struct {
+	mu sync.Mutex
+	members map[primitive.ObjectID]CommunityMember
+}
+
+func NewMemoryCommunityMemberStore() *MemoryCommunityMemberStore {
+	return &MemoryCommunityMemberStore{members: make(map[primitive.ObjectID]CommunityMember)}
+}
+
+func (m *MemoryCommunityMemberStore) Add(ctx context.Context, member CommunityMember) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, existing := range m.members {
+		if existing.CommunityId == member.CommunityId && existing.UserId == member.UserId {
+			return ErrDuplicate
+		}
+	}
+	m.members[member.Id] = member
+	return nil
+}
+
+func (m *MemoryCommunityMemberStore) Get(ctx context.Context, communityId primitive.ObjectID, userId primitive.ObjectID) (CommunityMember, error) {
+	members := m.filter(func(c CommunityMember) bool {
+		return c.CommunityId == communityId && c.UserId == userId
+	})
+	if len(members) == 0 {
+		return CommunityMember{}, ErrNotFound
+	}
+	return members[0], nil
+}
+
+func (m *MemoryCommunityMemberStore) ListByCommunity(ctx context.Context, communityId primitive.ObjectID) ([]CommunityMember, error) {
+	return m.filter(func(c CommunityMember) bool { return c.CommunityId == communityId }), nil
+}
+
+func (m *MemoryCommunityMemberStore) ListByUser(ctx context.Context, userId primitive.ObjectID) ([]CommunityMember, error) {
+	return m.filter(func(c CommunityMember) bool { return c.UserId == userId }), nil
+}
+
+func (m *MemoryCommunityMemberStore) UpdateRole(ctx context.Context, communityId primitive.ObjectID, userId primitive.ObjectID, role string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for id, member := range m.members {
+		if member.CommunityId == communityId && member.UserId == userId {
+			if member.IsAdmin() && role != COMMUNITY_ADMIN && m.countAdmins(communityId) <= 1 {
+				return ErrLastAdmin
+			}
+			member.Role = role
+			m.members[id] = member
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (m *MemoryCommunityMemberStore) Remove(ctx context.Context, communityId primitive.ObjectID, userId primitive.ObjectID) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for id, member := range m.members {
+		if member.CommunityId == communityId && member.UserId == userId {
+			if member.IsAdmin() && m.countAdmins(communityId) <= 1 {
+				return false, ErrLastAdmin
+			}
+			delete(m.members, id)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Count a community's admins, the caller must hold the lock
+func (m *MemoryCommunityMemberStore) countAdmins(communityId primitive.ObjectID) int {
+	admins := 0
+	for _, member := range m.members {
+		if member.CommunityId == communityId && member.IsAdmin() {
+			admins++
+		}
+	}
+	return admins
+}
+
+// Return matching members in the order they joined
+func (m *MemoryCommunityMemberStore) filter(match func(CommunityMember) bool) []CommunityMember {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	members := []CommunityMember{}
+	for _, member := range m.members {
+		if match(member) {
+			members = append(members, member)
+		}
+	}
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].Id.Hex() < members[j].Id.Hex()
+	})
+	return members
+}
@@ -0,0 +1,474 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/draw"
+	"strings"
+)
+
+// Image metadata handling for uploads
+// Stored images have their metadata removed, since it can include the GPS position
+// a photo was taken at and the serial number of the camera. A few camera settings
+// are read out first and kept on the entry as CameraInfo
+
+var errBadMetadata = errors.New("Image metadata is malformed")
+
+// EXIF tags that are read, all other tags are ignored
+const (
+	exifTagMake = 0x010F
+	exifTagModel = 0x0110
+	exifTagOrientation = 0x0112
+	exifTagExifIFD = 0x8769
+	exifTagExposureTime = 0x829A
+	exifTagFNumber = 0x829D
+	exifTagISO = 0x8827
+	exifTagFocalLength = 0x920A
+	exifTagLensModel = 0xA434
+)
+
+// Longest camera or lens name that is kept
+const maxCameraNameLength = 64
+
+// Remove metadata from an image file and read the allow-listed camera info
+// The EXIF orientation is the only metadata written back, so photos still display upright
+// Returns the cleaned file, the camera info if there was any and the orientation
+func stripMetadata(data []byte, format string) ([]byte, *CameraInfo, int, error) {
+	switch format {
+	case "jpeg":
+		return stripJpegMetadata(data)
+	case "png":
+		return stripPngMetadata(data)
+	case "webp":
+		return stripWebpMetadata(data)
+	default:
+		// GIF has no EXIF, and decodeUpload already rejects anything else
+		return data, nil, 1, nil
+	}
+}
+
+// JPEG files are a list of segments, each starting with a marker
+// Only segments needed to display the image are kept, along with the color profile.
+// Everything after the end of image marker is dropped, which includes the preview
+// images some cameras append (MPF) with their own copy of the EXIF and GPS data
+func stripJpegMetadata(data []byte) ([]byte, *CameraInfo, int, error) {
+	if len(data) < 2 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil, nil, 0, errBadMetadata
+	}
+	var camera *CameraInfo
+	orientation := 1
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(data[:2])
+	pos := 2
+	for {
+		if pos + 2 > len(data) || data[pos] != 0xFF {
+			return nil, nil, 0, errBadMetadata
+		}
+		marker := data[pos + 1]
+		if marker == 0xFF {
+			// Fill byte before a marker
+			pos++
+			continue
+		}
+		if marker == 0xD9 {
+			// End of image, anything after it isn't part of this image
+			out.Write(data[pos:pos + 2])
+			return out.Bytes(), camera, orientation, nil
+		}
+		if pos + 4 > len(data) {
+			return nil, nil, 0, errBadMetadata
+		}
+		length := int(binary.BigEndian.Uint16(data[pos + 2:]))
+		end := pos + 2 + length
+		if length < 2 || end > len(data) {
+			return nil, nil, 0, errBadMetadata
+		}
+		payload := data[pos + 4:end]
+		if marker == 0xDA {
+			// Start of scan, followed by image data up to the next marker.
+			// Progressive images have more segments and scans after it
+			next := nextJpegMarker(data, end)
+			out.Write(data[pos:next])
+			if next == len(data) {
+				// Truncated image without an end marker
+				return out.Bytes(), camera, orientation, nil
+			}
+			pos = next
+			continue
+		}
+
+		isApp := marker >= 0xE0 && marker <= 0xEF
+		keep := !isApp && marker != 0xFE
+		switch {
+		case marker == 0xE0, marker == 0xEE:
+			// JFIF and Adobe segments describe how to decode the image
+			keep = true
+		case marker == 0xE2 && bytes.HasPrefix(payload, []byte("ICC_PROFILE\x00")):
+			keep = true
+		case marker == 0xE1 && bytes.HasPrefix(payload, []byte("Exif\x00\x00")):
+			camera, orientation = parseExif(payload[6:])
+			if orientation != 1 {
+				exif := append([]byte("Exif\x00\x00"), orientationExif(orientation)...)
+				out.Write([]byte{0xFF, 0xE1})
+				binary.Write(out, binary.BigEndian, uint16(len(exif) + 2))
+				out.Write(exif)
+			}
+		}
+		if keep {
+			out.Write(data[pos:end])
+		}
+		pos = end
+	}
+}
+
+// Position of the first marker in JPEG image data starting at pos, or the end of data
+// 0xFF bytes in image data are followed by 0x00, and restart markers are part of the data
+func nextJpegMarker(data []byte, pos int) int {
+	for ; pos + 1 < len(data); pos++ {
+		if data[pos] != 0xFF {
+			continue
+		}
+		next := data[pos + 1]
+		if next != 0x00 && next != 0xFF && (next < 0xD0 || next > 0xD7) {
+			return pos
+		}
+	}
+	return len(data)
+}
+
+// PNG files are a list of chunks after the signature
+// Text, time and EXIF chunks are dropped, everything else is needed to display the image
+func stripPngMetadata(data []byte) ([]byte, *CameraInfo, int, error) {
+	if len(data) < 8 {
+		return nil, nil, 0, errBadMetadata
+	}
+	var camera *CameraInfo
+	orientation := 1
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(data[:8])
+	pos := 8
+	for pos < len(data) {
+		if pos + 12 > len(data) {
+			return nil, nil, 0, errBadMetadata
+		}
+		length := int(binary.BigEndian.Uint32(data[pos:]))
+		end := pos + 12 + length
+		if length < 0 || end > len(data) {
+			return nil, nil, 0, errBadMetadata
+		}
+		chunkType := string(data[pos + 4:pos + 8])
+		switch chunkType {
+		case "eXIf":
+			camera, orientation = parseExif(data[pos + 8:pos + 8 + length])
+			if orientation != 1 {
+				writePngChunk(out, "eXIf", orientationExif(orientation))
+			}
+		case "tEXt", "zTXt", "iTXt", "tIME":
+			// Dropped
+		default:
+			out.Write(data[pos:end])
+		}
+		pos = end
+	}
+	return out.Bytes(), camera, orientation, nil
+}
+
+func writePngChunk(out *bytes.Buffer, chunkType string, chunkData []byte) {
+	binary.Write(out, binary.BigEndian, uint32(len(chunkData)))
+	chunk := append([]byte(chunkType), chunkData...)
+	out.Write(chunk)
+	binary.Write(out, binary.BigEndian, crc32.ChecksumIEEE(chunk))
+}
+
+// WebP files are a RIFF container of chunks
+// EXIF and XMP chunks are dropped and the extended header's flags updated to match
+func stripWebpMetadata(data []byte) ([]byte, *CameraInfo, int, error) {
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return nil, nil, 0, errBadMetadata
+	}
+	var camera *CameraInfo
+	orientation := 1
+	var chunks [][]byte
+	vp8xIndex := -1
+	pos := 12
+	for pos < len(data) {
+		if pos + 8 > len(data) {
+			return nil, nil, 0, errBadMetadata
+		}
+		chunkType := string(data[pos:pos + 4])
+		length := int(binary.LittleEndian.Uint32(data[pos + 4:]))
+		end := pos + 8 + length
+		if length < 0 || end > len(data) {
+			return nil, nil, 0, errBadMetadata
+		}
+		chunk := data[pos:end]
+		// Chunks are padded to an even length
+		if length % 2 == 1 && end < len(data) {
+			end++
+			chunk = data[pos:end]
+		}
+		switch chunkType {
+		case "EXIF":
+			// Some encoders include the JPEG style prefix
+			camera, orientation = parseExif(bytes.TrimPrefix(data[pos + 8:pos + 8 + length], []byte("Exif\x00\x00")))
+			if orientation != 1 {
+				chunks = append(chunks, webpChunk("EXIF", orientationExif(orientation)))
+			}
+		case "XMP ":
+			// Dropped
+		case "VP8X":
+			vp8xIndex = len(chunks)
+			chunks = append(chunks, append([]byte(nil), chunk...))
+		default:
+			chunks = append(chunks, chunk)
+		}
+		pos = end
+	}
+	if vp8xIndex != -1 && len(chunks[vp8xIndex]) > 8 {
+		// Flags are the first byte of the VP8X chunk, 0x08 is EXIF and 0x04 is XMP
+		flags := chunks[vp8xIndex][8] &^ 0x0C
+		if orientation != 1 {
+			flags |= 0x08
+		}
+		chunks[vp8xIndex][8] = flags
+	}
+
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.WriteString("RIFF")
+	size := 4
+	for _, chunk := range chunks {
+		size += len(chunk)
+	}
+	binary.Write(out, binary.LittleEndian, uint32(size))
+	out.WriteString("WEBP")
+	for _, chunk := range chunks {
+		out.Write(chunk)
+	}
+	return out.Bytes(), camera, orientation, nil
+}
+
+func webpChunk(chunkType string, chunkData []byte) []byte {
+	chunk := bytes.NewBufferString(chunkType)
+	binary.Write(chunk, binary.LittleEndian, uint32(len(chunkData)))
+	chunk.Write(chunkData)
+	if len(chunkData) % 2 == 1 {
+		chunk.WriteByte(0)
+	}
+	return chunk.Bytes()
+}
+
+// Build EXIF data with only an orientation tag
+func orientationExif(orientation int) []byte {
+	exif := &bytes.Buffer{}
+	// Big endian TIFF header with the first IFD right after it
+	exif.WriteString("MM\x00\x2A")
+	binary.Write(exif, binary.BigEndian, uint32(8))
+	// One entry: tag, SHORT type, count 1, value padded to 4 bytes
+	binary.Write(exif, binary.BigEndian, uint16(1))
+	binary.Write(exif, binary.BigEndian, []uint16{exifTagOrientation, 3})
+	binary.Write(exif, binary.BigEndian, uint32(1))
+	binary.Write(exif, binary.BigEndian, []uint16{uint16(orientation), 0})
+	// No next IFD
+	binary.Write(exif, binary.BigEndian, uint32(0))
+	return exif.Bytes()
+}
+
+// ****
+// EXIF
+// ****
+
+// Reader for the TIFF structure inside EXIF data
+type exifReader struct {
+	data []byte
+	order binary.ByteOrder
+}
+
+// A tag's type, count and the 4 bytes holding its value or the offset to it
+type exifEntry struct {
+	dataType uint16
+	count uint32
+	value []byte
+}
+
+// Read the allow-listed camera info and the orientation from EXIF data
+// Malformed or missing tags are skipped, so this never fails
+func parseExif(data []byte) (*CameraInfo, int) {
+	if len(data) < 8 {
+		return nil, 1
+	}
+	reader := exifReader{data: data}
+	switch string(data[:2]) {
+	case "II":
+		reader.order = binary.LittleEndian
+	case "MM":
+		reader.order = binary.BigEndian
+	default:
+		return nil, 1
+	}
+	ifd0 := reader.readIFD(reader.order.Uint32(data[4:]))
+	orientation := 1
+	if entry, ok := ifd0[exifTagOrientation]; ok {
+		if value, ok := reader.integer(entry); ok && value >= 1 && value <= 8 {
+			orientation = value
+		}
+	}
+
+	camera := CameraInfo{
+		Make: reader.text(ifd0[exifTagMake]),
+		Model: reader.text(ifd0[exifTagModel]),
+	}
+	if entry, ok := ifd0[exifTagExifIFD]; ok {
+		if offset, ok := reader.integer(entry); ok {
+			exifIFD := reader.readIFD(uint32(offset))
+			camera.LensModel = reader.text(exifIFD[exifTagLensModel])
+			camera.ExposureTime = reader.rational(exifIFD[exifTagExposureTime])
+			camera.FNumber = reader.rational(exifIFD[exifTagFNumber])
+			camera.FocalLength = reader.rational(exifIFD[exifTagFocalLength])
+			if iso, ok := reader.integer(exifIFD[exifTagISO]); ok {
+				camera.ISO = iso
+			}
+		}
+	}
+	if camera == (CameraInfo{}) {
+		return nil, orientation
+	}
+	return &camera, orientation
+}
+
+// Read the entries of the IFD at an offset, keyed by tag
+func (r exifReader) readIFD(offset uint32) map[uint16]exifEntry {
+	entries := map[uint16]exifEntry{}
+	start := int(offset)
+	if start < 0 || start + 2 > len(r.data) {
+		return entries
+	}
+	count := int(r.order.Uint16(r.data[start:]))
+	for i := 0; i < count; i++ {
+		pos := start + 2 + i * 12
+		if pos + 12 > len(r.data) {
+			break
+		}
+		entries[r.order.Uint16(r.data[pos:])] = exifEntry{
+			dataType: r.order.Uint16(r.data[pos + 2:]),
+			count: r.order.Uint32(r.data[pos + 4:]),
+			value: r.data[pos + 8:pos + 12],
+		}
+	}
+	return entries
+}
+
+// Return the bytes of an entry's value, which are stored inline when they fit in 4 bytes
+func (r exifReader) bytes(entry exifEntry, size int) []byte {
+	total := int(entry.count) * size
+	if entry.count == 0 || total < 0 || total > len(r.data) {
+		return nil
+	}
+	if total <= 4 {
+		return entry.value[:total]
+	}
+	offset := int(r.order.Uint32(entry.value))
+	if offset < 0 || offset + total > len(r.data) {
+		return nil
+	}
+	return r.data[offset:offset + total]
+}
+
+// Read a SHORT or LONG value
+func (r exifReader) integer(entry exifEntry) (int, bool) {
+	if entry.dataType == 3 {
+		if value := r.bytes(entry, 2); value != nil {
+			return int(r.order.Uint16(value)), true
+		}
+	}
+	if entry.dataType == 4 {
+		if value := r.bytes(entry, 4); value != nil {
+			return int(r.order.Uint32(value)), true
+		}
+	}
+	return 0, false
+}
+
+// Read a RATIONAL value, 0 if missing
+func (r exifReader) rational(entry exifEntry) float64 {
+	if entry.dataType != 5 {
+		return 0
+	}
+	value := r.bytes(entry, 8)
+	if value == nil {
+		return 0
+	}
+	numerator := r.order.Uint32(value)
+	denominator := r.order.Uint32(value[4:])
+	if denominator == 0 {
+		return 0
+	}
+	return float64(numerator) / float64(denominator)
+}
+
+// Read an ASCII value, keeping only printable characters
+func (r exifReader) text(entry exifEntry) string {
+	if entry.dataType != 2 {
+		return ""
+	}
+	value := r.bytes(entry, 1)
+	text := strings.Map(func(c rune) rune {
+		if c < 0x20 || c > 0x7E {
+			return -1
+		}
+		return c
+	}, string(value))
+	text = strings.TrimSpace(text)
+	if len(text) > maxCameraNameLength {
+		text = text[:maxCameraNameLength]
+	}
+	return text
+}
+
+// ***********
+// Orientation
+// ***********
+
+// Rotate and flip an image so it displays upright without its EXIF orientation
+// Used for the resized copies, which are saved without any metadata
+func applyOrientation(src image.Image, orientation int) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return src
+	}
+	bounds := src.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	rgba := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(rgba, rgba.Bounds(), src, bounds.Min, draw.Src)
+
+	dstWidth, dstHeight := width, height
+	if orientation >= 5 {
+		dstWidth, dstHeight = height, width
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dstWidth, dstHeight))
+	for y := 0; y < dstHeight; y++ {
+		for x := 0; x < dstWidth; x++ {
+			// Find the source pixel for each destination pixel
+			srcX, srcY := x, y
+			switch orientation {
+			case 2:
+				srcX = width - 1 - x
+			case 3:
+				srcX, srcY = width - 1 - x, height - 1 - y
+			case 4:
+				srcY = height - 1 - y
+			case 5:
+				srcX, srcY = y, x
+			case 6:
+				srcX, srcY = y, height - 1 - x
+			case 7:
+				srcX, srcY = width - 1 - y, height - 1 - x
+			case 8:
+				srcX, srcY = width - 1 - y, x
+			}
+			copy(dst.Pix[dst.PixOffset(x, y):dst.PixOffset(x, y) + 4], rgba.Pix[rgba.PixOffset(srcX, srcY):])
+		}
+	}
+	return dst
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"net/http"
+	"testing"
+)
+
+type testTag struct {
+	tag uint16
+	dataType uint16
+	count uint32
+	value []byte
+}
+
+func asciiTag(tag uint16, text string) testTag {
+	return testTag{tag, 2, uint32(len(text) + 1), append([]byte(text), 0)}
+}
+
+func shortTag(tag uint16, value uint16) testTag {
+	data := make([]byte, 2)
+	binary.BigEndian.PutUint16(data, value)
+	return testTag{tag, 3, 1, data}
+}
+
+func rationalTag(tag uint16, numerator uint32, denominator uint32) testTag {
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint32(data, numerator)
+	binary.BigEndian.PutUint32(data[4:], denominator)
+	return testTag{tag, 5, 1, data}
+}
+
+// Build big endian EXIF data with the given IFD0 and Exif IFD tags
+func buildExif(ifd0 []testTag, exifIFD []testTag) []byte {
+	exifOffset := 8 + 2 + 12 * (len(ifd0) + 1) + 4
+	pointer := make([]byte, 4)
+	binary.BigEndian.PutUint32(pointer, uint32(exifOffset))
+	ifd0 = append(ifd0, testTag{exifTagExifIFD, 4, 1, pointer})
+	dataOffset := exifOffset + 2 + 12 * len(exifIFD) + 4
+
+	var values bytes.Buffer
+	out := bytes.NewBufferString("MM\x00\x2A")
+	binary.Write(out, binary.BigEndian, uint32(8))
+	for _, tags := range [][]testTag{ifd0, exifIFD} {
+		binary.Write(out, binary.BigEndian, uint16(len(tags)))
+		for _, tag := range tags {
+			binary.Write(out, binary.BigEndian, []uint16{tag.tag, tag.dataType})
+			binary.Write(out, binary.BigEndian, tag.count)
+			if len(tag.value) <= 4 {
+				padded := make([]byte, 4)
+				copy(padded, tag.value)
+				out.Write(padded)
+			} else {
+				binary.Write(out, binary.BigEndian, uint32(dataOffset + values.Len()))
+				values.Write(tag.value)
+			}
+		}
+		binary.Write(out, binary.BigEndian, uint32(0))
+	}
+	out.Write(values.Bytes())
+	return out.Bytes()
+}
+
+// EXIF data like a phone would write, with a serial number and location
+func createCameraExif() []byte {
+	return buildExif(
+		[]testTag{
+			asciiTag(exifTagMake, "Canon"),
+			asciiTag(exifTagModel, "Canon EOS R5"),
+			shortTag(exifTagOrientation, 6),
+			asciiTag(0x8825, "51.5074N 0.1278W"),
+		},
+		[]testTag{
+			rationalTag(exifTagExposureTime, 1, 250),
+			rationalTag(exifTagFNumber, 28, 10),
+			shortTag(exifTagISO, 100),
+			rationalTag(exifTagFocalLength, 35, 1),
+			asciiTag(exifTagLensModel, "RF24-70mm F2.8 L IS USM"),
+			asciiTag(0xA431, "SN0123456789"),
+		},
+	)
+}
+
+// Encode a JPEG that is wider than it is tall, with EXIF data after the start marker
+func createJPEG(exif []byte) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, 40, 20))
+	var buf bytes.Buffer
+	jpeg.Encode(&buf, img, nil)
+	data := buf.Bytes()
+	segment := append([]byte("Exif\x00\x00"), exif...)
+	var out bytes.Buffer
+	out.Write(data[:2])
+	out.Write([]byte{0xFF, 0xE1})
+	binary.Write(&out, binary.BigEndian, uint16(len(segment) + 2))
+	out.Write(segment)
+	out.Write(data[2:])
+	return out.Bytes()
+}
+
+func expectNoPrivateMetadata(t *testing.T, data []byte) {
+	t.Helper()
+	for _, private := range []string{"51.5074N", "SN0123456789", "Canon"} {
+		if bytes.Contains(data, []byte(private)) {
+			t.Errorf("Stored image should not contain %q", private)
+		}
+	}
+}
+
+func TestStripJpegMetadata(t *testing.T){
+	stripped, camera, orientation, err := stripMetadata(createJPEG(createCameraExif()), "jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectNoPrivateMetadata(t, stripped)
+	if orientation != 6 {
+		t.Errorf("Orientation should be read, got %v", orientation)
+	}
+	expected := CameraInfo{"Canon", "Canon EOS R5", "RF24-70mm F2.8 L IS USM", 0.004, 2.8, 100, 35}
+	if camera == nil || *camera != expected {
+		t.Fatalf("Unexpected camera info %+v", camera)
+	}
+	if camera.GetCamera() != "Canon EOS R5" || camera.GetSettings() != "1/250s f/2.8 ISO 100 35mm" {
+		t.Errorf("Unexpected camera info formatting %v %v", camera.GetCamera(), camera.GetSettings())
+	}
+
+	// Orientation is written back, and the image is still valid
+	if _, err := jpeg.Decode(bytes.NewReader(stripped)); err != nil {
+		t.Fatal(err)
+	}
+	_, camera, orientation, _ = stripMetadata(stripped, "jpeg")
+	if camera != nil || orientation != 6 {
+		t.Errorf("Only the orientation should be kept, got %+v %v", camera, orientation)
+	}
+
+	if _, _, _, err := stripMetadata([]byte{0xFF, 0xD8, 0xFF, 0xE1, 0xFF}, "jpeg"); err == nil {
+		t.Error("Truncated segment should be an error")
+	}
+}
+
+// Cameras append preview images after the end of the main image, with their own EXIF
+func TestStripJpegTrailingImage(t *testing.T){
+	main := createJPEG(nil)
+	withPreview := append(append([]byte{}, main...), createJPEG(createCameraExif())...)
+	stripped, _, _, err := stripMetadata(withPreview, "jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectNoPrivateMetadata(t, stripped)
+	if !bytes.HasSuffix(stripped, []byte{0xFF, 0xD9}) || len(stripped) > len(main) {
+		t.Errorf("Everything after the end of the image should be dropped, got %v of %v bytes", len(stripped), len(main))
+	}
+	if _, err := jpeg.Decode(bytes.NewReader(stripped)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStripPngMetadata(t *testing.T){
+	data := createPNG(4, 4)
+	var withMetadata bytes.Buffer
+	// Add metadata chunks after the IHDR chunk
+	withMetadata.Write(data[:33])
+	writePngChunk(&withMetadata, "tEXt", []byte("Comment\x00SN0123456789"))
+	writePngChunk(&withMetadata, "eXIf", createCameraExif())
+	withMetadata.Write(data[33:])
+
+	stripped, camera, orientation, err := stripMetadata(withMetadata.Bytes(), "png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectNoPrivateMetadata(t, stripped)
+	if camera == nil || camera.LensModel != "RF24-70mm F2.8 L IS USM" || orientation != 6 {
+		t.Errorf("Unexpected camera info %+v %v", camera, orientation)
+	}
+	if _, _, err := image.Decode(bytes.NewReader(stripped)); err != nil {
+		t.Errorf("Stripped PNG should decode: %v", err)
+	}
+}
+
+func TestStripWebpMetadata(t *testing.T){
+	// Extended WebP header with EXIF and XMP flags, image data and metadata chunks
+	chunks := [][]byte{
+		webpChunk("VP8X", []byte{0x0C, 0, 0, 0, 0, 0, 0, 0, 0, 0}),
+		webpChunk("VP8L", []byte("image data")),
+		webpChunk("EXIF", buildExif([]testTag{asciiTag(exifTagModel, "Pixel 7")}, nil)),
+		webpChunk("XMP ", []byte("<x:xmpmeta>SN0123456789</x:xmpmeta>")),
+	}
+	data := []byte("RIFF\x00\x00\x00\x00WEBP")
+	for _, chunk := range chunks {
+		data = append(data, chunk...)
+	}
+	stripped, camera, _, err := stripMetadata(data, "webp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := append([]byte("RIFF\x00\x00\x00\x00WEBP"), webpChunk("VP8X", make([]byte, 10))...)
+	expected = append(expected, chunks[1]...)
+	binary.LittleEndian.PutUint32(expected[4:], uint32(len(expected) - 8))
+	if !bytes.Equal(stripped, expected) {
+		t.Errorf("Metadata chunks and flags should be removed, got %q", stripped)
+	}
+	if camera == nil || camera.Model != "Pixel 7" {
+		t.Errorf("Unexpected camera info %+v", camera)
+	}
+}
+
+func TestApplyOrientation(t *testing.T){
+	src := image.NewRGBA(image.Rect(0, 0, 2, 1))
+	red := color.RGBA{255, 0, 0, 255}
+	src.Set(0, 0, red)
+	rotated := applyOrientation(src, 6)
+	if rotated.Bounds().Dx() != 1 || rotated.Bounds().Dy() != 2 {
+		t.Fatalf("Rotated image should be 1x2, got %v", rotated.Bounds())
+	}
+	// Rotating clockwise moves the left pixel to the top
+	if rotated.At(0, 0) != red {
+		t.Errorf("Unexpected pixel after rotation %v", rotated.At(0, 0))
+	}
+	if applyOrientation(src, 1) != image.Image(src) {
+		t.Error("Upright image should be unchanged")
+	}
+}
+
+func TestEntryCameraInfo(t *testing.T){
+	app := newTestApp(t)
+	owner := app.login(t, "bill")
+	contest := app.createContest(t, owner)
+	if rec := app.submitImage(contest, "photo.jpg", createJPEG(createCameraExif()), owner); rec.Code != http.StatusFound {
+		t.Fatalf("Submission should redirect, got %v", rec.Code)
+	}
+	entries, _ := app.entries.ListByContest(context.TODO(), contest.Id)
+	if entries[0].Camera == nil || entries[0].Camera.Model != "Canon EOS R5" {
+		t.Fatalf("Entry should keep camera info, got %+v", entries[0].Camera)
+	}
+
+	rec := app.get(entries[0].ImagePath, owner)
+	expectNoPrivateMetadata(t, rec.Body.Bytes())
+
+	app.changeState(contest, "start-vote", owner)
+	if body := app.get("/contests/" + contest.GetStringId(), owner).Body.String(); !bytes.Contains([]byte(body), []byte("1/250s f/2.8 ISO 100 35mm")) {
+		t.Error("Voting page should show camera settings")
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.mongodb.org/mongo-driver/event"
+)
+
+// Prometheus metrics, served on their own listener when metrics_addr is set
+// so they aren't reachable through the public site
+
+// Buckets for request and database latencies in seconds
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+var metricsRegistry = newMetricsRegistry()
+
+func newMetricsRegistry() *prometheus.Registry {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	return registry
+}
+
+var (
+	httpRequestDuration = promauto.With(metricsRegistry).NewHistogramVec(prometheus.HistogramOpts{
+		Name: "http_request_duration_seconds",
+		Help: "Time taken to handle HTTP requests, by route template and response code.",
+		Buckets: latencyBuckets,
+	}, []string{"method", "route", "code"})
+	mongoOperationDuration = promauto.With(metricsRegistry).NewHistogramVec(prometheus.HistogramOpts{
+		Name: "mongodb_operation_duration_seconds",
+		Help: "Time taken by MongoDB commands, by collection and command.",
+		Buckets: latencyBuckets,
+	}, []string{"collection", "command", "result"})
+	uploadBytes = promauto.With(metricsRegistry).NewCounter(prometheus.CounterOpts{
+		Name: "photospot_upload_bytes_total",
+		Help: "Bytes of image uploads received, including rejected uploads.",
+	})
+	contestsCreated = promauto.With(metricsRegistry).NewCounterVec(prometheus.CounterOpts{
+		Name: "photospot_contests_created_total",
+		Help: "Contests created, by voting method.",
+	}, []string{"voting_method"})
+	entriesSubmitted = promauto.With(metricsRegistry).NewCounter(prometheus.CounterOpts{
+		Name: "photospot_entries_submitted_total",
+		Help: "Entries submitted to contests.",
+	})
+	votesCast = promauto.With(metricsRegistry).NewCounterVec(prometheus.CounterOpts{
+		Name: "photospot_votes_cast_total",
+		Help: "Ballots cast, by voting method.",
+	}, []string{"voting_method"})
+	contestStateTransitions = promauto.With(metricsRegistry).NewCounterVec(prometheus.CounterOpts{
+		Name: "photospot_contest_state_transitions_total",
+		Help: "Contests moved into a new state, by the owner, the deadline scheduler or an admin.",
+	}, []string{"state", "trigger"})
+)
+
+// Triggers for contest state transitions
+const (
+	TRIGGER_OWNER = "owner"
+	TRIGGER_SCHEDULE = "schedule"
+	TRIGGER_ADMIN = "admin"
+)
+
+// Time every request by the route template it matched, e.g. /contests/{contestId},
+// so the number of series doesn't grow with the number of contests
+// promhttp wraps the response writer keeping http.Flusher and http.Hijacker
+func metricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := "unknown"
+		if current := mux.CurrentRoute(r); current != nil {
+			if template, err := current.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+		observer := httpRequestDuration.MustCurryWith(prometheus.Labels{"route": route})
+		promhttp.InstrumentHandlerDuration(observer, next).ServeHTTP(w, r)
+	})
+}
+
+// Handler for /metrics on the metrics listener
+func newMetricsHandler() http.Handler {
+	return promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{Registry: metricsRegistry})
+}
+
+// Serve /metrics on addr, separately from the site
+func newMetricsServer(addr string) *http.Server {
+	router := http.NewServeMux()
+	router.Handle("/metrics", newMetricsHandler())
+	return &http.Server{
+		Addr: addr,
+		Handler: router,
+		ReadHeaderTimeout: serverReadHeaderTimeout,
+		ReadTimeout: serverReadTimeout,
+		WriteTimeout: serverWriteTimeout,
+		IdleTimeout: serverIdleTimeout,
+	}
+}
+
+// Time MongoDB commands for mongoOperationDuration
+func newMongoMetricsMonitor() *event.CommandMonitor {
+	// Only the started event says which collection a command is for
+	var collections sync.Map
+	finished := func(e event.CommandFinishedEvent, result string) {
+		collection, _ := collections.LoadAndDelete(e.RequestID)
+		name, _ := collection.(string)
+		mongoOperationDuration.WithLabelValues(name, e.CommandName, result).Observe(time.Duration(e.DurationNanos).Seconds())
+	}
+	return &event.CommandMonitor{
+		Started: func(ctx context.Context, e *event.CommandStartedEvent) {
+			// Commands name their collection in the first field, e.g. {"find": "contests", ...}
+			collection := ""
+			if element, err := e.Command.IndexErr(0); err == nil {
+				collection, _ = element.Value().StringValueOK()
+			}
+			collections.Store(e.RequestID, collection)
+		},
+		Succeeded: func(ctx context.Context, e *event.CommandSucceededEvent) {
+			finished(e.CommandFinishedEvent, "ok")
+		},
+		Failed: func(ctx context.Context, e *event.CommandFailedEvent) {
+			finished(e.CommandFinishedEvent, "error")
+		},
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/event"
+)
+
+// Read the value of a series from the /metrics output, 0 if it isn't there yet
+func metricValue(t *testing.T, series string) float64 {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	newMetricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	for _, line := range strings.Split(rec.Body.String(), "\n") {
+		if strings.HasPrefix(line, series + " ") {
+			value, err := strconv.ParseFloat(strings.TrimPrefix(line, series + " "), 64)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return value
+		}
+	}
+	return 0
+}
+
+// A response writer that can be hijacked, which httptest.ResponseRecorder can't
+type hijackableRecorder struct {
+	*httptest.ResponseRecorder
+}
+
+func (h hijackableRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return nil, nil, nil
+}
+
+func TestMetricsServer(t *testing.T){
+	app := newTestApp(t)
+	if rec := app.get("/metrics", nil); rec.Code != http.StatusNotFound {
+		t.Errorf("Metrics should not be served on the site, got %v", rec.Code)
+	}
+
+	rec := httptest.NewRecorder()
+	newMetricsServer(":0").Handler.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "# TYPE photospot_entries_submitted_total counter") {
+		t.Errorf("Metrics server should serve metrics, got %v %v", rec.Code, rec.Body.String())
+	}
+}
+
+func TestMetricsMiddlewareWriter(t *testing.T){
+	handler := requestIdMiddleware(metricsMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := w.(http.Flusher); !ok {
+			t.Error("Handlers should still be able to flush")
+		}
+		if _, ok := w.(http.Hijacker); !ok {
+			t.Error("Handlers should still be able to hijack the connection")
+		}
+		w.WriteHeader(http.StatusTeapot)
+	})))
+	series := `http_request_duration_seconds_count{code="418",method="get",route="unknown"}`
+	before := metricValue(t, series)
+	handler.ServeHTTP(hijackableRecorder{httptest.NewRecorder()}, httptest.NewRequest("GET", "/", nil))
+	if got := metricValue(t, series) - before; got != 1 {
+		t.Errorf("Request should be timed by response code, got %v", got)
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T){
+	app := newTestApp(t)
+	owner := app.login(t, "bill")
+	voter := app.login(t, "alice")
+	created := `photospot_contests_created_total{voting_method="plurality"}`
+	requests := `http_request_duration_seconds_count{code="302",method="post",route="/contests/{contestId}/vote"}`
+	transitions := `photospot_contest_state_transitions_total{state="voting",trigger="owner"}`
+	before := map[string]float64{}
+	for _, series := range []string{created, requests, transitions, "photospot_entries_submitted_total", `photospot_votes_cast_total{voting_method="plurality"}`, "photospot_upload_bytes_total"} {
+		before[series] = metricValue(t, series)
+	}
+
+	contest := app.createContest(t, owner)
+	image := createPNG(10, 10)
+	app.submitImage(contest, "photo.png", image, owner)
+	app.changeState(contest, "start-vote", owner)
+	entries := getContestEntries(context.TODO(), contest.Id, app.entries)
+	app.vote(contest, entries[0].GetStringId(), voter)
+	// A second vote is rejected, and isn't counted
+	app.postForm("/contests/" + contest.GetStringId() + "/vote", url.Values{"image-vote": {entries[0].GetStringId()}}, voter)
+
+	increases := map[string]float64{
+		created: 1,
+		requests: 1,
+		transitions: 1,
+		"photospot_entries_submitted_total": 1,
+		`photospot_votes_cast_total{voting_method="plurality"}`: 1,
+		"photospot_upload_bytes_total": float64(len(image)),
+	}
+	for series, increase := range increases {
+		if got := metricValue(t, series) - before[series]; got != increase {
+			t.Errorf("%v should increase by %v, got %v", series, increase, got)
+		}
+	}
+}
+
+func TestMongoMetricsMonitor(t *testing.T){
+	series := `mongodb_operation_duration_seconds_count{collection="contests",command="find",result="ok"}`
+	before := metricValue(t, series)
+
+	monitor := newMongoMetricsMonitor()
+	command, _ := bson.Marshal(bson.D{{"find", "contests"}, {"filter", bson.D{}}})
+	monitor.Started(context.TODO(), &event.CommandStartedEvent{Command: command, CommandName: "find", RequestID: 7})
+	monitor.Succeeded(context.TODO(), &event.CommandSucceededEvent{
+		CommandFinishedEvent: event.CommandFinishedEvent{DurationNanos: 2000000, CommandName: "find", RequestID: 7},
+	})
+	if got := metricValue(t, series) - before; got != 1 {
+		t.Errorf("Command should be timed by collection, got %v", got)
+	}
+}
@@ -0,0 +1,1078 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Translate the driver's missing document error into ErrNotFound
+func mongoFindErr(err error) error {
+	if err == mongo.ErrNoDocuments {
+		return ErrNotFound
+	}
+	return err
+}
+
+// Translate the driver's duplicate key error into ErrDuplicate
+func mongoInsertErr(err error) error {
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrDuplicate
+	}
+	return err
+}
+
+// Create indexes that the stores rely on to reject duplicates and find similar images
+// Creating an index that already exists is a no-op, so this is safe to run on every startup
+func ensureMongoIndexes(
+	ctx context.Context,
+	userStore *MongoUserStore,
+	contestStore *MongoContestStore,
+	entryStore *MongoEntryStore,
+	voteStore *MongoVoteStore,
+	tokenStore *MongoTokenStore,
+	loginAttemptStore *MongoLoginAttemptStore,
+	sessionStore *MongoSessionStore,
+	participantStore *MongoParticipantStore,
+	inviteStore *MongoInviteStore,
+	communityStore *MongoCommunityStore,
+	memberStore *MongoCommunityMemberStore,
+) error {
+	unique := options.Index().SetUnique(true)
+	indexes := []struct {
+		collection *mongo.Collection
+		model mongo.IndexModel
+	}{
+		{userStore.collection, mongo.IndexModel{
+			Keys: bson.D{{"username", 1}},
+			Options: unique,
+		}},
+		{entryStore.collection, mongo.IndexModel{
+			Keys: bson.D{{"contest_id", 1}, {"owner_id", 1}},
+			Options: unique,
+		}},
+		{entryStore.collection, mongo.IndexModel{
+			Keys: bson.D{{"image_hash_bands", 1}},
+		}},
+		// Contest list search and sorting
+		{contestStore.collection, mongo.IndexModel{
+			Keys: bson.D{{"name", "text"}, {"description", "text"}},
+		}},
+		{contestStore.collection, mongo.IndexModel{
+			Keys: bson.D{{"entry_count", -1}, {"_id", -1}},
+		}},
+		{contestStore.collection, mongo.IndexModel{
+			Keys: bson.D{{"state", 1}, {"_id", -1}},
+		}},
+		// Lookups for profile pages
+		{contestStore.collection, mongo.IndexModel{
+			Keys: bson.D{{"owner_id", 1}},
+		}},
+		{entryStore.collection, mongo.IndexModel{
+			Keys: bson.D{{"owner_id", 1}},
+		}},
+		{voteStore.collection, mongo.IndexModel{
+			Keys: bson.D{{"user_id", 1}},
+		}},
+		{voteStore.collection, mongo.IndexModel{
+			Keys: bson.D{{"contest_id", 1}, {"user_id", 1}},
+			Options: unique,
+		}},
+		{tokenStore.collection, mongo.IndexModel{
+			Keys: bson.D{{"token_hash", 1}},
+			Options: unique,
+		}},
+		// Failure counts are only needed for loginFailureWindow, so old ones are removed automatically
+		{loginAttemptStore.collection, mongo.IndexModel{
+			Keys: bson.D{{"last_failure", 1}},
+			Options: options.Index().SetExpireAfterSeconds(int32(loginAttemptExpiry.Seconds())),
+		}},
+		{loginAttemptStore.lockouts, mongo.IndexModel{
+			Keys: bson.D{{"start", -1}},
+		}},
+		{sessionStore.collection, mongo.IndexModel{
+			Keys: bson.D{{"token_hash", 1}},
+			Options: unique,
+		}},
+		{sessionStore.collection, mongo.IndexModel{
+			Keys: bson.D{{"user_id", 1}},
+		}},
+		{participantStore.collection, mongo.IndexModel{
+			Keys: bson.D{{"contest_id", 1}, {"user_id", 1}},
+			Options: unique,
+		}},
+		{participantStore.collection, mongo.IndexModel{
+			Keys: bson.D{{"user_id", 1}},
+		}},
+		{inviteStore.collection, mongo.IndexModel{
+			Keys: bson.D{{"code", 1}},
+			Options: unique,
+		}},
+		{inviteStore.collection, mongo.IndexModel{
+			Keys: bson.D{{"contest_id", 1}},
+		}},
+		{contestStore.collection, mongo.IndexModel{
+			Keys: bson.D{{"community_id", 1}, {"_id", -1}},
+		}},
+		{communityStore.collection, mongo.IndexModel{
+			Keys: bson.D{{"slug", 1}},
+			Options: unique,
+		}},
+		{memberStore.collection, mongo.IndexModel{
+			Keys: bson.D{{"community_id", 1}, {"user_id", 1}},
+			Options: unique,
+		}},
+		{memberStore.collection, mongo.IndexModel{
+			Keys: bson.D{{"user_id", 1}},
+		}},
+		// Sessions past their absolute expiry are removed automatically
+		{sessionStore.collection, mongo.IndexModel{
+			Keys: bson.D{{"expires_at", 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		}},
+	}
+	// Every index is tried, so one that can't be built doesn't stop the rest
+	var failures []string
+	for _, index := range indexes {
+		if _, err := index.collection.Indexes().CreateOne(ctx, index.model); err != nil {
+			slog.ErrorContext(ctx, "Couldn't create index", "collection", index.collection.Name(), "error", err)
+			failures = append(failures, index.collection.Name())
+		}
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("Couldn't create %v indexes, on %v", len(failures), strings.Join(failures, ", "))
+	}
+	return nil
+}
+
+// Count the entries of contests saved before entry counts were stored
+// Only contests without a count are updated, so this is safe to run on every startup
+func backfillEntryCounts(ctx context.Context, contestStore *MongoContestStore, entryStore *MongoEntryStore) error {
+	opts := options.Find().SetProjection(bson.D{{"_id", 1}})
+	cursor, err := contestStore.collection.Find(ctx, bson.D{{"entry_count", bson.D{{"$exists", false}}}}, opts)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+	for cursor.Next(ctx) {
+		var contest Contest
+		if err := cursor.Decode(&contest); err != nil {
+			return err
+		}
+		count, err := entryStore.CountByContest(ctx, contest.Id)
+		if err != nil {
+			return err
+		}
+		_, err = contestStore.collection.UpdateOne(
+			ctx,
+			bson.D{{"_id", contest.Id}, {"entry_count", bson.D{{"$exists", false}}}},
+			bson.D{{"$set", bson.D{{"entry_count", count}}}},
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
+// *****
+// Users
+// *****
+
+type MongoUserStore struct {
+	collection *mongo.Collection
+}
+
+func NewMongoUserStore(collection *mongo.Collection) *MongoUserStore {
+	return &MongoUserStore{collection}
+}
+
+func (m *MongoUserStore) Get(ctx context.Context, userId primitive.ObjectID) (User, error) {
+	var user User
+	err := m.collection.FindOne(ctx, bson.D{{"_id", userId}}).Decode(&user)
+	return user, mongoFindErr(err)
+}
+
+func (m *MongoUserStore) GetByUsername(ctx context.Context, username string) (User, error) {
+	var user User
+	err := m.collection.FindOne(ctx, bson.D{{"username", username}}).Decode(&user)
+	return user, mongoFindErr(err)
+}
+
+func (m *MongoUserStore) Create(ctx context.Context, user User) error {
+	_, err := m.collection.InsertOne(ctx, user)
+	return mongoInsertErr(err)
+}
+
+func (m *MongoUserStore) UpdatePassword(ctx context.Context, userId primitive.ObjectID, passwordHash string) error {
+	update := bson.D{{"$set", bson.D{{"password", passwordHash}}}}
+	_, err := m.collection.UpdateOne(ctx, bson.D{{"_id", userId}}, update)
+	return err
+}
+
+func (m *MongoUserStore) UpdatePrivacy(ctx context.Context, userId primitive.ObjectID, privacy UserPrivacy) error {
+	update := bson.D{{"$set", bson.D{{"privacy", privacy}}}}
+	_, err := m.collection.UpdateOne(ctx, bson.D{{"_id", userId}}, update)
+	return err
+}
+
+func (m *MongoUserStore) UpdateRole(ctx context.Context, userId primitive.ObjectID, role string) error {
+	return m.update(ctx, userId, bson.D{{"$set", bson.D{{"role", role}}}})
+}
+
+func (m *MongoUserStore) UpdateBanned(ctx context.Context, userId primitive.ObjectID, banned bool) error {
+	return m.update(ctx, userId, bson.D{{"$set", bson.D{{"banned", banned}}}})
+}
+
+func (m *MongoUserStore) ListStaffAndBanned(ctx context.Context) ([]User, error) {
+	users := []User{}
+	filter := bson.D{{"$or", bson.A{
+		bson.D{{"role", bson.D{{"$in", bson.A{ROLE_ADMIN, ROLE_MODERATOR}}}}},
+		bson.D{{"banned", true}},
+	}}}
+	opts := options.Find().SetSort(bson.D{{"username", 1}})
+	cursor, err := m.collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := cursor.All(ctx, &users); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// Update a user, returning ErrNotFound if there is no such user
+func (m *MongoUserStore) update(ctx context.Context, userId primitive.ObjectID, update bson.D) error {
+	result, err := m.collection.UpdateOne(ctx, bson.D{{"_id", userId}}, update)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// ********
+// Contests
+// ********
+
+type MongoContestStore struct {
+	collection *mongo.Collection
+}
+
+func NewMongoContestStore(collection *mongo.Collection) *MongoContestStore {
+	return &MongoContestStore{collection}
+}
+
+func (m *MongoContestStore) Get(ctx context.Context, contestId primitive.ObjectID) (Contest, error) {
+	var contest Contest
+	err := m.collection.FindOne(ctx, bson.D{{"_id", contestId}}).Decode(&contest)
+	return contest, mongoFindErr(err)
+}
+
+func (m *MongoContestStore) List(ctx context.Context) ([]Contest, error) {
+	return m.find(ctx, bson.D{})
+}
+
+// The current deadline depends on the state, so it is added as a field before sorting on it
+func (m *MongoContestStore) Search(ctx context.Context, query ContestQuery) ([]Contest, error) {
+	filter := bson.D{}
+	if query.Search != "" {
+		filter = append(filter, bson.E{"$text", bson.D{{"$search", query.Search}}})
+	}
+	if query.State != nil {
+		filter = append(filter, bson.E{"state", *query.State})
+	}
+	if query.OwnerId != nil {
+		filter = append(filter, bson.E{"owner_id", *query.OwnerId})
+	}
+	if query.CommunityId != nil {
+		filter = append(filter, bson.E{"community_id", *query.CommunityId})
+	}
+	// Same rule as isContestListed, contests created before visibility was added have none
+	memberOf := query.MemberOf
+	if memberOf == nil {
+		memberOf = []primitive.ObjectID{}
+	}
+	communities := query.Communities
+	if communities == nil {
+		communities = []primitive.ObjectID{}
+	}
+	filter = append(filter, bson.E{"$or", bson.A{
+		bson.D{{"visibility", bson.D{{"$exists", false}}}},
+		bson.D{{"visibility", PUBLIC}},
+		bson.D{{"owner_id", query.ViewerId}},
+		bson.D{{"visibility", INVITE_ONLY}, {"_id", bson.D{{"$in", memberOf}}}},
+		bson.D{{"visibility", MEMBERS_ONLY}, {"community_id", bson.D{{"$in", communities}}}},
+	}})
+	deadline := bson.D{{"$switch", bson.D{
+		{"branches", bson.A{
+			bson.D{{"case", bson.D{{"$eq", bson.A{"$state", OPEN}}}}, {"then", "$submission_end"}},
+			bson.D{{"case", bson.D{{"$eq", bson.A{"$state", VOTING}}}}, {"then", "$voting_end"}},
+		}},
+		{"default", nil},
+	}}}
+
+	var after bson.D
+	var sortOrder bson.D
+	switch query.Sort {
+	case SORT_MOST_ENTRIES:
+		sortOrder = bson.D{{"entry_count", -1}, {"_id", -1}}
+		if query.After != nil {
+			after = bson.D{{"$or", bson.A{
+				bson.D{{"entry_count", bson.D{{"$lt", query.After.EntryCount}}}},
+				bson.D{{"entry_count", query.After.EntryCount}, {"_id", bson.D{{"$lt", query.After.Id}}}},
+			}}}
+		}
+	case SORT_ENDING_SOON:
+		sortOrder = bson.D{{"deadline", 1}, {"_id", 1}}
+		after = bson.D{{"deadline", bson.D{{"$type", "date"}}}}
+		if query.After != nil {
+			after = append(after, bson.E{"$or", bson.A{
+				bson.D{{"deadline", bson.D{{"$gt", *query.After.Deadline}}}},
+				bson.D{{"deadline", *query.After.Deadline}, {"_id", bson.D{{"$gt", query.After.Id}}}},
+			}})
+		}
+	default:
+		sortOrder = bson.D{{"_id", -1}}
+		if query.After != nil {
+			after = bson.D{{"_id", bson.D{{"$lt", query.After.Id}}}}
+		}
+	}
+
+	pipeline := mongo.Pipeline{
+		{{"$match", filter}},
+		{{"$addFields", bson.D{{"deadline", deadline}}}},
+	}
+	if after != nil {
+		pipeline = append(pipeline, bson.D{{"$match", after}})
+	}
+	pipeline = append(pipeline, bson.D{{"$sort", sortOrder}}, bson.D{{"$limit", query.Limit}})
+
+	contests := []Contest{}
+	cursor, err := m.collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	if err := cursor.All(ctx, &contests); err != nil {
+		return nil, err
+	}
+	return contests, nil
+}
+
+func (m *MongoContestStore) IncrementEntryCount(ctx context.Context, contestId primitive.ObjectID) error {
+	update := bson.D{{"$inc", bson.D{{"entry_count", 1}}}}
+	_, err := m.collection.UpdateOne(ctx, bson.D{{"_id", contestId}}, update)
+	return err
+}
+
+func (m *MongoContestStore) DecrementEntryCount(ctx context.Context, contestId primitive.ObjectID) error {
+	update := bson.D{{"$inc", bson.D{{"entry_count", -1}}}}
+	_, err := m.collection.UpdateOne(ctx, bson.D{{"_id", contestId}}, update)
+	return err
+}
+
+func (m *MongoContestStore) ListByOwner(ctx context.Context, ownerId primitive.ObjectID) ([]Contest, error) {
+	contests := []Contest{}
+	opts := options.Find().SetSort(bson.D{{"_id", -1}})
+	cursor, err := m.collection.Find(ctx, bson.D{{"owner_id", ownerId}}, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := cursor.All(ctx, &contests); err != nil {
+		return nil, err
+	}
+	return contests, nil
+}
+
+func (m *MongoContestStore) Create(ctx context.Context, contest Contest) error {
+	_, err := m.collection.InsertOne(ctx, contest)
+	return err
+}
+
+func (m *MongoContestStore) UpdateState(ctx context.Context, contestId primitive.ObjectID, from int, to int) (bool, error) {
+	result, err := m.collection.UpdateOne(
+		ctx,
+		bson.D{{"_id", contestId}, {"state", from}},
+		bson.D{{"$set", bson.D{{"state", to}}}, {"$unset", bson.D{{"results_recorded", ""}}}},
+	)
+	if err != nil {
+		return false, err
+	}
+	return result.MatchedCount == 1, nil
+}
+
+func (m *MongoContestStore) SetResultsRecorded(ctx context.Context, contestId primitive.ObjectID, recorded bool) error {
+	update := bson.D{{"$set", bson.D{{"results_recorded", recorded}}}}
+	_, err := m.collection.UpdateOne(ctx, bson.D{{"_id", contestId}}, update)
+	return err
+}
+
+func (m *MongoContestStore) UpdateDetails(ctx context.Context, contestId primitive.ObjectID, name string, description string) error {
+	result, err := m.collection.UpdateOne(
+		ctx,
+		bson.D{{"_id", contestId}},
+		bson.D{{"$set", bson.D{{"name", name}, {"description", description}}}},
+	)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (m *MongoContestStore) Delete(ctx context.Context, contestId primitive.ObjectID) (bool, error) {
+	result, err := m.collection.DeleteOne(ctx, bson.D{{"_id", contestId}})
+	if err != nil {
+		return false, err
+	}
+	return result.DeletedCount == 1, nil
+}
+
+func (m *MongoContestStore) ListDeadlinePassed(ctx context.Context, now time.Time) ([]Contest, error) {
+	return m.find(ctx, bson.D{{"$or", bson.A{
+		bson.D{{"state", OPEN}, {"submission_end", bson.D{{"$lte", now}}}},
+		bson.D{{"state", VOTING}, {"voting_end", bson.D{{"$lte", now}}}},
+	}}})
+}
+
+func (m *MongoContestStore) find(ctx context.Context, filter interface{}) ([]Contest, error) {
+	contests := []Contest{}
+	cursor, err := m.collection.Find(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	if err := cursor.All(ctx, &contests); err != nil {
+		return nil, err
+	}
+	return contests, nil
+}
+
+// *******
+// Entries
+// *******
+
+type MongoEntryStore struct {
+	collection *mongo.Collection
+}
+
+func NewMongoEntryStore(collection *mongo.Collection) *MongoEntryStore {
+	return &MongoEntryStore{collection}
+}
+
+func (m *MongoEntryStore) Get(ctx context.Context, entryId primitive.ObjectID) (ContestEntry, error) {
+	var entry ContestEntry
+	err := m.collection.FindOne(ctx, bson.D{{"_id", entryId}}).Decode(&entry)
+	return entry, mongoFindErr(err)
+}
+
+func (m *MongoEntryStore) Create(ctx context.Context, entry ContestEntry) error {
+	_, err := m.collection.InsertOne(ctx, entry)
+	return mongoInsertErr(err)
+}
+
+func (m *MongoEntryStore) ListByContest(ctx context.Context, contestId primitive.ObjectID) ([]ContestEntry, error) {
+	entries := []ContestEntry{}
+	cursor, err := m.collection.Find(ctx, bson.D{{"contest_id", contestId}})
+	if err != nil {
+		return nil, err
+	}
+	if err := cursor.All(ctx, &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func (m *MongoEntryStore) CountByContest(ctx context.Context, contestId primitive.ObjectID) (int64, error) {
+	return m.collection.CountDocuments(ctx, bson.D{{"contest_id", contestId}})
+}
+
+func (m *MongoEntryStore) CountByOwner(ctx context.Context, contestId primitive.ObjectID, ownerId primitive.ObjectID) (int64, error) {
+	return m.collection.CountDocuments(ctx, bson.D{{"contest_id", contestId}, {"owner_id", ownerId}})
+}
+
+func (m *MongoEntryStore) ListByOwner(ctx context.Context, ownerId primitive.ObjectID) ([]ContestEntry, error) {
+	entries := []ContestEntry{}
+	opts := options.Find().SetSort(bson.D{{"_id", -1}})
+	cursor, err := m.collection.Find(ctx, bson.D{{"owner_id", ownerId}}, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := cursor.All(ctx, &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// Similar hashes share at least one band, so the band index narrows down
+// the entries that need their distance checked
+func (m *MongoEntryStore) ListSimilarImages(ctx context.Context, hash int64, maxDistance int) ([]ContestEntry, error) {
+	candidates := []ContestEntry{}
+	cursor, err := m.collection.Find(ctx, bson.D{{"image_hash_bands", bson.D{{"$in", imageHashBands(hash)}}}})
+	if err != nil {
+		return nil, err
+	}
+	if err := cursor.All(ctx, &candidates); err != nil {
+		return nil, err
+	}
+	entries := []ContestEntry{}
+	for _, entry := range candidates {
+		if imageHashDistance(entry.ImageHash, hash) <= maxDistance {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+func (m *MongoEntryStore) UpdateResult(ctx context.Context, entryId primitive.ObjectID, placement int, won bool) error {
+	update := bson.D{{"$set", bson.D{{"placement", placement}, {"won", won}}}}
+	_, err := m.collection.UpdateOne(ctx, bson.D{{"_id", entryId}}, update)
+	return err
+}
+
+func (m *MongoEntryStore) Delete(ctx context.Context, entryId primitive.ObjectID) (bool, error) {
+	result, err := m.collection.DeleteOne(ctx, bson.D{{"_id", entryId}})
+	if err != nil {
+		return false, err
+	}
+	return result.DeletedCount == 1, nil
+}
+
+func (m *MongoEntryStore) DeleteByContest(ctx context.Context, contestId primitive.ObjectID) (int64, error) {
+	result, err := m.collection.DeleteMany(ctx, bson.D{{"contest_id", contestId}})
+	if err != nil {
+		return 0, err
+	}
+	return result.DeletedCount, nil
+}
+
+// *****
+// Votes
+// *****
+
+type MongoVoteStore struct {
+	collection *mongo.Collection
+}
+
+func NewMongoVoteStore(collection *mongo.Collection) *MongoVoteStore {
+	return &MongoVoteStore{collection}
+}
+
+func (m *MongoVoteStore) Create(ctx context.Context, vote ContestVote) error {
+	_, err := m.collection.InsertOne(ctx, vote)
+	return mongoInsertErr(err)
+}
+
+func (m *MongoVoteStore) CountByUser(ctx context.Context, contestId primitive.ObjectID, userId primitive.ObjectID) (int64, error) {
+	return m.collection.CountDocuments(ctx, bson.D{{"contest_id", contestId}, {"user_id", userId}})
+}
+
+func (m *MongoVoteStore) CountByVoter(ctx context.Context, userId primitive.ObjectID) (int64, error) {
+	return m.collection.CountDocuments(ctx, bson.D{{"user_id", userId}})
+}
+
+func (m *MongoVoteStore) ListByContest(ctx context.Context, contestId primitive.ObjectID) ([]ContestVote, error) {
+	votes := []ContestVote{}
+	cursor, err := m.collection.Find(ctx, bson.D{{"contest_id", contestId}})
+	if err != nil {
+		return nil, err
+	}
+	if err := cursor.All(ctx, &votes); err != nil {
+		return nil, err
+	}
+	return votes, nil
+}
+
+// Plurality ballots name their entry directly, other ballots list it in their choices
+func (m *MongoVoteStore) DeleteByEntry(ctx context.Context, contestId primitive.ObjectID, entryId primitive.ObjectID) (int64, error) {
+	result, err := m.collection.DeleteMany(ctx, bson.D{
+		{"contest_id", contestId},
+		{"$or", bson.A{
+			bson.D{{"entry_id", entryId}},
+			bson.D{{"choices.entry_id", entryId}},
+		}},
+	})
+	if err != nil {
+		return 0, err
+	}
+	return result.DeletedCount, nil
+}
+
+func (m *MongoVoteStore) DeleteByContest(ctx context.Context, contestId primitive.ObjectID) (int64, error) {
+	result, err := m.collection.DeleteMany(ctx, bson.D{{"contest_id", contestId}})
+	if err != nil {
+		return 0, err
+	}
+	return result.DeletedCount, nil
+}
+
+// ******
+// Tokens
+// ******
+
+type MongoTokenStore struct {
+	collection *mongo.Collection
+}
+
+func NewMongoTokenStore(collection *mongo.Collection) *MongoTokenStore {
+	return &MongoTokenStore{collection}
+}
+
+func (m *MongoTokenStore) Create(ctx context.Context, token AccessToken) error {
+	_, err := m.collection.InsertOne(ctx, token)
+	return mongoInsertErr(err)
+}
+
+func (m *MongoTokenStore) GetByHash(ctx context.Context, tokenHash string) (AccessToken, error) {
+	var token AccessToken
+	err := m.collection.FindOne(ctx, bson.D{{"token_hash", tokenHash}}).Decode(&token)
+	return token, mongoFindErr(err)
+}
+
+func (m *MongoTokenStore) ListByUser(ctx context.Context, userId primitive.ObjectID) ([]AccessToken, error) {
+	tokens := []AccessToken{}
+	cursor, err := m.collection.Find(ctx, bson.D{{"user_id", userId}})
+	if err != nil {
+		return nil, err
+	}
+	if err := cursor.All(ctx, &tokens); err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+func (m *MongoTokenStore) Delete(ctx context.Context, userId primitive.ObjectID, tokenId primitive.ObjectID) (bool, error) {
+	result, err := m.collection.DeleteOne(ctx, bson.D{{"_id", tokenId}, {"user_id", userId}})
+	if err != nil {
+		return false, err
+	}
+	return result.DeletedCount == 1, nil
+}
+
+func (m *MongoTokenStore) UpdateLastUsed(ctx context.Context, tokenId primitive.ObjectID, lastUsed time.Time) error {
+	update := bson.D{{"$set", bson.D{{"last_used", lastUsed}}}}
+	_, err := m.collection.UpdateOne(ctx, bson.D{{"_id", tokenId}}, update)
+	return err
+}
+
+// **************
+// Login attempts
+// **************
+
+type MongoLoginAttemptStore struct {
+	collection *mongo.Collection
+	lockouts *mongo.Collection
+}
+
+func NewMongoLoginAttemptStore(collection *mongo.Collection, lockouts *mongo.Collection) *MongoLoginAttemptStore {
+	return &MongoLoginAttemptStore{collection, lockouts}
+}
+
+func (m *MongoLoginAttemptStore) Get(ctx context.Context, key string) (LoginAttempts, error) {
+	var attempts LoginAttempts
+	err := m.collection.FindOne(ctx, bson.D{{"_id", key}}).Decode(&attempts)
+	return attempts, mongoFindErr(err)
+}
+
+func (m *MongoLoginAttemptStore) AddAttempt(ctx context.Context, key string, now time.Time, resetBefore time.Time) (LoginAttempts, error) {
+	// An update pipeline, so the count is reset and incremented in one atomic update
+	// A missing last_failure sorts before any date, so new documents start at one
+	update := mongo.Pipeline{
+		{{"$set", bson.D{
+			{"failures", bson.D{{"$cond", bson.A{
+				bson.D{{"$lt", bson.A{"$last_failure", resetBefore}}},
+				1,
+				bson.D{{"$add", bson.A{"$failures", 1}}},
+			}}}},
+			{"last_failure", now},
+		}}},
+	}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.Before)
+	var attempts LoginAttempts
+	err := m.collection.FindOneAndUpdate(ctx, bson.D{{"_id", key}}, update, opts).Decode(&attempts)
+	if err == mongo.ErrNoDocuments {
+		// This is the first attempt
+		return LoginAttempts{Key: key}, nil
+	}
+	return attempts, err
+}
+
+func (m *MongoLoginAttemptStore) RemoveAttempt(ctx context.Context, key string) error {
+	filter := bson.D{{"_id", key}, {"failures", bson.D{{"$gt", 0}}}}
+	_, err := m.collection.UpdateOne(ctx, filter, bson.D{{"$inc", bson.D{{"failures", -1}}}})
+	return err
+}
+
+func (m *MongoLoginAttemptStore) Lock(ctx context.Context, key string, until time.Time) error {
+	update := bson.D{{"$set", bson.D{{"failures", 0}, {"locked_until", until}}}}
+	_, err := m.collection.UpdateOne(ctx, bson.D{{"_id", key}}, update, options.Update().SetUpsert(true))
+	return err
+}
+
+func (m *MongoLoginAttemptStore) Reset(ctx context.Context, key string) error {
+	_, err := m.collection.DeleteOne(ctx, bson.D{{"_id", key}})
+	return err
+}
+
+func (m *MongoLoginAttemptStore) CreateLockout(ctx context.Context, lockout LoginLockout) error {
+	_, err := m.lockouts.InsertOne(ctx, lockout)
+	return mongoInsertErr(err)
+}
+
+func (m *MongoLoginAttemptStore) ListLockouts(ctx context.Context, since time.Time) ([]LoginLockout, error) {
+	lockouts := []LoginLockout{}
+	opts := options.Find().SetSort(bson.D{{"start", -1}})
+	cursor, err := m.lockouts.Find(ctx, bson.D{{"start", bson.D{{"$gte", since}}}}, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := cursor.All(ctx, &lockouts); err != nil {
+		return nil, err
+	}
+	return lockouts, nil
+}
+
+// ********
+// Sessions
+// ********
+
+type MongoSessionStore struct {
+	collection *mongo.Collection
+}
+
+func NewMongoSessionStore(collection *mongo.Collection) *MongoSessionStore {
+	return &MongoSessionStore{collection}
+}
+
+func (m *MongoSessionStore) Create(ctx context.Context, session UserSession) error {
+	_, err := m.collection.InsertOne(ctx, session)
+	return mongoInsertErr(err)
+}
+
+func (m *MongoSessionStore) GetByHash(ctx context.Context, tokenHash string) (UserSession, error) {
+	var session UserSession
+	err := m.collection.FindOne(ctx, bson.D{{"token_hash", tokenHash}}).Decode(&session)
+	return session, mongoFindErr(err)
+}
+
+func (m *MongoSessionStore) ListByUser(ctx context.Context, userId primitive.ObjectID) ([]UserSession, error) {
+	sessions := []UserSession{}
+	opts := options.Find().SetSort(bson.D{{"last_seen", -1}})
+	cursor, err := m.collection.Find(ctx, bson.D{{"user_id", userId}}, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := cursor.All(ctx, &sessions); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+func (m *MongoSessionStore) UpdateLastSeen(ctx context.Context, sessionId primitive.ObjectID, lastSeen time.Time, ip string) error {
+	update := bson.D{{"$set", bson.D{{"last_seen", lastSeen}, {"ip", ip}}}}
+	_, err := m.collection.UpdateOne(ctx, bson.D{{"_id", sessionId}}, update)
+	return err
+}
+
+func (m *MongoSessionStore) Delete(ctx context.Context, userId primitive.ObjectID, sessionId primitive.ObjectID) (bool, error) {
+	result, err := m.collection.DeleteOne(ctx, bson.D{{"_id", sessionId}, {"user_id", userId}})
+	if err != nil {
+		return false, err
+	}
+	return result.DeletedCount == 1, nil
+}
+
+func (m *MongoSessionStore) DeleteByUser(ctx context.Context, userId primitive.ObjectID) (int64, error) {
+	result, err := m.collection.DeleteMany(ctx, bson.D{{"user_id", userId}})
+	if err != nil {
+		return 0, err
+	}
+	return result.DeletedCount, nil
+}
+
+// ************
+// Participants
+// ************
+
+type MongoParticipantStore struct {
+	collection *mongo.Collection
+}
+
+func NewMongoParticipantStore(collection *mongo.Collection) *MongoParticipantStore {
+	return &MongoParticipantStore{collection}
+}
+
+func (m *MongoParticipantStore) Add(ctx context.Context, participant ContestParticipant) error {
+	_, err := m.collection.InsertOne(ctx, participant)
+	return mongoInsertErr(err)
+}
+
+func (m *MongoParticipantStore) IsParticipant(ctx context.Context, contestId primitive.ObjectID, userId primitive.ObjectID) (bool, error) {
+	count, err := m.collection.CountDocuments(ctx, bson.D{{"contest_id", contestId}, {"user_id", userId}})
+	return count > 0, err
+}
+
+func (m *MongoParticipantStore) ListByContest(ctx context.Context, contestId primitive.ObjectID) ([]ContestParticipant, error) {
+	participants := []ContestParticipant{}
+	opts := options.Find().SetSort(bson.D{{"_id", 1}})
+	cursor, err := m.collection.Find(ctx, bson.D{{"contest_id", contestId}}, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := cursor.All(ctx, &participants); err != nil {
+		return nil, err
+	}
+	return participants, nil
+}
+
+func (m *MongoParticipantStore) ListContestIds(ctx context.Context, userId primitive.ObjectID) ([]primitive.ObjectID, error) {
+	var participants []ContestParticipant
+	opts := options.Find().SetProjection(bson.D{{"contest_id", 1}})
+	cursor, err := m.collection.Find(ctx, bson.D{{"user_id", userId}}, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := cursor.All(ctx, &participants); err != nil {
+		return nil, err
+	}
+	contestIds := []primitive.ObjectID{}
+	for _, participant := range participants {
+		contestIds = append(contestIds, participant.ContestId)
+	}
+	return contestIds, nil
+}
+
+func (m *MongoParticipantStore) Remove(ctx context.Context, contestId primitive.ObjectID, userId primitive.ObjectID) (bool, error) {
+	result, err := m.collection.DeleteOne(ctx, bson.D{{"contest_id", contestId}, {"user_id", userId}})
+	if err != nil {
+		return false, err
+	}
+	return result.DeletedCount == 1, nil
+}
+
+// *******
+// Invites
+// *******
+
+type MongoInviteStore struct {
+	collection *mongo.Collection
+}
+
+func NewMongoInviteStore(collection *mongo.Collection) *MongoInviteStore {
+	return &MongoInviteStore{collection}
+}
+
+func (m *MongoInviteStore) Create(ctx context.Context, invite ContestInvite) error {
+	_, err := m.collection.InsertOne(ctx, invite)
+	return mongoInsertErr(err)
+}
+
+func (m *MongoInviteStore) GetByCode(ctx context.Context, code string) (ContestInvite, error) {
+	var invite ContestInvite
+	err := m.collection.FindOne(ctx, bson.D{{"code", code}}).Decode(&invite)
+	return invite, mongoFindErr(err)
+}
+
+func (m *MongoInviteStore) ListByContest(ctx context.Context, contestId primitive.ObjectID) ([]ContestInvite, error) {
+	invites := []ContestInvite{}
+	opts := options.Find().SetSort(bson.D{{"_id", -1}})
+	cursor, err := m.collection.Find(ctx, bson.D{{"contest_id", contestId}}, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := cursor.All(ctx, &invites); err != nil {
+		return nil, err
+	}
+	return invites, nil
+}
+
+// The expiry and use limit are checked in the update, so concurrent uses can't go over the limit
+func (m *MongoInviteStore) Use(ctx context.Context, inviteId primitive.ObjectID, now time.Time) (bool, error) {
+	filter := bson.D{
+		{"_id", inviteId},
+		{"$and", bson.A{
+			bson.D{{"$or", bson.A{
+				bson.D{{"expires_at", bson.D{{"$exists", false}}}},
+				bson.D{{"expires_at", bson.D{{"$gt", now}}}},
+			}}},
+			bson.D{{"$or", bson.A{
+				bson.D{{"max_uses", 0}},
+				bson.D{{"$expr", bson.D{{"$lt", bson.A{"$uses", "$max_uses"}}}}},
+			}}},
+		}},
+	}
+	result, err := m.collection.UpdateOne(ctx, filter, bson.D{{"$inc", bson.D{{"uses", 1}}}})
+	if err != nil {
+		return false, err
+	}
+	return result.ModifiedCount == 1, nil
+}
+
+func (m *MongoInviteStore) Delete(ctx context.Context, contestId primitive.ObjectID, inviteId primitive.ObjectID) (bool, error) {
+	result, err := m.collection.DeleteOne(ctx, bson.D{{"_id", inviteId}, {"contest_id", contestId}})
+	if err != nil {
+		return false, err
+	}
+	return result.DeletedCount == 1, nil
+}
+
+// ***********
+// Communities
+// ***********
+
+type MongoCommunityStore struct {
+	collection *mongo.Collection
+}
+
+func NewMongoCommunityStore(collection *mongo.Collection) *MongoCommunityStore {
+	return &MongoCommunityStore{collection}
+}
+
+func (m *MongoCommunityStore) Create(ctx context.Context, community Community) error {
+	_, err := m.collection.InsertOne(ctx, community)
+	return mongoInsertErr(err)
+}
+
+func (m *MongoCommunityStore) Get(ctx context.Context, communityId primitive.ObjectID) (Community, error) {
+	var community Community
+	err := m.collection.FindOne(ctx, bson.D{{"_id", communityId}}).Decode(&community)
+	return community, mongoFindErr(err)
+}
+
+func (m *MongoCommunityStore) GetBySlug(ctx context.Context, slug string) (Community, error) {
+	var community Community
+	err := m.collection.FindOne(ctx, bson.D{{"slug", slug}}).Decode(&community)
+	return community, mongoFindErr(err)
+}
+
+func (m *MongoCommunityStore) List(ctx context.Context) ([]Community, error) {
+	communities := []Community{}
+	opts := options.Find().SetSort(bson.D{{"name", 1}})
+	cursor, err := m.collection.Find(ctx, bson.D{}, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := cursor.All(ctx, &communities); err != nil {
+		return nil, err
+	}
+	return communities, nil
+}
+
+func (m *MongoCommunityStore) Delete(ctx context.Context, communityId primitive.ObjectID) (bool, error) {
+	result, err := m.collection.DeleteOne(ctx, bson.D{{"_id", communityId}})
+	if err != nil {
+		return false, err
+	}
+	return result.DeletedCount == 1, nil
+}
+
+// *****************
+// Community Members
+// *****************
+
+type MongoCommunityMemberStore struct {
+	collection *mongo.Collection
+}
+
+func NewMongoCommunityMemberStore(collection *mongo.Collection) *MongoCommunityMemberStore {
+	return &MongoCommunityMemberStore{collection}
+}
+
+func (m *MongoCommunityMemberStore) Add(ctx context.Context, member CommunityMember) error {
+	_, err := m.collection.InsertOne(ctx, member)
+	return mongoInsertErr(err)
+}
+
+func (m *MongoCommunityMemberStore) Get(ctx context.Context, communityId primitive.ObjectID, userId primitive.ObjectID) (CommunityMember, error) {
+	var member CommunityMember
+	err := m.collection.FindOne(ctx, bson.D{{"community_id", communityId}, {"user_id", userId}}).Decode(&member)
+	return member, mongoFindErr(err)
+}
+
+func (m *MongoCommunityMemberStore) ListByCommunity(ctx context.Context, communityId primitive.ObjectID) ([]CommunityMember, error) {
+	return m.find(ctx, bson.D{{"community_id", communityId}})
+}
+
+func (m *MongoCommunityMemberStore) ListByUser(ctx context.Context, userId primitive.ObjectID) ([]CommunityMember, error) {
+	return m.find(ctx, bson.D{{"user_id", userId}})
+}
+
+func (m *MongoCommunityMemberStore) UpdateRole(ctx context.Context, communityId primitive.ObjectID, userId primitive.ObjectID, role string) error {
+	filter := bson.D{{"community_id", communityId}, {"user_id", userId}}
+	var before CommunityMember
+	err := m.collection.FindOneAndUpdate(ctx, filter, bson.D{{"$set", bson.D{{"role", role}}}}).Decode(&before)
+	if err != nil {
+		return mongoFindErr(err)
+	}
+	if !before.IsAdmin() || role == COMMUNITY_ADMIN {
+		return nil
+	}
+	return m.checkAdminLeft(ctx, communityId, func() error {
+		_, err := m.collection.UpdateOne(ctx, filter, bson.D{{"$set", bson.D{{"role", COMMUNITY_ADMIN}}}})
+		return err
+	})
+}
+
+func (m *MongoCommunityMemberStore) Remove(ctx context.Context, communityId primitive.ObjectID, userId primitive.ObjectID) (bool, error) {
+	var removed CommunityMember
+	err := m.collection.FindOneAndDelete(ctx, bson.D{{"community_id", communityId}, {"user_id", userId}}).Decode(&removed)
+	if err == mongo.ErrNoDocuments {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if !removed.IsAdmin() {
+		return true, nil
+	}
+	err = m.checkAdminLeft(ctx, communityId, func() error {
+		_, err := m.collection.InsertOne(ctx, removed)
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Undo a change that left a community without an admin, returning ErrLastAdmin
+// A single write can't check the community's other admins without a transaction, so demoting or removing
+// an admin is checked afterwards. If two admins demote each other at once both changes may be undone,
+// but the community always keeps an admin
+func (m *MongoCommunityMemberStore) checkAdminLeft(ctx context.Context, communityId primitive.ObjectID, undo func() error) error {
+	admins, err := m.collection.CountDocuments(ctx, bson.D{{"community_id", communityId}, {"role", COMMUNITY_ADMIN}})
+	if err != nil {
+		return err
+	}
+	if admins > 0 {
+		return nil
+	}
+	if err := undo(); err != nil {
+		return err
+	}
+	return ErrLastAdmin
+}
+
+// Find members in the order they joined
+func (m *MongoCommunityMemberStore) find(ctx context.Context, filter bson.D) ([]CommunityMember, error) {
+	members := []CommunityMember{}
+	opts := options.Find().SetSort(bson.D{{"_id", 1}})
+	cursor, err := m.collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := cursor.All(ctx, &members); err != nil {
+		return nil, err
+	}
+	return members, nil
+}
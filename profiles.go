@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/sessions"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// User profile pages
+// A profile lists the contests a user created, the entries they submitted with their placements,
+// the contests they won and totals, each of which the user can hide from everyone else
+
+// ********
+// Handlers
+// ********
+
+// Handler for /users/{username} endpoint
+func userProfileHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+	s *sessions.CookieStore,
+	tmplMap map[string]*template.Template,
+	userStore UserStore,
+	contestStore ContestStore,
+	entryStore EntryStore,
+	voteStore VoteStore,
+	participantStore ParticipantStore,
+	memberStore CommunityMemberStore,
+	username string,
+) {
+	viewerId, _, err := getSessionUser(r)
+	if err != nil {
+		logRequestError(r.Context(), "Couldn't get session user", err)
+		http.Redirect(w, r, "/contests", 302)
+		return
+	}
+	profile, err := getUserProfile(r.Context(), viewerId, username, userStore, contestStore, entryStore, voteStore, participantStore, memberStore)
+	if err != nil {
+		logRequestError(r.Context(), "Couldn't get user profile", err)
+		renderError(w, r, s, tmplMap, err, "/contests")
+		return
+	}
+	renderTemplate(w, r, s, tmplMap["profile.html"], http.StatusOK, profile)
+}
+
+// Handler for /account/profile endpoint, which links to the logged in user's profile
+func ownProfileHandler(w http.ResponseWriter, r *http.Request) {
+	_, username, err := getSessionUser(r)
+	if err != nil {
+		logRequestError(r.Context(), "Couldn't get session user", err)
+		http.Redirect(w, r, "/contests", 302)
+		return
+	}
+	http.Redirect(w, r, profileUrl(username), 302)
+}
+
+// Handler for changing which parts of a profile other users can see
+func profilePrivacyHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+	s *sessions.CookieStore,
+	tmplMap map[string]*template.Template,
+	userStore UserStore,
+	username string,
+) {
+	userId, _, err := getSessionUser(r)
+	if err != nil {
+		logRequestError(r.Context(), "Couldn't get session user", err)
+		http.Redirect(w, r, "/contests", 302)
+		return
+	}
+	privacy := UserPrivacy{
+		HideContests: r.PostFormValue("hidecontests") != "",
+		HideEntries: r.PostFormValue("hideentries") != "",
+		HideWins: r.PostFormValue("hidewins") != "",
+		HideStats: r.PostFormValue("hidestats") != "",
+	}
+	if err := updatePrivacy(r.Context(), userId, username, privacy, userStore); err != nil {
+		logRequestError(r.Context(), "Couldn't update privacy settings", err)
+		renderError(w, r, s, tmplMap, err, profileUrl(username))
+		return
+	}
+	http.Redirect(w, r, profileUrl(username), 302)
+}
+
+// *******
+// Actions
+// *******
+
+// Get what a viewer can see of a user's profile
+// Contests that aren't listed for the viewer are left out, and only the user sees them counted in the stats
+func getUserProfile(
+	ctx context.Context,
+	viewerId primitive.ObjectID,
+	username string,
+	userStore UserStore,
+	contestStore ContestStore,
+	entryStore EntryStore,
+	voteStore VoteStore,
+	participantStore ParticipantStore,
+	memberStore CommunityMemberStore,
+) (UserProfile, error) {
+	user, err := findUser(ctx, username, userStore)
+	if err != nil {
+		return UserProfile{}, err
+	}
+	ownProfile := user.Id == viewerId
+	profile := UserProfile{
+		UserId: user.Id,
+		Username: user.Username,
+		IsOwnProfile: ownProfile,
+		Privacy: user.Privacy,
+		ShowContests: ownProfile || !user.Privacy.HideContests,
+		ShowEntries: ownProfile || !user.Privacy.HideEntries,
+		ShowWins: ownProfile || !user.Privacy.HideWins,
+		ShowStats: ownProfile || !user.Privacy.HideStats,
+	}
+	contests, err := contestStore.ListByOwner(ctx, user.Id)
+	if err != nil {
+		return UserProfile{}, err
+	}
+	entries, err := entryStore.ListByOwner(ctx, user.Id)
+	if err != nil {
+		return UserProfile{}, err
+	}
+	stats := ProfileStats{}
+	stats.VotesCast, err = voteStore.CountByVoter(ctx, user.Id)
+	if err != nil {
+		return UserProfile{}, err
+	}
+	memberOf, err := participantStore.ListContestIds(ctx, viewerId)
+	if err != nil {
+		return UserProfile{}, err
+	}
+	communities, err := listCommunityIds(ctx, viewerId, memberStore)
+	if err != nil {
+		return UserProfile{}, err
+	}
+	listedContests := []Contest{}
+	for _, contest := range contests {
+		if isContestListed(contest, viewerId, memberOf, communities) {
+			listedContests = append(listedContests, contest)
+		}
+	}
+	stats.ContestsCreated = len(listedContests)
+	if ownProfile {
+		stats.ContestsCreated = len(contests)
+	}
+
+	visibleEntries := []ProfileEntry{}
+	wins := []ProfileEntry{}
+	for _, entry := range getProfileEntries(ctx, entries, contestStore, entryStore, voteStore) {
+		listed := isContestListed(entry.Contest, viewerId, memberOf, communities)
+		// Entries are hidden on the contest page until voting starts, so they are here too
+		visible := listed && (ownProfile || !entry.Contest.IsOpen())
+		if visible {
+			visibleEntries = append(visibleEntries, entry)
+		}
+		if entry.Won && listed {
+			wins = append(wins, entry)
+		}
+		if !visible && !ownProfile {
+			continue
+		}
+		stats.EntriesSubmitted++
+		if entry.Won {
+			stats.Wins++
+		}
+		if entry.Placement >= 1 && entry.Placement <= 3 {
+			stats.Podiums++
+		}
+	}
+
+	if profile.ShowContests {
+		profile.Contests = listedContests
+	}
+	if profile.ShowEntries {
+		profile.Entries = visibleEntries
+	}
+	if profile.ShowWins {
+		profile.Wins = wins
+	}
+	if profile.ShowStats {
+		profile.Stats = &stats
+	}
+	return profile, nil
+}
+
+// Change which parts of a user's profile other users can see
+func updatePrivacy(
+	ctx context.Context,
+	userId primitive.ObjectID,
+	username string,
+	privacy UserPrivacy,
+	userStore UserStore,
+) error {
+	user, err := findUser(ctx, username, userStore)
+	if err != nil {
+		return err
+	}
+	if user.Id != userId {
+		return forbiddenError("You can only change your own privacy settings")
+	}
+	return userStore.UpdatePrivacy(ctx, user.Id, privacy)
+}
+
+// *******
+// Helpers
+// *******
+
+// Look up a user from the username in a request path
+func findUser(ctx context.Context, username string, userStore UserStore) (User, error) {
+	user, err := userStore.GetByUsername(ctx, username)
+	if err == ErrNotFound {
+		return User{}, notFoundError("User not found")
+	}
+	return user, err
+}
+
+func profileUrl(username string) string {
+	return "/users/" + username
+}
+
+// Add each entry's contest, and its placement once the contest has concluded
+// Placements are read from the entry, tallying the contest first if they haven't been recorded
+func getProfileEntries(
+	ctx context.Context,
+	entries []ContestEntry,
+	contestStore ContestStore,
+	entryStore EntryStore,
+	voteStore VoteStore,
+) []ProfileEntry {
+	profileEntries := []ProfileEntry{}
+	for _, entry := range entries {
+		contest, err := contestStore.Get(ctx, entry.ContestID)
+		if err != nil {
+			slog.ErrorContext(ctx, "Couldn't find entry's contest", "entry_id", entry.GetStringId(), "error", err)
+			continue
+		}
+		profileEntry := ProfileEntry{Entry: entry, Contest: contest}
+		if contest.IsConcluded() {
+			if !contest.ResultsRecorded {
+				recorded, err := recordContestResults(ctx, contest, contestStore, entryStore, voteStore)
+				if err != nil {
+					slog.ErrorContext(ctx, "Couldn't record contest results", "contest_id", contest.GetStringId(), "error", err)
+				}
+				entry = recorded[entry.Id]
+			}
+			profileEntry.Placement = entry.Placement
+			profileEntry.Won = entry.Won
+			profileEntry.EntryCount = int(contest.EntryCount)
+		}
+		profileEntries = append(profileEntries, profileEntry)
+	}
+	return profileEntries
+}
+
+// Tally a concluded contest and save each entry's placement on it, so profiles don't tally
+// every contest they list each time they're viewed
+// Returns the contest's entries with their results, by ID
+func recordContestResults(
+	ctx context.Context,
+	contest Contest,
+	contestStore ContestStore,
+	entryStore EntryStore,
+	voteStore VoteStore,
+) (map[primitive.ObjectID]ContestEntry, error) {
+	recorded := make(map[primitive.ObjectID]ContestEntry)
+	entries, err := entryStore.ListByContest(ctx, contest.Id)
+	if err != nil {
+		return recorded, err
+	}
+	votes, err := voteStore.ListByContest(ctx, contest.Id)
+	if err != nil {
+		return recorded, err
+	}
+	results := tallyVotes(contest.GetVotingMethod(), entries, votes)
+	winners := make(map[primitive.ObjectID]bool)
+	for _, winner := range contestWinners(results) {
+		winners[winner.Id] = true
+	}
+	for _, result := range results {
+		entry := result.Entry
+		entry.Placement = entryPlacement(results, entry.Id)
+		entry.Won = winners[entry.Id]
+		recorded[entry.Id] = entry
+		if err := entryStore.UpdateResult(ctx, entry.Id, entry.Placement, entry.Won); err != nil {
+			return recorded, err
+		}
+	}
+	return recorded, contestStore.SetResultsRecorded(ctx, contest.Id, true)
+}
+
+// Format a placement like "1st" or "22nd"
+func formatOrdinal(n int) string {
+	suffix := "th"
+	if n % 100 < 11 || n % 100 > 13 {
+		switch n % 10 {
+		case 1:
+			suffix = "st"
+		case 2:
+			suffix = "nd"
+		case 3:
+			suffix = "rd"
+		}
+	}
+	return strconv.Itoa(n) + suffix
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// Run a contest where ted's entry beats rufus's, returning the users' cookies
+func (a *testApp) concludedContest(t *testing.T) map[string][]*http.Cookie {
+	users := map[string][]*http.Cookie{}
+	for _, username := range []string{"bill", "ted", "rufus", "alice"} {
+		users[username] = a.login(t, username)
+	}
+	contest := a.createContest(t, users["bill"])
+	a.submitEntry(contest, users["ted"])
+	a.submitEntry(contest, users["rufus"])
+	a.changeState(contest, "start-vote", users["bill"])
+	entries, _ := a.entries.ListByContest(context.TODO(), contest.Id)
+	for _, entry := range entries {
+		if entry.OwnerName == "ted" {
+			a.vote(contest, entry.GetStringId(), users["alice"])
+		}
+	}
+	if rec := a.changeState(contest, "stop-vote", users["bill"]); rec.Code != http.StatusFound {
+		t.Fatalf("Contest should conclude, got %v", rec.Code)
+	}
+	return users
+}
+
+func TestProfilePlacements(t *testing.T){
+	app := newTestApp(t)
+	users := app.concludedContest(t)
+	// An entry in a contest still open is only shown to its owner
+	openContest := app.createContest(t, users["bill"])
+	app.submitEntry(openContest, users["ted"])
+
+	var profile APIUserProfile
+	app.apiCall(t, "GET", "/users/ted", nil, users["alice"], &profile)
+	if len(profile.Entries) != 1 || profile.Entries[0].Placement != 1 || profile.Entries[0].EntryCount != 2 {
+		t.Fatalf("Other users should see the concluded entry's placement, got %+v", profile.Entries)
+	}
+	if len(profile.Wins) != 1 || profile.Privacy != nil {
+		t.Errorf("Win should be listed, got %+v", profile)
+	}
+	// The open contest's entry isn't counted either
+	expected := APIProfileStats{ContestsCreated: 0, EntriesSubmitted: 1, Wins: 1, Podiums: 1, VotesCast: 0}
+	if profile.Stats == nil || *profile.Stats != expected {
+		t.Errorf("Unexpected stats %+v", profile.Stats)
+	}
+	app.apiCall(t, "GET", "/users/ted", nil, users["ted"], &profile)
+	if len(profile.Entries) != 2 || profile.Privacy == nil || profile.Stats.EntriesSubmitted != 2 {
+		t.Errorf("Users should see all their own entries, got %+v", profile.Entries)
+	}
+
+	body := app.get("/users/rufus", users["alice"]).Body.String()
+	if !strings.Contains(body, "2nd of 2") || !strings.Contains(body, "No wins yet") {
+		t.Error("Profile page should show the entry's placement")
+	}
+	body = app.get("/users/bill", users["alice"]).Body.String()
+	if strings.Count(body, `href="/contests/`) != 2 {
+		t.Error("Profile page should list the contests the user created")
+	}
+	expectAPIError(t, app.apiCall(t, "GET", "/users/nobody", nil, users["alice"], nil), http.StatusNotFound)
+}
+
+func TestProfilePrivacy(t *testing.T){
+	app := newTestApp(t)
+	users := app.concludedContest(t)
+	form := url.Values{"hideentries": {"on"}, "hidestats": {"on"}}
+	if rec := app.postForm("/users/ted/privacy", form, users["alice"]); rec.Code != http.StatusForbidden {
+		t.Errorf("Users should not change each other's settings, got %v", rec.Code)
+	}
+	if rec := app.postForm("/users/ted/privacy", form, users["ted"]); rec.Header().Get("Location") != "/users/ted" {
+		t.Fatalf("Saving settings should redirect to the profile, got %v", rec.Code)
+	}
+
+	var profile APIUserProfile
+	rec := app.apiCall(t, "GET", "/users/ted", nil, users["alice"], &profile)
+	if profile.Entries != nil || profile.Stats != nil || len(profile.Wins) != 1 {
+		t.Errorf("Hidden sections should be null, got %v", rec.Body.String())
+	}
+	if body := app.get("/users/ted", users["alice"]).Body.String(); strings.Contains(body, "Entries") {
+		t.Error("Profile page should not show hidden entries")
+	}
+	app.apiCall(t, "GET", "/users/ted", nil, users["ted"], &profile)
+	if len(profile.Entries) != 1 || profile.Stats == nil || !profile.Privacy.HideEntries || profile.Privacy.HideWins {
+		t.Errorf("Users should see their hidden sections and settings, got %+v", profile)
+	}
+
+	var privacy APIPrivacy
+	app.apiCall(t, "PUT", "/users/ted/privacy", APIPrivacy{HideWins: true}, users["ted"], &privacy)
+	app.apiCall(t, "GET", "/users/ted", nil, users["alice"], &profile)
+	if !privacy.HideWins || profile.Wins != nil || profile.Entries == nil {
+		t.Errorf("Settings should be replaced through the API, got %+v", profile)
+	}
+}
+
+func TestProfileResultsRecorded(t *testing.T){
+	app := newTestApp(t)
+	users := app.concludedContest(t)
+	contests, _ := app.contests.ListByOwner(context.TODO(), objectId(t, app.userId(t, "bill")))
+	contest := contests[0]
+	if contest.ResultsRecorded {
+		t.Fatal("Results should be recorded when first needed")
+	}
+
+	var profile APIUserProfile
+	app.apiCall(t, "GET", "/users/ted", nil, users["alice"], &profile)
+	contest, _ = app.contests.Get(context.TODO(), contest.Id)
+	entries, _ := app.entries.ListByContest(context.TODO(), contest.Id)
+	if !contest.ResultsRecorded || len(entries) != 2 {
+		t.Fatal("Viewing a profile should record the contest's results")
+	}
+	for _, entry := range entries {
+		if expected := map[string]int{"ted": 1, "rufus": 2}[entry.OwnerName]; entry.Placement != expected || entry.Won != (expected == 1) {
+			t.Errorf("%v's entry should be recorded in place %v, got %+v", entry.OwnerName, expected, entry)
+		}
+	}
+
+	// Removing the winner changes the results, so they're recorded again
+	for _, entry := range entries {
+		if entry.OwnerName == "ted" {
+			app.postForm("/contests/" + contest.GetStringId() + "/entries/" + entry.GetStringId() + "/remove", url.Values{}, users["bill"])
+		}
+	}
+	if contest, _ = app.contests.Get(context.TODO(), contest.Id); contest.ResultsRecorded {
+		t.Fatal("Removing an entry should clear the recorded results")
+	}
+	app.apiCall(t, "GET", "/users/rufus", nil, users["alice"], &profile)
+	if len(profile.Entries) != 1 || profile.Entries[0].Placement != 1 || len(profile.Wins) != 1 {
+		t.Errorf("Remaining entry should win, got %+v", profile)
+	}
+}
+
+func TestEntryPlacement(t *testing.T){
+	entries := createEntries("a", "b", "c", "d")
+	results := []EntryResult{{entries[0], 3}, {entries[1], 3}, {entries[2], 1}, {entries[3], 0}}
+	for i, expected := range []int{1, 1, 3, 4} {
+		if placement := entryPlacement(results, entries[i].Id); placement != expected {
+			t.Errorf("Entry %v should place %v, got %v", i, expected, placement)
+		}
+	}
+	if len(contestWinners(results)) != 2 {
+		t.Error("Tied entries should both win")
+	}
+	for n, expected := range map[int]string{1: "1st", 2: "2nd", 3: "3rd", 4: "4th", 11: "11th", 12: "12th", 22: "22nd", 113: "113th"} {
+		if got := formatOrdinal(n); got != expected {
+			t.Errorf("%v should be formatted %v, got %v", n, expected, got)
+		}
+	}
+}
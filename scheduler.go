@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// How often the scheduler checks for contests with passed deadlines
+const schedulerInterval = time.Minute
+
+// Start background scheduler that advances contests once their deadlines pass
+// Deadlines are stored with the contest, so any deadline missed while the server
+// was down is applied on the first run after a restart
+// The scheduler stops when ctx is cancelled
+func startContestScheduler(
+	ctx context.Context,
+	contestStore ContestStore,
+	entryStore EntryStore,
+	interval time.Duration,
+) {
+	go func() {
+		runScheduler := func(now time.Time) {
+			// Don't let a slow database hold up the next run
+			runCtx, cancel := context.WithTimeout(ctx, interval)
+			defer cancel()
+			advanceScheduledContests(runCtx, now, contestStore, entryStore)
+		}
+		runScheduler(time.Now())
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				runScheduler(now)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// Move every contest with a passed deadline into its scheduled state
+func advanceScheduledContests(
+	ctx context.Context,
+	now time.Time,
+	contestStore ContestStore,
+	entryStore EntryStore,
+) {
+	contests, err := contestStore.ListDeadlinePassed(ctx, now)
+	if err != nil {
+		slog.ErrorContext(ctx, "Couldn't list contests past their deadline", "error", err)
+		return
+	}
+	for _, contest := range contests {
+		entryCount := getNumSubmissions(ctx, contest.Id, entryStore)
+		if entryCount < 0 {
+			continue
+		}
+		state := scheduledState(contest, entryCount, now)
+		if state == contest.State {
+			continue
+		}
+		// Only update if the state hasn't been changed by the owner or another server in the meantime
+		updated, updateErr := contestStore.UpdateState(ctx, contest.Id, contest.State, state)
+		if updateErr != nil {
+			slog.ErrorContext(ctx, "Couldn't update contest state", "contest_id", contest.GetStringId(), "error", updateErr)
+			continue
+		}
+		if updated {
+			contestStateTransitions.WithLabelValues(apiStateNames[state], TRIGGER_SCHEDULE).Inc()
+			slog.InfoContext(ctx, "Contest moved to new state by schedule", "contest_id", contest.GetStringId(), "state", apiStateNames[state])
+		}
+	}
+}
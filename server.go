@@ -2,10 +2,18 @@ package main
 
 import (
 	"context"
-	"fmt"
+	"flag"
 	"html/template"
-	"log"
+	"log/slog"
 	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+	// Timezone data for reading contest deadlines in the creator's timezone, even without system tzdata
+	_ "time/tzdata"
+
 	"github.com/gorilla/mux"
 	"github.com/gorilla/sessions"
 	"go.mongodb.org/mongo-driver/mongo"
@@ -13,84 +21,155 @@ import (
 )
 
 
+// Timeouts for the HTTP server
+// Uploads must be read within serverReadTimeout, and the write timeout
+// starts before the upload is read so it has to be longer
+const (
+	serverReadHeaderTimeout = 10 * time.Second
+	serverReadTimeout = time.Minute
+	serverWriteTimeout = 2 * time.Minute
+	serverIdleTimeout = 2 * time.Minute
+	// Deadline for the database and storage calls made while handling a request
+	requestTimeout = 90 * time.Second
+	// How long requests in progress get to finish when the server is stopped
+	shutdownTimeout = 30 * time.Second
+	// How long a stopping server keeps accepting requests in production while reporting not ready
+	drainDelay = 5 * time.Second
+	mongoConnectTimeout = 10 * time.Second
+)
+
 // Connect to MongoDB
 func getMongoClient(uri string) *mongo.Client {
-	// Use local db instance for demonstration purposes
-	clientOptions := options.Client().ApplyURI(uri)
-	client, err := mongo.Connect(context.TODO(), clientOptions)
+	ctx, cancel := context.WithTimeout(context.Background(), mongoConnectTimeout)
+	defer cancel()
+	clientOptions := options.Client().ApplyURI(uri).SetMonitor(newMongoMetricsMonitor())
+	client, err := mongo.Connect(ctx, clientOptions)
 	if err != nil {
-		log.Fatal(err)
+		logFatal("Couldn't connect to MongoDB", err)
 	}
-	err = client.Ping(context.TODO(), nil)
+	err = client.Ping(ctx, nil)
 	if err != nil {
-		log.Fatal(err)
+		logFatal("Couldn't reach MongoDB", err)
 	}
 	return client
 }
 
-func main() {
-	// HARD VALUES FOR DEVELOPMENT/DEMONSTRATION PURPOSES ONLY
-	dbName := "photospot"
-	dbUri := "mongodb://localhost:27017"
-	secretKey := "superdupersecret42"
-
-	// MongoDB setup
-	client := getMongoClient(dbUri)
-	userCollection := client.Database(dbName).Collection("users")
-	contestCollection := client.Database(dbName).Collection("contests")
-	contestEntryCollection := client.Database(dbName).Collection("contestEntries")
-	contestVoteCollection := client.Database(dbName).Collection("contestVotes")
-
-	// Setup cookie store for sessions
-	// Authentication logic from:
-	// https://thewhitetulip.gitbooks.io/webapp-with-golang-anti-textbook/content/manuscript/4.0authentication.html
-	store := sessions.NewCookieStore([]byte(secretKey))
-
-	// Serve static files
-	staticFs := http.FileServer(http.Dir("static/"))
-	imageFs := http.FileServer(http.Dir("uploadedImages/"))
-	router := mux.NewRouter()
-	router.PathPrefix("/static/").Handler(http.StripPrefix("/static/", staticFs))
-	router.PathPrefix("/uploadedImages/").Handler(http.StripPrefix("/uploadedImages/", imageFs))
+// Give every request a deadline, which store calls made with the request context inherit
+func requestTimeoutMiddleware(timeout time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx, cancel := context.WithTimeout(r.Context(), timeout)
+			defer cancel()
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
 
-	// Initialize templates
+// Parse page templates, keyed by page file name
+func loadTemplates() map[string]*template.Template {
 	tmplMap := make(map[string]*template.Template)
-	tmplMap["index.html"] = template.Must(template.ParseFiles("static/index.html", "static/base.html"))
-	tmplMap["authForm.html"] = template.Must(template.ParseFiles("static/authForm.html", "static/base.html"))
-	tmplMap["contests.html"] = template.Must(template.ParseFiles("static/contests.html", "static/base.html"))
-	tmplMap["createContest.html"] = template.Must(template.ParseFiles("static/createContest.html", "static/base.html"))
-	tmplMap["contestDetailOpen.html"] = template.Must(template.ParseFiles(
+	tmplMap["index.html"] = parseTemplate("static/index.html", "static/base.html")
+	tmplMap["authForm.html"] = parseTemplate("static/authForm.html", "static/base.html")
+	tmplMap["contests.html"] = parseTemplate("static/contests.html", "static/base.html")
+	tmplMap["createContest.html"] = parseTemplate("static/createContest.html", "static/base.html")
+	tmplMap["tokens.html"] = parseTemplate("static/tokens.html", "static/base.html")
+	tmplMap["sessions.html"] = parseTemplate("static/sessions.html", "static/base.html")
+	tmplMap["profile.html"] = parseTemplate("static/profile.html", "static/base.html")
+	tmplMap["participants.html"] = parseTemplate("static/participants.html", "static/base.html")
+	tmplMap["invite.html"] = parseTemplate("static/invite.html", "static/base.html")
+	tmplMap["communities.html"] = parseTemplate("static/communities.html", "static/base.html")
+	tmplMap["community.html"] = parseTemplate("static/community.html", "static/base.html")
+	tmplMap["contestDuplicates.html"] = parseTemplate("static/contestDuplicates.html", "static/base.html")
+	tmplMap["editContest.html"] = parseTemplate("static/editContest.html", "static/base.html")
+	tmplMap["admin.html"] = parseTemplate("static/admin.html", "static/base.html")
+	tmplMap["error.html"] = parseTemplate("static/error.html", "static/base.html")
+	tmplMap["contestDetailOpen.html"] = parseTemplate(
 		"static/contestDetailOpen.html",
 		"static/contestDetail.html",
 		"static/base.html",
-	))
-	tmplMap["contestDetailVoting.html"] = template.Must(template.ParseFiles(
+	)
+	tmplMap["contestDetailVoting.html"] = parseTemplate(
 		"static/contestDetailVoting.html",
 		"static/contestDetail.html",
 		"static/base.html",
-	))
-	tmplMap["contestDetailConcluded.html"] = template.Must(template.ParseFiles(
+	)
+	tmplMap["contestDetailConcluded.html"] = parseTemplate(
 		"static/contestDetailConcluded.html",
 		"static/contestDetail.html",
 		"static/base.html",
-	))
+	)
+	return tmplMap
+}
+
+// Parse a page and the templates it uses, with templateFuncs available
+// Pages are only executed through renderTemplate
+func parseTemplate(files ...string) *template.Template {
+	return template.Must(template.New(filepath.Base(files[0])).Funcs(templateFuncs).ParseFiles(files...))
+}
+
+// Register all routes
+func newRouter(
+	store *sessions.CookieStore,
+	tmplMap map[string]*template.Template,
+	userStore UserStore,
+	contestStore ContestStore,
+	entryStore EntryStore,
+	voteStore VoteStore,
+	tokenStore TokenStore,
+	loginAttemptStore LoginAttemptStore,
+	sessionStore SessionStore,
+	participantStore ParticipantStore,
+	inviteStore InviteStore,
+	communityStore CommunityStore,
+	memberStore CommunityMemberStore,
+	blobStore BlobStore,
+	health *HealthChecker,
+) *mux.Router {
+	// Serve static files
+	staticFs := http.FileServer(http.Dir("static/"))
+	router := mux.NewRouter()
+	router.Use(requestIdMiddleware)
+	router.Use(metricsMiddleware)
+	router.Use(requestTimeoutMiddleware(requestTimeout))
+	router.PathPrefix("/static/").Handler(http.StripPrefix("/static/", staticFs))
+
+	// Health checks for load balancers and orchestrators
+	router.HandleFunc("/healthz", healthzHandler).Methods("GET")
+
+	router.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		readyzHandler(w, r, health)
+	}).Methods("GET")
+
+	// Serve uploaded images from blob storage, to anyone who can see their contest
+	router.HandleFunc(imageUrlPrefix + "{name}", func(w http.ResponseWriter, r *http.Request) {
+		uploadedImageHandler(w, r, contestStore, entryStore, participantStore, memberStore, blobStore, mux.Vars(r)["name"])
+	}).Methods("GET", "HEAD")
+
+	// Accept personal access tokens as well as session cookies
+	router.Use(tokenAuthMiddleware(tokenStore))
+	router.Use(sessionMiddleware(store, sessionStore))
+	router.Use(userMiddleware(store, tmplMap, userStore))
+	router.Use(csrfMiddleware(store, tmplMap))
+
+	// JSON API routes
+	registerAPIRoutes(router, store, userStore, contestStore, entryStore, voteStore, tokenStore, loginAttemptStore, sessionStore, participantStore, inviteStore, communityStore, memberStore, blobStore)
 
 	// Index route
 	router.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		tmplMap["index.html"].ExecuteTemplate(w, "base", nil)
+		renderTemplate(w, r, store, tmplMap["index.html"], http.StatusOK, nil)
 	}).Methods("GET")
 
 	// Authentication routes
 	router.HandleFunc("/signup", func(w http.ResponseWriter, r *http.Request) {
-		signupHandler(w, r, store, tmplMap, userCollection)
+		signupHandler(w, r, store, tmplMap, userStore)
 	}).Methods("GET", "POST")
 
 	router.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {
-		loginHandler(w, r, store, tmplMap, userCollection)
+		loginHandler(w, r, store, tmplMap, userStore, loginAttemptStore, sessionStore)
 	}).Methods("GET", "POST")
 
 	router.HandleFunc("/logout", func(w http.ResponseWriter, r *http.Request) {
-		logoutHandler(w, r, store)
+		logoutHandler(w, r, store, sessionStore)
 	}).Methods("POST")
 
 	router.HandleFunc("/home", func(w http.ResponseWriter, r *http.Request) {
@@ -100,14 +179,14 @@ func main() {
 
 	// Contest routes (authentication needed)
 	router.HandleFunc("/contests", func(w http.ResponseWriter, r *http.Request) {
-		if loginRequiredHandlerMixin(w, r, store) {
+		if loginRequiredHandlerMixin(w, r, store, SCOPE_READ) {
 			return
 		}
-		contestIndexHandler(w, r, store, tmplMap, contestCollection)
+		contestIndexHandler(w, r, store, tmplMap, userStore, contestStore, communityStore, participantStore, memberStore)
 	}).Methods("GET")
 
 	router.HandleFunc("/contests/{contestId}", func(w http.ResponseWriter, r *http.Request) {
-		if loginRequiredHandlerMixin(w, r, store) {
+		if loginRequiredHandlerMixin(w, r, store, SCOPE_READ) {
 			return
 		}
 		vars := mux.Vars(r)
@@ -115,63 +194,494 @@ func main() {
 		contestDetailHandler(
 			w, r, store, 
 			tmplMap,
-			contestCollection,
-			contestEntryCollection,
-			contestVoteCollection,
+			contestStore,
+			entryStore,
+			voteStore,
+			participantStore,
+			memberStore,
 			contestId,
 		)
 	}).Methods("GET")
 
 	router.HandleFunc("/contests/{contestId}/submit", func(w http.ResponseWriter, r *http.Request) {
-		if loginRequiredHandlerMixin(w, r, store) {
+		if loginRequiredHandlerMixin(w, r, store, SCOPE_SUBMIT) {
 			return
 		}
 		vars := mux.Vars(r)
 		contestId := vars["contestId"]
-		contestPhotoSubmissionHandler(w, r, store, tmplMap, contestEntryCollection, contestId)
+		contestPhotoSubmissionHandler(w, r, store, tmplMap, contestStore, entryStore, voteStore, participantStore, memberStore, blobStore, contestId)
+	}).Methods("POST")
+
+	router.HandleFunc("/contests/{contestId}/duplicates", func(w http.ResponseWriter, r *http.Request) {
+		if loginRequiredHandlerMixin(w, r, store, SCOPE_MANAGE) {
+			return
+		}
+		contestId := mux.Vars(r)["contestId"]
+		contestDuplicatesHandler(w, r, store, tmplMap, contestStore, entryStore, participantStore, memberStore, contestId)
+	}).Methods("GET")
+
+	// Participant and invite routes for invite-only contests
+	router.HandleFunc("/contests/{contestId}/participants", func(w http.ResponseWriter, r *http.Request) {
+		// Viewing the list only needs read access, adding a participant needs manage
+		scope := SCOPE_READ
+		if r.Method == "POST" {
+			scope = SCOPE_MANAGE
+		}
+		if loginRequiredHandlerMixin(w, r, store, scope) {
+			return
+		}
+		contestId := mux.Vars(r)["contestId"]
+		contestParticipantsHandler(w, r, store, tmplMap, userStore, contestStore, participantStore, memberStore, inviteStore, contestId)
+	}).Methods("GET", "POST")
+
+	router.HandleFunc("/contests/{contestId}/participants/{userId}/remove", func(w http.ResponseWriter, r *http.Request) {
+		if loginRequiredHandlerMixin(w, r, store, SCOPE_MANAGE) {
+			return
+		}
+		vars := mux.Vars(r)
+		removeParticipantHandler(w, r, store, tmplMap, contestStore, participantStore, memberStore, vars["contestId"], vars["userId"])
+	}).Methods("POST")
+
+	router.HandleFunc("/contests/{contestId}/invites", func(w http.ResponseWriter, r *http.Request) {
+		if loginRequiredHandlerMixin(w, r, store, SCOPE_MANAGE) {
+			return
+		}
+		contestId := mux.Vars(r)["contestId"]
+		createInviteHandler(w, r, store, tmplMap, contestStore, participantStore, memberStore, inviteStore, contestId)
 	}).Methods("POST")
 
+	router.HandleFunc("/contests/{contestId}/invites/{inviteId}/revoke", func(w http.ResponseWriter, r *http.Request) {
+		if loginRequiredHandlerMixin(w, r, store, SCOPE_MANAGE) {
+			return
+		}
+		vars := mux.Vars(r)
+		revokeInviteHandler(w, r, store, tmplMap, contestStore, participantStore, memberStore, inviteStore, vars["contestId"], vars["inviteId"])
+	}).Methods("POST")
+
+	router.HandleFunc("/invites/{code}", func(w http.ResponseWriter, r *http.Request) {
+		// Viewing the invite only needs read access, accepting it needs manage
+		scope := SCOPE_READ
+		if r.Method == "POST" {
+			scope = SCOPE_MANAGE
+		}
+		if loginRequiredHandlerMixin(w, r, store, scope) {
+			return
+		}
+		code := mux.Vars(r)["code"]
+		inviteHandler(w, r, store, tmplMap, contestStore, participantStore, memberStore, inviteStore, code)
+	}).Methods("GET", "POST")
+
 	router.HandleFunc("/create-contest", func(w http.ResponseWriter, r *http.Request) {
-		if loginRequiredHandlerMixin(w, r, store) {
+		// Viewing the form only needs read access, creating a contest needs manage
+		scope := SCOPE_READ
+		if r.Method == "POST" {
+			scope = SCOPE_MANAGE
+		}
+		if loginRequiredHandlerMixin(w, r, store, scope) {
 			return
 		}
-		createContestHandler(w, r, store, tmplMap, contestCollection)
+		createContestHandler(w, r, store, tmplMap, contestStore, communityStore, memberStore)
 	}).Methods("GET", "POST")
 
 	router.HandleFunc("/contests/{contestId}/start-vote", func(w http.ResponseWriter, r *http.Request) {
-		if loginRequiredHandlerMixin(w, r, store) {
+		if loginRequiredHandlerMixin(w, r, store, SCOPE_MANAGE) {
 			return
 		}
 		vars := mux.Vars(r)
 		contestId := vars["contestId"]
-		contestChangeStateHandler(w, r, store, contestCollection, contestId, VOTING)
+		contestChangeStateHandler(
+			w, r, store,
+			tmplMap,
+			contestStore,
+			entryStore,
+			participantStore,
+			memberStore,
+			contestId,
+			VOTING,
+		)
 	}).Methods("POST")
 
 	router.HandleFunc("/contests/{contestId}/stop-vote", func(w http.ResponseWriter, r *http.Request) {
-		if loginRequiredHandlerMixin(w, r, store) {
+		if loginRequiredHandlerMixin(w, r, store, SCOPE_MANAGE) {
 			return
 		}
 		vars := mux.Vars(r)
 		contestId := vars["contestId"]
-		contestChangeStateHandler(w, r, store, contestCollection, contestId, CONCLUDED)
+		contestChangeStateHandler(
+			w, r, store,
+			tmplMap,
+			contestStore,
+			entryStore,
+			participantStore,
+			memberStore,
+			contestId,
+			CONCLUDED,
+		)
+	}).Methods("POST")
+
+	// Contest moderation routes, for owners and site staff
+	router.HandleFunc("/contests/{contestId}/edit", func(w http.ResponseWriter, r *http.Request) {
+		// Viewing the form only needs read access, saving it needs manage
+		scope := SCOPE_READ
+		if r.Method == "POST" {
+			scope = SCOPE_MANAGE
+		}
+		if loginRequiredHandlerMixin(w, r, store, scope) {
+			return
+		}
+		contestId := mux.Vars(r)["contestId"]
+		editContestHandler(w, r, store, tmplMap, contestStore, participantStore, memberStore, contestId)
+	}).Methods("GET", "POST")
+
+	router.HandleFunc("/contests/{contestId}/delete", func(w http.ResponseWriter, r *http.Request) {
+		if loginRequiredHandlerMixin(w, r, store, SCOPE_MANAGE) {
+			return
+		}
+		contestId := mux.Vars(r)["contestId"]
+		deleteContestHandler(w, r, store, tmplMap, contestStore, entryStore, voteStore, participantStore, memberStore, blobStore, contestId)
+	}).Methods("POST")
+
+	router.HandleFunc("/contests/{contestId}/entries/{entryId}/remove", func(w http.ResponseWriter, r *http.Request) {
+		if loginRequiredHandlerMixin(w, r, store, SCOPE_MANAGE) {
+			return
+		}
+		vars := mux.Vars(r)
+		removeEntryHandler(w, r, store, tmplMap, contestStore, entryStore, voteStore, participantStore, memberStore, blobStore, vars["contestId"], vars["entryId"])
+	}).Methods("POST")
+
+	router.HandleFunc("/contests/{contestId}/force-state", func(w http.ResponseWriter, r *http.Request) {
+		if loginRequiredHandlerMixin(w, r, store, SCOPE_MANAGE) {
+			return
+		}
+		contestId := mux.Vars(r)["contestId"]
+		forceStateHandler(w, r, store, tmplMap, contestStore, participantStore, memberStore, contestId)
 	}).Methods("POST")
 
 	router.HandleFunc("/contests/{contestId}/vote", func(w http.ResponseWriter, r *http.Request) {
-		if loginRequiredHandlerMixin(w, r, store) {
+		if loginRequiredHandlerMixin(w, r, store, SCOPE_VOTE) {
 			return
 		}
 		vars := mux.Vars(r)
 		contestId := vars["contestId"]
 		contestVoteHandler(
 			w, r, store,
-			contestCollection,
-			contestVoteCollection,
-			contestEntryCollection,
+			tmplMap,
+			contestStore,
+			voteStore,
+			entryStore,
+			participantStore,
+			memberStore,
 			contestId,
 		)
 	}).Methods("POST")
 
+	// Access token routes (browser session needed)
+	router.HandleFunc("/account/tokens", func(w http.ResponseWriter, r *http.Request) {
+		if loginRequiredHandlerMixin(w, r, store, "") {
+			return
+		}
+		tokenIndexHandler(w, r, store, tmplMap, tokenStore)
+	}).Methods("GET", "POST")
+
+	router.HandleFunc("/account/tokens/{tokenId}/revoke", func(w http.ResponseWriter, r *http.Request) {
+		if loginRequiredHandlerMixin(w, r, store, "") {
+			return
+		}
+		tokenId := mux.Vars(r)["tokenId"]
+		revokeTokenHandler(w, r, store, tmplMap, tokenStore, tokenId)
+	}).Methods("POST")
+
+	// Community routes
+	router.HandleFunc("/communities", func(w http.ResponseWriter, r *http.Request) {
+		// Viewing communities only needs read access, creating one needs manage
+		scope := SCOPE_READ
+		if r.Method == "POST" {
+			scope = SCOPE_MANAGE
+		}
+		if loginRequiredHandlerMixin(w, r, store, scope) {
+			return
+		}
+		communityIndexHandler(w, r, store, tmplMap, communityStore, memberStore)
+	}).Methods("GET", "POST")
+
+	router.HandleFunc("/communities/{slug}", func(w http.ResponseWriter, r *http.Request) {
+		if loginRequiredHandlerMixin(w, r, store, SCOPE_READ) {
+			return
+		}
+		slug := mux.Vars(r)["slug"]
+		communityHandler(w, r, store, tmplMap, userStore, contestStore, communityStore, participantStore, memberStore, slug)
+	}).Methods("GET")
+
+	router.HandleFunc("/communities/{slug}/join", func(w http.ResponseWriter, r *http.Request) {
+		if loginRequiredHandlerMixin(w, r, store, SCOPE_MANAGE) {
+			return
+		}
+		slug := mux.Vars(r)["slug"]
+		communityMembershipHandler(w, r, store, tmplMap, communityStore, memberStore, slug, true)
+	}).Methods("POST")
+
+	router.HandleFunc("/communities/{slug}/leave", func(w http.ResponseWriter, r *http.Request) {
+		if loginRequiredHandlerMixin(w, r, store, SCOPE_MANAGE) {
+			return
+		}
+		slug := mux.Vars(r)["slug"]
+		communityMembershipHandler(w, r, store, tmplMap, communityStore, memberStore, slug, false)
+	}).Methods("POST")
+
+	router.HandleFunc("/communities/{slug}/members/{userId}/role", func(w http.ResponseWriter, r *http.Request) {
+		if loginRequiredHandlerMixin(w, r, store, SCOPE_MANAGE) {
+			return
+		}
+		vars := mux.Vars(r)
+		communityRoleHandler(w, r, store, tmplMap, communityStore, memberStore, vars["slug"], vars["userId"])
+	}).Methods("POST")
+
+	router.HandleFunc("/communities/{slug}/members/{userId}/remove", func(w http.ResponseWriter, r *http.Request) {
+		if loginRequiredHandlerMixin(w, r, store, SCOPE_MANAGE) {
+			return
+		}
+		vars := mux.Vars(r)
+		removeCommunityMemberHandler(w, r, store, tmplMap, communityStore, memberStore, vars["slug"], vars["userId"])
+	}).Methods("POST")
+
+	// Site administration routes (browser session needed)
+	router.HandleFunc("/admin", func(w http.ResponseWriter, r *http.Request) {
+		if loginRequiredHandlerMixin(w, r, store, "") {
+			return
+		}
+		adminHandler(w, r, store, tmplMap, userStore, loginAttemptStore)
+	}).Methods("GET")
+
+	router.HandleFunc("/admin/users/role", func(w http.ResponseWriter, r *http.Request) {
+		if loginRequiredHandlerMixin(w, r, store, "") {
+			return
+		}
+		userRoleHandler(w, r, store, tmplMap, userStore)
+	}).Methods("POST")
+
+	router.HandleFunc("/admin/users/ban", func(w http.ResponseWriter, r *http.Request) {
+		if loginRequiredHandlerMixin(w, r, store, "") {
+			return
+		}
+		userBanHandler(w, r, store, tmplMap, userStore, sessionStore)
+	}).Methods("POST")
+
+	// Profile routes
+	router.HandleFunc("/users/{username}", func(w http.ResponseWriter, r *http.Request) {
+		if loginRequiredHandlerMixin(w, r, store, SCOPE_READ) {
+			return
+		}
+		username := mux.Vars(r)["username"]
+		userProfileHandler(w, r, store, tmplMap, userStore, contestStore, entryStore, voteStore, participantStore, memberStore, username)
+	}).Methods("GET")
+
+	router.HandleFunc("/users/{username}/privacy", func(w http.ResponseWriter, r *http.Request) {
+		if loginRequiredHandlerMixin(w, r, store, "") {
+			return
+		}
+		username := mux.Vars(r)["username"]
+		profilePrivacyHandler(w, r, store, tmplMap, userStore, username)
+	}).Methods("POST")
+
+	router.HandleFunc("/account/profile", func(w http.ResponseWriter, r *http.Request) {
+		if loginRequiredHandlerMixin(w, r, store, "") {
+			return
+		}
+		ownProfileHandler(w, r)
+	}).Methods("GET")
+
+	// Session routes
+	router.HandleFunc("/account/sessions", func(w http.ResponseWriter, r *http.Request) {
+		if loginRequiredHandlerMixin(w, r, store, "") {
+			return
+		}
+		sessionIndexHandler(w, r, store, tmplMap, sessionStore)
+	}).Methods("GET")
+
+	router.HandleFunc("/account/sessions/revoke-all", func(w http.ResponseWriter, r *http.Request) {
+		if loginRequiredHandlerMixin(w, r, store, "") {
+			return
+		}
+		revokeAllSessionsHandler(w, r, store, tmplMap, sessionStore)
+	}).Methods("POST")
+
+	router.HandleFunc("/account/sessions/{sessionId}/revoke", func(w http.ResponseWriter, r *http.Request) {
+		if loginRequiredHandlerMixin(w, r, store, "") {
+			return
+		}
+		sessionId := mux.Vars(r)["sessionId"]
+		revokeSessionHandler(w, r, store, tmplMap, sessionStore, sessionId)
+	}).Methods("POST")
+
+	return router
+}
+
+// Create the configured storage for uploaded images
+// Images are stored in an S3 compatible bucket when one is configured,
+// so several server instances can share them, otherwise in a local directory
+func newBlobStore(config Config) (BlobStore, error) {
+	if config.S3.Bucket != "" {
+		return NewS3BlobStore(
+			config.S3.Endpoint,
+			config.S3.Bucket,
+			config.S3.Region,
+			config.S3.AccessKey,
+			config.S3.SecretKey,
+		)
+	}
+	return NewLocalBlobStore(config.Uploads.Dir)
+}
+
+func main() {
+	config, err := loadConfig(os.Args[1:], os.Getenv)
+	if err == flag.ErrHelp {
+		return
+	}
+	if err != nil {
+		logFatal("Invalid configuration", err)
+	}
+	logLevel, _ := config.GetLogLevel()
+	slog.SetDefault(newLogger(os.Stderr, logLevel))
+	if config.SecretKey == defaultSecretKey {
+		slog.Warn("Using the default secret key, set SECRET_KEY before deploying")
+	}
+	maxUploadSize = config.Uploads.MaxSizeMB << 20
+	trustProxyHeaders = config.TrustProxy
+
+	blobStore, err := newBlobStore(config)
+	if err != nil {
+		logFatal("Couldn't set up image storage", err)
+	}
+
+	// MongoDB setup
+	client := getMongoClient(config.Mongo.URI)
+	dbName := config.Mongo.Database
+	userStore := NewMongoUserStore(client.Database(dbName).Collection("users"))
+	contestStore := NewMongoContestStore(client.Database(dbName).Collection("contests"))
+	entryStore := NewMongoEntryStore(client.Database(dbName).Collection("contestEntries"))
+	voteStore := NewMongoVoteStore(client.Database(dbName).Collection("contestVotes"))
+	tokenStore := NewMongoTokenStore(client.Database(dbName).Collection("accessTokens"))
+	loginAttemptStore := NewMongoLoginAttemptStore(
+		client.Database(dbName).Collection("loginAttempts"),
+		client.Database(dbName).Collection("loginLockouts"),
+	)
+	sessionStore := NewMongoSessionStore(client.Database(dbName).Collection("userSessions"))
+	participantStore := NewMongoParticipantStore(client.Database(dbName).Collection("contestParticipants"))
+	inviteStore := NewMongoInviteStore(client.Database(dbName).Collection("contestInvites"))
+	communityStore := NewMongoCommunityStore(client.Database(dbName).Collection("communities"))
+	memberStore := NewMongoCommunityMemberStore(client.Database(dbName).Collection("communityMembers"))
+	indexCtx, cancelIndexes := context.WithTimeout(context.Background(), mongoConnectTimeout)
+	if err := ensureMongoIndexes(
+		indexCtx,
+		userStore,
+		contestStore,
+		entryStore,
+		voteStore,
+		tokenStore,
+		loginAttemptStore,
+		sessionStore,
+		participantStore,
+		inviteStore,
+		communityStore,
+		memberStore,
+	); err != nil {
+		// Unique indexes are what keep usernames, votes and entries unique, so don't run without them
+		// Existing duplicate documents prevent a unique index from being built
+		logFatal("Couldn't create MongoDB indexes", err)
+	}
+	cancelIndexes()
+	backfillCtx, cancelBackfill := context.WithTimeout(context.Background(), time.Minute)
+	if err := backfillEntryCounts(backfillCtx, contestStore, entryStore); err != nil {
+		// Contests without a count sort as having no entries until this succeeds
+		slog.Error("Couldn't count contest entries", "error", err)
+	}
+	cancelBackfill()
+	adminCtx, cancelAdmins := context.WithTimeout(context.Background(), mongoConnectTimeout)
+	promoteAdmins(adminCtx, config.Admins, userStore)
+	cancelAdmins()
+
+	health := NewHealthChecker()
+	health.AddCheck("mongo", func(ctx context.Context) error {
+		return client.Ping(ctx, nil)
+	})
+
+	// Advance contests automatically when their deadlines pass
+	schedulerCtx, stopScheduler := context.WithCancel(context.Background())
+	startContestScheduler(schedulerCtx, contestStore, entryStore, schedulerInterval)
+
+	// Setup cookie store for sessions
+	// Authentication logic from:
+	// https://thewhitetulip.gitbooks.io/webapp-with-golang-anti-textbook/content/manuscript/4.0authentication.html
+	store := newSessionStore(config.SecretKey)
+
+	router := newRouter(
+		store,
+		loadTemplates(),
+		userStore,
+		contestStore,
+		entryStore,
+		voteStore,
+		tokenStore,
+		loginAttemptStore,
+		sessionStore,
+		participantStore,
+		inviteStore,
+		communityStore,
+		memberStore,
+		blobStore,
+		health,
+	)
+
 	// Start server
-	fmt.Println("Server running")
-	http.ListenAndServe(":3000", router)
+	server := &http.Server{
+		Addr: config.ListenAddr,
+		Handler: router,
+		ReadHeaderTimeout: serverReadHeaderTimeout,
+		ReadTimeout: serverReadTimeout,
+		WriteTimeout: serverWriteTimeout,
+		IdleTimeout: serverIdleTimeout,
+	}
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.ListenAndServe()
+	}()
+	slog.Info("Server running", "addr", config.ListenAddr)
+
+	// Metrics get their own listener, so they can be kept off the public internet
+	var metricsServer *http.Server
+	if config.MetricsAddr != "" {
+		metricsServer = newMetricsServer(config.MetricsAddr)
+		go func() {
+			serverErr <- metricsServer.ListenAndServe()
+		}()
+		slog.Info("Metrics server running", "addr", config.MetricsAddr)
+	}
+
+	// Stop accepting connections on SIGTERM or Ctrl+C, and let requests in progress finish
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
+	select {
+	case err := <-serverErr:
+		logFatal("Server stopped unexpectedly", err)
+	case sig := <-stop:
+		slog.Info("Shutting down", "signal", sig.String())
+	}
+	health.SetDraining()
+	if config.IsProduction() {
+		// Keep serving until load balancers see /readyz failing and stop sending requests
+		time.Sleep(drainDelay)
+	}
+	stopScheduler()
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		slog.Warn("Requests were still running at shutdown", "error", err)
+	}
+	if metricsServer != nil {
+		metricsServer.Shutdown(shutdownCtx)
+	}
+	if err := client.Disconnect(shutdownCtx); err != nil {
+		slog.Error("Couldn't disconnect from MongoDB", "error", err)
+	}
+	slog.Info("Server stopped")
 }
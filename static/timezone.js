@@ -0,0 +1,9 @@
+// Fill in timezone fields with the browser's IANA timezone name,
+// so the server can read datetime-local inputs in the user's timezone
+document.querySelectorAll('input[name="timezone"]').forEach(function (input) {
+    try {
+        input.value = Intl.DateTimeFormat().resolvedOptions().timeZone || "";
+    } catch (e) {
+        input.value = "";
+    }
+});
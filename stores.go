@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Returned by stores when a requested document doesn't exist
+var ErrNotFound = errors.New("Not found")
+
+// Returned by stores when a create would break a uniqueness constraint
+var ErrDuplicate = errors.New("Duplicate")
+
+// Returned by the community member store when a change would leave a community without an admin
+var ErrLastAdmin = errors.New("Last admin")
+
+// Storage for users
+type UserStore interface {
+	Get(ctx context.Context, userId primitive.ObjectID) (User, error)
+	GetByUsername(ctx context.Context, username string) (User, error)
+	Create(ctx context.Context, user User) error
+	UpdatePassword(ctx context.Context, userId primitive.ObjectID, passwordHash string) error
+	UpdatePrivacy(ctx context.Context, userId primitive.ObjectID, privacy UserPrivacy) error
+	// Returns ErrNotFound if there is no such user
+	UpdateRole(ctx context.Context, userId primitive.ObjectID, role string) error
+	// Returns ErrNotFound if there is no such user
+	UpdateBanned(ctx context.Context, userId primitive.ObjectID, banned bool) error
+	// List admins, moderators and banned users, by username
+	ListStaffAndBanned(ctx context.Context) ([]User, error)
+}
+
+// Storage for contests
+type ContestStore interface {
+	Get(ctx context.Context, contestId primitive.ObjectID) (Contest, error)
+	List(ctx context.Context) ([]Contest, error)
+	// List contests matching a query's filters, in its sort order
+	Search(ctx context.Context, query ContestQuery) ([]Contest, error)
+	// Count another entry in the contest's stored entry count
+	IncrementEntryCount(ctx context.Context, contestId primitive.ObjectID) error
+	// Take a removed entry off the contest's stored entry count
+	DecrementEntryCount(ctx context.Context, contestId primitive.ObjectID) error
+	// List the contests a user created, newest first
+	ListByOwner(ctx context.Context, ownerId primitive.ObjectID) ([]Contest, error)
+	Create(ctx context.Context, contest Contest) error
+	// Set a contest's state only if it is still in the expected state, clearing ResultsRecorded
+	// Returns false if the contest was not in the expected state
+	UpdateState(ctx context.Context, contestId primitive.ObjectID, from int, to int) (bool, error)
+	SetResultsRecorded(ctx context.Context, contestId primitive.ObjectID, recorded bool) error
+	// Returns ErrNotFound if there is no such contest
+	UpdateDetails(ctx context.Context, contestId primitive.ObjectID, name string, description string) error
+	// List open or voting contests whose current deadline is at or before now
+	ListDeadlinePassed(ctx context.Context, now time.Time) ([]Contest, error)
+	// Returns false if there was no such contest
+	Delete(ctx context.Context, contestId primitive.ObjectID) (bool, error)
+}
+
+// Storage for contest entries
+type EntryStore interface {
+	Get(ctx context.Context, entryId primitive.ObjectID) (ContestEntry, error)
+	Create(ctx context.Context, entry ContestEntry) error
+	ListByContest(ctx context.Context, contestId primitive.ObjectID) ([]ContestEntry, error)
+	CountByContest(ctx context.Context, contestId primitive.ObjectID) (int64, error)
+	CountByOwner(ctx context.Context, contestId primitive.ObjectID, ownerId primitive.ObjectID) (int64, error)
+	// List a user's entries in every contest, newest first
+	ListByOwner(ctx context.Context, ownerId primitive.ObjectID) ([]ContestEntry, error)
+	// Save an entry's final placement, see recordContestResults
+	UpdateResult(ctx context.Context, entryId primitive.ObjectID, placement int, won bool) error
+	// List entries in any contest whose image hash is at most maxDistance bits from hash
+	// maxDistance must be less than imageHashBandCount
+	ListSimilarImages(ctx context.Context, hash int64, maxDistance int) ([]ContestEntry, error)
+	// Returns false if there was no such entry
+	Delete(ctx context.Context, entryId primitive.ObjectID) (bool, error)
+	// Delete every entry in a contest, returning how many there were
+	DeleteByContest(ctx context.Context, contestId primitive.ObjectID) (int64, error)
+}
+
+// Storage for contest votes
+type VoteStore interface {
+	Create(ctx context.Context, vote ContestVote) error
+	CountByUser(ctx context.Context, contestId primitive.ObjectID, userId primitive.ObjectID) (int64, error)
+	ListByContest(ctx context.Context, contestId primitive.ObjectID) ([]ContestVote, error)
+	// Count the votes a user has cast in every contest
+	CountByVoter(ctx context.Context, userId primitive.ObjectID) (int64, error)
+	// Delete the ballots in a contest that include an entry, returning how many there were
+	DeleteByEntry(ctx context.Context, contestId primitive.ObjectID, entryId primitive.ObjectID) (int64, error)
+	// Delete every ballot in a contest, returning how many there were
+	DeleteByContest(ctx context.Context, contestId primitive.ObjectID) (int64, error)
+}
+
+// Storage for communities
+type CommunityStore interface {
+	// Returns ErrDuplicate if the slug is taken
+	Create(ctx context.Context, community Community) error
+	Get(ctx context.Context, communityId primitive.ObjectID) (Community, error)
+	GetBySlug(ctx context.Context, slug string) (Community, error)
+	// List every community, by name
+	List(ctx context.Context) ([]Community, error)
+	// Returns false if there was no such community
+	Delete(ctx context.Context, communityId primitive.ObjectID) (bool, error)
+}
+
+// Storage for community members and their roles
+type CommunityMemberStore interface {
+	// Returns ErrDuplicate if the user is already a member
+	Add(ctx context.Context, member CommunityMember) error
+	// Returns ErrNotFound if the user isn't a member
+	Get(ctx context.Context, communityId primitive.ObjectID, userId primitive.ObjectID) (CommunityMember, error)
+	// List a community's members in the order they joined
+	ListByCommunity(ctx context.Context, communityId primitive.ObjectID) ([]CommunityMember, error)
+	// List the communities a user is a member of
+	ListByUser(ctx context.Context, userId primitive.ObjectID) ([]CommunityMember, error)
+	// Returns ErrNotFound if the user isn't a member, and ErrLastAdmin if they are the community's last admin
+	// and the new role isn't admin
+	UpdateRole(ctx context.Context, communityId primitive.ObjectID, userId primitive.ObjectID, role string) error
+	// Returns false if the user wasn't a member, and ErrLastAdmin if they are the community's last admin
+	Remove(ctx context.Context, communityId primitive.ObjectID, userId primitive.ObjectID) (bool, error)
+}
+
+// Storage for the users allowed into invite-only contests
+type ParticipantStore interface {
+	// Returns ErrDuplicate if the user is already a participant
+	Add(ctx context.Context, participant ContestParticipant) error
+	IsParticipant(ctx context.Context, contestId primitive.ObjectID, userId primitive.ObjectID) (bool, error)
+	// List a contest's participants in the order they were added
+	ListByContest(ctx context.Context, contestId primitive.ObjectID) ([]ContestParticipant, error)
+	// List the contests a user is a participant in
+	ListContestIds(ctx context.Context, userId primitive.ObjectID) ([]primitive.ObjectID, error)
+	// Returns false if the user wasn't a participant
+	Remove(ctx context.Context, contestId primitive.ObjectID, userId primitive.ObjectID) (bool, error)
+}
+
+// Storage for contest invite links
+type InviteStore interface {
+	Create(ctx context.Context, invite ContestInvite) error
+	GetByCode(ctx context.Context, code string) (ContestInvite, error)
+	// List a contest's invites, newest first
+	ListByContest(ctx context.Context, contestId primitive.ObjectID) ([]ContestInvite, error)
+	// Count a use of an invite, returns false if it has expired or been used up
+	Use(ctx context.Context, inviteId primitive.ObjectID, now time.Time) (bool, error)
+	// Delete one of a contest's invites, returns false if the contest has no invite with that ID
+	Delete(ctx context.Context, contestId primitive.ObjectID, inviteId primitive.ObjectID) (bool, error)
+}
+
+// Storage for personal access tokens
+type TokenStore interface {
+	Create(ctx context.Context, token AccessToken) error
+	GetByHash(ctx context.Context, tokenHash string) (AccessToken, error)
+	ListByUser(ctx context.Context, userId primitive.ObjectID) ([]AccessToken, error)
+	// Delete a user's token, returns false if the user has no token with that ID
+	Delete(ctx context.Context, userId primitive.ObjectID, tokenId primitive.ObjectID) (bool, error)
+	UpdateLastUsed(ctx context.Context, tokenId primitive.ObjectID, lastUsed time.Time) error
+}
+
+// Storage for logged in sessions
+type SessionStore interface {
+	Create(ctx context.Context, session UserSession) error
+	GetByHash(ctx context.Context, tokenHash string) (UserSession, error)
+	// List a user's sessions, most recently used first
+	ListByUser(ctx context.Context, userId primitive.ObjectID) ([]UserSession, error)
+	UpdateLastSeen(ctx context.Context, sessionId primitive.ObjectID, lastSeen time.Time, ip string) error
+	// Delete a user's session, returns false if the user has no session with that ID
+	Delete(ctx context.Context, userId primitive.ObjectID, sessionId primitive.ObjectID) (bool, error)
+	// Delete all of a user's sessions, returning how many there were
+	DeleteByUser(ctx context.Context, userId primitive.ObjectID) (int64, error)
+}
+
+// Storage for failed login counts and the lockouts they caused
+// Keys name an account or IP address, see loginAttemptKey
+type LoginAttemptStore interface {
+	// Returns ErrNotFound if there are no recent failures for key
+	Get(ctx context.Context, key string) (LoginAttempts, error)
+	// Count a login attempt at now, starting again from one if the last attempt was before resetBefore
+	// Returns the attempts from before this one, so the caller can tell if it was allowed
+	AddAttempt(ctx context.Context, key string, now time.Time, resetBefore time.Time) (LoginAttempts, error)
+	// Take back an attempt counted by AddAttempt, for a login that succeeded
+	RemoveAttempt(ctx context.Context, key string) error
+	// Lock key out until the given time, and clear its failure count
+	Lock(ctx context.Context, key string, until time.Time) error
+	// Forget the failures for key
+	Reset(ctx context.Context, key string) error
+	CreateLockout(ctx context.Context, lockout LoginLockout) error
+	// List lockouts that started at or after since, newest first
+	ListLockouts(ctx context.Context, since time.Time) ([]LoginLockout, error)
+}
+
+// Storage for uploaded image files
+// Names are generated by the server and never contain a path separator
+type BlobStore interface {
+	Put(ctx context.Context, name string, data []byte, contentType string) error
+	// Returns ErrNotFound if there is no file with that name
+	Get(ctx context.Context, name string) (io.ReadCloser, error)
+	Delete(ctx context.Context, name string) error
+}
@@ -9,13 +9,13 @@ import (
 // Test contest methods
 func createContest(id primitive.ObjectID, ownerId primitive.ObjectID, state int) Contest {
 	return Contest {
-		id,
-		"test contest",
-		state,
-		"contest for unit test",
-		ownerId,
-		"Bill",
-		time.Now(),
+		Id: id,
+		Name: "test contest",
+		State: state,
+		Description: "contest for unit test",
+		OwnerId: ownerId,
+		OwnerName: "Bill",
+		TimeCreated: time.Now(),
 	}
 }
 
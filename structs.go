@@ -1,6 +1,9 @@
 package main
 
 import (
+	"math"
+	"strconv"
+	"strings"
 	"time"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
@@ -12,11 +15,68 @@ const (
 	CONCLUDED
 )
 
+// Voting methods a contest can use
+const (
+	PLURALITY = "plurality"
+	APPROVAL = "approval"
+	SCORE = "score"
+	RANKED = "ranked"
+)
+
+// Who can see a contest
+const (
+	// Listed for everyone
+	PUBLIC = "public"
+	// Anyone with the link can see it, but it isn't listed
+	UNLISTED = "unlisted"
+	// Only the owner and participants can see it
+	INVITE_ONLY = "invite"
+	// Only members of the contest's community can see it
+	MEMBERS_ONLY = "members"
+)
+
+// Roles in a community, from most to least trusted
+const (
+	// Manages members and roles, and hosts and runs the community's contests
+	COMMUNITY_ADMIN = "admin"
+	// Removes members
+	COMMUNITY_MODERATOR = "moderator"
+	COMMUNITY_MEMBER = "member"
+)
+
+// Site wide roles, see authorization.go for what each may do
+const (
+	ROLE_ADMIN = "admin"
+	ROLE_MODERATOR = "moderator"
+	ROLE_USER = "user"
+)
+
 // User collection in Mongo
 type User struct {
 	Id primitive.ObjectID `bson:"_id"`
 	Username string `bson:"username"`
 	Password string `bson:"password"`
+	Privacy UserPrivacy `bson:"privacy"`
+	// Users created before roles have no role, and are plain users
+	Role string `bson:"role,omitempty"`
+	// Banned users can't log in or use their sessions and tokens
+	Banned bool `bson:"banned,omitempty"`
+}
+
+func (u User) GetRole() string {
+	if u.Role == "" {
+		return ROLE_USER
+	}
+	return u.Role
+}
+
+// Parts of a user's profile page hidden from other users
+// Users created before profiles had everything visible
+type UserPrivacy struct {
+	HideContests bool `bson:"hide_contests"`
+	HideEntries bool `bson:"hide_entries"`
+	HideWins bool `bson:"hide_wins"`
+	HideStats bool `bson:"hide_stats"`
 }
 
 // Contest collection in Mongo
@@ -28,6 +88,20 @@ type Contest struct {
 	OwnerId primitive.ObjectID `bson:"owner_id"`
 	OwnerName string `bson:"owner_name"`
 	TimeCreated time.Time `bson:"time_created"`
+	SubmissionEnd *time.Time `bson:"submission_end,omitempty"`
+	VotingEnd *time.Time `bson:"voting_end,omitempty"`
+	// Contests created before voting methods were added use plurality
+	VotingMethod string `bson:"voting_method,omitempty"`
+	// Kept up to date as entries are submitted, for sorting contest lists
+	EntryCount int64 `bson:"entry_count"`
+	// Contests created before visibility levels were added are public
+	Visibility string `bson:"visibility,omitempty"`
+	// Set for contests hosted by a community, whose admins manage them along with the owner
+	CommunityId *primitive.ObjectID `bson:"community_id,omitempty"`
+	CommunitySlug string `bson:"community_slug,omitempty"`
+	CommunityName string `bson:"community_name,omitempty"`
+	// Set once the final placements are saved on the entries, cleared when the state or entries change
+	ResultsRecorded bool `bson:"results_recorded,omitempty"`
 }
 
 // Contest helper methods
@@ -35,6 +109,25 @@ func (c Contest) FormatTime() string {
 	return c.TimeCreated.Format("Jan 2")
 }
 
+func (c Contest) FormatSubmissionEnd() string {
+	return c.SubmissionEnd.Local().Format("Jan 2 3:04 PM MST")
+}
+
+func (c Contest) FormatVotingEnd() string {
+	return c.VotingEnd.Local().Format("Jan 2 3:04 PM MST")
+}
+
+// Deadline for the contest's current state, nil if it has none
+func (c Contest) CurrentDeadline() *time.Time {
+	if c.IsOpen() {
+		return c.SubmissionEnd
+	}
+	if c.IsVoting() {
+		return c.VotingEnd
+	}
+	return nil
+}
+
 func (c Contest) GetStringId() string {
 	return c.Id.Hex()
 }
@@ -49,6 +142,66 @@ func (c Contest) GetStateString() string {
 	}
 }
 
+func (c Contest) GetVotingMethod() string {
+	if c.VotingMethod == "" {
+		return PLURALITY
+	}
+	return c.VotingMethod
+}
+
+func (c Contest) GetVotingMethodString() string {
+	switch c.GetVotingMethod() {
+	case APPROVAL:
+		return "Approval Voting"
+	case SCORE:
+		return "Score Voting"
+	case RANKED:
+		return "Ranked Choice Voting"
+	default:
+		return "Plurality Voting"
+	}
+}
+
+func (c Contest) GetVisibility() string {
+	if c.Visibility == "" {
+		return PUBLIC
+	}
+	return c.Visibility
+}
+
+func (c Contest) GetVisibilityString() string {
+	switch c.GetVisibility() {
+	case UNLISTED:
+		return "Unlisted"
+	case INVITE_ONLY:
+		return "Invite Only"
+	case MEMBERS_ONLY:
+		return "Members Only"
+	default:
+		return "Public"
+	}
+}
+
+func (c Contest) IsInviteOnly() bool {
+	return c.GetVisibility() == INVITE_ONLY
+}
+
+func (c Contest) IsPlurality() bool {
+	return c.GetVotingMethod() == PLURALITY
+}
+
+func (c Contest) IsApproval() bool {
+	return c.GetVotingMethod() == APPROVAL
+}
+
+func (c Contest) IsScore() bool {
+	return c.GetVotingMethod() == SCORE
+}
+
+func (c Contest) IsRanked() bool {
+	return c.GetVotingMethod() == RANKED
+}
+
 func (c Contest) IsOpen() bool {
 	return c.State == OPEN
 }
@@ -69,17 +222,317 @@ type ContestEntry struct {
 	Name string `bson:"title"`
 	OwnerId primitive.ObjectID `bson:"owner_id"`
 	OwnerName string `bson:"owner_name"`
+	// Resized copies of the image, smallest first
+	Variants []ImageVariant `bson:"variants,omitempty"`
+	// Camera settings from the image metadata, nil if it had none
+	Camera *CameraInfo `bson:"camera,omitempty"`
+	// Perceptual hash of the image, see imageHash
+	ImageHash int64 `bson:"image_hash"`
+	// Keys for looking up entries with a similar image, empty for entries saved before hashing
+	ImageHashBands []int32 `bson:"image_hash_bands,omitempty"`
+	// Final results, only current while the contest's ResultsRecorded is set
+	Placement int `bson:"placement,omitempty"`
+	Won bool `bson:"won,omitempty"`
 }
 
 func (c ContestEntry) GetStringId() string {
 	return c.Id.Hex()
 }
 
+func (c ContestEntry) HasImageHash() bool {
+	return len(c.ImageHashBands) > 0
+}
+
+// List the resized copies of the image for an img srcset attribute
+// Empty for images too small to resize, in which case browsers use src
+func (c ContestEntry) SrcSet() string {
+	srcSet := ""
+	for i, variant := range c.Variants {
+		if i > 0 {
+			srcSet += ", "
+		}
+		srcSet += variant.Path + " " + strconv.Itoa(variant.Width) + "w"
+	}
+	return srcSet
+}
+
+// Allow-listed camera settings read from an image's EXIF metadata
+// Everything else in the metadata, like GPS position and serial numbers, is discarded
+type CameraInfo struct {
+	Make string `bson:"make,omitempty"`
+	Model string `bson:"model,omitempty"`
+	LensModel string `bson:"lens_model,omitempty"`
+	// Seconds
+	ExposureTime float64 `bson:"exposure_time,omitempty"`
+	FNumber float64 `bson:"f_number,omitempty"`
+	ISO int `bson:"iso,omitempty"`
+	// Millimetres
+	FocalLength float64 `bson:"focal_length,omitempty"`
+}
+
+// Camera name, with the make added if the model doesn't already include it
+func (c CameraInfo) GetCamera() string {
+	if c.Make == "" || strings.HasPrefix(strings.ToLower(c.Model), strings.ToLower(c.Make)) {
+		return c.Model
+	}
+	return strings.TrimSpace(c.Make + " " + c.Model)
+}
+
+// Exposure settings formatted like "1/250s f/2.8 ISO 100 35mm"
+func (c CameraInfo) GetSettings() string {
+	var settings []string
+	if c.ExposureTime > 0 && c.ExposureTime < 1 {
+		settings = append(settings, "1/" + strconv.FormatFloat(math.Round(1 / c.ExposureTime), 'f', -1, 64) + "s")
+	} else if c.ExposureTime >= 1 {
+		settings = append(settings, strconv.FormatFloat(c.ExposureTime, 'f', -1, 64) + "s")
+	}
+	if c.FNumber > 0 {
+		settings = append(settings, "f/" + strconv.FormatFloat(c.FNumber, 'f', -1, 64))
+	}
+	if c.ISO > 0 {
+		settings = append(settings, "ISO " + strconv.Itoa(c.ISO))
+	}
+	if c.FocalLength > 0 {
+		settings = append(settings, strconv.FormatFloat(math.Round(c.FocalLength), 'f', -1, 64) + "mm")
+	}
+	return strings.Join(settings, " ")
+}
+
+// A resized copy of an entry's image
+type ImageVariant struct {
+	Name string `bson:"name"`
+	Width int `bson:"width"`
+	Path string `bson:"path"`
+}
+
+// ContestVote collection in Mongo
+// A plurality vote only sets EntryID, other voting methods record a Choice per entry
 type ContestVote struct {
 	Id primitive.ObjectID `bson:"_id"`
 	ContestID primitive.ObjectID `bson:"contest_id"`
-	EntryID primitive.ObjectID `bson:"entry_id"`
+	EntryID primitive.ObjectID `bson:"entry_id,omitempty"`
 	UserID primitive.ObjectID `bson:"user_id"`
+	Choices []BallotChoice `bson:"choices,omitempty"`
+}
+
+// Return the choices on a ballot, treating a plurality vote as a single choice
+func (v ContestVote) GetChoices() []BallotChoice {
+	if len(v.Choices) == 0 && !v.EntryID.IsZero() {
+		return []BallotChoice{{v.EntryID, 1}}
+	}
+	return v.Choices
+}
+
+// One entry on a ballot
+// Value is 1 for an approval, the stars for a score, or the position in a ranking
+type BallotChoice struct {
+	EntryID primitive.ObjectID `bson:"entry_id"`
+	Value int `bson:"value"`
+}
+
+// Communities collection in Mongo
+type Community struct {
+	Id primitive.ObjectID `bson:"_id"`
+	Name string `bson:"name"`
+	// Unique name used in URLs
+	Slug string `bson:"slug"`
+	Description string `bson:"description"`
+	CreatedBy primitive.ObjectID `bson:"created_by"`
+	TimeCreated time.Time `bson:"time_created"`
+}
+
+func (c Community) GetStringId() string {
+	return c.Id.Hex()
+}
+
+func (c Community) FormatTime() string {
+	return c.TimeCreated.Format("Jan 2, 2006")
+}
+
+// CommunityMembers collection in Mongo
+type CommunityMember struct {
+	Id primitive.ObjectID `bson:"_id"`
+	CommunityId primitive.ObjectID `bson:"community_id"`
+	UserId primitive.ObjectID `bson:"user_id"`
+	Username string `bson:"username"`
+	Role string `bson:"role"`
+	TimeJoined time.Time `bson:"time_joined"`
+}
+
+func (m CommunityMember) IsAdmin() bool {
+	return m.Role == COMMUNITY_ADMIN
+}
+
+// Admins and moderators can remove members
+func (m CommunityMember) IsModerator() bool {
+	return m.Role == COMMUNITY_ADMIN || m.Role == COMMUNITY_MODERATOR
+}
+
+func (m CommunityMember) FormatTime() string {
+	return m.TimeJoined.Format("Jan 2")
+}
+
+// ContestParticipants collection in Mongo
+// Users allowed into an invite-only contest
+type ContestParticipant struct {
+	Id primitive.ObjectID `bson:"_id"`
+	ContestId primitive.ObjectID `bson:"contest_id"`
+	UserId primitive.ObjectID `bson:"user_id"`
+	Username string `bson:"username"`
+	TimeAdded time.Time `bson:"time_added"`
+	// Invite the user joined with, nil if the owner added them
+	InviteId *primitive.ObjectID `bson:"invite_id,omitempty"`
+}
+
+func (p ContestParticipant) FormatTime() string {
+	return p.TimeAdded.Format("Jan 2")
+}
+
+// ContestInvites collection in Mongo
+// A shareable link that adds whoever opens it to an invite-only contest
+type ContestInvite struct {
+	Id primitive.ObjectID `bson:"_id"`
+	ContestId primitive.ObjectID `bson:"contest_id"`
+	Code string `bson:"code"`
+	TimeCreated time.Time `bson:"time_created"`
+	// Nil for invites that don't expire
+	ExpiresAt *time.Time `bson:"expires_at,omitempty"`
+	// 0 for invites that can be used any number of times
+	MaxUses int `bson:"max_uses"`
+	Uses int `bson:"uses"`
+}
+
+func (i ContestInvite) GetStringId() string {
+	return i.Id.Hex()
+}
+
+func (i ContestInvite) IsUsable(now time.Time) bool {
+	if i.ExpiresAt != nil && !now.Before(*i.ExpiresAt) {
+		return false
+	}
+	return i.MaxUses == 0 || i.Uses < i.MaxUses
+}
+
+func (i ContestInvite) FormatExpiry() string {
+	if i.ExpiresAt == nil {
+		return "Never expires"
+	}
+	return "Expires " + i.ExpiresAt.Local().Format("Jan 2 3:04 PM")
+}
+
+func (i ContestInvite) FormatUses() string {
+	if i.MaxUses == 0 {
+		return strconv.Itoa(i.Uses) + " uses"
+	}
+	return strconv.Itoa(i.Uses) + " of " + strconv.Itoa(i.MaxUses) + " uses"
+}
+
+// UserSessions collection in Mongo
+// Only a hash of the session token is stored, the token itself is in the session cookie
+type UserSession struct {
+	Id primitive.ObjectID `bson:"_id"`
+	TokenHash string `bson:"token_hash"`
+	UserId primitive.ObjectID `bson:"user_id"`
+	Username string `bson:"username"`
+	UserAgent string `bson:"user_agent"`
+	// Address the session was last used from
+	IP string `bson:"ip"`
+	TimeCreated time.Time `bson:"time_created"`
+	LastSeen time.Time `bson:"last_seen"`
+	ExpiresAt time.Time `bson:"expires_at"`
+}
+
+func (s UserSession) GetStringId() string {
+	return s.Id.Hex()
+}
+
+// Sessions can be used until they expire or go unused for sessionIdleTimeout
+func (s UserSession) IsActive(now time.Time) bool {
+	return now.Before(s.ExpiresAt) && now.Sub(s.LastSeen) < sessionIdleTimeout
+}
+
+func (s UserSession) Device() string {
+	return describeUserAgent(s.UserAgent)
+}
+
+func (s UserSession) FormatTime() string {
+	return s.TimeCreated.Local().Format("Jan 2 3:04 PM")
+}
+
+func (s UserSession) FormatLastSeen() string {
+	return s.LastSeen.Local().Format("Jan 2 3:04 PM")
+}
+
+// LoginAttempts collection in Mongo
+// Failed logins for an account or IP address, see loginThrottle.go
+type LoginAttempts struct {
+	Key string `bson:"_id"`
+	// Includes attempts whose password hasn't been checked yet
+	Failures int `bson:"failures"`
+	// Time of the last attempt counted
+	LastFailure time.Time `bson:"last_failure"`
+	LockedUntil time.Time `bson:"locked_until,omitempty"`
+}
+
+// LoginLockouts collection in Mongo
+// Record of an account or IP address being locked out after repeated failed logins
+type LoginLockout struct {
+	Id primitive.ObjectID `bson:"_id"`
+	// LOCKOUT_ACCOUNT or LOCKOUT_IP
+	Kind string `bson:"kind"`
+	// Username or IP address that was locked out
+	Value string `bson:"value"`
+	// Address of the attempt that caused the lockout
+	IP string `bson:"ip"`
+	Failures int `bson:"failures"`
+	Start time.Time `bson:"start"`
+	Until time.Time `bson:"until"`
+}
+
+func (l LoginLockout) FormatStart() string {
+	return l.Start.Local().Format("Jan 2 3:04 PM")
+}
+
+func (l LoginLockout) FormatUntil() string {
+	return l.Until.Local().Format("Jan 2 3:04 PM")
+}
+
+// AccessToken collection in Mongo
+// Only a hash of the token is stored, the token itself is shown to the user once
+type AccessToken struct {
+	Id primitive.ObjectID `bson:"_id"`
+	UserId primitive.ObjectID `bson:"user_id"`
+	Username string `bson:"username"`
+	Name string `bson:"name"`
+	Prefix string `bson:"prefix"`
+	TokenHash string `bson:"token_hash"`
+	Scopes []string `bson:"scopes"`
+	TimeCreated time.Time `bson:"time_created"`
+	LastUsed *time.Time `bson:"last_used,omitempty"`
+}
+
+func (t AccessToken) GetStringId() string {
+	return t.Id.Hex()
+}
+
+func (t AccessToken) FormatTime() string {
+	return t.TimeCreated.Format("Jan 2")
+}
+
+func (t AccessToken) FormatLastUsed() string {
+	if t.LastUsed == nil {
+		return "Never"
+	}
+	return t.LastUsed.Format("Jan 2")
+}
+
+func (t AccessToken) HasScope(scope string) bool {
+	for _, tokenScope := range t.Scopes {
+		if tokenScope == scope {
+			return true
+		}
+	}
+	return false
 }
 
 // Struct to hold data for rendering contest detail view
@@ -91,4 +544,190 @@ type ContestDetailData struct {
 	ShowEndVoting bool
 	EntryCount int64
 	Entries []ContestEntry
+	Error string
+	ShowDuplicateReport bool
+	ShowParticipants bool
+	ShowEdit bool
+	ShowDelete bool
+	ShowRemoveEntries bool
+	// Every entry, whatever the state, for users who can remove entries
+	RemovableEntries []ContestEntry
+	ShowForceState bool
+}
+
+type EditContestData struct {
+	Contest Contest
+	Name string
+	Description string
+	Error string
+}
+
+// Users with a role or a ban, and recent login lockouts, for the admin page
+type AdminPageData struct {
+	Users []User
+	Lockouts []LoginLockout
+	CanSetRoles bool
+	CanViewLockouts bool
+}
+
+// An entry whose image looks the same as another entry's
+type DuplicateMatch struct {
+	Entry ContestEntry
+	Match ContestEntry
+	// The contest the matching entry was submitted to
+	MatchContest Contest
+	// Number of hash bits that differ, 0 for the same image
+	Distance int
+}
+
+func (d DuplicateMatch) IsSameOwner() bool {
+	return d.Entry.OwnerId == d.Match.OwnerId
+}
+
+// Struct to hold data for rendering a contest's possible duplicates
+type DuplicateReportData struct {
+	Contest Contest
+	Matches []DuplicateMatch
+}
+
+// Struct to hold data for rendering the contest list
+type ContestListData struct {
+	Contests []Contest
+	// Current filters, to fill in the search form
+	Search string
+	State string
+	Owner string
+	Community string
+	Sort string
+	// Empty on the last page
+	NextUrl string
+	// Whether this is a later page, with a link back to the first
+	IsLaterPage bool
+	// Whether to link to the admin page
+	ShowAdmin bool
+	Error string
+}
+
+// Struct to hold data for rendering create contest form
+type CreateContestData struct {
+	Error string
+	Name string
+	Description string
+	VotingMethod string
+	Visibility string
+	Community string
+	// Communities the user can host contests for
+	Communities []Community
+}
+
+// Struct to hold data for rendering an invite-only contest's participants page
+type ParticipantPageData struct {
+	Contest Contest
+	Participants []ContestParticipant
+	Invites []ContestInvite
+	// Scheme and host for invite links
+	BaseUrl string
+	Error string
+}
+
+// Struct to hold data for rendering the community list
+type CommunityListData struct {
+	Communities []Community
+	// Communities the user is a member of, keyed by ID
+	Memberships map[primitive.ObjectID]CommunityMember
+	Error string
+	Name string
+	Description string
+}
+
+// Struct to hold data for rendering a community's page
+type CommunityPageData struct {
+	Community Community
+	// Zero value if the user isn't a member
+	Membership CommunityMember
+	IsMember bool
+	Members []CommunityMember
+	// The community's contests listed for the user, newest first
+	Contests []Contest
+	NextUrl string
+	IsLaterPage bool
+}
+
+// Struct to hold data for rendering the page an invite link opens
+type InvitePageData struct {
+	Contest Contest
+	Code string
+}
+
+// Struct to hold data for rendering access token page
+type TokenPageData struct {
+	Tokens []AccessToken
+	Scopes []string
+	NewToken string
+	Error string
+}
+
+// Struct to hold data for rendering sessions page
+type SessionPageData struct {
+	Sessions []SessionListItem
+}
+
+type SessionListItem struct {
+	UserSession
+	// Session the page was loaded with
+	Current bool
+}
+
+// What a user can see of another user's profile page
+// Sections hidden by the user's privacy settings are nil
+type UserProfile struct {
+	UserId primitive.ObjectID
+	Username string
+	// Whether the profile belongs to the logged in user, who sees every section and can change the settings
+	IsOwnProfile bool
+	Privacy UserPrivacy
+	ShowContests bool
+	ShowEntries bool
+	ShowWins bool
+	ShowStats bool
+	Contests []Contest
+	Entries []ProfileEntry
+	Wins []ProfileEntry
+	Stats *ProfileStats
+}
+
+// An entry on a profile page, with how it placed once its contest concluded
+type ProfileEntry struct {
+	Entry ContestEntry
+	Contest Contest
+	// Position in the final results, tied entries share a place. 0 until the contest concludes
+	Placement int
+	// Number of entries in the final results
+	EntryCount int
+	Won bool
+}
+
+func (p ProfileEntry) FormatPlacement() string {
+	if !p.Contest.IsConcluded() {
+		return p.Contest.GetStateString()
+	}
+	return formatOrdinal(p.Placement) + " of " + strconv.Itoa(p.EntryCount)
+}
+
+// Totals shown on a profile page
+type ProfileStats struct {
+	ContestsCreated int
+	EntriesSubmitted int
+	Wins int
+	// Entries placing in the top three of a concluded contest
+	Podiums int
+	VotesCast int64
+}
+
+// Struct to hold data for rendering error page
+type ErrorData struct {
+	Status int
+	StatusText string
+	Message string
+	BackUrl string
 }
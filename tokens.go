@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Scopes that can be granted to a personal access token
+const (
+	SCOPE_READ = "read"
+	SCOPE_SUBMIT = "submit"
+	SCOPE_VOTE = "vote"
+	SCOPE_MANAGE = "manage"
+)
+
+var tokenScopes = []string{SCOPE_READ, SCOPE_SUBMIT, SCOPE_VOTE, SCOPE_MANAGE}
+
+// Prefix on every token so they are easy to recognize, e.g. in leaked credential scans
+const tokenPrefix = "ps_"
+
+// Key for values stored in a request context
+type contextKey int
+
+const (
+	tokenContextKey contextKey = iota
+	sessionContextKey
+	userContextKey
+)
+
+// ********
+// Handlers
+// ********
+
+// Handler for /account/tokens endpoint
+func tokenIndexHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+	s *sessions.CookieStore,
+	tmplMap map[string]*template.Template,
+	tokenStore TokenStore,
+) {
+	userId, username, err := getSessionUser(r)
+	if err != nil {
+		logRequestError(r.Context(), "Couldn't get session user", err)
+		http.Redirect(w, r, "/contests", 302)
+		return
+	}
+	pageData := TokenPageData{Scopes: tokenScopes}
+	status := http.StatusOK
+	if r.Method == "POST" {
+		r.ParseForm()
+		token, newToken, err := createAccessToken(
+			r.Context(),
+			userId,
+			username,
+			r.PostFormValue("tokenname"),
+			r.PostForm["scopes"],
+			tokenStore,
+		)
+		if err != nil {
+			logRequestError(r.Context(), "Couldn't create access token", err)
+			status = errorStatus(err)
+			pageData.Error = err.Error()
+		} else {
+			slog.InfoContext(r.Context(), "Created access token", "token_id", token.GetStringId())
+			pageData.NewToken = newToken
+		}
+	}
+	pageData.Tokens, err = tokenStore.ListByUser(r.Context(), userId)
+	if err != nil {
+		logRequestError(r.Context(), "Couldn't list access tokens", err)
+	}
+	renderTemplate(w, r, s, tmplMap["tokens.html"], status, pageData)
+}
+
+// Handler for revoking an access token
+func revokeTokenHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+	s *sessions.CookieStore,
+	tmplMap map[string]*template.Template,
+	tokenStore TokenStore,
+	tokenId string,
+) {
+	userId, _, err := getSessionUser(r)
+	if err != nil {
+		logRequestError(r.Context(), "Couldn't get session user", err)
+		http.Redirect(w, r, "/contests", 302)
+		return
+	}
+	if err := revokeAccessToken(r.Context(), userId, tokenId, tokenStore); err != nil {
+		logRequestError(r.Context(), "Couldn't revoke access token", err)
+		renderError(w, r, s, tmplMap, err, "/account/tokens")
+		return
+	}
+	http.Redirect(w, r, "/account/tokens", 302)
+}
+
+// ***********
+// Middlewares
+// ***********
+
+// Authenticate requests that carry an "Authorization: Bearer <token>" header
+// The token is stored in the request context, where isLoggedIn and getSessionUser find it
+func tokenAuthMiddleware(tokenStore TokenStore) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			header := r.Header.Get("Authorization")
+			if header == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if !strings.HasPrefix(header, "Bearer ") {
+				writeAPIError(w, r, unauthorizedError("Authorization header must be a bearer token"))
+				return
+			}
+			token, err := tokenStore.GetByHash(r.Context(), hashToken(strings.TrimPrefix(header, "Bearer ")))
+			if err != nil {
+				if err != ErrNotFound {
+					slog.ErrorContext(r.Context(), "Couldn't look up access token", "error", err)
+				}
+				writeAPIError(w, r, unauthorizedError("Token is invalid or has been revoked"))
+				return
+			}
+			if err := tokenStore.UpdateLastUsed(r.Context(), token.Id, time.Now()); err != nil {
+				slog.ErrorContext(r.Context(), "Couldn't update access token last used time", "error", err)
+			}
+			ctx := context.WithValue(r.Context(), tokenContextKey, token)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// *******
+// Helpers
+// *******
+
+// Return the access token a request was authenticated with, if any
+func getRequestToken(r *http.Request) (AccessToken, bool) {
+	token, ok := r.Context().Value(tokenContextKey).(AccessToken)
+	return token, ok
+}
+
+// Check if a request may use a route that needs the given scope
+// Browser sessions have every scope, tokens only have the scopes they were granted
+// An empty scope means the route only accepts browser sessions
+func checkScope(r *http.Request, scope string) error {
+	token, ok := getRequestToken(r)
+	if !ok {
+		return nil
+	}
+	if scope == "" {
+		return forbiddenError("Access tokens can't be used for this request")
+	}
+	if !token.HasScope(scope) {
+		return forbiddenError("Access token is missing the \"" + scope + "\" scope")
+	}
+	return nil
+}
+
+// Hash a token for storage and lookup
+// Tokens are long and random, so a fast hash is enough to protect them
+func hashToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+// Generate a new random token
+func generateToken() (string, error) {
+	tokenBytes := make([]byte, 32)
+	if _, err := rand.Read(tokenBytes); err != nil {
+		return "", err
+	}
+	return tokenPrefix + base64.RawURLEncoding.EncodeToString(tokenBytes), nil
+}
+
+// Create a new access token for a user
+// Returns the stored token and the token value, which is not stored and can only be shown once
+func createAccessToken(
+	ctx context.Context,
+	userId primitive.ObjectID,
+	username string,
+	name string,
+	scopes []string,
+	tokenStore TokenStore,
+) (AccessToken, string, error) {
+	if name == "" {
+		return AccessToken{}, "", badRequestError("Token name is required")
+	}
+	if len(scopes) == 0 {
+		return AccessToken{}, "", badRequestError("Select at least one scope")
+	}
+	for _, scope := range scopes {
+		valid := false
+		for _, tokenScope := range tokenScopes {
+			valid = valid || scope == tokenScope
+		}
+		if !valid {
+			return AccessToken{}, "", badRequestError("Unknown scope \"" + scope + "\"")
+		}
+	}
+	value, err := generateToken()
+	if err != nil {
+		return AccessToken{}, "", err
+	}
+	token := AccessToken{
+		Id: primitive.NewObjectID(),
+		UserId: userId,
+		Username: username,
+		Name: name,
+		Prefix: value[:len(tokenPrefix) + 4],
+		TokenHash: hashToken(value),
+		Scopes: scopes,
+		TimeCreated: time.Now(),
+	}
+	if err := tokenStore.Create(ctx, token); err != nil {
+		return AccessToken{}, "", err
+	}
+	return token, value, nil
+}
+
+// Revoke one of a user's access tokens
+func revokeAccessToken(ctx context.Context, userId primitive.ObjectID, tokenId string, tokenStore TokenStore) error {
+	tokenObjId, err := primitive.ObjectIDFromHex(tokenId)
+	if err != nil {
+		return notFoundError("Token not found")
+	}
+	deleted, err := tokenStore.Delete(ctx, userId, tokenObjId)
+	if err != nil {
+		return err
+	}
+	if !deleted {
+		return notFoundError("Token not found")
+	}
+	return nil
+}
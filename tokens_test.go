@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// Create an access token through the API with a logged in session
+func (a *testApp) createToken(t *testing.T, cookies []*http.Cookie, scopes ...string) APIAccessToken {
+	var token APIAccessToken
+	rec := a.apiCall(t, "POST", "/tokens", APINewAccessToken{"script", scopes}, cookies, &token)
+	if rec.Code != http.StatusCreated || token.Token == "" {
+		t.Fatalf("Token should be created, got %v", rec.Body.String())
+	}
+	return token
+}
+
+// Send a JSON API request authenticated with a bearer token
+func (a *testApp) tokenCall(
+	t *testing.T,
+	method string,
+	path string,
+	body interface{},
+	token string,
+	out interface{},
+) *httptest.ResponseRecorder {
+	req := newAPIRequest(method, path, body)
+	req.Header.Set("Authorization", "Bearer " + token)
+	rec := a.do(req, nil)
+	decodeResponse(t, rec, out)
+	return rec
+}
+
+func (a *testApp) apiSubmitEntryWithToken(contestId string, token string) *httptest.ResponseRecorder {
+	req := newEntryUploadRequest(contestId)
+	req.Header.Set("Authorization", "Bearer " + token)
+	return a.do(req, nil)
+}
+
+func TestTokenAuthenticatesAPI(t *testing.T){
+	app := newTestApp(t)
+	cookies := app.apiLogin(t, "bill")
+	token := app.createToken(t, cookies, SCOPE_READ)
+
+	var user APIUser
+	rec := app.tokenCall(t, "GET", "/auth/me", nil, token.Token, &user)
+	if rec.Code != http.StatusOK || user.Username != "bill" {
+		t.Errorf("Token should authenticate as its owner, got %v", rec.Body.String())
+	}
+
+	stored, _ := app.tokens.ListByUser(context.TODO(), getUserId(context.TODO(), "bill", app.users))
+	if len(stored) != 1 || stored[0].TokenHash == token.Token || stored[0].LastUsed == nil {
+		t.Error("Token should be stored hashed with its last use recorded")
+	}
+}
+
+func TestTokenAuthenticatesHTMLRoutes(t *testing.T){
+	app := newTestApp(t)
+	cookies := app.apiLogin(t, "bill")
+	token := app.createToken(t, cookies, SCOPE_READ)
+	req := httptest.NewRequest("GET", "/contests", nil)
+	req.Header.Set("Authorization", "Bearer " + token.Token)
+	if rec := app.do(req, nil); rec.Code != http.StatusOK {
+		t.Errorf("Token should be accepted by login required routes, got %v", rec.Code)
+	}
+}
+
+func TestTokenScopes(t *testing.T){
+	app := newTestApp(t)
+	cookies := app.apiLogin(t, "bill")
+	readToken := app.createToken(t, cookies, SCOPE_READ)
+	manageToken := app.createToken(t, cookies, SCOPE_READ, SCOPE_MANAGE)
+
+	newContest := APINewContest{Name: "Sunsets"}
+	expectAPIError(t, app.tokenCall(t, "POST", "/contests", newContest, readToken.Token, nil), http.StatusForbidden)
+	var contest APIContest
+	if rec := app.tokenCall(t, "POST", "/contests", newContest, manageToken.Token, &contest); rec.Code != http.StatusCreated {
+		t.Fatalf("Manage token should create contests, got %v", rec.Body.String())
+	}
+
+	expectAPIError(t, app.apiSubmitEntryWithToken(contest.Id, manageToken.Token), http.StatusForbidden)
+	expectAPIError(t, app.tokenCall(t, "POST", "/contests/" + contest.Id + "/votes", APINewVote{EntryId: "x"}, readToken.Token, nil), http.StatusForbidden)
+
+	req := httptest.NewRequest("POST", "/contests/" + contest.Id + "/start-vote", nil)
+	req.Header.Set("Authorization", "Bearer " + readToken.Token)
+	if rec := app.do(req, nil); rec.Code != http.StatusForbidden {
+		t.Errorf("HTML routes should enforce scopes too, got %v", rec.Code)
+	}
+}
+
+func TestTokenCannotMintTokens(t *testing.T){
+	app := newTestApp(t)
+	cookies := app.apiLogin(t, "bill")
+	token := app.createToken(t, cookies, SCOPE_READ, SCOPE_SUBMIT, SCOPE_VOTE, SCOPE_MANAGE)
+	body := APINewAccessToken{"other", []string{SCOPE_READ}}
+	expectAPIError(t, app.tokenCall(t, "POST", "/tokens", body, token.Token, nil), http.StatusForbidden)
+}
+
+func TestTokenRevoke(t *testing.T){
+	app := newTestApp(t)
+	cookies := app.apiLogin(t, "bill")
+	token := app.createToken(t, cookies, SCOPE_READ)
+
+	other := app.apiLogin(t, "ted")
+	expectAPIError(t, app.apiCall(t, "DELETE", "/tokens/" + token.Id, nil, other, nil), http.StatusNotFound)
+
+	if rec := app.apiCall(t, "DELETE", "/tokens/" + token.Id, nil, cookies, nil); rec.Code != http.StatusNoContent {
+		t.Fatalf("Owner should be able to revoke token, got %v", rec.Code)
+	}
+	expectAPIError(t, app.tokenCall(t, "GET", "/auth/me", nil, token.Token, nil), http.StatusUnauthorized)
+
+	var tokens []APIAccessToken
+	app.apiCall(t, "GET", "/tokens", nil, cookies, &tokens)
+	if len(tokens) != 0 {
+		t.Error("Revoked token should not be listed")
+	}
+}
+
+func TestTokenInvalid(t *testing.T){
+	app := newTestApp(t)
+	expectAPIError(t, app.tokenCall(t, "GET", "/contests", nil, "ps_nope", nil), http.StatusUnauthorized)
+	cookies := app.apiLogin(t, "bill")
+	expectAPIError(t, app.apiCall(t, "POST", "/tokens", APINewAccessToken{"x", nil}, cookies, nil), http.StatusBadRequest)
+	expectAPIError(t, app.apiCall(t, "POST", "/tokens", APINewAccessToken{"x", []string{"admin"}}, cookies, nil), http.StatusBadRequest)
+}
+
+func TestTokenPage(t *testing.T){
+	app := newTestApp(t)
+	cookies := app.login(t, "bill")
+	rec := app.postForm("/account/tokens", url.Values{"tokenname": {"laptop"}, "scopes": {SCOPE_READ, SCOPE_VOTE}}, cookies)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), tokenPrefix) {
+		t.Fatal("New token should be shown once on the token page")
+	}
+	tokens, _ := app.tokens.ListByUser(context.TODO(), getUserId(context.TODO(), "bill", app.users))
+	if len(tokens) != 1 || !tokens[0].HasScope(SCOPE_VOTE) || tokens[0].HasScope(SCOPE_MANAGE) {
+		t.Fatal("Token should be stored with selected scopes")
+	}
+	app.postForm("/account/tokens/" + tokens[0].GetStringId() + "/revoke", url.Values{}, cookies)
+	tokens, _ = app.tokens.ListByUser(context.TODO(), getUserId(context.TODO(), "bill", app.users))
+	if len(tokens) != 0 {
+		t.Error("Token should be revoked")
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Logged in sessions are stored server-side, so they can be listed and revoked
+// The session cookie only holds a random token, and the store only holds its hash
+
+const (
+	// Sessions end this long after logging in, however active they are
+	sessionMaxAge = 30 * 24 * time.Hour
+	// Sessions end after going unused for this long
+	sessionIdleTimeout = 7 * 24 * time.Hour
+	// Last seen times are only updated this often, so every request isn't a database write
+	sessionTouchInterval = 5 * time.Minute
+	// Session cookie value holding the session token
+	sessionTokenKey = "sessionToken"
+)
+
+// ********
+// Handlers
+// ********
+
+// Handler for /account/sessions endpoint
+func sessionIndexHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+	s *sessions.CookieStore,
+	tmplMap map[string]*template.Template,
+	sessionStore SessionStore,
+) {
+	userId, _, err := getSessionUser(r)
+	if err != nil {
+		logRequestError(r.Context(), "Couldn't get session user", err)
+		http.Redirect(w, r, "/contests", 302)
+		return
+	}
+	userSessions, err := sessionStore.ListByUser(r.Context(), userId)
+	if err != nil {
+		logRequestError(r.Context(), "Couldn't list sessions", err)
+		renderError(w, r, s, tmplMap, err, "/contests")
+		return
+	}
+	current, _ := getRequestSession(r)
+	pageData := SessionPageData{}
+	for _, userSession := range userSessions {
+		pageData.Sessions = append(pageData.Sessions, SessionListItem{userSession, userSession.Id == current.Id})
+	}
+	renderTemplate(w, r, s, tmplMap["sessions.html"], http.StatusOK, pageData)
+}
+
+// Handler for logging out one session
+func revokeSessionHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+	s *sessions.CookieStore,
+	tmplMap map[string]*template.Template,
+	sessionStore SessionStore,
+	sessionId string,
+) {
+	userId, _, err := getSessionUser(r)
+	if err != nil {
+		logRequestError(r.Context(), "Couldn't get session user", err)
+		http.Redirect(w, r, "/contests", 302)
+		return
+	}
+	if err := revokeSession(r.Context(), userId, sessionId, sessionStore); err != nil {
+		logRequestError(r.Context(), "Couldn't revoke session", err)
+		renderError(w, r, s, tmplMap, err, "/account/sessions")
+		return
+	}
+	if current, _ := getRequestSession(r); current.GetStringId() == sessionId {
+		http.Redirect(w, r, "/login", 302)
+		return
+	}
+	http.Redirect(w, r, "/account/sessions", 302)
+}
+
+// Handler for logging out every session, including this one
+func revokeAllSessionsHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+	s *sessions.CookieStore,
+	tmplMap map[string]*template.Template,
+	sessionStore SessionStore,
+) {
+	userId, _, err := getSessionUser(r)
+	if err != nil {
+		logRequestError(r.Context(), "Couldn't get session user", err)
+		http.Redirect(w, r, "/contests", 302)
+		return
+	}
+	if _, err := sessionStore.DeleteByUser(r.Context(), userId); err != nil {
+		logRequestError(r.Context(), "Couldn't revoke sessions", err)
+		renderError(w, r, s, tmplMap, err, "/account/sessions")
+		return
+	}
+	http.Redirect(w, r, "/login", 302)
+}
+
+// ***********
+// Middlewares
+// ***********
+
+// Look up the session named by the session cookie, and store it in the request context
+// where isLoggedIn and getSessionUser find it. Expired and revoked sessions are ignored
+func sessionMiddleware(s *sessions.CookieStore, sessionStore SessionStore) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if _, ok := getRequestToken(r); ok {
+				next.ServeHTTP(w, r)
+				return
+			}
+			cookieSession, _ := s.Get(r, "session")
+			value, _ := cookieSession.Values[sessionTokenKey].(string)
+			if value == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			userSession, err := sessionStore.GetByHash(r.Context(), hashToken(value))
+			if err != nil {
+				if err != ErrNotFound {
+					slog.ErrorContext(r.Context(), "Couldn't look up session", "error", err)
+				}
+				next.ServeHTTP(w, r)
+				return
+			}
+			now := time.Now()
+			if !userSession.IsActive(now) {
+				if _, err := sessionStore.Delete(r.Context(), userSession.UserId, userSession.Id); err != nil {
+					slog.ErrorContext(r.Context(), "Couldn't delete expired session", "error", err)
+				}
+				next.ServeHTTP(w, r)
+				return
+			}
+			if now.Sub(userSession.LastSeen) >= sessionTouchInterval {
+				userSession.LastSeen = now
+				userSession.IP = clientIP(r)
+				if err := sessionStore.UpdateLastSeen(r.Context(), userSession.Id, now, userSession.IP); err != nil {
+					slog.ErrorContext(r.Context(), "Couldn't update session last seen time", "error", err)
+				}
+			}
+			ctx := context.WithValue(r.Context(), sessionContextKey, userSession)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// *******
+// Helpers
+// *******
+
+// Return the logged in session a request was made with, if any
+func getRequestSession(r *http.Request) (UserSession, bool) {
+	userSession, ok := r.Context().Value(sessionContextKey).(UserSession)
+	return userSession, ok
+}
+
+// Log a user in, storing a new session and putting its token in the session cookie
+func startSession(
+	w http.ResponseWriter,
+	r *http.Request,
+	s *sessions.CookieStore,
+	sessionStore SessionStore,
+	userId primitive.ObjectID,
+	username string,
+) error {
+	value, err := generateToken()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	userSession := UserSession{
+		Id: primitive.NewObjectID(),
+		TokenHash: hashToken(value),
+		UserId: userId,
+		Username: username,
+		UserAgent: r.UserAgent(),
+		IP: clientIP(r),
+		TimeCreated: now,
+		LastSeen: now,
+		ExpiresAt: now.Add(sessionMaxAge),
+	}
+	if err := sessionStore.Create(r.Context(), userSession); err != nil {
+		return err
+	}
+	// A new CSRF token for the logged in session, so a token seen before logging in can't be used
+	csrfToken, err := newCSRFToken()
+	if err != nil {
+		return err
+	}
+	cookieSession, _ := s.Get(r, "session")
+	cookieSession.Values[sessionTokenKey] = value
+	cookieSession.Values[csrfSessionKey] = csrfToken
+	return cookieSession.Save(r, w)
+}
+
+// Log the current session out, so its token can't be used again even if the cookie was copied
+func endSession(w http.ResponseWriter, r *http.Request, s *sessions.CookieStore, sessionStore SessionStore) {
+	if userSession, ok := getRequestSession(r); ok {
+		if _, err := sessionStore.Delete(r.Context(), userSession.UserId, userSession.Id); err != nil {
+			slog.ErrorContext(r.Context(), "Couldn't delete session", "error", err)
+		}
+	}
+	cookieSession, err := s.Get(r, "session")
+	if err == nil && cookieSession.Values[sessionTokenKey] != nil {
+		delete(cookieSession.Values, sessionTokenKey)
+		cookieSession.Save(r, w)
+	}
+}
+
+// Log out one of a user's sessions
+func revokeSession(ctx context.Context, userId primitive.ObjectID, sessionId string, sessionStore SessionStore) error {
+	sessionObjId, err := primitive.ObjectIDFromHex(sessionId)
+	if err != nil {
+		return notFoundError("Session not found")
+	}
+	deleted, err := sessionStore.Delete(ctx, userId, sessionObjId)
+	if err != nil {
+		return err
+	}
+	if !deleted {
+		return notFoundError("Session not found")
+	}
+	return nil
+}
+
+// Browser and operating system names, checked in order as user agents mention several
+var (
+	userAgentBrowsers = []struct{ token, name string }{
+		{"Edg/", "Edge"}, {"OPR/", "Opera"}, {"Firefox/", "Firefox"}, {"Chrome/", "Chrome"}, {"Safari/", "Safari"},
+		{"curl/", "curl"},
+	}
+	userAgentSystems = []struct{ token, name string }{
+		{"Android", "Android"}, {"iPhone", "iOS"}, {"iPad", "iPadOS"}, {"Windows", "Windows"},
+		{"Mac OS X", "macOS"}, {"CrOS", "ChromeOS"}, {"Linux", "Linux"},
+	}
+)
+
+// Short description of the device a session was started on, e.g. "Firefox on Linux"
+func describeUserAgent(userAgent string) string {
+	browser := ""
+	for _, candidate := range userAgentBrowsers {
+		if strings.Contains(userAgent, candidate.token) {
+			browser = candidate.name
+			break
+		}
+	}
+	system := ""
+	for _, candidate := range userAgentSystems {
+		if strings.Contains(userAgent, candidate.token) {
+			system = candidate.name
+			break
+		}
+	}
+	switch {
+	case browser != "" && system != "":
+		return browser + " on " + system
+	case browser != "":
+		return browser
+	case system != "":
+		return system
+	}
+	return "Unknown device"
+}
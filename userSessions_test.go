@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Sessions stored for a user
+func (a *testApp) userSessionList(t *testing.T, username string) []UserSession {
+	user, err := a.users.GetByUsername(context.TODO(), username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	userSessions, err := a.userSessions.ListByUser(context.TODO(), user.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return userSessions
+}
+
+// Log an existing user in from another device
+func (a *testApp) loginAgain(t *testing.T, username string) []*http.Cookie {
+	credentials := url.Values{"username": {username}, "password": {"password"}}
+	rec := a.postForm("/login", credentials, a.visit("/login"))
+	if rec.Header().Get("Location") != "/contests" {
+		t.Fatalf("Login for %v failed", username)
+	}
+	return rec.Result().Cookies()
+}
+
+func TestLogoutEndsSession(t *testing.T){
+	app := newTestApp(t)
+	cookies := app.login(t, "bill")
+	if rec := app.postForm("/logout", url.Values{}, cookies); rec.Header().Get("Location") != "/login" {
+		t.Fatalf("Logout should redirect to login, got %v", rec.Code)
+	}
+	// A copy of the cookie from before logging out can't be used
+	if rec := app.get("/contests", cookies); rec.Header().Get("Location") != "/login" {
+		t.Errorf("Logged out session should not be usable, got %v", rec.Code)
+	}
+	if len(app.userSessionList(t, "bill")) != 0 {
+		t.Error("Logging out should delete the stored session")
+	}
+}
+
+func TestListAndRevokeSessions(t *testing.T){
+	app := newTestApp(t)
+	laptop := app.login(t, "bill")
+	phone := app.loginAgain(t, "bill")
+	app.login(t, "ted")
+
+	var apiSessions []APIUserSession
+	app.apiCall(t, "GET", "/sessions", nil, laptop, &apiSessions)
+	if len(apiSessions) != 2 {
+		t.Fatalf("Only the user's own sessions should be listed, got %+v", apiSessions)
+	}
+	if apiSessions[0].Current == apiSessions[1].Current {
+		t.Errorf("Only the laptop's session should be marked current, got %+v", apiSessions)
+	}
+	body := app.get("/account/sessions", laptop).Body.String()
+	if strings.Count(body, "/revoke\"") != 2 || !strings.Contains(body, "This device") {
+		t.Error("Sessions page should list both sessions")
+	}
+
+	// Another user can't revoke the sessions
+	teds := app.userSessionList(t, "ted")
+	expectAPIError(t, app.apiCall(t, "DELETE", "/sessions/" + teds[0].GetStringId(), nil, laptop, nil), http.StatusNotFound)
+
+	// Revoking the phone's session logs it out, the laptop stays logged in
+	rec := app.postForm("/account/sessions/" + apiSessionId(apiSessions, false) + "/revoke", url.Values{}, laptop)
+	if rec.Header().Get("Location") != "/account/sessions" {
+		t.Fatalf("Revoking a session should redirect back, got %v", rec.Code)
+	}
+	if rec := app.get("/contests", phone); rec.Code != http.StatusFound {
+		t.Errorf("Revoked session should be logged out, got %v", rec.Code)
+	}
+	if rec := app.get("/contests", laptop); rec.Code != http.StatusOK {
+		t.Errorf("Other sessions should stay logged in, got %v", rec.Code)
+	}
+}
+
+// Id of the current or other session in a session list
+func apiSessionId(apiSessions []APIUserSession, current bool) string {
+	for _, apiSession := range apiSessions {
+		if apiSession.Current == current {
+			return apiSession.Id
+		}
+	}
+	return ""
+}
+
+func TestRevokeAllSessions(t *testing.T){
+	app := newTestApp(t)
+	laptop := app.login(t, "bill")
+	phone := app.loginAgain(t, "bill")
+	if rec := app.postForm("/account/sessions/revoke-all", url.Values{}, laptop); rec.Header().Get("Location") != "/login" {
+		t.Fatalf("Revoking every session should redirect to login, got %v", rec.Code)
+	}
+	for _, cookies := range [][]*http.Cookie{laptop, phone} {
+		if rec := app.get("/contests", cookies); rec.Code != http.StatusFound {
+			t.Errorf("Every session should be logged out, got %v", rec.Code)
+		}
+	}
+}
+
+func TestIdleSessionExpires(t *testing.T){
+	app := newTestApp(t)
+	cookies := app.login(t, "bill")
+	userSession := app.userSessionList(t, "bill")[0]
+	idle := time.Now().Add(-sessionIdleTimeout - time.Minute)
+	app.userSessions.UpdateLastSeen(context.TODO(), userSession.Id, idle, userSession.IP)
+	if rec := app.get("/contests", cookies); rec.Header().Get("Location") != "/login" {
+		t.Errorf("Idle session should be logged out, got %v", rec.Code)
+	}
+	if len(app.userSessionList(t, "bill")) != 0 {
+		t.Error("Idle session should be deleted")
+	}
+}
+
+func TestDescribeUserAgent(t *testing.T){
+	expected := map[string]string{
+		"Mozilla/5.0 (X11; Linux x86_64; rv:89.0) Gecko/20100101 Firefox/89.0": "Firefox on Linux",
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/91.0 Safari/537.36 Edg/91.0": "Edge on Windows",
+		"Mozilla/5.0 (iPhone; CPU iPhone OS 14_6 like Mac OS X) AppleWebKit/605.1.15 Version/14.1 Mobile Safari/604.1": "Safari on iOS",
+		"curl/7.68.0": "curl",
+		"": "Unknown device",
+	}
+	for userAgent, description := range expected {
+		if got := describeUserAgent(userAgent); got != description {
+			t.Errorf("%q should be described as %q, got %q", userAgent, description, got)
+		}
+	}
+}
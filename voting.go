@@ -0,0 +1,195 @@
+package main
+
+import (
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Ballots and winner computation for each voting method
+
+// Highest number of stars a voter can give an entry in score voting
+const maxScore = 5
+
+var votingMethods = []string{PLURALITY, APPROVAL, SCORE, RANKED}
+
+func isVotingMethod(method string) bool {
+	for _, votingMethod := range votingMethods {
+		if method == votingMethod {
+			return true
+		}
+	}
+	return false
+}
+
+// Read a ballot from the vote form on the contest page
+// Returns a map from entry ID to the value the voter gave it
+func parseBallotForm(contest Contest, form url.Values) (map[string]int, error) {
+	ballot := map[string]int{}
+	if contest.IsScore() || contest.IsRanked() {
+		// One number input per entry, named "score-<entryId>" or "rank-<entryId>"
+		prefix := "score-"
+		if contest.IsRanked() {
+			prefix = "rank-"
+		}
+		for key, values := range form {
+			if !strings.HasPrefix(key, prefix) || len(values) == 0 || values[0] == "" {
+				continue
+			}
+			value, err := strconv.Atoi(values[0])
+			if err != nil {
+				return nil, badRequestError("Please enter whole numbers only")
+			}
+			ballot[strings.TrimPrefix(key, prefix)] = value
+		}
+		return ballot, nil
+	}
+	// Radio buttons for plurality, checkboxes for approval
+	for _, entryId := range form["image-vote"] {
+		if entryId != "" {
+			ballot[entryId] = 1
+		}
+	}
+	return ballot, nil
+}
+
+// Check a ballot follows the rules of the contest's voting method
+// Returns the choices to store, ordered by ranking for ranked ballots
+func buildBallot(contest Contest, ballot map[string]int, entries []ContestEntry) ([]BallotChoice, error) {
+	method := contest.GetVotingMethod()
+	if len(ballot) == 0 {
+		switch method {
+		case APPROVAL:
+			return nil, badRequestError("Please approve at least one entry")
+		case SCORE:
+			return nil, badRequestError("Please score at least one entry")
+		case RANKED:
+			return nil, badRequestError("Please rank at least one entry")
+		default:
+			return nil, badRequestError("Please select an entry to vote for")
+		}
+	}
+	if method == PLURALITY && len(ballot) > 1 {
+		return nil, badRequestError("You may only vote for one entry")
+	}
+
+	contestEntries := map[string]bool{}
+	for _, entry := range entries {
+		contestEntries[entry.GetStringId()] = true
+	}
+	choices := []BallotChoice{}
+	ranks := map[int]bool{}
+	for entryId, value := range ballot {
+		entryObjId, err := primitive.ObjectIDFromHex(entryId)
+		if err != nil || !contestEntries[entryId] {
+			return nil, badRequestError("That entry is not part of this contest")
+		}
+		switch method {
+		case SCORE:
+			if value < 1 || value > maxScore {
+				return nil, badRequestError("Scores must be between 1 and " + strconv.Itoa(maxScore))
+			}
+		case RANKED:
+			if value < 1 || value > len(ballot) || ranks[value] {
+				return nil, badRequestError("Rank entries 1, 2, 3 and so on without skipping or repeating a number")
+			}
+			ranks[value] = true
+		default:
+			if value != 1 {
+				return nil, badRequestError("That is not a valid vote")
+			}
+		}
+		choices = append(choices, BallotChoice{entryObjId, value})
+	}
+	sort.Slice(choices, func(i, j int) bool {
+		if choices[i].Value != choices[j].Value {
+			return choices[i].Value < choices[j].Value
+		}
+		return choices[i].EntryID.Hex() < choices[j].EntryID.Hex()
+	})
+	return choices, nil
+}
+
+// Count the votes for each entry using a voting method
+// Results are ordered from first place to last, entries tied with the first are the winners
+func tallyVotes(method string, entries []ContestEntry, votes []ContestVote) []EntryResult {
+	if method == RANKED {
+		return instantRunoff(entries, votes)
+	}
+	// Plurality and approval choices are worth 1, so adding up values covers every other method
+	totals := map[primitive.ObjectID]int64{}
+	for _, vote := range votes {
+		for _, choice := range vote.GetChoices() {
+			totals[choice.EntryID] += int64(choice.Value)
+		}
+	}
+	results := []EntryResult{}
+	for _, entry := range entries {
+		results = append(results, EntryResult{entry, totals[entry.Id]})
+	}
+	sortResults(results)
+	return results
+}
+
+// Instant-runoff count for ranked ballots
+// Each round, a ballot counts for its highest ranked entry still in the running
+// The entries with the fewest votes are eliminated until one entry has a majority
+// of the ballots still counting, or every entry left is tied
+// Votes for an eliminated entry are its votes in the round it was eliminated
+func instantRunoff(entries []ContestEntry, votes []ContestVote) []EntryResult {
+	if len(entries) == 0 {
+		return []EntryResult{}
+	}
+	running := map[primitive.ObjectID]bool{}
+	for _, entry := range entries {
+		running[entry.Id] = true
+	}
+	eliminated := []EntryResult{}
+	for {
+		counts := map[primitive.ObjectID]int64{}
+		var active int64
+		for _, vote := range votes {
+			// Choices are stored in ranked order
+			for _, choice := range vote.GetChoices() {
+				if running[choice.EntryID] {
+					counts[choice.EntryID]++
+					active++
+					break
+				}
+			}
+		}
+
+		remaining := []EntryResult{}
+		for _, entry := range entries {
+			if running[entry.Id] {
+				remaining = append(remaining, EntryResult{entry, counts[entry.Id]})
+			}
+		}
+		sortResults(remaining)
+		most := remaining[0].Votes
+		fewest := remaining[len(remaining) - 1].Votes
+		if most * 2 > active || most == fewest {
+			return append(remaining, eliminated...)
+		}
+
+		// Entries knocked out later placed higher, so they go in front
+		round := []EntryResult{}
+		for _, result := range remaining {
+			if result.Votes == fewest {
+				delete(running, result.Entry.Id)
+				round = append(round, result)
+			}
+		}
+		eliminated = append(round, eliminated...)
+	}
+}
+
+// Sort results by votes, most first, keeping ties in submission order
+func sortResults(results []EntryResult) {
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].Votes > results[j].Votes
+	})
+}
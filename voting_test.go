@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func createEntries(names ...string) []ContestEntry {
+	var entries []ContestEntry
+	for _, name := range names {
+		entries = append(entries, ContestEntry{Id: primitive.NewObjectID(), Name: name})
+	}
+	return entries
+}
+
+// Create a ballot with a choice for each entry, values in the order given
+func createBallot(entries []ContestEntry, values ...int) ContestVote {
+	vote := ContestVote{Id: primitive.NewObjectID()}
+	for i, value := range values {
+		vote.Choices = append(vote.Choices, BallotChoice{entries[i].Id, value})
+	}
+	return vote
+}
+
+func resultNames(results []EntryResult) []string {
+	var names []string
+	for _, result := range results {
+		names = append(names, result.Entry.Name)
+	}
+	return names
+}
+
+func TestTallyPlurality(t *testing.T){
+	entries := createEntries("a", "b")
+	votes := []ContestVote{
+		{Id: primitive.NewObjectID(), EntryID: entries[1].Id},
+		{Id: primitive.NewObjectID(), EntryID: entries[1].Id},
+		{Id: primitive.NewObjectID(), EntryID: entries[0].Id},
+	}
+	results := tallyVotes(PLURALITY, entries, votes)
+	if results[0].Entry.Name != "b" || results[0].Votes != 2 || results[1].Votes != 1 {
+		t.Errorf("Unexpected plurality results %+v", results)
+	}
+}
+
+func TestTallyApprovalAndScore(t *testing.T){
+	entries := createEntries("a", "b", "c")
+	approvals := []ContestVote{
+		createBallot(entries, 1, 1),
+		createBallot(entries[1:], 1, 1),
+	}
+	results := tallyVotes(APPROVAL, entries, approvals)
+	if results[0].Entry.Name != "b" || results[0].Votes != 2 || results[1].Votes != 1 {
+		t.Errorf("Unexpected approval results %+v", results)
+	}
+
+	scores := []ContestVote{
+		createBallot(entries, 5, 1, 3),
+		createBallot(entries, 2, 4, 3),
+	}
+	results = tallyVotes(SCORE, entries, scores)
+	if results[0].Entry.Name != "a" || results[0].Votes != 7 || results[2].Votes != 5 {
+		t.Errorf("Unexpected score results %+v", results)
+	}
+}
+
+func TestInstantRunoff(t *testing.T){
+	entries := createEntries("a", "b", "c")
+	votes := []ContestVote{
+		createBallot(entries[:1], 1),
+		createBallot(entries[:1], 1),
+		createBallot(entries[2:], 1),
+		createBallot(entries[2:], 1),
+		// Ranks b first and c second
+		createBallot(entries[1:], 1, 2),
+	}
+	// a and c tie on first choices, b is eliminated and its ballot moves to c
+	results := tallyVotes(RANKED, entries, votes)
+	names := resultNames(results)
+	if len(names) != 3 || names[0] != "c" || names[1] != "a" || names[2] != "b" {
+		t.Fatalf("Unexpected ranked results %v", names)
+	}
+	if results[0].Votes != 3 || results[1].Votes != 2 || results[2].Votes != 1 {
+		t.Errorf("Unexpected ranked vote counts %+v", results)
+	}
+
+	// Every entry left tied
+	votes = []ContestVote{createBallot(entries[:1], 1), createBallot(entries[1:], 1)}
+	results = tallyVotes(RANKED, entries, votes)
+	if results[0].Votes != 1 || results[1].Votes != 1 || results[2].Entry.Name != "c" {
+		t.Errorf("Tied entries should share first place, got %+v", results)
+	}
+
+	if len(tallyVotes(RANKED, nil, nil)) != 0 {
+		t.Error("Contest without entries should have no results")
+	}
+}
+
+func TestBuildBallot(t *testing.T){
+	entries := createEntries("a", "b", "c")
+	a, b := entries[0].GetStringId(), entries[1].GetStringId()
+	other := primitive.NewObjectID().Hex()
+	tests := []struct {
+		method string
+		ballot map[string]int
+		valid bool
+	}{
+		{PLURALITY, map[string]int{a: 1}, true},
+		{PLURALITY, map[string]int{}, false},
+		{PLURALITY, map[string]int{a: 1, b: 1}, false},
+		{PLURALITY, map[string]int{other: 1}, false},
+		{APPROVAL, map[string]int{a: 1, b: 1}, true},
+		{APPROVAL, map[string]int{a: 2}, false},
+		{SCORE, map[string]int{a: 5, b: 1}, true},
+		{SCORE, map[string]int{a: 6}, false},
+		{SCORE, map[string]int{a: 0}, false},
+		{RANKED, map[string]int{a: 2, b: 1}, true},
+		{RANKED, map[string]int{a: 1, b: 1}, false},
+		{RANKED, map[string]int{a: 1, b: 3}, false},
+		{RANKED, map[string]int{"nope": 1}, false},
+	}
+	for _, test := range tests {
+		choices, err := buildBallot(Contest{VotingMethod: test.method}, test.ballot, entries)
+		if (err == nil) != test.valid {
+			t.Errorf("%v ballot %v: expected valid %v, got %v", test.method, test.ballot, test.valid, err)
+		}
+		if err != nil && errorStatus(err) != http.StatusBadRequest {
+			t.Errorf("Invalid ballot should be a bad request, got %v", errorStatus(err))
+		}
+		if test.method == RANKED && err == nil && choices[0].EntryID != entries[1].Id {
+			t.Error("Ranked choices should be stored in order of preference")
+		}
+	}
+}
+
+func TestCreateContestVotingMethod(t *testing.T){
+	app := newTestApp(t)
+	cookies := app.login(t, "bill")
+	rec := app.postForm("/create-contest", url.Values{"contestname": {"Sunsets"}, "votingmethod": {"borda"}}, cookies)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Unknown voting method should be rejected, got %v", rec.Code)
+	}
+	contest := app.createContest(t, cookies)
+	if contest.GetVotingMethod() != PLURALITY {
+		t.Errorf("Contests should default to plurality, got %v", contest.VotingMethod)
+	}
+}
+
+func TestRankedContest(t *testing.T){
+	app := newTestApp(t)
+	owner := app.apiLogin(t, "bill")
+	var contest APIContest
+	app.apiCall(t, "POST", "/contests", APINewContest{Name: "Sunsets", VotingMethod: RANKED}, owner, &contest)
+	if contest.VotingMethod != RANKED {
+		t.Fatalf("Contest should use ranked voting, got %v", contest.VotingMethod)
+	}
+
+	var entryIds []string
+	for _, username := range []string{"ted", "rufus", "missy"} {
+		var entry APIEntry
+		rec := app.apiSubmitEntry(contest.Id, app.apiLogin(t, username))
+		decodeResponse(t, rec, &entry)
+		entryIds = append(entryIds, entry.Id)
+	}
+	stateUrl := "/contests/" + contest.Id + "/state"
+	app.apiCall(t, "POST", stateUrl, APIStateChange{State: "voting"}, owner, nil)
+
+	// Ranking through the vote form on the contest page
+	rec := app.get("/contests/" + contest.Id, owner)
+	if !strings.Contains(rec.Body.String(), "rank-" + entryIds[0]) {
+		t.Fatal("Contest page should show a ranking form")
+	}
+	contestObjId, _ := primitive.ObjectIDFromHex(contest.Id)
+	form := url.Values{"rank-" + entryIds[2]: {"1"}, "rank-" + entryIds[0]: {"2"}, "rank-" + entryIds[1]: {""}}
+	if rec := app.postForm("/contests/" + contest.Id + "/vote", form, owner); rec.Code != http.StatusFound {
+		t.Fatalf("Ranked vote should redirect, got %v", rec.Code)
+	}
+	votes, _ := app.votes.ListByContest(context.TODO(), contestObjId)
+	if len(votes) != 1 || len(votes[0].Choices) != 2 || votes[0].Choices[0].EntryID.Hex() != entryIds[2] {
+		t.Fatalf("Ranked ballot should be stored in order, got %+v", votes)
+	}
+
+	votesUrl := "/contests/" + contest.Id + "/votes"
+	voter := app.apiLogin(t, "socrates")
+	expectAPIError(t, app.apiCall(t, "POST", votesUrl, APINewVote{EntryId: entryIds[0]}, voter, nil), http.StatusBadRequest)
+	repeated := APINewVote{Ranking: []string{entryIds[0], entryIds[0]}}
+	expectAPIError(t, app.apiCall(t, "POST", votesUrl, repeated, voter, nil), http.StatusBadRequest)
+	var vote APIVote
+	rec = app.apiCall(t, "POST", votesUrl, APINewVote{Ranking: []string{entryIds[2], entryIds[1]}}, voter, &vote)
+	if rec.Code != http.StatusCreated || len(vote.Choices) != 2 || vote.Choices[1].Value != 2 {
+		t.Fatalf("Ranked vote should be created, got %v", rec.Body.String())
+	}
+
+	app.apiCall(t, "POST", stateUrl, APIStateChange{State: "concluded"}, owner, nil)
+	var results APIResults
+	app.apiCall(t, "GET", "/contests/" + contest.Id + "/results", nil, owner, &results)
+	if results.VotingMethod != RANKED || len(results.Winners) != 1 || results.Winners[0].Id != entryIds[2] {
+		t.Errorf("Unexpected results %+v", results)
+	}
+}